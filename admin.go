@@ -0,0 +1,93 @@
+package slidingsync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+)
+
+// AdminResyncPath is the path of the admin endpoint which forces a device's poller to start again
+// from an initial sync.
+const AdminResyncPath = "/_syncv3/admin/resync"
+
+type adminResyncRequest struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+type adminResyncResponse struct {
+	// true if a running poller was asked to resync, false if the device will do an initial sync
+	// when its poller is next started.
+	PollerRunning bool `json:"poller_running"`
+}
+
+// AdminHandler serves operator-only endpoints. Requests must include the admin token as a bearer
+// token in the Authorization header.
+type AdminHandler struct {
+	h2         *handler2.Handler
+	adminToken string
+}
+
+func NewAdminHandler(h2 *handler2.Handler, adminToken string) *AdminHandler {
+	return &AdminHandler{
+		h2:         h2,
+		adminToken: adminToken,
+	}
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	res, herr := h.serve(req)
+	if herr != nil {
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *AdminHandler) serve(req *http.Request) (*adminResyncResponse, *internal.HandlerError) {
+	authHeader := req.Header.Get("Authorization")
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if token == authHeader || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		return nil, &internal.HandlerError{
+			StatusCode: 401,
+			Err:        fmt.Errorf("missing or invalid admin token"),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		}
+	}
+	var body adminResyncRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.UserID == "" || body.DeviceID == "" {
+		return nil, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("request body must contain user_id and device_id"),
+			ErrCode:    "M_BAD_JSON",
+		}
+	}
+	pollerRunning, err := h.h2.ResyncDevice(body.UserID, body.DeviceID)
+	if err == handler2.ErrUnknownDevice {
+		return nil, &internal.HandlerError{
+			StatusCode: 404,
+			Err:        err,
+			ErrCode:    "M_NOT_FOUND",
+		}
+	}
+	if err != nil {
+		logger.Err(err).Str("user_id", body.UserID).Str("device_id", body.DeviceID).Msg("failed to resync device")
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	return &adminResyncResponse{PollerRunning: pollerRunning}, nil
+}
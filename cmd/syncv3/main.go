@@ -18,6 +18,7 @@ import (
 	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
 	"github.com/pressly/goose/v3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
@@ -51,6 +52,20 @@ const (
 	EnvSentryDsn    = "SYNCV3_SENTRY_DSN"
 	EnvLogLevel     = "SYNCV3_LOG_LEVEL"
 	EnvMaxConns     = "SYNCV3_MAX_DB_CONN"
+	EnvV2Since      = "SYNCV3_EXPOSE_V2_SINCE"
+	EnvPollTimeout  = "SYNCV3_POLL_TIMEOUT_MS"
+	EnvPollLimit    = "SYNCV3_POLL_TIMELINE_LIMIT"
+	EnvConnTTL      = "SYNCV3_CONN_TTL_SECS"
+	EnvMaxClockSkew = "SYNCV3_MAX_CLOCK_SKEW_SECS"
+	EnvMaxNewConns  = "SYNCV3_MAX_NEW_CONNS_PER_MIN"
+	EnvBatchWrites  = "SYNCV3_BATCH_POLLER_WRITES"
+	EnvShareRooms   = "SYNCV3_SHARE_ROOM_POLLERS"
+	EnvToDeviceTTL  = "SYNCV3_TO_DEVICE_RETENTION_DAYS"
+	EnvToDeviceCap  = "SYNCV3_MAX_TO_DEVICE_PER_DEVICE"
+	EnvPersistConns = "SYNCV3_PERSIST_CONNECTIONS"
+	EnvAdminToken   = "SYNCV3_ADMIN_TOKEN"
+	EnvMaxOps       = "SYNCV3_MAX_OPS_PER_RESPONSE"
+	EnvPresence     = "SYNCV3_ENABLE_PRESENCE"
 )
 
 var helpMsg = fmt.Sprintf(`
@@ -69,8 +84,23 @@ Environment var
 %s Default: unset. The Sentry DSN to report events to e.g https://sliding-sync@sentry.example.com/123 - if unset does not send sentry events.
 %s  Default: info. The level of verbosity for messages logged. Available values are trace, debug, info, warn, error and fatal
 %s Default: unset. Max database connections to use when communicating with postgres. Unset or 0 means no limit.
+%s Default: unset. If set to 1, clients may request the sync v2 since token for their device by setting 'include_v2_since'.
+%s Default: 30000. The long-poll timeout in milliseconds sent to the homeserver on sync v2 requests. Must be less than 5 minutes.
+%s Default: 50. The timeline limit sent to the homeserver on incremental sync v2 requests. Lower limits reduce the load on the homeserver but make gappy syncs more likely.
+%s Default: 1800. How long in seconds a connection can go unused before it is reaped. Clients returning later must reset their connection.
+%s Default: 300. How far in seconds an event's timestamp can be ahead of the proxy's clock before it is clamped when sorting rooms by recency. Must be positive, or -1 to disable clamping.
+%s Default: 0. The number of new connections each user can make per minute. Further requests for new connections are rejected with a retryable error. 0 disables the limit.
+%s Default: unset. If set to 1, all of the data in each sync v2 response is stored in a single database transaction along with the since token.
+%s Default: unset. If set to 1, room data is only fetched on one sync v2 poller per user rather than on every device's poller.
+%s Default: 30. How long in days to-device messages are kept for, even if the device never acknowledges them. 0 keeps messages until they are acknowledged.
+%s Default: 0. The number of to-device messages kept for each device. Older messages beyond this are deleted. 0 disables the limit.
+%s Default: unset. If set to 1, connections are saved to the database so clients can resume them after the proxy restarts.
+%s Default: unset. A bearer token for admin endpoints, such as forcing a device to resync. If unset, admin endpoints are disabled.
+%s Default: 50. The number of list operations after which live updates are deferred to the next response. The operations of a single update are never split, so a response may go slightly over.
+%s Default: unset. If set to 1, presence is fetched from the homeserver for the presence extension. This increases the load on the homeserver.
 `, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvOTLP, EnvOTLPUsername, EnvOTLPPassword,
-	EnvSentryDsn, EnvLogLevel, EnvMaxConns)
+	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvV2Since, EnvPollTimeout, EnvPollLimit, EnvConnTTL, EnvMaxClockSkew, EnvMaxNewConns, EnvBatchWrites, EnvShareRooms,
+	EnvToDeviceTTL, EnvToDeviceCap, EnvPersistConns, EnvAdminToken, EnvMaxOps, EnvPresence)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -105,6 +135,20 @@ func main() {
 		EnvSentryDsn:    os.Getenv(EnvSentryDsn),
 		EnvLogLevel:     os.Getenv(EnvLogLevel),
 		EnvMaxConns:     defaulting(os.Getenv(EnvMaxConns), "0"),
+		EnvV2Since:      os.Getenv(EnvV2Since),
+		EnvPollTimeout:  defaulting(os.Getenv(EnvPollTimeout), "30000"),
+		EnvPollLimit:    defaulting(os.Getenv(EnvPollLimit), "50"),
+		EnvConnTTL:      defaulting(os.Getenv(EnvConnTTL), "1800"),
+		EnvMaxClockSkew: defaulting(os.Getenv(EnvMaxClockSkew), "300"),
+		EnvMaxNewConns:  defaulting(os.Getenv(EnvMaxNewConns), "0"),
+		EnvBatchWrites:  os.Getenv(EnvBatchWrites),
+		EnvShareRooms:   os.Getenv(EnvShareRooms),
+		EnvToDeviceTTL:  defaulting(os.Getenv(EnvToDeviceTTL), "30"),
+		EnvToDeviceCap:  defaulting(os.Getenv(EnvToDeviceCap), "0"),
+		EnvPersistConns: os.Getenv(EnvPersistConns),
+		EnvAdminToken:   os.Getenv(EnvAdminToken),
+		EnvMaxOps:       defaulting(os.Getenv(EnvMaxOps), "50"),
+		EnvPresence:     os.Getenv(EnvPresence),
 	}
 	requiredEnvVars := []string{EnvServer, EnvDB, EnvSecret, EnvBindAddr}
 	for _, requiredEnvVar := range requiredEnvVars {
@@ -192,14 +236,65 @@ func main() {
 	if err != nil {
 		panic("invalid value for " + EnvMaxConns + ": " + args[EnvMaxConns])
 	}
+	pollTimeoutMs, err := strconv.Atoi(args[EnvPollTimeout])
+	// the HTTP client used for polling times out after 5 minutes
+	if err != nil || pollTimeoutMs <= 0 || pollTimeoutMs >= 5*60*1000 {
+		panic("invalid value for " + EnvPollTimeout + ": " + args[EnvPollTimeout])
+	}
+	pollTimelineLimit, err := strconv.Atoi(args[EnvPollLimit])
+	if err != nil || pollTimelineLimit <= 0 {
+		panic("invalid value for " + EnvPollLimit + ": " + args[EnvPollLimit])
+	}
+	connTTLSecs, err := strconv.Atoi(args[EnvConnTTL])
+	if err != nil || connTTLSecs <= 0 {
+		panic("invalid value for " + EnvConnTTL + ": " + args[EnvConnTTL])
+	}
+	maxClockSkewSecs, err := strconv.Atoi(args[EnvMaxClockSkew])
+	if err != nil || maxClockSkewSecs == 0 || maxClockSkewSecs < -1 {
+		panic("invalid value for " + EnvMaxClockSkew + ": " + args[EnvMaxClockSkew])
+	}
+	maxNewConns, err := strconv.Atoi(args[EnvMaxNewConns])
+	if err != nil || maxNewConns < 0 {
+		panic("invalid value for " + EnvMaxNewConns + ": " + args[EnvMaxNewConns])
+	}
+	toDeviceTTLDays, err := strconv.Atoi(args[EnvToDeviceTTL])
+	if err != nil || toDeviceTTLDays < 0 {
+		panic("invalid value for " + EnvToDeviceTTL + ": " + args[EnvToDeviceTTL])
+	}
+	toDeviceRetention := time.Duration(toDeviceTTLDays) * 24 * time.Hour
+	if toDeviceTTLDays == 0 {
+		toDeviceRetention = -1 // keep messages until they are acknowledged
+	}
+	maxToDevice, err := strconv.Atoi(args[EnvToDeviceCap])
+	if err != nil || maxToDevice < 0 {
+		panic("invalid value for " + EnvToDeviceCap + ": " + args[EnvToDeviceCap])
+	}
+	maxOps, err := strconv.Atoi(args[EnvMaxOps])
+	if err != nil || maxOps <= 0 {
+		panic("invalid value for " + EnvMaxOps + ": " + args[EnvMaxOps])
+	}
 	h2, h3 := syncv3.Setup(args[EnvServer], args[EnvDB], args[EnvSecret], syncv3.Opts{
 		AddPrometheusMetrics:  args[EnvPrometheus] != "",
 		DBMaxConns:            maxConnsInt,
 		DBConnMaxIdleTime:     time.Hour,
 		MaxTransactionIDDelay: time.Second,
+		ExposeV2Since:         args[EnvV2Since] == "1",
+		PollTimeout:           time.Duration(pollTimeoutMs) * time.Millisecond,
+		PollTimelineLimit:     pollTimelineLimit,
+		ConnTTL:               time.Duration(connTTLSecs) * time.Second,
+		MaxClockSkew:          time.Duration(maxClockSkewSecs) * time.Second,
+		MaxNewConnsPerMinute:  maxNewConns,
+		BatchPollerWrites:     args[EnvBatchWrites] == "1",
+		ShareRoomPollers:      args[EnvShareRooms] == "1",
+		ToDeviceRetention:     toDeviceRetention,
+		MaxToDevicePerDevice:  maxToDevice,
+		PersistConnections:    args[EnvPersistConns] == "1",
+		MaxOpsPerResponse:     maxOps,
+		EnablePresence:        args[EnvPresence] == "1",
 	})
 
 	go h2.StartV2Pollers()
+	go toggleMaintenanceModeOnSignal(h3.(*handler.SyncLiveHandler))
 	if args[EnvOTLP] != "" {
 		h3 = otelhttp.NewHandler(h3, "Sync")
 	}
@@ -212,10 +307,25 @@ func main() {
 		h3 = sentryHandler.Handle(h3)
 	}
 
-	syncv3.RunSyncV3Server(h3, args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
+	var admin http.Handler
+	if args[EnvAdminToken] != "" {
+		admin = syncv3.NewAdminHandler(h2, args[EnvAdminToken])
+	}
+
+	syncv3.RunSyncV3Server(h3, admin, args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
 	WaitForShutdown(args[EnvSentryDsn] != "")
 }
 
+// toggleMaintenanceModeOnSignal enables or disables maintenance mode each time the process receives
+// a SIGUSR1 signal. In maintenance mode, new connections are rejected but existing connections continue.
+func toggleMaintenanceModeOnSignal(h3 *handler.SyncLiveHandler) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	for range sigs {
+		h3.SetMaintenanceMode(!h3.InMaintenanceMode(), handler.DefaultMaintenanceRetryAfter)
+	}
+}
+
 // WaitForShutdown blocks until the process receives a SIGINT or SIGTERM signal
 // (see `man 7 signal`). It performs any last cleanup tasks and then exits.
 func WaitForShutdown(sentryInUse bool) {
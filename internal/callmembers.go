@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"sort"
+
+	"github.com/tidwall/gjson"
+)
+
+// IsActiveCallMembership returns true if the content of an m.call.member state event means the
+// sender is in a call. Older clients list their calls in a single event per user, keyed on their
+// user ID, which has an empty memberships array when they aren't in a call. Newer clients send one
+// event per device, which has empty content when they leave the call.
+func IsActiveCallMembership(content gjson.Result) bool {
+	if memberships := content.Get("memberships"); memberships.Exists() {
+		return len(memberships.Array()) > 0
+	}
+	return content.IsObject() && len(content.Map()) > 0
+}
+
+// SetCallMembership returns a copy of the call memberships with the m.call.member state event
+// with this state key added or removed. Memberships map the state key to the sender of the event.
+// The existing map is never modified, so copies of RoomMetadata can tell when it changes.
+func SetCallMembership(memberships map[string]string, stateKey, sender string, active bool) map[string]string {
+	if _, exists := memberships[stateKey]; !exists && !active {
+		return memberships
+	}
+	result := make(map[string]string, len(memberships)+1)
+	for k, v := range memberships {
+		result[k] = v
+	}
+	if active {
+		result[stateKey] = sender
+	} else {
+		delete(result, stateKey)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// CallMembers returns the sorted user IDs of the users who are in a call in this room.
+func (m *RoomMetadata) CallMembers() []string {
+	var userIDs []string
+	seen := make(map[string]struct{}, len(m.CallMemberships))
+	for _, userID := range m.CallMemberships {
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// SameCallMembers checks if the users in a call have changed between the two metadatas.
+// Returns true if there are no changes.
+func (m *RoomMetadata) SameCallMembers(other *RoomMetadata) bool {
+	return sameStrings(m.CallMembers(), other.CallMembers())
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 
@@ -17,10 +18,37 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 	TimeFormat: "15:04:05",
 })
 
+// Reasons why a client's connection was reset, returned alongside M_UNKNOWN_POS.
+const (
+	// The connection was not used for a long time and was cleaned up.
+	ResetReasonExpired = "expired"
+	// The server has no record of the connection, most likely because it restarted.
+	ResetReasonServerRestart = "server_restart"
+	// The connection buffered too many updates without the client syncing, so it was closed to
+	// bound memory usage.
+	ResetReasonEvictedForMemory = "evicted_for_memory"
+	// The access token for the device expired, so all of its connections were closed.
+	ResetReasonTokenExpired = "token_expired"
+	// The device was soft logged out, so all of its connections were closed. The client should log
+	// in again, keeping its local data.
+	ResetReasonSoftLogout = "soft_logout"
+	// The client supplied a position which was never sent on this connection.
+	ResetReasonUnknownPos = "unknown_pos"
+	// The client supplied a position older than one it has already acknowledged on this connection,
+	// e.g. because it restored old local state.
+	ResetReasonStalePos = "stale_pos"
+)
+
 type HandlerError struct {
 	StatusCode int
 	Err        error
 	ErrCode    string
+	// ResetReason is one of the ResetReason constants, if this error resets the connection.
+	ResetReason string
+	// RetryAfterMs is how long the client should wait before retrying the request, if non-zero.
+	RetryAfterMs int64
+	// SoftLogout is true if this is a 401 for a device which was soft logged out.
+	SoftLogout bool
 }
 
 func (e *HandlerError) Error() string {
@@ -32,24 +60,53 @@ func (e *HandlerError) Unwrap() error {
 }
 
 type jsonError struct {
-	Err  string `json:"error"`
-	Code string `json:"errcode,omitempty"`
+	Err          string `json:"error"`
+	Code         string `json:"errcode,omitempty"`
+	ResetReason  string `json:"reset_reason,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+	SoftLogout   bool   `json:"soft_logout,omitempty"`
 }
 
 func (e HandlerError) JSON() []byte {
 	je := jsonError{
-		Err:  e.Error(),
-		Code: e.ErrCode,
+		Err:          e.Error(),
+		Code:         e.ErrCode,
+		ResetReason:  e.ResetReason,
+		RetryAfterMs: e.RetryAfterMs,
+		SoftLogout:   e.SoftLogout,
 	}
 	b, _ := json.Marshal(je)
 	return b
 }
 
-func ExpiredSessionError() *HandlerError {
+func ExpiredSessionError(resetReason string) *HandlerError {
+	return &HandlerError{
+		StatusCode:  400,
+		Err:         fmt.Errorf("session expired, restart the connection without a pos"),
+		ErrCode:     "M_UNKNOWN_POS",
+		ResetReason: resetReason,
+	}
+}
+
+// MaintenanceError is returned to clients trying to make new connections whilst the server is in
+// maintenance mode. Clients should retry after retryAfter.
+func MaintenanceError(retryAfter time.Duration) *HandlerError {
+	return &HandlerError{
+		StatusCode:   503,
+		Err:          fmt.Errorf("server is in maintenance mode"),
+		ErrCode:      "M_MAINTENANCE",
+		RetryAfterMs: retryAfter.Milliseconds(),
+	}
+}
+
+// RateLimitedError is returned to clients which are making requests too quickly. Clients should
+// retry after retryAfter.
+func RateLimitedError(retryAfter time.Duration) *HandlerError {
 	return &HandlerError{
-		StatusCode: 400,
-		Err:        fmt.Errorf("session expired"),
-		ErrCode:    "M_UNKNOWN_POS",
+		StatusCode:   429,
+		Err:          fmt.Errorf("too many requests"),
+		ErrCode:      "M_LIMIT_EXCEEDED",
+		RetryAfterMs: retryAfter.Milliseconds(),
 	}
 }
 
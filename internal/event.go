@@ -1,6 +1,11 @@
 package internal
 
-import "github.com/tidwall/gjson"
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
 
 func IsMembershipChange(eventJSON gjson.Result) bool {
 	// membership event possibly, make sure the membership has changed else
@@ -17,3 +22,36 @@ func IsMembershipChange(eventJSON gjson.Result) bool {
 	}
 	return prevMembership != currMembership // membership was changed
 }
+
+// ProjectEventContent returns a copy of the event whose `content` only contains the given paths.
+// Paths are gjson paths relative to `content`, so keys containing dots must be escaped e.g
+// `m\.relates_to`. Paths which do not exist in the content are skipped. If no paths are given,
+// or the event has no content object, the event is returned unaltered.
+func ProjectEventContent(eventJSON json.RawMessage, paths []string) json.RawMessage {
+	if len(paths) == 0 {
+		return eventJSON
+	}
+	content := gjson.GetBytes(eventJSON, "content")
+	if !content.IsObject() {
+		return eventJSON
+	}
+	projected := []byte(`{}`)
+	for _, path := range paths {
+		val := content.Get(path)
+		if !val.Exists() {
+			continue
+		}
+		p, err := sjson.SetRawBytes(projected, path, []byte(val.Raw))
+		if err != nil {
+			logger.Warn().Err(err).Str("path", path).Msg("ProjectEventContent: failed to set path")
+			continue
+		}
+		projected = p
+	}
+	result, err := sjson.SetRawBytes(eventJSON, "content", projected)
+	if err != nil {
+		logger.Warn().Err(err).Msg("ProjectEventContent: failed to replace content")
+		return eventJSON
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestProjectEventContent(t *testing.T) {
+	event := json.RawMessage(`{"type":"m.room.message","sender":"@alice:localhost","content":{"body":"hello","format":"org.matrix.custom.html","formatted_body":"<b>hello</b>","m.relates_to":{"rel_type":"m.thread","event_id":"$abc"},"info":{"w":100,"h":200}}}`)
+	testCases := []struct {
+		name  string
+		paths []string
+		want  string
+	}{
+		{
+			name:  "no paths returns the event unaltered",
+			paths: nil,
+			want:  string(event),
+		},
+		{
+			name:  "top-level paths",
+			paths: []string{"body"},
+			want:  `{"type":"m.room.message","sender":"@alice:localhost","content":{"body":"hello"}}`,
+		},
+		{
+			name:  "nested and escaped paths",
+			paths: []string{"body", "info.w", `m\.relates_to`},
+			want:  `{"type":"m.room.message","sender":"@alice:localhost","content":{"body":"hello","info":{"w":100},"m.relates_to":{"rel_type":"m.thread","event_id":"$abc"}}}`,
+		},
+		{
+			name:  "missing paths are skipped",
+			paths: []string{"url"},
+			want:  `{"type":"m.room.message","sender":"@alice:localhost","content":{}}`,
+		},
+	}
+	for _, tc := range testCases {
+		got := ProjectEventContent(event, tc.paths)
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, string(got), tc.want)
+		}
+	}
+	// the input must not be modified
+	if string(event) != `{"type":"m.room.message","sender":"@alice:localhost","content":{"body":"hello","format":"org.matrix.custom.html","formatted_body":"<b>hello</b>","m.relates_to":{"rel_type":"m.thread","event_id":"$abc"},"info":{"w":100,"h":200}}}` {
+		t.Errorf("ProjectEventContent modified the input event: %s", string(event))
+	}
+}
@@ -11,6 +11,8 @@ import (
 type EventMetadata struct {
 	NID       int64
 	Timestamp uint64
+	// The user who sent the event. Only set for events in LatestEventsByType.
+	Sender string
 }
 
 // RoomMetadata holds room-scoped data.
@@ -50,6 +52,11 @@ type RoomMetadata struct {
 	ChildSpaceRooms map[string]struct{}
 	// The latest m.typing ephemeral event for this room.
 	TypingEvent json.RawMessage
+	// The content of the m.room.server_acl state event, or nil if there is none.
+	ServerACL *ServerACL
+	// The state keys of active m.call.member events, mapped to their senders. Replaced rather than
+	// modified when it changes, see SetCallMembership.
+	CallMemberships map[string]string
 }
 
 func NewRoomMetadata(roomID string) *RoomMetadata {
@@ -103,6 +110,12 @@ func (m *RoomMetadata) SameRoomAvatar(other *RoomMetadata) bool {
 	return m.AvatarEvent == other.AvatarEvent && sameHeroAvatars(m.Heroes, other.Heroes)
 }
 
+// SameServerACL checks if the server ACL has changed between the two metadatas.
+// Returns true if there are no changes.
+func (m *RoomMetadata) SameServerACL(other *RoomMetadata) bool {
+	return m.ServerACL.Equal(other.ServerACL)
+}
+
 func (m *RoomMetadata) SameJoinCount(other *RoomMetadata) bool {
 	return m.JoinCount == other.JoinCount
 }
@@ -154,6 +167,32 @@ func (m *RoomMetadata) IsSpace() bool {
 	return m.RoomType != nil && *m.RoomType == "m.space"
 }
 
+// LooksLikeDM returns true if the room is structured like a DM: two members, no name or alias, and
+// no room type in the create event. This is a best-effort guess for rooms which aren't in m.direct,
+// which is only set by the user who created the DM.
+func (m *RoomMetadata) LooksLikeDM() bool {
+	return m.JoinCount+m.InviteCount == 2 && m.NameEvent == "" && m.CanonicalAlias == "" && m.RoomType == nil
+}
+
+// LatestBumpEvent returns the most recent event in the room with one of the given types, or of any
+// type if no types are given. Returns false if there is no such event.
+func (m *RoomMetadata) LatestBumpEvent(bumpEventTypes []string) (EventMetadata, bool) {
+	var latest EventMetadata
+	if len(bumpEventTypes) == 0 {
+		for _, ev := range m.LatestEventsByType {
+			if ev.NID > latest.NID {
+				latest = ev
+			}
+		}
+	}
+	for _, evType := range bumpEventTypes {
+		if ev := m.LatestEventsByType[evType]; ev.NID > latest.NID {
+			latest = ev
+		}
+	}
+	return latest, latest.NID > 0
+}
+
 type Hero struct {
 	ID     string
 	Name   string
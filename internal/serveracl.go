@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"github.com/tidwall/gjson"
+)
+
+// ServerACL is the content of a room's m.room.server_acl state event, which controls which servers
+// may participate in the room.
+type ServerACL struct {
+	Allow           []string `json:"allow"`
+	Deny            []string `json:"deny"`
+	AllowIPLiterals bool     `json:"allow_ip_literals"`
+}
+
+// NewServerACL parses the content of an m.room.server_acl event. Invalid entries are ignored.
+func NewServerACL(content gjson.Result) *ServerACL {
+	acl := &ServerACL{
+		Allow:           []string{},
+		Deny:            []string{},
+		AllowIPLiterals: true, // the default, per the spec
+	}
+	for _, server := range content.Get("allow").Array() {
+		if server.Type == gjson.String {
+			acl.Allow = append(acl.Allow, server.Str)
+		}
+	}
+	for _, server := range content.Get("deny").Array() {
+		if server.Type == gjson.String {
+			acl.Deny = append(acl.Deny, server.Str)
+		}
+	}
+	if allowIPLiterals := content.Get("allow_ip_literals"); allowIPLiterals.IsBool() {
+		acl.AllowIPLiterals = allowIPLiterals.Bool()
+	}
+	return acl
+}
+
+// Equal returns true if both ACLs are nil, or both have the same allow and deny lists.
+func (a *ServerACL) Equal(other *ServerACL) bool {
+	if a == nil || other == nil {
+		return a == other
+	}
+	return a.AllowIPLiterals == other.AllowIPLiterals && sameStrings(a.Allow, other.Allow) && sameStrings(a.Deny, other.Deny)
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxClockSkew is how far ahead of the proxy's clock an event's origin_server_ts can be before
+// it is distrusted when sorting rooms by recency.
+const DefaultMaxClockSkew = 5 * time.Minute
+
+var maxClockSkew = int64(DefaultMaxClockSkew)
+
+// SetMaxClockSkew sets how far ahead of the proxy's clock an event's origin_server_ts can be before it
+// is clamped by RecencyTimestamp. A negative duration disables clamping.
+func SetMaxClockSkew(d time.Duration) {
+	atomic.StoreInt64(&maxClockSkew, int64(d))
+}
+
+// RecencyTimestamp returns the timestamp to use when sorting rooms by recency for an event with this
+// origin_server_ts. Servers with broken or malicious clocks can send events from far in the future,
+// which would pin their room to the top of recency sorted lists. Timestamps too far ahead of now are
+// therefore clamped to now, which approximates when the event was received: events received later
+// in other rooms will then sort above it, as they would when sorting by stream position.
+func RecencyTimestamp(originServerTS uint64, now time.Time) uint64 {
+	skew := time.Duration(atomic.LoadInt64(&maxClockSkew))
+	if skew < 0 {
+		return originServerTS
+	}
+	nowMs := uint64(now.UnixMilli())
+	if originServerTS > nowMs+uint64(skew.Milliseconds()) {
+		return nowMs
+	}
+	return originServerTS
+}
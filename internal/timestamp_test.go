@@ -0,0 +1,29 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecencyTimestamp(t *testing.T) {
+	now := time.UnixMilli(1632131678061)
+	nowMs := uint64(now.UnixMilli())
+	testCases := []struct {
+		name   string
+		skew   time.Duration
+		ts     uint64
+		wantTS uint64
+	}{
+		{name: "past timestamps are kept", skew: DefaultMaxClockSkew, ts: nowMs - 1000, wantTS: nowMs - 1000},
+		{name: "timestamps within the skew are kept", skew: DefaultMaxClockSkew, ts: nowMs + 1000, wantTS: nowMs + 1000},
+		{name: "timestamps beyond the skew are clamped", skew: DefaultMaxClockSkew, ts: nowMs + uint64(time.Hour.Milliseconds()), wantTS: nowMs},
+		{name: "negative skew disables clamping", skew: -1, ts: nowMs + uint64(time.Hour.Milliseconds()), wantTS: nowMs + uint64(time.Hour.Milliseconds())},
+	}
+	defer SetMaxClockSkew(DefaultMaxClockSkew)
+	for _, tc := range testCases {
+		SetMaxClockSkew(tc.skew)
+		if got := RecencyTimestamp(tc.ts, now); got != tc.wantTS {
+			t.Errorf("%s: got %d want %d", tc.name, got, tc.wantTS)
+		}
+	}
+}
@@ -22,8 +22,10 @@ type V2Listener interface {
 	OnDeviceData(p *V2DeviceData)
 	OnTyping(p *V2Typing)
 	OnReceipt(p *V2Receipt)
+	OnPresence(p *V2Presence)
 	OnDeviceMessages(p *V2DeviceMessages)
 	OnExpiredToken(p *V2ExpiredToken)
+	OnPollerLagging(p *V2PollerLagging)
 }
 
 type V2Initialise struct {
@@ -114,6 +116,13 @@ type V2Receipt struct {
 
 func (*V2Receipt) Type() string { return "V2Receipt" }
 
+// V2Presence contains the m.presence events which changed each user's presence.
+type V2Presence struct {
+	UserIDToEvent map[string]json.RawMessage
+}
+
+func (*V2Presence) Type() string { return "V2Presence" }
+
 type V2DeviceMessages struct {
 	UserID   string
 	DeviceID string
@@ -122,11 +131,22 @@ type V2DeviceMessages struct {
 func (*V2DeviceMessages) Type() string { return "V2DeviceMessages" }
 
 type V2ExpiredToken struct {
+	UserID     string
+	DeviceID   string
+	SoftLogout bool
+}
+
+func (*V2ExpiredToken) Type() string { return "V2ExpiredToken" }
+
+type V2PollerLagging struct {
 	UserID   string
 	DeviceID string
+	Lagging  bool
+	// True if the poller fetches room data for all of the user's devices
+	FetchesRoomData bool
 }
 
-func (*V2ExpiredToken) Type() string { return "V2ExpiredToken" }
+func (*V2PollerLagging) Type() string { return "V2PollerLagging" }
 
 type V2Sub struct {
 	listener Listener
@@ -148,6 +168,8 @@ func (v *V2Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V2Receipt:
 		v.receiver.OnReceipt(pl)
+	case *V2Presence:
+		v.receiver.OnPresence(pl)
 	case *V2Initialise:
 		v.receiver.Initialise(pl)
 	case *V2Accumulate:
@@ -172,6 +194,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnDeviceMessages(pl)
 	case *V2ExpiredToken:
 		v.receiver.OnExpiredToken(pl)
+	case *V2PollerLagging:
+		v.receiver.OnPollerLagging(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V2Sub: unhandled payload type")
 	}
@@ -49,6 +49,15 @@ func WithTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
 	return
 }
 
+// WithOptionalTransaction runs fn inside txn if it is non-nil, so that it commits or rolls back with
+// the rest of txn. Otherwise, fn is run in a new transaction as per WithTransaction.
+func WithOptionalTransaction(db *sqlx.DB, txn *sqlx.Tx, fn func(txn *sqlx.Tx) error) error {
+	if txn != nil {
+		return fn(txn)
+	}
+	return WithTransaction(db, fn)
+}
+
 type Chunker interface {
 	Len() int
 	Subslice(i, j int) Chunker
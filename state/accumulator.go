@@ -10,8 +10,10 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // Accumulator tracks room state and timelines.
@@ -159,12 +161,14 @@ type InitialiseResult struct {
 //   - returns (via InitialiseResult.PrependTimelineEvents) a slice of unknown state events,
 //
 // and otherwise does nothing.
-func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (InitialiseResult, error) {
+//
+// If given a transaction, the room is initialised inside that transaction.
+func (a *Accumulator) Initialise(txn *sqlx.Tx, roomID string, state []json.RawMessage) (InitialiseResult, error) {
 	var res InitialiseResult
 	if len(state) == 0 {
 		return res, nil
 	}
-	err := sqlutil.WithTransaction(a.db, func(txn *sqlx.Tx) error {
+	err := sqlutil.WithOptionalTransaction(a.db, txn, func(txn *sqlx.Tx) error {
 		// Attempt to short-circuit. This has to be done inside a transaction to make sure
 		// we don't race with multiple calls to Initialise with the same room ID.
 		snapshotID, err := a.roomsTable.CurrentAfterSnapshotID(txn, roomID)
@@ -457,6 +461,10 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, prevBatch
 		return 0, nil, fmt.Errorf("HandleSpaceUpdates: %s", err)
 	}
 
+	if err = a.applyRedactions(txn, roomID, newEvents); err != nil {
+		return 0, nil, fmt.Errorf("applyRedactions: %s", err)
+	}
+
 	// the last fetched snapshot ID is the current one
 	info := a.roomInfoDelta(roomID, newEvents)
 	if err = a.roomsTable.Upsert(txn, info, snapID, latestNID); err != nil {
@@ -465,6 +473,65 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, prevBatch
 	return numNew, timelineNIDs, nil
 }
 
+// applyRedactions redacts the stored events targeted by any m.room.redaction events in this room, so
+// they are served in their redacted form from then on. The redaction events themselves are unaltered.
+func (a *Accumulator) applyRedactions(txn *sqlx.Tx, roomID string, events []Event) error {
+	redactionsByTarget := make(map[string]json.RawMessage)
+	for _, ev := range events {
+		if ev.Type != "m.room.redaction" {
+			continue
+		}
+		// room versions 11+ move redacts into the content
+		target := gjson.GetBytes(ev.JSON, "redacts").Str
+		if target == "" {
+			target = gjson.GetBytes(ev.JSON, "content.redacts").Str
+		}
+		if target != "" {
+			redactionsByTarget[target] = ev.JSON
+		}
+	}
+	if len(redactionsByTarget) == 0 {
+		return nil
+	}
+	targetIDs := make([]string, 0, len(redactionsByTarget))
+	for target := range redactionsByTarget {
+		targetIDs = append(targetIDs, target)
+	}
+	targets, err := a.eventsTable.SelectByIDs(txn, false, targetIDs)
+	if err != nil {
+		return fmt.Errorf("failed to select redacted events: %s", err)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	roomVersion, err := a.eventsTable.SelectRoomVersion(txn, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to select room version: %s", err)
+	}
+	if _, err = gomatrixserverlib.RoomVersion(roomVersion).RedactionAlgorithm(); err != nil {
+		// newer room versions redact at least as much content as v10 does
+		roomVersion = string(gomatrixserverlib.RoomVersionV10)
+	}
+	for _, target := range targets {
+		// don't let redactions in one room alter events in another
+		if target.RoomID != roomID {
+			continue
+		}
+		redactedJSON, err := gomatrixserverlib.RedactEventJSON(target.JSON, gomatrixserverlib.RoomVersion(roomVersion))
+		if err != nil {
+			return fmt.Errorf("failed to redact event %s: %s", target.ID, err)
+		}
+		redactedJSON, err = sjson.SetRawBytes(redactedJSON, "unsigned.redacted_because", redactionsByTarget[target.ID])
+		if err != nil {
+			return fmt.Errorf("failed to set redacted_because on event %s: %s", target.ID, err)
+		}
+		if err = a.eventsTable.UpdateEventJSON(txn, target.NID, redactedJSON); err != nil {
+			return fmt.Errorf("failed to update redacted event %s: %s", target.ID, err)
+		}
+	}
+	return nil
+}
+
 // filterAndParseTimelineEvents takes a raw timeline array from sync v2 and applies sanity to it:
 // - removes duplicate events: this is just a bug which has been seen on Synapse on matrix.org
 // - removes old events: this is an edge case when joining rooms over federation, see https://github.com/matrix-org/sliding-sync/issues/192
@@ -30,7 +30,7 @@ func TestAccumulatorInitialise(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
 	accumulator := NewAccumulator(db)
-	res, err := accumulator.Initialise(roomID, roomEvents)
+	res, err := accumulator.Initialise(nil, roomID, roomEvents)
 	if err != nil {
 		t.Fatalf("falied to Initialise accumulator: %s", err)
 	}
@@ -87,7 +87,7 @@ func TestAccumulatorInitialise(t *testing.T) {
 	}
 
 	// Subsequent calls do nothing and are not an error
-	res, err = accumulator.Initialise(roomID, roomEvents)
+	res, err = accumulator.Initialise(nil, roomID, roomEvents)
 	if err != nil {
 		t.Fatalf("falied to Initialise accumulator: %s", err)
 	}
@@ -105,7 +105,7 @@ func TestAccumulatorInitialiseBadInputs(t *testing.T) {
 	notcreate := testutils.NewStateEvent(t, "com.example.notacreate", "potato", "@someone:else", map[string]any{})
 
 	accumulator := NewAccumulator(db)
-	_, err := accumulator.Initialise(roomID, []json.RawMessage{notcreate})
+	_, err := accumulator.Initialise(nil, roomID, []json.RawMessage{notcreate})
 	if err == nil {
 		t.Fatalf("Initialise suceeded, but it should not have")
 	}
@@ -121,7 +121,7 @@ func TestAccumulatorAccumulate(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
 	accumulator := NewAccumulator(db)
-	_, err := accumulator.Initialise(roomID, roomEvents)
+	_, err := accumulator.Initialise(nil, roomID, roomEvents)
 	if err != nil {
 		t.Fatalf("failed to Initialise accumulator: %s", err)
 	}
@@ -220,12 +220,70 @@ func TestAccumulatorAccumulate(t *testing.T) {
 	}
 }
 
+// Test that redactions strip the content of the stored events they target, leaving the redaction
+// event itself alone.
+func TestAccumulatorRedactions(t *testing.T) {
+	roomID := "!TestAccumulatorRedactions:localhost"
+	roomEvents := []json.RawMessage{
+		[]byte(`{"event_id":"$TestAccumulatorRedactions_create", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost","room_version":"10"}}`),
+		[]byte(`{"event_id":"$TestAccumulatorRedactions_join", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`),
+	}
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	_, err := accumulator.Initialise(nil, roomID, roomEvents)
+	assertNoError(t, err)
+
+	message := []byte(`{"event_id":"$TestAccumulatorRedactions_msg", "type":"m.room.message", "sender":"@me:localhost", "origin_server_ts":1, "content":{"body":"secret","msgtype":"m.text"}}`)
+	sameBatchMessage := []byte(`{"event_id":"$TestAccumulatorRedactions_msg2", "type":"m.room.message", "sender":"@me:localhost", "origin_server_ts":2, "content":{"body":"also secret","msgtype":"m.text"}}`)
+	redaction := []byte(`{"event_id":"$TestAccumulatorRedactions_redact", "type":"m.room.redaction", "sender":"@me:localhost", "redacts":"$TestAccumulatorRedactions_msg", "content":{"reason":"oops"}}`)
+	// room v11 style redaction
+	sameBatchRedaction := []byte(`{"event_id":"$TestAccumulatorRedactions_redact2", "type":"m.room.redaction", "sender":"@me:localhost", "content":{"redacts":"$TestAccumulatorRedactions_msg2"}}`)
+	for _, timeline := range [][]json.RawMessage{
+		{message},
+		{redaction, sameBatchMessage, sameBatchRedaction},
+	} {
+		err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+			_, _, err := accumulator.Accumulate(txn, userID, roomID, "", timeline)
+			return err
+		})
+		assertNoError(t, err)
+	}
+
+	txn, err := accumulator.db.Beginx()
+	assertNoError(t, err)
+	defer txn.Rollback()
+	events, err := accumulator.eventsTable.SelectByIDs(txn, true, []string{
+		"$TestAccumulatorRedactions_msg", "$TestAccumulatorRedactions_msg2", "$TestAccumulatorRedactions_redact",
+	})
+	assertNoError(t, err)
+	for _, ev := range events {
+		content := gjson.GetBytes(ev.JSON, "content")
+		switch ev.ID {
+		case "$TestAccumulatorRedactions_redact":
+			if content.Get("reason").Str != "oops" {
+				t.Errorf("redaction event was altered: %s", string(ev.JSON))
+			}
+		default:
+			if len(content.Map()) != 0 {
+				t.Errorf("event %s was not redacted: %s", ev.ID, string(ev.JSON))
+			}
+			if !gjson.GetBytes(ev.JSON, "unsigned.redacted_because").Exists() {
+				t.Errorf("event %s missing unsigned.redacted_because: %s", ev.ID, string(ev.JSON))
+			}
+			if gjson.GetBytes(ev.JSON, "origin_server_ts").Int() == 0 {
+				t.Errorf("event %s lost origin_server_ts: %s", ev.ID, string(ev.JSON))
+			}
+		}
+	}
+}
+
 func TestAccumulatorMembershipLogs(t *testing.T) {
 	roomID := "!TestAccumulatorMembershipLogs:localhost"
 	db, close := connectToDB(t)
 	defer close()
 	accumulator := NewAccumulator(db)
-	_, err := accumulator.Initialise(roomID, nil)
+	_, err := accumulator.Initialise(nil, roomID, nil)
 	if err != nil {
 		t.Fatalf("failed to Initialise accumulator: %s", err)
 	}
@@ -378,7 +436,7 @@ func TestAccumulatorDupeEvents(t *testing.T) {
 	defer close()
 	accumulator := NewAccumulator(db)
 	roomID := "!buggy:localhost"
-	_, err := accumulator.Initialise(roomID, joinRoom.State.Events)
+	_, err := accumulator.Initialise(nil, roomID, joinRoom.State.Events)
 	if err != nil {
 		t.Fatalf("failed to Initialise accumulator: %s", err)
 	}
@@ -392,6 +450,127 @@ func TestAccumulatorDupeEvents(t *testing.T) {
 	}
 }
 
+// Test that events which were stored by an earlier Accumulate call are dropped when they are
+// re-delivered alongside new events, e.g. after a gappy sync.
+func TestAccumulatorDupeEventsAcrossBatches(t *testing.T) {
+	roomID := "!TestAccumulatorDupeEventsAcrossBatches:localhost"
+	roomEvents := []json.RawMessage{
+		[]byte(`{"event_id":"$create", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+		[]byte(`{"event_id":"$join", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`),
+	}
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	_, err := accumulator.Initialise(nil, roomID, roomEvents)
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+
+	first := []byte(`{"event_id":"$first", "type":"m.room.message", "content":{"body":"first","msgtype":"m.text"}}`)
+	second := []byte(`{"event_id":"$second", "type":"m.room.message", "content":{"body":"second","msgtype":"m.text"}}`)
+	var firstNIDs []int64
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		_, firstNIDs, err = accumulator.Accumulate(txn, userID, roomID, "", []json.RawMessage{first})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+	if len(firstNIDs) != 1 {
+		t.Fatalf("got %d timeline NIDs for the first event, want 1", len(firstNIDs))
+	}
+
+	// the first event is delivered again along with a new event
+	var numNew int
+	var timelineNIDs []int64
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		numNew, timelineNIDs, err = accumulator.Accumulate(txn, userID, roomID, "", []json.RawMessage{first, second})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate re-delivered event: %s", err)
+	}
+	if numNew != 1 {
+		t.Errorf("got %d new events, want 1", numNew)
+	}
+	if len(timelineNIDs) != 1 || timelineNIDs[0] <= firstNIDs[0] {
+		t.Fatalf("got timeline NIDs %v, want a single NID after %d", timelineNIDs, firstNIDs[0])
+	}
+	txn, err := accumulator.db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start assert txn: %s", err)
+	}
+	defer txn.Rollback()
+	events, err := accumulator.eventsTable.SelectByNIDs(txn, true, timelineNIDs)
+	if err != nil {
+		t.Fatalf("failed to select events: %s", err)
+	}
+	if len(events) != 1 || events[0].ID != "$second" {
+		t.Errorf("got events %+v, want only $second", events)
+	}
+}
+
+// Test that state from a gappy sync's state block replaces the stored state. Initialise returns the
+// unknown state events, which the poller prepends to the timeline for Accumulate.
+func TestAccumulatorGappyStateOverwritesState(t *testing.T) {
+	roomID := "!TestAccumulatorGappyStateOverwritesState:localhost"
+	createEvent := []byte(`{"event_id":"$create", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`)
+	joinEvent := []byte(`{"event_id":"$join", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`)
+	oldName := []byte(`{"event_id":"$old_name", "type":"m.room.name", "state_key":"", "content":{"name":"old"}}`)
+	newName := []byte(`{"event_id":"$new_name", "type":"m.room.name", "state_key":"", "content":{"name":"new"}}`)
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	_, err := accumulator.Initialise(nil, roomID, []json.RawMessage{createEvent, joinEvent, oldName})
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+
+	// a limited sync arrives, with the name changed during the gap
+	res, err := accumulator.Initialise(nil, roomID, []json.RawMessage{createEvent, joinEvent, newName})
+	if err != nil {
+		t.Fatalf("failed to Initialise with gappy state: %s", err)
+	}
+	if len(res.PrependTimelineEvents) != 1 || gjson.GetBytes(res.PrependTimelineEvents[0], "event_id").Str != "$new_name" {
+		t.Fatalf("got prepended events %v, want only $new_name", res.PrependTimelineEvents)
+	}
+	timeline := append(res.PrependTimelineEvents, []byte(`{"event_id":"$msg", "type":"m.room.message", "content":{"body":"hi","msgtype":"m.text"}}`))
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		_, _, err = accumulator.Accumulate(txn, userID, roomID, "", timeline)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+
+	txn, err := accumulator.db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start assert txn: %s", err)
+	}
+	defer txn.Rollback()
+	snapID, err := accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+	if err != nil {
+		t.Fatalf("failed to select current snapshot: %s", err)
+	}
+	row, err := accumulator.snapshotTable.Select(txn, snapID)
+	if err != nil {
+		t.Fatalf("failed to select snapshot %d: %s", snapID, err)
+	}
+	events, err := accumulator.eventsTable.SelectByNIDs(txn, true, row.OtherEvents)
+	if err != nil {
+		t.Fatalf("failed to extract events in snapshot: %s", err)
+	}
+	var gotNameIDs []string
+	for _, ev := range events {
+		if ev.Type == "m.room.name" {
+			gotNameIDs = append(gotNameIDs, ev.ID)
+		}
+	}
+	if !reflect.DeepEqual(gotNameIDs, []string{"$new_name"}) {
+		t.Errorf("got m.room.name events %v in current state, want only $new_name", gotNameIDs)
+	}
+}
+
 // Regression test for corrupt state snapshots.
 // This seems to have happened in the wild, whereby the snapshot exhibited 2 things:
 //   - A message event having a event_replaces_nid. This should be impossible as messages are not state.
@@ -562,7 +741,7 @@ func TestAccumulatorConcurrency(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
 	accumulator := NewAccumulator(db)
-	_, err := accumulator.Initialise(roomID, roomEvents)
+	_, err := accumulator.Initialise(nil, roomID, roomEvents)
 	if err != nil {
 		t.Fatalf("failed to Initialise accumulator: %s", err)
 	}
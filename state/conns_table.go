@@ -0,0 +1,70 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConnsTable stores the sticky request parameters of sync v3 connections, along with the last
+// position sent on each connection and what the client has been sent, so connections can be
+// resumed after the proxy restarts.
+type ConnsTable struct {
+	db *sqlx.DB
+}
+
+func NewConnsTable(db *sqlx.DB) *ConnsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_conns (
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		conn_id TEXT NOT NULL,
+		pos BIGINT NOT NULL,
+		request TEXT NOT NULL, -- the combination of every request made on this connection
+		state TEXT NOT NULL, -- what the client has been sent on this connection
+		updated_ts BIGINT NOT NULL,
+		UNIQUE(user_id, device_id, conn_id)
+	);
+	`)
+	return &ConnsTable{db}
+}
+
+// Upsert the request, state and latest position for this connection.
+func (t *ConnsTable) Upsert(userID, deviceID, connID string, pos int64, request, state json.RawMessage) error {
+	_, err := t.db.Exec(`INSERT INTO syncv3_conns(user_id, device_id, conn_id, pos, request, state, updated_ts) VALUES($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (user_id, device_id, conn_id) DO UPDATE SET pos=excluded.pos, request=excluded.request, state=excluded.state, updated_ts=excluded.updated_ts`,
+		userID, deviceID, connID, pos, string(request), string(state), time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// UpdatePos updates the latest position for this connection, for when the request and state have
+// not changed. Does nothing if the connection has not been upserted.
+func (t *ConnsTable) UpdatePos(userID, deviceID, connID string, pos int64) error {
+	_, err := t.db.Exec(`UPDATE syncv3_conns SET pos=$1, updated_ts=$2 WHERE user_id=$3 AND device_id=$4 AND conn_id=$5`,
+		pos, time.Now().UnixMilli(), userID, deviceID, connID,
+	)
+	return err
+}
+
+// Select the request, state and latest position for this connection, if it was updated after the
+// given time. Returns sql.ErrNoRows if there is no such connection.
+func (t *ConnsTable) Select(userID, deviceID, connID string, updatedAfter time.Time) (pos int64, request, state json.RawMessage, err error) {
+	var req, st string
+	err = t.db.QueryRow(`SELECT pos, request, state FROM syncv3_conns WHERE user_id=$1 AND device_id=$2 AND conn_id=$3 AND updated_ts > $4`,
+		userID, deviceID, connID, updatedAfter.UnixMilli(),
+	).Scan(&pos, &req, &st)
+	return pos, json.RawMessage(req), json.RawMessage(st), err
+}
+
+// DeleteUpdatedBefore deletes connections which were last updated before the given time, returning
+// how many were deleted.
+func (t *ConnsTable) DeleteUpdatedBefore(before time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_conns WHERE updated_ts < $1`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
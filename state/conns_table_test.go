@@ -0,0 +1,62 @@
+package state
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestConnsTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewConnsTable(db)
+	alice := "@TestConnsTable_alice:localhost"
+	device := "TestConnsTable_DEVICE"
+
+	// unknown connections return sql.ErrNoRows
+	_, _, _, err := table.Select(alice, device, "unknown", time.Time{})
+	if err != sql.ErrNoRows {
+		t.Fatalf("Select: got %v want sql.ErrNoRows", err)
+	}
+
+	// the latest upsert wins
+	assertNoError(t, table.Upsert(alice, device, "conn", 1, []byte(`{"lists":{}}`), []byte(`{}`)))
+	assertNoError(t, table.Upsert(alice, device, "conn", 2, []byte(`{"lists":{"a":{}}}`), []byte(`{"sent_rooms":{"!a":1}}`)))
+	pos, req, st, err := table.Select(alice, device, "conn", time.Time{})
+	assertNoError(t, err)
+	if pos != 2 {
+		t.Errorf("Select: got pos %d want 2", pos)
+	}
+	if string(req) != `{"lists":{"a":{}}}` {
+		t.Errorf("Select: got request %s", string(req))
+	}
+	if string(st) != `{"sent_rooms":{"!a":1}}` {
+		t.Errorf("Select: got state %s", string(st))
+	}
+
+	// updating the pos leaves the request and state alone
+	assertNoError(t, table.UpdatePos(alice, device, "conn", 3))
+	pos, req, st, err = table.Select(alice, device, "conn", time.Time{})
+	assertNoError(t, err)
+	if pos != 3 {
+		t.Errorf("Select: got pos %d want 3", pos)
+	}
+	if string(req) != `{"lists":{"a":{}}}` || string(st) != `{"sent_rooms":{"!a":1}}` {
+		t.Errorf("Select: UpdatePos changed request %s or state %s", string(req), string(st))
+	}
+
+	// connections updated too long ago are not returned, and can be deleted
+	_, _, _, err = table.Select(alice, device, "conn", time.Now().Add(time.Hour))
+	if err != sql.ErrNoRows {
+		t.Fatalf("Select: got %v want sql.ErrNoRows for stale connection", err)
+	}
+	deleted, err := table.DeleteUpdatedBefore(time.Now().Add(time.Hour))
+	assertNoError(t, err)
+	if deleted < 1 {
+		t.Errorf("DeleteUpdatedBefore: got %d deleted want at least 1", deleted)
+	}
+	_, _, _, err = table.Select(alice, device, "conn", time.Time{})
+	if err != sql.ErrNoRows {
+		t.Fatalf("Select: got %v want sql.ErrNoRows after deletion", err)
+	}
+}
@@ -133,6 +133,16 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 	CREATE INDEX IF NOT EXISTS syncv3_nid_room_state_idx ON syncv3_events(room_id, event_nid, is_state);
 
 	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key);
+
+	-- the searchable text of a message event. jsonb can't hold NUL characters, so events containing a
+	-- \u0000 escape are not searchable, rather than failing to be inserted. The index on this is made
+	-- by a migration, as it has to be built concurrently.
+	CREATE OR REPLACE FUNCTION syncv3_event_body_tsvector(event BYTEA) RETURNS tsvector AS $$
+		SELECT CASE WHEN position('\x5c7530303030'::bytea IN event) = 0
+			THEN to_tsvector('english', COALESCE(convert_from(event, 'UTF8')::jsonb->'content'->>'body', ''))
+			ELSE ''::tsvector
+		END
+	$$ LANGUAGE SQL IMMUTABLE PARALLEL SAFE;
 	`)
 	return &EventTable{db}
 }
@@ -231,6 +241,16 @@ func (t *EventTable) SelectByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (ev
 	WHERE event_id = ANY ($1) ORDER BY event_nid ASC;`, pq.StringArray(ids))
 }
 
+// SelectMembershipsByNIDs fetches the m.room.member events with the given nids whose state keys are
+// one of stateKeys. The returned events are ordered by ascending nid.
+func (t *EventTable) SelectMembershipsByNIDs(txn *sqlx.Tx, nids []int64, stateKeys []string) (events []Event, err error) {
+	err = txn.Select(&events, `
+	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership FROM syncv3_events
+	WHERE event_nid = ANY ($1) AND event_type = 'm.room.member' AND state_key = ANY ($2) ORDER BY event_nid ASC;`,
+		pq.Int64Array(nids), pq.StringArray(stateKeys))
+	return
+}
+
 // SelectNIDsByIDs does just that. Returns a map from event ID to nid, with a key-value
 // pair for every event_id that was found in the database.
 func (t *EventTable) SelectNIDsByIDs(txn *sqlx.Tx, ids []string) (nids map[string]int64, err error) {
@@ -336,6 +356,33 @@ func (t *EventTable) LatestEventNIDInRooms(txn *sqlx.Tx, roomIDs []string, highe
 	return
 }
 
+// UpdateEventJSON replaces the JSON of an event, e.g. when it is redacted.
+func (t *EventTable) UpdateEventJSON(txn *sqlx.Tx, eventNID int64, eventJSON []byte) error {
+	_, err := txn.Exec(`UPDATE syncv3_events SET event=$1 WHERE event_nid=$2`, eventJSON, eventNID)
+	return err
+}
+
+// SelectRoomVersion returns the room version from the create event for this room. Returns the
+// default room version "1" if the create event omits it, or the empty string if the create event is
+// unknown.
+func (t *EventTable) SelectRoomVersion(txn *sqlx.Tx, roomID string) (roomVersion string, err error) {
+	var createEvent []byte
+	err = txn.QueryRow(
+		`SELECT event FROM syncv3_events WHERE room_id=$1 AND event_type='m.room.create' AND state_key='' LIMIT 1`, roomID,
+	).Scan(&createEvent)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	roomVersion = gjson.GetBytes(createEvent, "content.room_version").Str
+	if roomVersion == "" {
+		roomVersion = "1"
+	}
+	return roomVersion, nil
+}
+
 func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
 	var events []Event
 	// do not pull in events which were in the v2 state block
@@ -345,6 +392,29 @@ func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowe
 	return events, err
 }
 
+// SearchMessagesBetween returns the most recent m.room.message events in this room between the two
+// positions whose body matches the full text search query, most recent first.
+func (t *EventTable) SearchMessagesBetween(txn *sqlx.Tx, roomID, query string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
+	var events []Event
+	err := txn.Select(&events, `SELECT event_nid, event_id, event FROM syncv3_events
+		WHERE event_type = 'm.room.message' AND syncv3_event_body_tsvector(event) @@ plainto_tsquery('english', $1)
+		AND room_id = $2 AND event_nid > $3 AND event_nid <= $4 AND is_state=FALSE
+		ORDER BY event_nid DESC LIMIT $5`,
+		query, roomID, lowerExclusive, upperInclusive, limit,
+	)
+	return events, err
+}
+
+// SelectEarliestEventsBetween is the same as SelectLatestEventsBetween but returns the earliest
+// events first.
+func (t *EventTable) SelectEarliestEventsBetween(txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
+	var events []Event
+	err := txn.Select(&events, `SELECT event_nid, event FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE ORDER BY event_nid ASC LIMIT $4`,
+		lowerExclusive, upperInclusive, roomID, limit,
+	)
+	return events, err
+}
+
 func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, error) {
 	result := []Event{}
 	// TODO: this query ends up doing a sequential scan on the events table. We have
@@ -415,6 +485,19 @@ func (t *EventTable) SelectEventNIDsWithTypeInRoom(txn *sqlx.Tx, eventType strin
 	return
 }
 
+// SelectTimelineStartsAtCreate returns true if the earliest timeline event stored for this room is the
+// m.room.create event, meaning we have every timeline event since the room was created. Returns false
+// if the create event was only seen in a state block, or if there are no timeline events.
+func (t *EventTable) SelectTimelineStartsAtCreate(txn *sqlx.Tx, roomID string) (startsAtCreate bool, err error) {
+	err = txn.QueryRow(
+		`SELECT event_type = 'm.room.create' AND state_key = '' FROM syncv3_events WHERE room_id=$1 AND is_state=FALSE ORDER BY event_nid ASC LIMIT 1`, roomID,
+	).Scan(&startsAtCreate)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
 // SelectClosestPrevBatchByID is the same as SelectClosestPrevBatch but works on event IDs not NIDs
 func (t *EventTable) SelectClosestPrevBatchByID(roomID string, eventID string) (prevBatch string, err error) {
 	err = t.db.QueryRow(
@@ -42,17 +42,29 @@ func NewInvitesTable(db *sqlx.DB) *InvitesTable {
 	return &InvitesTable{db}
 }
 
-func (t *InvitesTable) RemoveInvite(userID, roomID string) error {
-	_, err := t.db.Exec(`DELETE FROM syncv3_invites WHERE user_id = $1 AND room_id = $2`, userID, roomID)
+// RemoveInvite deletes the invite for this user in this room, if any. If given a transaction, it
+// will DELETE inside that transaction.
+func (t *InvitesTable) RemoveInvite(txn *sqlx.Tx, userID, roomID string) error {
+	var db sqlx.Execer = t.db
+	if txn != nil {
+		db = txn
+	}
+	_, err := db.Exec(`DELETE FROM syncv3_invites WHERE user_id = $1 AND room_id = $2`, userID, roomID)
 	return err
 }
 
-func (t *InvitesTable) InsertInvite(userID, roomID string, inviteRoomState []json.RawMessage) error {
+// InsertInvite stores the invite state for this user in this room, replacing any existing invite.
+// If given a transaction, it will INSERT inside that transaction.
+func (t *InvitesTable) InsertInvite(txn *sqlx.Tx, userID, roomID string, inviteRoomState []json.RawMessage) error {
 	blob, err := json.Marshal(inviteRoomState)
 	if err != nil {
 		return err
 	}
-	_, err = t.db.Exec(
+	var db sqlx.Execer = t.db
+	if txn != nil {
+		db = txn
+	}
+	_, err = db.Exec(
 		`INSERT INTO syncv3_invites(user_id, room_id, invite_state) VALUES($1,$2,$3)
 		ON CONFLICT (user_id, room_id) DO UPDATE SET invite_state = $3`,
 		userID, roomID, blob,
@@ -18,13 +18,13 @@ func TestInviteTable(t *testing.T) {
 	inviteStateB := []json.RawMessage{[]byte(`{"foo":"bar"}`), []byte(`{"baz":"quuz"}`)}
 
 	// Add some invites
-	if err := table.InsertInvite(alice, roomA, inviteStateA); err != nil {
+	if err := table.InsertInvite(nil, alice, roomA, inviteStateA); err != nil {
 		t.Fatalf("failed to InsertInvite: %s", err)
 	}
-	if err := table.InsertInvite(bob, roomA, inviteStateB); err != nil {
+	if err := table.InsertInvite(nil, bob, roomA, inviteStateB); err != nil {
 		t.Fatalf("failed to InsertInvite: %s", err)
 	}
-	if err := table.InsertInvite(alice, roomB, inviteStateB); err != nil {
+	if err := table.InsertInvite(nil, alice, roomB, inviteStateB); err != nil {
 		t.Fatalf("failed to InsertInvite: %s", err)
 	}
 
@@ -72,7 +72,7 @@ func TestInviteTable(t *testing.T) {
 	}
 
 	// Update alice's invite, clobber and re-query (inviteState A -> B)
-	if err := table.InsertInvite(alice, roomA, inviteStateB); err != nil {
+	if err := table.InsertInvite(nil, alice, roomA, inviteStateB); err != nil {
 		t.Fatalf("failed to InsertInvite: %s", err)
 	}
 	invites, err = table.SelectAllInvitesForUser(alice)
@@ -84,7 +84,7 @@ func TestInviteTable(t *testing.T) {
 	}
 
 	// Retire one of Alice's invites and re-query
-	if err = table.RemoveInvite(alice, roomA); err != nil {
+	if err = table.RemoveInvite(nil, alice, roomA); err != nil {
 		t.Fatalf("failed to RemoveInvite: %s", err)
 	}
 	invites, err = table.SelectAllInvitesForUser(alice)
@@ -99,7 +99,7 @@ func TestInviteTable(t *testing.T) {
 	}
 
 	// Retire Bob's non-existent invite
-	if err = table.RemoveInvite(bob, "!nothing"); err != nil {
+	if err = table.RemoveInvite(nil, bob, "!nothing"); err != nil {
 		t.Fatalf("failed to RemoveInvite: %s", err)
 	}
 	invites, err = table.SelectAllInvitesForUser(bob)
@@ -111,7 +111,7 @@ func TestInviteTable(t *testing.T) {
 	}
 
 	// Retire Bob's invite
-	if err = table.RemoveInvite(bob, roomA); err != nil {
+	if err = table.RemoveInvite(nil, bob, roomA); err != nil {
 		t.Fatalf("failed to RemoveInvite: %s", err)
 	}
 	invites, err = table.SelectAllInvitesForUser(bob)
@@ -123,7 +123,7 @@ func TestInviteTable(t *testing.T) {
 	}
 
 	// Retire no-ones invite, no-ops
-	if err = table.RemoveInvite("no one", roomA); err != nil {
+	if err = table.RemoveInvite(nil, "no one", roomA); err != nil {
 		t.Fatalf("failed to RemoveInvite: %s", err)
 	}
 }
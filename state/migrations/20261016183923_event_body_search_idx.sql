@@ -0,0 +1,11 @@
+-- +goose NO TRANSACTION
+
+-- The index for searching messages. This scans every message event, so it is built concurrently to
+-- avoid blocking writes to the events table whilst it is made. syncv3_event_body_tsvector is
+-- created along with the events table.
+-- +goose Up
+CREATE INDEX CONCURRENTLY IF NOT EXISTS syncv3_events_body_search_idx ON syncv3_events
+    USING GIN (syncv3_event_body_tsvector(event)) WHERE event_type = 'm.room.message';
+
+-- +goose Down
+DROP INDEX CONCURRENTLY IF EXISTS syncv3_events_body_search_idx;
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/tidwall/gjson"
+)
+
+type presenceRow struct {
+	UserID string `db:"user_id"`
+	Event  string `db:"event"`
+}
+
+// PresenceTable stores the latest m.presence event for each user.
+type PresenceTable struct {
+	db *sqlx.DB
+}
+
+func NewPresenceTable(db *sqlx.DB) *PresenceTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_presence_seq;
+	CREATE TABLE IF NOT EXISTS syncv3_presence (
+		user_id TEXT NOT NULL PRIMARY KEY,
+		stream_id BIGINT NOT NULL DEFAULT nextval('syncv3_presence_seq'),
+		state TEXT NOT NULL, -- the fields of the event which, when changed, are sent to clients
+		event TEXT NOT NULL
+	);
+	`)
+	return &PresenceTable{db}
+}
+
+// Insert the latest presence for the senders of these m.presence events. If given a transaction,
+// it will INSERT inside that transaction. Returns the events which changed a user's presence,
+// keyed by user ID. Every poller sees the presence of every user it shares a room with, and
+// last_active_ago changes on every sync, so events which only change last_active_ago are not
+// treated as changes to avoid flooding clients with presence updates.
+func (t *PresenceTable) Insert(txn *sqlx.Tx, events []json.RawMessage) (changed map[string]json.RawMessage, err error) {
+	// only the latest event for each user matters
+	latest := make(map[string]json.RawMessage, len(events))
+	for _, ev := range events {
+		userID := gjson.GetBytes(ev, "sender").Str
+		if userID == "" {
+			continue
+		}
+		latest[userID] = ev
+	}
+	if len(latest) == 0 {
+		return nil, nil
+	}
+	changed = make(map[string]json.RawMessage)
+	err = sqlutil.WithOptionalTransaction(t.db, txn, func(txn *sqlx.Tx) error {
+		for userID, ev := range latest {
+			var updatedUserID string
+			err := txn.QueryRow(`INSERT INTO syncv3_presence(user_id, state, event) VALUES($1, $2, $3)
+			ON CONFLICT (user_id) DO UPDATE SET state=excluded.state, event=excluded.event, stream_id=nextval('syncv3_presence_seq')
+			WHERE syncv3_presence.state != excluded.state RETURNING user_id`,
+				userID, presenceState(ev), string(ev),
+			).Scan(&updatedUserID)
+			if err == nil {
+				changed[userID] = ev
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert presence: %s", err)
+	}
+	return changed, nil
+}
+
+// Presence returns the latest m.presence event for each of the given users, keyed by user ID.
+// Users without any known presence are not included.
+func (t *PresenceTable) Presence(userIDs []string) (map[string]json.RawMessage, error) {
+	var rows []presenceRow
+	err := t.db.Select(&rows, `SELECT user_id, event FROM syncv3_presence WHERE user_id = ANY($1)`, pq.StringArray(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]json.RawMessage, len(rows))
+	for _, row := range rows {
+		result[row.UserID] = json.RawMessage(row.Event)
+	}
+	return result, nil
+}
+
+// presenceState returns the parts of an m.presence event which clients display.
+func presenceState(ev json.RawMessage) string {
+	content := gjson.GetBytes(ev, "content")
+	return fmt.Sprintf("%s|%v|%s",
+		content.Get("presence").Str, content.Get("currently_active").Bool(), content.Get("status_msg").Str,
+	)
+}
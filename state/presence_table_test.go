@@ -0,0 +1,56 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPresenceTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewPresenceTable(db)
+	alice := "@TestPresenceTable_alice:localhost"
+	bob := "@TestPresenceTable_bob:localhost"
+	aliceOnline := json.RawMessage(`{"type":"m.presence","sender":"` + alice + `","content":{"presence":"online","last_active_ago":1}}`)
+	aliceOnlineLater := json.RawMessage(`{"type":"m.presence","sender":"` + alice + `","content":{"presence":"online","last_active_ago":500}}`)
+	aliceAway := json.RawMessage(`{"type":"m.presence","sender":"` + alice + `","content":{"presence":"unavailable","last_active_ago":1}}`)
+	bobOffline := json.RawMessage(`{"type":"m.presence","sender":"` + bob + `","content":{"presence":"offline"}}`)
+
+	// new presence is always a change, and only the latest event for each user is used
+	changed, err := table.Insert(nil, []json.RawMessage{aliceAway, aliceOnline, bobOffline})
+	assertNoError(t, err)
+	want := map[string]json.RawMessage{
+		alice: aliceOnline,
+		bob:   bobOffline,
+	}
+	if !reflect.DeepEqual(changed, want) {
+		t.Fatalf("Insert: got changes %v want %v", changed, want)
+	}
+
+	// changing only last_active_ago is not a change
+	changed, err = table.Insert(nil, []json.RawMessage{aliceOnlineLater, bobOffline})
+	assertNoError(t, err)
+	if len(changed) != 0 {
+		t.Fatalf("Insert: got changes %v want none", changed)
+	}
+
+	changed, err = table.Insert(nil, []json.RawMessage{aliceAway})
+	assertNoError(t, err)
+	want = map[string]json.RawMessage{
+		alice: aliceAway,
+	}
+	if !reflect.DeepEqual(changed, want) {
+		t.Fatalf("Insert: got changes %v want %v", changed, want)
+	}
+
+	got, err := table.Presence([]string{alice, bob, "@TestPresenceTable_unknown:localhost"})
+	assertNoError(t, err)
+	want = map[string]json.RawMessage{
+		alice: aliceAway,
+		bob:   bobOffline,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Presence: got %v want %v", got, want)
+	}
+}
@@ -57,7 +57,8 @@ func NewReceiptTable(db *sqlx.DB) *ReceiptTable {
 // Insert new receipts based on a receipt EDU
 // Returns newly inserted receipts, or nil if there are no new receipts.
 // These newly inserted receipts can then be sent to the API processes for live updates.
-func (t *ReceiptTable) Insert(roomID string, ephEvent json.RawMessage) (receipts []internal.Receipt, err error) {
+// If given a transaction, it will INSERT inside that transaction.
+func (t *ReceiptTable) Insert(txn *sqlx.Tx, roomID string, ephEvent json.RawMessage) (receipts []internal.Receipt, err error) {
 	readReceipts, privateReceipts, err := UnpackReceiptsFromEDU(roomID, ephEvent)
 	if err != nil {
 		return nil, err
@@ -65,7 +66,7 @@ func (t *ReceiptTable) Insert(roomID string, ephEvent json.RawMessage) (receipts
 	if len(readReceipts) == 0 && len(privateReceipts) == 0 {
 		return nil, nil
 	}
-	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithOptionalTransaction(t.db, txn, func(txn *sqlx.Tx) error {
 		readReceipts, err = t.bulkInsert("syncv3_receipts", txn, readReceipts)
 		if err != nil {
 			return err
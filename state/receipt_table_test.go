@@ -57,7 +57,7 @@ func TestReceiptTable(t *testing.T) {
 
 	// inserting same receipts for different rooms should work - compound key should include the room ID
 	for _, roomID := range []string{roomA, roomB} {
-		newReceipts, err := table.Insert(roomID, edu)
+		newReceipts, err := table.Insert(nil, roomID, edu)
 		if err != nil {
 			t.Fatalf("Insert: %s", err)
 		}
@@ -80,7 +80,7 @@ func TestReceiptTable(t *testing.T) {
 		})
 	}
 	// dupe receipts = no delta
-	newReceipts, err := table.Insert(roomA, edu)
+	newReceipts, err := table.Insert(nil, roomA, edu)
 	assertNoError(t, err)
 	parsedReceiptsEqual(t, newReceipts, nil)
 
@@ -98,7 +98,7 @@ func TestReceiptTable(t *testing.T) {
 	})
 
 	// new receipt with old receipt -> 1 delta, also check thread_id is saved.
-	newReceipts, err = table.Insert(roomA, json.RawMessage(`{
+	newReceipts, err = table.Insert(nil, roomA, json.RawMessage(`{
 		"content": {
 		  "$1435641916114394fHBLK:matrix.org": {
 			"m.read": {
@@ -126,7 +126,7 @@ func TestReceiptTable(t *testing.T) {
 	})
 
 	// updated receipt for user -> 1 delta
-	newReceipts, err = table.Insert(roomA, json.RawMessage(`{
+	newReceipts, err = table.Insert(nil, roomA, json.RawMessage(`{
 			"content": {
 			  "$aaaaaaaa:matrix.org": {
 				"m.read": {
@@ -150,7 +150,7 @@ func TestReceiptTable(t *testing.T) {
 	})
 
 	// selecting multiple receipts
-	table.Insert(roomA, json.RawMessage(`{
+	table.Insert(nil, roomA, json.RawMessage(`{
 		"content": {
 		  "$aaaaaaaa:matrix.org": {
 			"m.read": {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/lib/pq"
@@ -35,6 +36,8 @@ type LatestEvents struct {
 	Timeline  []json.RawMessage
 	PrevBatch string
 	LatestNID int64
+	// True if the proxy has stored every timeline event in this room since it was created
+	TimelineComplete bool
 }
 
 // DiscardIgnoredMessages modifies the struct in-place, replacing the Timeline with
@@ -53,6 +56,18 @@ func (e *LatestEvents) DiscardIgnoredMessages(shouldIgnore func(sender string) b
 	e.Timeline = newTimeline
 }
 
+// TrimToAfter modifies the struct in-place, removing this event and all events before it from the
+// Timeline. Returns false and leaves the Timeline unaltered if the event is not in the Timeline.
+func (e *LatestEvents) TrimToAfter(eventID string) bool {
+	for i, ev := range e.Timeline {
+		if gjson.GetBytes(ev, "event_id").Str == eventID {
+			e.Timeline = e.Timeline[i+1:]
+			return true
+		}
+	}
+	return false
+}
+
 type Storage struct {
 	Accumulator       *Accumulator
 	EventsTable       *EventTable
@@ -63,6 +78,8 @@ type Storage struct {
 	TransactionsTable *TransactionsTable
 	DeviceDataTable   *DeviceDataTable
 	ReceiptTable      *ReceiptTable
+	PresenceTable     *PresenceTable
+	ConnsTable        *ConnsTable
 	DB                *sqlx.DB
 }
 
@@ -95,6 +112,8 @@ func NewStorageWithDB(db *sqlx.DB) *Storage {
 		TransactionsTable: NewTransactionsTable(db),
 		DeviceDataTable:   NewDeviceDataTable(db),
 		ReceiptTable:      NewReceiptTable(db),
+		PresenceTable:     NewPresenceTable(db),
+		ConnsTable:        NewConnsTable(db),
 		DB:                db,
 	}
 }
@@ -129,7 +148,9 @@ func (s *Storage) AccountDatas(userID string, roomIDs ...string) (datas []Accoun
 	return
 }
 
-func (s *Storage) InsertAccountData(userID, roomID string, events []json.RawMessage) (data []AccountData, err error) {
+// InsertAccountData stores these account data events for this user. If given a transaction, it will
+// INSERT inside that transaction.
+func (s *Storage) InsertAccountData(txn *sqlx.Tx, userID, roomID string, events []json.RawMessage) (data []AccountData, err error) {
 	data = make([]AccountData, len(events))
 	for i := range events {
 		data[i] = AccountData{
@@ -139,7 +160,7 @@ func (s *Storage) InsertAccountData(userID, roomID string, events []json.RawMess
 			Type:   gjson.ParseBytes(events[i]).Get("type").Str,
 		}
 	}
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithOptionalTransaction(s.Accumulator.db, txn, func(txn *sqlx.Tx) error {
 		data, err = s.AccountDataTable.Insert(txn, data)
 		return err
 	})
@@ -207,19 +228,21 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 	if err != nil {
 		return err
 	}
+	now := time.Now()
 	for _, ev := range events {
 		metadata := loadMetadata(ev.RoomID)
 
 		// For a given room, we'll see many events (one for each event type in the
 		// room's state). We need to pick the largest of these events' timestamps here.
-		ts := gjson.ParseBytes(ev.JSON).Get("origin_server_ts").Uint()
+		ts := internal.RecencyTimestamp(gjson.ParseBytes(ev.JSON).Get("origin_server_ts").Uint(), now)
 		if ts > metadata.LastMessageTimestamp {
 			metadata.LastMessageTimestamp = ts
 		}
 		parsed := gjson.ParseBytes(ev.JSON)
 		eventMetadata := internal.EventMetadata{
 			NID:       ev.NID,
-			Timestamp: parsed.Get("origin_server_ts").Uint(),
+			Timestamp: ts,
+			Sender:    parsed.Get("sender").Str,
 		}
 		metadata.LatestEventsByType[parsed.Get("type").Str] = eventMetadata
 		// it's possible the latest event is a brand new room not caught by the first SELECT for joined
@@ -232,7 +255,7 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 
 	// Select the name / canonical alias for all rooms
 	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, []string{
-		"m.room.name", "m.room.canonical_alias", "m.room.avatar",
+		"m.room.name", "m.room.canonical_alias", "m.room.avatar", "m.room.server_acl", "m.call.member",
 	})
 	if err != nil {
 		return fmt.Errorf("failed to load state events for all rooms: %s", err)
@@ -246,6 +269,13 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 				metadata.CanonicalAlias = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
 			} else if ev.Type == "m.room.avatar" && ev.StateKey == "" {
 				metadata.AvatarEvent = gjson.ParseBytes(ev.JSON).Get("content.url").Str
+			} else if ev.Type == "m.room.server_acl" && ev.StateKey == "" {
+				metadata.ServerACL = internal.NewServerACL(gjson.ParseBytes(ev.JSON).Get("content"))
+			} else if ev.Type == "m.call.member" {
+				parsed := gjson.ParseBytes(ev.JSON)
+				metadata.CallMemberships = internal.SetCallMembership(
+					metadata.CallMemberships, ev.StateKey, parsed.Get("sender").Str, internal.IsActiveCallMembership(parsed.Get("content")),
+				)
 			}
 		}
 		result[roomID] = metadata
@@ -335,7 +365,7 @@ func (s *Storage) Accumulate(userID, roomID, prevBatch string, timeline []json.R
 }
 
 func (s *Storage) Initialise(roomID string, state []json.RawMessage) (InitialiseResult, error) {
-	return s.Accumulator.Initialise(roomID, state)
+	return s.Accumulator.Initialise(nil, roomID, state)
 }
 
 // EventNIDs fetches the raw JSON form of events given a slice of eventNIDs. The events
@@ -569,6 +599,57 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 	return
 }
 
+// SenderMembershipsAtEvents returns the m.room.member event of the sender of each event as it was when
+// the event was sent, i.e from the room state before the event. This lets clients render old events
+// with the sender's display name and avatar at the time, rather than their current ones. Returns a
+// map of event ID to membership event. Events which are unknown, are part of the room's initial state
+// or whose sender had no membership are omitted.
+func (s *Storage) SenderMembershipsAtEvents(ctx context.Context, eventIDs []string) (eventIDToMembership map[string]json.RawMessage, err error) {
+	_, span := internal.StartSpan(ctx, "SenderMembershipsAtEvents")
+	defer span.End()
+	eventIDToMembership = make(map[string]json.RawMessage, len(eventIDs))
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		events, err := s.Accumulator.eventsTable.SelectByIDs(txn, false, eventIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select events: %s", err)
+		}
+		// many events share the same state, so look up each snapshot once
+		snapshotToSenders := make(map[int64][]string)
+		for _, ev := range events {
+			if ev.BeforeStateSnapshotID == 0 {
+				continue
+			}
+			snapshotToSenders[ev.BeforeStateSnapshotID] = append(
+				snapshotToSenders[ev.BeforeStateSnapshotID], gjson.GetBytes(ev.JSON, "sender").Str,
+			)
+		}
+		// snapshot ID -> sender -> membership event
+		snapshotMemberships := make(map[int64]map[string]json.RawMessage, len(snapshotToSenders))
+		for snapshotID, senders := range snapshotToSenders {
+			snapshot, err := s.Accumulator.snapshotTable.Select(txn, snapshotID)
+			if err != nil {
+				return fmt.Errorf("failed to select snapshot %d: %s", snapshotID, err)
+			}
+			memberships, err := s.Accumulator.eventsTable.SelectMembershipsByNIDs(txn, snapshot.MembershipEvents, senders)
+			if err != nil {
+				return fmt.Errorf("failed to select memberships in snapshot %d: %s", snapshotID, err)
+			}
+			snapshotMemberships[snapshotID] = make(map[string]json.RawMessage, len(memberships))
+			for _, membership := range memberships {
+				snapshotMemberships[snapshotID][membership.StateKey] = membership.JSON
+			}
+		}
+		for _, ev := range events {
+			membership, ok := snapshotMemberships[ev.BeforeStateSnapshotID][gjson.GetBytes(ev.JSON, "sender").Str]
+			if ok {
+				eventIDToMembership[ev.ID] = membership
+			}
+		}
+		return nil
+	})
+	return
+}
+
 func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*LatestEvents, error) {
 	roomIDToRanges, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, 0, to)
 	if err != nil {
@@ -615,6 +696,10 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 				}
 				latestEvents.PrevBatch = prevBatch
 			}
+			latestEvents.TimelineComplete, err = s.EventsTable.SelectTimelineStartsAtCreate(txn, roomID)
+			if err != nil {
+				return fmt.Errorf("failed to check if timeline is complete for room %s : %s", roomID, err)
+			}
 			result[roomID] = &latestEvents
 		}
 		return nil
@@ -622,6 +707,88 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 	return result, err
 }
 
+// EventsAroundEvent returns up to limit events either side of the given event in this room, along
+// with the event itself, as of the position to. Only events visible to the user without leaving the
+// room are returned. Returns nil if the event is not a stored timeline event visible to this user.
+func (s *Storage) EventsAroundEvent(userID, roomID, eventID string, to int64, limit int) (*LatestEvents, error) {
+	roomIDToRanges, err := s.visibleEventNIDsBetweenForRooms(userID, []string{roomID}, 0, to)
+	if err != nil {
+		return nil, err
+	}
+	var result *LatestEvents
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		nids, err := s.EventsTable.SelectNIDsByIDs(txn, []string{eventID})
+		if err != nil {
+			return fmt.Errorf("failed to select NID for event %s: %s", eventID, err)
+		}
+		nid, ok := nids[eventID]
+		if !ok {
+			return nil
+		}
+		for _, r := range roomIDToRanges[roomID] {
+			if nid < r[0] || nid > r[1] {
+				continue
+			}
+			// the most recent event will be first, which must be the centre event else it is in
+			// another room or was in the state block
+			before, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, nid, limit+1)
+			if err != nil {
+				return fmt.Errorf("room %s failed to SelectLatestEventsBetween: %s", roomID, err)
+			}
+			if len(before) == 0 || before[0].NID != nid {
+				return nil
+			}
+			after, err := s.EventsTable.SelectEarliestEventsBetween(txn, roomID, nid, r[1], limit)
+			if err != nil {
+				return fmt.Errorf("room %s failed to SelectEarliestEventsBetween: %s", roomID, err)
+			}
+			result = &LatestEvents{
+				Timeline: make([]json.RawMessage, 0, len(before)+len(after)),
+			}
+			for i := len(before) - 1; i >= 0; i-- {
+				result.Timeline = append(result.Timeline, before[i].JSON)
+			}
+			for _, ev := range after {
+				result.Timeline = append(result.Timeline, ev.JSON)
+			}
+			result.LatestNID = nid
+			if len(after) > 0 {
+				result.LatestNID = after[len(after)-1].NID
+			}
+			result.PrevBatch, err = s.EventsTable.SelectClosestPrevBatch(txn, roomID, before[len(before)-1].NID)
+			if err != nil {
+				return fmt.Errorf("failed to select prev_batch for room %s : %s", roomID, err)
+			}
+			return nil
+		}
+		return nil
+	})
+	return result, err
+}
+
+// SearchRoom returns up to limit of the most recent messages in this room which match the query and
+// are visible to the user as of the position to, most recent first.
+func (s *Storage) SearchRoom(userID, roomID, query string, to int64, limit int) ([]Event, error) {
+	roomIDToRanges, err := s.visibleEventNIDsBetweenForRooms(userID, []string{roomID}, 0, to)
+	if err != nil {
+		return nil, err
+	}
+	ranges := roomIDToRanges[roomID]
+	var results []Event
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		// start at the most recent range as we want to return the most recent matches
+		for i := len(ranges) - 1; i >= 0 && len(results) < limit; i-- {
+			events, err := s.EventsTable.SearchMessagesBetween(txn, roomID, query, ranges[i][0]-1, ranges[i][1], limit-len(results))
+			if err != nil {
+				return fmt.Errorf("room %s failed to SearchMessagesBetween: %s", roomID, err)
+			}
+			results = append(results, events...)
+		}
+		return nil
+	})
+	return results, err
+}
+
 func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []string, from, to int64) (map[string][][2]int64, error) {
 	// load *THESE* joined rooms for this user at from (inclusive)
 	var membershipEvents []Event
@@ -944,7 +1111,7 @@ func (s *Storage) determineJoinedRoomsFromMemberships(membershipEvents []Event)
 			if _, currentlyJoined := joinTimingByRoomID[ev.RoomID]; !currentlyJoined {
 				joinTimingByRoomID[ev.RoomID] = internal.EventMetadata{
 					NID:       ev.NID,
-					Timestamp: parsed.Get("origin_server_ts").Uint(),
+					Timestamp: internal.RecencyTimestamp(parsed.Get("origin_server_ts").Uint(), time.Now()),
 				}
 			}
 		case "ban":
@@ -958,6 +1125,7 @@ func (s *Storage) determineJoinedRoomsFromMemberships(membershipEvents []Event)
 }
 
 func (s *Storage) Teardown() {
+	s.ToDeviceTable.StopSweeper()
 	err := s.Accumulator.db.Close()
 	if err != nil {
 		panic("Storage.Teardown: " + err.Error())
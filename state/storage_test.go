@@ -583,6 +583,238 @@ func TestStorageLatestEventsInRoomsPrevBatch(t *testing.T) {
 	}
 }
 
+func TestStorageEventsAroundEvent(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageEventsAroundEvent:localhost"
+	alice := "@alice_TestStorageEventsAroundEvent:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+	var timeline []json.RawMessage
+	for i := 0; i < 20; i++ {
+		timeline = append(timeline, testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": fmt.Sprintf("%d", i)}))
+	}
+	_, _, err = store.Accumulate(alice, roomID, "prev_batch", timeline)
+	assertNoError(t, err)
+	latestNID, err := store.LatestEventNID()
+	assertNoError(t, err)
+	eventID := func(i int) string {
+		return gjson.GetBytes(timeline[i], "event_id").Str
+	}
+
+	testCases := []struct {
+		name      string
+		center    int
+		limit     int
+		wantStart int
+		wantEnd   int // inclusive
+		// prev_batch tokens are only known for the first event of each accumulated timeline
+		wantPrevBatch string
+	}{
+		{name: "middle", center: 9, limit: 3, wantStart: 6, wantEnd: 12},
+		{name: "near the start", center: 1, limit: 3, wantStart: 0, wantEnd: 4, wantPrevBatch: "prev_batch"},
+		{name: "near the end", center: 18, limit: 3, wantStart: 15, wantEnd: 19},
+	}
+	for _, tc := range testCases {
+		got, err := store.EventsAroundEvent(alice, roomID, eventID(tc.center), latestNID, tc.limit)
+		assertNoError(t, err)
+		if got == nil {
+			t.Fatalf("%s: got nil events", tc.name)
+		}
+		want := timeline[tc.wantStart : tc.wantEnd+1]
+		if len(got.Timeline) != len(want) {
+			t.Fatalf("%s: got %d events want %d", tc.name, len(got.Timeline), len(want))
+		}
+		for i := range want {
+			if gjson.GetBytes(got.Timeline[i], "event_id").Str != gjson.GetBytes(want[i], "event_id").Str {
+				t.Errorf("%s: event %d: got %s want %s", tc.name, i, string(got.Timeline[i]), string(want[i]))
+			}
+		}
+		if got.PrevBatch != tc.wantPrevBatch {
+			t.Errorf("%s: got prev_batch %q want %q", tc.name, got.PrevBatch, tc.wantPrevBatch)
+		}
+	}
+
+	// unknown events and other users return nothing
+	got, err := store.EventsAroundEvent(alice, roomID, "$unknown", latestNID, 3)
+	assertNoError(t, err)
+	if got != nil {
+		t.Errorf("got events %v for unknown event, want nil", got.Timeline)
+	}
+	got, err = store.EventsAroundEvent("@bob_TestStorageEventsAroundEvent:localhost", roomID, eventID(9), latestNID, 3)
+	assertNoError(t, err)
+	if got != nil {
+		t.Errorf("got events %v for user not in the room, want nil", got.Timeline)
+	}
+}
+
+func TestStorageSearchRoom(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageSearchRoom:localhost"
+	alice := "@alice_TestStorageSearchRoom:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+	bodies := []string{
+		"shall we get lunch?",
+		"the cat sat on the mat",
+		"anyone seen my cats",
+		"lunch was great",
+		"CAT PICTURES",
+	}
+	var timeline []json.RawMessage
+	for _, body := range bodies {
+		timeline = append(timeline, testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": body}))
+	}
+	// non-message events are never returned, even if they have a matching body
+	timeline = append(timeline, testutils.NewEvent(t, "m.room.not_a_message", alice, map[string]interface{}{"body": "cat"}))
+	_, _, err = store.Accumulate(alice, roomID, "", timeline)
+	assertNoError(t, err)
+	latestNID, err := store.LatestEventNID()
+	assertNoError(t, err)
+
+	testCases := []struct {
+		name  string
+		query string
+		limit int
+		want  []int // indexes into timeline, most recent first
+	}{
+		{name: "stemmed and case insensitive", query: "cat", limit: 10, want: []int{4, 2, 1}},
+		{name: "limit", query: "cat", limit: 2, want: []int{4, 2}},
+		{name: "multiple words", query: "great lunch", limit: 10, want: []int{3}},
+		{name: "no matches", query: "dog", limit: 10, want: nil},
+	}
+	for _, tc := range testCases {
+		got, err := store.SearchRoom(alice, roomID, tc.query, latestNID, tc.limit)
+		assertNoError(t, err)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: got %d results want %d", tc.name, len(got), len(tc.want))
+		}
+		for i, wantIndex := range tc.want {
+			wantID := gjson.GetBytes(timeline[wantIndex], "event_id").Str
+			if got[i].ID != wantID {
+				t.Errorf("%s: result %d: got %s want %s", tc.name, i, got[i].ID, wantID)
+			}
+		}
+	}
+
+	// users who were never in the room see nothing
+	got, err := store.SearchRoom("@bob_TestStorageSearchRoom:localhost", roomID, "cat", latestNID, 10)
+	assertNoError(t, err)
+	if len(got) != 0 {
+		t.Errorf("got %d results for user not in the room, want 0", len(got))
+	}
+}
+
+func TestStorageSenderMembershipsAtEvents(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageSenderMembershipsAtEvents:localhost"
+	alice := "@alice_TestStorageSenderMembershipsAtEvents:localhost"
+	aliceJoin := testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{
+		"membership":  "join",
+		"displayname": "Alice",
+	})
+	stateEvents := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		aliceJoin,
+	}
+	beforeRename := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "before rename"})
+	aliceRename := testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{
+		"membership":  "join",
+		"displayname": "Alice Renamed",
+	})
+	afterRename := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "after rename"})
+	if _, err := store.Initialise(roomID, stateEvents); err != nil {
+		t.Fatalf("failed to initialise: %s", err)
+	}
+	if _, _, err := store.Accumulate(userID, roomID, "", []json.RawMessage{beforeRename, aliceRename, afterRename}); err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+	eventID := func(ev json.RawMessage) string {
+		return gjson.GetBytes(ev, "event_id").Str
+	}
+	got, err := store.SenderMembershipsAtEvents(context.Background(), []string{
+		eventID(stateEvents[0]), eventID(beforeRename), eventID(aliceRename), eventID(afterRename), "$unknown",
+	})
+	if err != nil {
+		t.Fatalf("SenderMembershipsAtEvents: %s", err)
+	}
+	want := map[string]json.RawMessage{
+		// the event was sent before alice renamed, so carries the old name
+		eventID(beforeRename): aliceJoin,
+		// the rename itself was sent by alice with her old name
+		eventID(aliceRename): aliceJoin,
+		eventID(afterRename): aliceRename,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d memberships want %d: %v", len(got), len(want), got)
+	}
+	for id, wantMembership := range want {
+		if !bytes.Equal(got[id], wantMembership) {
+			t.Errorf("event %s: got membership %s want %s", id, string(got[id]), string(wantMembership))
+		}
+	}
+}
+
+func TestStorageLatestEventsInRoomsTimelineComplete(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice_TestStorageLatestEventsInRoomsTimelineComplete:localhost"
+	// the proxy saw this room being created, so has the entire timeline
+	completeRoomID := "!TestStorageLatestEventsInRoomsTimelineComplete_complete:localhost"
+	_, _, err := store.Accumulate(alice, completeRoomID, "batch A", []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "1"}),
+	})
+	if err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+	// the proxy only saw the create event in a state block, so there is a gap before the timeline
+	gappyRoomID := "!TestStorageLatestEventsInRoomsTimelineComplete_gappy:localhost"
+	_, err = store.Initialise(gappyRoomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("failed to initialise: %s", err)
+	}
+	_, _, err = store.Accumulate(alice, gappyRoomID, "batch B", []json.RawMessage{
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "1"}),
+	})
+	if err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+
+	latestNID, err := store.EventsTable.SelectHighestNID()
+	if err != nil {
+		t.Fatalf("failed to select highest nid: %s", err)
+	}
+	roomIDToLatestEvents, err := store.LatestEventsInRooms(alice, []string{completeRoomID, gappyRoomID}, latestNID, 10)
+	if err != nil {
+		t.Fatalf("LatestEventsInRooms: %s", err)
+	}
+	for roomID, wantComplete := range map[string]bool{
+		completeRoomID: true,
+		gappyRoomID:    false,
+	} {
+		latestEvents := roomIDToLatestEvents[roomID]
+		if latestEvents == nil {
+			t.Fatalf("no latest events for room %s", roomID)
+		}
+		if latestEvents.TimelineComplete != wantComplete {
+			t.Errorf("room %s: got TimelineComplete=%v want %v", roomID, latestEvents.TimelineComplete, wantComplete)
+		}
+	}
+}
+
 func TestGlobalSnapshot(t *testing.T) {
 	alice := "@TestGlobalSnapshot_alice:localhost"
 	bob := "@TestGlobalSnapshot_bob:localhost"
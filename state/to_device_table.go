@@ -1,12 +1,16 @@
 package state
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/tidwall/gjson"
 )
@@ -16,9 +20,17 @@ const (
 	ActionCancel  = 2
 )
 
+// DefaultToDeviceRetention is how long to-device messages are kept for before they are swept,
+// regardless of whether the device has acknowledged them.
+const DefaultToDeviceRetention = 30 * 24 * time.Hour
+
 // ToDeviceTable stores to_device messages for devices.
 type ToDeviceTable struct {
-	db *sqlx.DB
+	db           *sqlx.DB
+	retention    time.Duration
+	maxPerDevice int
+	// closed to stop the sweeper goroutine, nil if it isn't running
+	sweepStop chan struct{}
 }
 
 type ToDeviceRow struct {
@@ -30,6 +42,8 @@ type ToDeviceRow struct {
 	Sender    string  `db:"sender"`
 	UniqueKey *string `db:"unique_key"`
 	Action    int     `db:"action"`
+	Timestamp int64   `db:"ts"`
+	DedupeKey *string `db:"dedupe_key"`
 }
 
 type ToDeviceRowChunker []ToDeviceRow
@@ -56,6 +70,12 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 		unique_key TEXT,
 		action SMALLINT DEFAULT 0 -- 0 means unknown
 	);
+	-- when the message was received, in milliseconds. Messages which existed before this column was
+	-- added are treated as received now, so they are not all swept on upgrade.
+	ALTER TABLE syncv3_to_device_messages ADD COLUMN IF NOT EXISTS ts BIGINT NOT NULL DEFAULT (extract(epoch from now()) * 1000)::BIGINT;
+	-- identifies redeliveries of the same message, see toDeviceDedupeKey. NULL for messages which
+	-- existed before this column was added, which are never treated as duplicates.
+	ALTER TABLE syncv3_to_device_messages ADD COLUMN IF NOT EXISTS dedupe_key TEXT;
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
@@ -65,8 +85,83 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_ukey_idx ON syncv3_to_device_messages(unique_key, device_id);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_pos_device_idx ON syncv3_to_device_messages(position, device_id);
+	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_ts_idx ON syncv3_to_device_messages(ts);
+	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_to_device_messages_dedupe_idx ON syncv3_to_device_messages(user_id, device_id, dedupe_key);
 	`)
-	return &ToDeviceTable{db}
+	return &ToDeviceTable{
+		db:        db,
+		retention: DefaultToDeviceRetention,
+	}
+}
+
+// SetRetention configures which messages are removed by Sweep. Messages received longer than
+// `retention` ago are removed, as are the oldest messages for any device with more than
+// `maxPerDevice` messages. A value of 0 or less disables that limit.
+func (t *ToDeviceTable) SetRetention(retention time.Duration, maxPerDevice int) {
+	t.retention = retention
+	t.maxPerDevice = maxPerDevice
+}
+
+// StartSweeper calls Sweep every `interval` until StopSweeper is called.
+func (t *ToDeviceTable) StartSweeper(interval time.Duration) {
+	if t.sweepStop != nil {
+		return
+	}
+	t.sweepStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := t.Sweep(); err != nil {
+					logger.Err(err).Msg("ToDeviceTable: failed to sweep to-device messages")
+				}
+			}
+		}
+	}(t.sweepStop)
+}
+
+func (t *ToDeviceTable) StopSweeper() {
+	if t.sweepStop != nil {
+		close(t.sweepStop)
+		t.sweepStop = nil
+	}
+}
+
+// Sweep deletes to-device messages which are older than the retention period or which exceed the
+// per-device cap, regardless of whether they have been acknowledged. Devices which never come back
+// never acknowledge their messages, so without this the table grows forever. Returns the number of
+// messages deleted.
+func (t *ToDeviceTable) Sweep() (deleted int64, err error) {
+	if t.retention > 0 {
+		boundary := time.Now().Add(-t.retention).UnixMilli()
+		res, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE ts < $1`, boundary)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete expired messages: %s", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	if t.maxPerDevice > 0 {
+		res, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE position IN (
+			SELECT position FROM (
+				SELECT position, row_number() OVER (PARTITION BY user_id, device_id ORDER BY position DESC) AS newest
+				FROM syncv3_to_device_messages
+			) ranked WHERE newest > $1
+		)`, t.maxPerDevice)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete messages over the per-device cap: %s", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	if deleted > 0 {
+		logger.Info().Int64("deleted", deleted).Msg("ToDeviceTable: swept to-device messages")
+	}
+	return deleted, nil
 }
 
 func (t *ToDeviceTable) SetUnackedPosition(userID, deviceID string, pos int64) error {
@@ -75,6 +170,16 @@ func (t *ToDeviceTable) SetUnackedPosition(userID, deviceID string, pos int64) e
 	return err
 }
 
+// UnackedPosition returns the position of the last to-device message sent to this device, or 0 if
+// nothing has been sent to it yet. Clients should never ack a position beyond this.
+func (t *ToDeviceTable) UnackedPosition(userID, deviceID string) (pos int64, err error) {
+	err = t.db.QueryRow(`SELECT unack_pos FROM syncv3_to_device_ack_pos WHERE user_id=$1 AND device_id=$2`, userID, deviceID).Scan(&pos)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
 func (t *ToDeviceTable) DeleteMessagesUpToAndIncluding(userID, deviceID string, toIncl int64) error {
 	_, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position <= $3`, userID, deviceID, toIncl)
 	return err
@@ -90,6 +195,15 @@ func (t *ToDeviceTable) DeleteAllMessagesForDevice(userID, deviceID string) erro
 	return err
 }
 
+// CountMessages returns the number of to-device messages waiting for this device after and excluding `from`.
+func (t *ToDeviceTable) CountMessages(userID, deviceID string, from int64) (count int, err error) {
+	err = t.db.QueryRow(
+		`SELECT count(*) FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position > $3`,
+		userID, deviceID, from,
+	).Scan(&count)
+	return
+}
+
 // Messages fetches up to `limit` to-device messages for this device, starting from and excluding `from`.
 // Returns the fetches messages ordered by ascending position, as well as the position of the last to-device message
 // fetched.
@@ -116,53 +230,72 @@ func (t *ToDeviceTable) Messages(userID, deviceID string, from, limit int64) (ms
 	return
 }
 
-func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawMessage) (pos int64, err error) {
+// InsertMessages adds these messages to the device's inbox, dropping duplicates and cancelled requests.
+// If given a transaction, it will INSERT inside that transaction. Returns the position of the last
+// inserted message.
+func (t *ToDeviceTable) InsertMessages(txn *sqlx.Tx, userID, deviceID string, msgs []json.RawMessage) (pos int64, err error) {
 	var lastPos int64
-	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithOptionalTransaction(t.db, txn, func(txn *sqlx.Tx) error {
 		var unackPos int64
 		err = txn.QueryRow(`SELECT unack_pos FROM syncv3_to_device_ack_pos WHERE user_id=$1 AND device_id=$2`, userID, deviceID).Scan(&unackPos)
 		if err != nil && err != sql.ErrNoRows {
 			return fmt.Errorf("unable to select unacked pos: %s", err)
 		}
 
+		// Homeservers may redeliver the same to-device message, e.g. if they retry a sync request.
+		// Duplicates of messages still in this device's inbox are dropped by the unique dedupe_key
+		// index when inserting, so the dedupe window lasts until the original is acknowledged or
+		// swept. Duplicates within this batch are dropped here.
+		seen := make(map[string]struct{}, len(msgs))
+
 		// Some of these events may be "cancel" actions. If we find events for the unique key of this event, then delete them
 		// and ignore the "cancel" action.
 		cancels := []string{}
 		allRequests := make(map[string]struct{})
 		allCancels := make(map[string]struct{})
 
-		rows := make([]ToDeviceRow, len(msgs))
+		ts := time.Now().UnixMilli()
+		rows := make([]ToDeviceRow, 0, len(msgs))
 		for i := range msgs {
 			m := gjson.ParseBytes(msgs[i])
-			rows[i] = ToDeviceRow{
-				UserID:   userID,
-				DeviceID: deviceID,
-				Message:  string(msgs[i]),
-				Type:     m.Get("type").Str,
-				Sender:   m.Get("sender").Str,
+			dedupeKey := toDeviceDedupeKey(m)
+			if _, exists := seen[dedupeKey]; exists {
+				logger.Debug().Str("user", userID).Str("device", deviceID).Str("type", m.Get("type").Str).Msg("ToDeviceTable.InsertMessages: dropping duplicate message")
+				continue
+			}
+			seen[dedupeKey] = struct{}{}
+			row := ToDeviceRow{
+				UserID:    userID,
+				DeviceID:  deviceID,
+				Message:   string(msgs[i]),
+				Type:      m.Get("type").Str,
+				Sender:    m.Get("sender").Str,
+				Timestamp: ts,
+				DedupeKey: &dedupeKey,
 			}
 			msgId := m.Get(`content.org\.matrix\.msgid`).Str
 			if msgId != "" {
 				logger.Debug().Str("msgid", msgId).Str("user", userID).Str("device", deviceID).Msg("ToDeviceTable.InsertMessages")
 			}
-			switch rows[i].Type {
+			switch row.Type {
 			case "m.room_key_request":
 				action := m.Get("content.action").Str
 				if action == "request" {
-					rows[i].Action = ActionRequest
+					row.Action = ActionRequest
 				} else if action == "request_cancellation" {
-					rows[i].Action = ActionCancel
+					row.Action = ActionCancel
 				}
 				// "the same request_id and requesting_device_id fields, sent by the same user."
-				key := fmt.Sprintf("%s-%s-%s-%s", rows[i].Type, rows[i].Sender, m.Get("content.requesting_device_id").Str, m.Get("content.request_id").Str)
-				rows[i].UniqueKey = &key
+				key := fmt.Sprintf("%s-%s-%s-%s", row.Type, row.Sender, m.Get("content.requesting_device_id").Str, m.Get("content.request_id").Str)
+				row.UniqueKey = &key
 			}
-			if rows[i].Action == ActionCancel && rows[i].UniqueKey != nil {
-				cancels = append(cancels, *rows[i].UniqueKey)
-				allCancels[*rows[i].UniqueKey] = struct{}{}
-			} else if rows[i].Action == ActionRequest && rows[i].UniqueKey != nil {
-				allRequests[*rows[i].UniqueKey] = struct{}{}
+			if row.Action == ActionCancel && row.UniqueKey != nil {
+				cancels = append(cancels, *row.UniqueKey)
+				allCancels[*row.UniqueKey] = struct{}{}
+			} else if row.Action == ActionRequest && row.UniqueKey != nil {
+				allRequests[*row.UniqueKey] = struct{}{}
 			}
+			rows = append(rows, row)
 		}
 		if len(cancels) > 0 {
 			var cancelled []string
@@ -196,15 +329,16 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 			}
 			rows = newRows
 		}
-		// we may have nothing to do if the entire set of events were cancellations
+		// we may have nothing to do if the entire set of events were cancellations or duplicates
 		if len(rows) == 0 {
 			return nil
 		}
 
-		chunks := sqlutil.Chunkify(7, MaxPostgresParameters, ToDeviceRowChunker(rows))
+		chunks := sqlutil.Chunkify(9, MaxPostgresParameters, ToDeviceRowChunker(rows))
 		for _, chunk := range chunks {
-			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key)
-        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key) RETURNING position`, chunk)
+			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key, ts, dedupe_key)
+        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key, :ts, :dedupe_key)
+        ON CONFLICT (user_id, device_id, dedupe_key) DO NOTHING RETURNING position`, chunk)
 			if err != nil {
 				return err
 			}
@@ -220,3 +354,26 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 	})
 	return lastPos, err
 }
+
+// toDeviceDedupeKey returns a key identifying this to-device message, such that redeliveries of the
+// same message have the same key. The message ID is used if the sender included one, else the hash
+// of the canonicalised content.
+func toDeviceDedupeKey(m gjson.Result) string {
+	sender := m.Get("sender").Str
+	evType := m.Get("type").Str
+	msgID := m.Get(`content.org\.matrix\.msgid`).Str
+	if msgID != "" {
+		return fmt.Sprintf("msgid|%s|%s|%s", sender, evType, msgID)
+	}
+	content := m.Get("content")
+	// fall back to the whole message if there is no content to compare
+	toHash := []byte(m.Raw)
+	if content.IsObject() {
+		toHash = []byte(content.Raw)
+		if canonical, err := gomatrixserverlib.CanonicalJSON(toHash); err == nil {
+			toHash = canonical
+		}
+	}
+	hash := sha256.Sum256(toHash)
+	return fmt.Sprintf("content|%s|%s|%s", sender, evType, hex.EncodeToString(hash[:]))
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -21,7 +22,7 @@ func TestToDeviceTable(t *testing.T) {
 	}
 	var lastPos int64
 	var err error
-	if lastPos, err = table.InsertMessages(sender, deviceID, msgs); err != nil {
+	if lastPos, err = table.InsertMessages(nil, sender, deviceID, msgs); err != nil {
 		t.Fatalf("InsertMessages: %s", err)
 	}
 	if lastPos != 2 {
@@ -133,7 +134,7 @@ func TestToDeviceTableDeleteCancels(t *testing.T) {
 	reqEv1 := newRoomKeyEvent(t, "request", "1", sender, map[string]interface{}{
 		"foo": "bar",
 	})
-	_, err := table.InsertMessages(sender, destination, []json.RawMessage{reqEv1})
+	_, err := table.InsertMessages(nil, sender, destination, []json.RawMessage{reqEv1})
 	assertNoError(t, err)
 	gotMsgs, _, err := table.Messages(sender, destination, 0, 10)
 	assertNoError(t, err)
@@ -141,7 +142,7 @@ func TestToDeviceTableDeleteCancels(t *testing.T) {
 	reqEv2 := newRoomKeyEvent(t, "request", "2", sender, map[string]interface{}{
 		"foo": "baz",
 	})
-	_, err = table.InsertMessages(sender, destination, []json.RawMessage{reqEv2})
+	_, err = table.InsertMessages(nil, sender, destination, []json.RawMessage{reqEv2})
 	assertNoError(t, err)
 	gotMsgs, _, err = table.Messages(sender, destination, 0, 10)
 	assertNoError(t, err)
@@ -149,7 +150,7 @@ func TestToDeviceTableDeleteCancels(t *testing.T) {
 
 	// now delete 1
 	cancelEv1 := newRoomKeyEvent(t, "request_cancellation", "1", sender, nil)
-	_, err = table.InsertMessages(sender, destination, []json.RawMessage{cancelEv1})
+	_, err = table.InsertMessages(nil, sender, destination, []json.RawMessage{cancelEv1})
 	assertNoError(t, err)
 	// selecting messages now returns only reqEv2
 	gotMsgs, _, err = table.Messages(sender, destination, 0, 10)
@@ -157,13 +158,13 @@ func TestToDeviceTableDeleteCancels(t *testing.T) {
 	bytesEqual(t, gotMsgs[0], reqEv2)
 
 	// now do lots of close but not quite cancellation requests that should not match reqEv2
-	_, err = table.InsertMessages(sender, destination, []json.RawMessage{
+	_, err = table.InsertMessages(nil, sender, destination, []json.RawMessage{
 		newRoomKeyEvent(t, "cancellation", "2", sender, nil),                      // wrong action
 		newRoomKeyEvent(t, "request_cancellation", "22", sender, nil),             // wrong request ID
 		newRoomKeyEvent(t, "request_cancellation", "2", "not_who_you_think", nil), // wrong req device id
 	})
 	assertNoError(t, err)
-	_, err = table.InsertMessages(sender, "wrong_destination", []json.RawMessage{ // wrong destination
+	_, err = table.InsertMessages(nil, sender, "wrong_destination", []json.RawMessage{ // wrong destination
 		newRoomKeyEvent(t, "request_cancellation", "2", sender, nil),
 	})
 	assertNoError(t, err)
@@ -176,7 +177,7 @@ func TestToDeviceTableDeleteCancels(t *testing.T) {
 
 	// request + cancel in one go => nothing inserted
 	destination2 := "DEST2"
-	_, err = table.InsertMessages(sender, destination2, []json.RawMessage{
+	_, err = table.InsertMessages(nil, sender, destination2, []json.RawMessage{
 		newRoomKeyEvent(t, "request", "A", sender, map[string]interface{}{
 			"foo": "baz",
 		}),
@@ -201,7 +202,7 @@ func TestToDeviceTableNoDeleteUnacks(t *testing.T) {
 	reqEv := newRoomKeyEvent(t, "request", "1", sender, map[string]interface{}{
 		"foo": "bar",
 	})
-	pos, err := table.InsertMessages(sender, destination, []json.RawMessage{reqEv})
+	pos, err := table.InsertMessages(nil, sender, destination, []json.RawMessage{reqEv})
 	assertNoError(t, err)
 	// mark this position as unacked: this means the client MAY know about this request so it isn't
 	// safe to delete it
@@ -209,7 +210,7 @@ func TestToDeviceTableNoDeleteUnacks(t *testing.T) {
 	assertNoError(t, err)
 	// now issue a cancellation: this should NOT result in a cancellation due to protection for unacked events
 	cancelEv := newRoomKeyEvent(t, "request_cancellation", "1", sender, nil)
-	_, err = table.InsertMessages(sender, destination, []json.RawMessage{cancelEv})
+	_, err = table.InsertMessages(nil, sender, destination, []json.RawMessage{cancelEv})
 	assertNoError(t, err)
 	// selecting messages returns both events
 	gotMsgs, _, err := table.Messages(sender, destination, 0, 10)
@@ -221,11 +222,11 @@ func TestToDeviceTableNoDeleteUnacks(t *testing.T) {
 	bytesEqual(t, gotMsgs[1], cancelEv)
 
 	// test that injecting another req/cancel does cause them to be deleted
-	_, err = table.InsertMessages(sender, destination, []json.RawMessage{newRoomKeyEvent(t, "request", "2", sender, map[string]interface{}{
+	_, err = table.InsertMessages(nil, sender, destination, []json.RawMessage{newRoomKeyEvent(t, "request", "2", sender, map[string]interface{}{
 		"foo": "bar",
 	})})
 	assertNoError(t, err)
-	_, err = table.InsertMessages(sender, destination, []json.RawMessage{newRoomKeyEvent(t, "request_cancellation", "2", sender, nil)})
+	_, err = table.InsertMessages(nil, sender, destination, []json.RawMessage{newRoomKeyEvent(t, "request_cancellation", "2", sender, nil)})
 	assertNoError(t, err)
 	// selecting messages returns the same as before
 	gotMsgs, _, err = table.Messages(sender, destination, 0, 10)
@@ -237,6 +238,165 @@ func TestToDeviceTableNoDeleteUnacks(t *testing.T) {
 	bytesEqual(t, gotMsgs[1], cancelEv)
 }
 
+func TestToDeviceTableCountMessages(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableCountMessages"
+	deviceID := "COUNT_DEVICE"
+	table := NewToDeviceTable(db)
+	count, err := table.CountMessages(userID, deviceID, 0)
+	assertNoError(t, err)
+	if count != 0 {
+		t.Fatalf("got %d pending messages for a device with no messages, want 0", count)
+	}
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"type":"m.count","content":{"n":1}}`),
+		json.RawMessage(`{"type":"m.count","content":{"n":2}}`),
+		json.RawMessage(`{"type":"m.count","content":{"n":3}}`),
+	}
+	lastPos, err := table.InsertMessages(nil, userID, deviceID, msgs)
+	assertNoError(t, err)
+	// messages for other devices are not counted
+	_, err = table.InsertMessages(nil, userID, "OTHER_DEVICE", msgs)
+	assertNoError(t, err)
+
+	count, err = table.CountMessages(userID, deviceID, 0)
+	assertNoError(t, err)
+	if count != len(msgs) {
+		t.Fatalf("got %d pending messages, want %d", count, len(msgs))
+	}
+	// only messages after from are counted
+	count, err = table.CountMessages(userID, deviceID, lastPos-1)
+	assertNoError(t, err)
+	if count != 1 {
+		t.Fatalf("got %d pending messages after pos %d, want 1", count, lastPos-1)
+	}
+
+	// the count decreases as messages are deleted
+	assertNoError(t, table.DeleteMessagesUpToAndIncluding(userID, deviceID, lastPos-1))
+	count, err = table.CountMessages(userID, deviceID, 0)
+	assertNoError(t, err)
+	if count != 1 {
+		t.Fatalf("got %d pending messages after deleting, want 1", count)
+	}
+	assertNoError(t, table.DeleteMessagesUpToAndIncluding(userID, deviceID, lastPos))
+	count, err = table.CountMessages(userID, deviceID, 0)
+	assertNoError(t, err)
+	if count != 0 {
+		t.Fatalf("got %d pending messages after deleting all, want 0", count)
+	}
+}
+
+func TestToDeviceTableUnackedPosition(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableUnackedPosition"
+	deviceID := "UNACK_DEVICE"
+	table := NewToDeviceTable(db)
+	pos, err := table.UnackedPosition(userID, deviceID)
+	assertNoError(t, err)
+	if pos != 0 {
+		t.Fatalf("got unacked pos %d for a new device, want 0", pos)
+	}
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"type":"m.unack","content":{"n":1}}`),
+		json.RawMessage(`{"type":"m.unack","content":{"n":2}}`),
+	}
+	_, err = table.InsertMessages(nil, userID, deviceID, msgs)
+	assertNoError(t, err)
+	_, upTo, err := table.Messages(userID, deviceID, 0, 1)
+	assertNoError(t, err)
+	assertNoError(t, table.SetUnackedPosition(userID, deviceID, upTo))
+
+	// the position is per device
+	pos, err = table.UnackedPosition(userID, "OTHER_DEVICE")
+	assertNoError(t, err)
+	if pos != 0 {
+		t.Fatalf("got unacked pos %d for another device, want 0", pos)
+	}
+	pos, err = table.UnackedPosition(userID, deviceID)
+	assertNoError(t, err)
+	if pos != upTo {
+		t.Fatalf("got unacked pos %d, want %d", pos, upTo)
+	}
+
+	// acking the position deletes only the messages which were sent
+	assertNoError(t, table.DeleteMessagesUpToAndIncluding(userID, deviceID, pos))
+	gotMsgs, _, err := table.Messages(userID, deviceID, 0, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != 1 {
+		t.Fatalf("got %d msgs after ack, want 1: %v", len(gotMsgs), jsonArrStr(gotMsgs))
+	}
+	bytesEqual(t, gotMsgs[0], msgs[1])
+
+	// deleting the device resets the position
+	assertNoError(t, table.DeleteAllMessagesForDevice(userID, deviceID))
+	pos, err = table.UnackedPosition(userID, deviceID)
+	assertNoError(t, err)
+	if pos != 0 {
+		t.Fatalf("got unacked pos %d after deleting device, want 0", pos)
+	}
+}
+
+func TestToDeviceTableSweep(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableSweep"
+	deviceID := "SWEEP_DEVICE"
+	table := NewToDeviceTable(db)
+	table.SetRetention(24*time.Hour, 0)
+	oldMsgs := []json.RawMessage{
+		json.RawMessage(`{"type":"m.sweep","content":{"n":1}}`),
+		json.RawMessage(`{"type":"m.sweep","content":{"n":2}}`),
+	}
+	newMsgs := []json.RawMessage{
+		json.RawMessage(`{"type":"m.sweep","content":{"n":3}}`),
+	}
+	oldPos, err := table.InsertMessages(nil, userID, deviceID, oldMsgs)
+	assertNoError(t, err)
+	_, err = table.InsertMessages(nil, userID, deviceID, newMsgs)
+	assertNoError(t, err)
+	// backdate the old messages beyond the retention period
+	_, err = db.Exec(`UPDATE syncv3_to_device_messages SET ts = $1 WHERE user_id = $2 AND device_id = $3 AND position <= $4`,
+		time.Now().Add(-48*time.Hour).UnixMilli(), userID, deviceID, oldPos)
+	assertNoError(t, err)
+
+	_, err = table.Sweep()
+	assertNoError(t, err)
+	gotMsgs, _, err := table.Messages(userID, deviceID, 0, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != len(newMsgs) {
+		t.Fatalf("got %d msgs after sweep, want %d: %v", len(gotMsgs), len(newMsgs), jsonArrStr(gotMsgs))
+	}
+	bytesEqual(t, gotMsgs[0], newMsgs[0])
+
+	// the per-device cap drops the oldest messages
+	capDeviceID := "SWEEP_CAP_DEVICE"
+	capMsgs := []json.RawMessage{
+		json.RawMessage(`{"type":"m.sweep_cap","content":{"n":1}}`),
+		json.RawMessage(`{"type":"m.sweep_cap","content":{"n":2}}`),
+		json.RawMessage(`{"type":"m.sweep_cap","content":{"n":3}}`),
+	}
+	_, err = table.InsertMessages(nil, userID, capDeviceID, capMsgs)
+	assertNoError(t, err)
+	table.SetRetention(24*time.Hour, 2)
+	_, err = table.Sweep()
+	assertNoError(t, err)
+	gotMsgs, _, err = table.Messages(userID, capDeviceID, 0, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != 2 {
+		t.Fatalf("got %d msgs after capped sweep, want 2: %v", len(gotMsgs), jsonArrStr(gotMsgs))
+	}
+	bytesEqual(t, gotMsgs[0], capMsgs[1])
+	bytesEqual(t, gotMsgs[1], capMsgs[2])
+	// devices under the cap are unaffected
+	gotMsgs, _, err = table.Messages(userID, deviceID, 0, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != len(newMsgs) {
+		t.Fatalf("got %d msgs for uncapped device, want %d: %v", len(gotMsgs), len(newMsgs), jsonArrStr(gotMsgs))
+	}
+}
+
 // Guard against possible message truncation?
 func TestToDeviceTableBytesInEqualBytesOut(t *testing.T) {
 	db, close := connectToDB(t)
@@ -252,7 +412,7 @@ func TestToDeviceTableBytesInEqualBytesOut(t *testing.T) {
 	}
 	var pos int64
 	for _, msg := range testCases {
-		nextPos, err := table.InsertMessages(sender, "A", []json.RawMessage{msg})
+		nextPos, err := table.InsertMessages(nil, sender, "A", []json.RawMessage{msg})
 		if err != nil {
 			t.Fatalf("InsertMessages: %s", err)
 		}
@@ -264,7 +424,7 @@ func TestToDeviceTableBytesInEqualBytesOut(t *testing.T) {
 		pos = nextPos
 	}
 	// and all at once
-	_, err := table.InsertMessages(sender, "B", testCases)
+	_, err := table.InsertMessages(nil, sender, "B", testCases)
 	if err != nil {
 		t.Fatalf("InsertMessages: %s", err)
 	}
@@ -280,6 +440,56 @@ func TestToDeviceTableBytesInEqualBytesOut(t *testing.T) {
 	}
 }
 
+// Test that redelivered to-device messages are only stored once whilst they remain in the inbox.
+func TestToDeviceTableDeduplicates(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableDeduplicates:localhost"
+	deviceID := "DEDUPE"
+	table := NewToDeviceTable(db)
+	msg := json.RawMessage(`{"sender":"@bob:localhost","type":"m.room_key","content":{"room_id":"!a:localhost","session_id":"s1"}}`)
+	sameContentReordered := json.RawMessage(`{"type":"m.room_key","sender":"@bob:localhost","content":{"session_id":"s1","room_id":"!a:localhost"}}`)
+	otherSender := json.RawMessage(`{"sender":"@charlie:localhost","type":"m.room_key","content":{"room_id":"!a:localhost","session_id":"s1"}}`)
+	withMsgID := json.RawMessage(`{"sender":"@bob:localhost","type":"m.room.encrypted","content":{"ciphertext":"AAA","org.matrix.msgid":"msg1"}}`)
+	sameMsgID := json.RawMessage(`{"sender":"@bob:localhost","type":"m.room.encrypted","content":{"ciphertext":"BBB","org.matrix.msgid":"msg1"}}`)
+
+	// duplicates within a single batch are dropped
+	_, err := table.InsertMessages(nil, userID, deviceID, []json.RawMessage{msg, msg, otherSender, withMsgID})
+	assertNoError(t, err)
+	// duplicates of messages already in the inbox are dropped
+	_, err = table.InsertMessages(nil, userID, deviceID, []json.RawMessage{msg, sameContentReordered, otherSender, sameMsgID})
+	assertNoError(t, err)
+	gotMsgs, upTo, err := table.Messages(userID, deviceID, 0, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != 3 {
+		t.Fatalf("got %d msgs, want 3: %v", len(gotMsgs), jsonArrStr(gotMsgs))
+	}
+	bytesEqual(t, gotMsgs[0], msg)
+	bytesEqual(t, gotMsgs[1], otherSender)
+	bytesEqual(t, gotMsgs[2], withMsgID)
+
+	// other devices have their own inbox
+	_, err = table.InsertMessages(nil, userID, "OTHER_DEVICE", []json.RawMessage{msg})
+	assertNoError(t, err)
+	gotMsgs, _, err = table.Messages(userID, "OTHER_DEVICE", 0, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != 1 {
+		t.Fatalf("got %d msgs for other device, want 1: %v", len(gotMsgs), jsonArrStr(gotMsgs))
+	}
+
+	// once the messages have been acknowledged and deleted, the same message can be stored again
+	err = table.DeleteMessagesUpToAndIncluding(userID, deviceID, upTo)
+	assertNoError(t, err)
+	_, err = table.InsertMessages(nil, userID, deviceID, []json.RawMessage{msg})
+	assertNoError(t, err)
+	gotMsgs, _, err = table.Messages(userID, deviceID, upTo, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != 1 {
+		t.Fatalf("got %d msgs after deletion, want 1: %v", len(gotMsgs), jsonArrStr(gotMsgs))
+	}
+	bytesEqual(t, gotMsgs[0], msg)
+}
+
 func TestMsgID(t *testing.T) {
 	data := json.RawMessage(`{
 		"content": {
@@ -34,7 +34,13 @@ func NewTransactionsTable(db *sqlx.DB) *TransactionsTable {
 	return &TransactionsTable{db}
 }
 
-func (t *TransactionsTable) Insert(userID, deviceID string, eventIDToTxnID map[string]string) error {
+// Insert the transaction IDs for these events. If given a transaction, it will INSERT inside
+// that transaction.
+func (t *TransactionsTable) Insert(txn *sqlx.Tx, userID, deviceID string, eventIDToTxnID map[string]string) error {
+	var db sqlx.Ext = t.db
+	if txn != nil {
+		db = txn
+	}
 	ts := time.Now()
 	rows := make([]txnRow, 0, len(eventIDToTxnID))
 	for eventID, txnID := range eventIDToTxnID {
@@ -46,7 +52,7 @@ func (t *TransactionsTable) Insert(userID, deviceID string, eventIDToTxnID map[s
 			Timestamp: ts.UnixMilli(),
 		})
 	}
-	result, err := t.db.NamedQuery(`
+	result, err := sqlx.NamedQuery(db, `
 		INSERT INTO syncv3_txns (user_id, device_id, event_id, txn_id, ts)
         VALUES (:user_id, :device_id, :event_id, :txn_id, :ts)`, rows)
 	if err == nil {
@@ -38,7 +38,7 @@ func TestTransactionTable(t *testing.T) {
 	assertTxns(t, gotTxns, nil)
 
 	// basic insert and select
-	err = table.Insert(userID, deviceID, map[string]string{
+	err = table.Insert(nil, userID, deviceID, map[string]string{
 		eventA: txnIDA,
 	})
 	assertNoError(t, err)
@@ -49,7 +49,7 @@ func TestTransactionTable(t *testing.T) {
 	})
 
 	// multiple txns
-	err = table.Insert(userID, deviceID, map[string]string{
+	err = table.Insert(nil, userID, deviceID, map[string]string{
 		eventB: txnIDB,
 	})
 	assertNoError(t, err)
@@ -61,3 +61,24 @@ func (t *TypingTable) Typing(roomID string, fromStreamIDExcl, toStreamIDIncl int
 	}
 	return userIDsArray, latest, err
 }
+
+// TypingForRooms returns the users typing in each of the given rooms, for rooms whose typing
+// notifications changed between the two stream IDs. Rooms without changes are not included.
+func (t *TypingTable) TypingForRooms(roomIDs []string, fromStreamIDExcl, toStreamIDIncl int64) (map[string][]string, error) {
+	var rows []struct {
+		RoomID  string         `db:"room_id"`
+		UserIDs pq.StringArray `db:"user_ids"`
+	}
+	err := t.db.Select(&rows,
+		`SELECT room_id, user_ids FROM syncv3_typing WHERE room_id = ANY($1) AND stream_id > $2 AND stream_id <= $3`,
+		pq.StringArray(roomIDs), fromStreamIDExcl, toStreamIDIncl,
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]string, len(rows))
+	for _, row := range rows {
+		result[row.RoomID] = row.UserIDs
+	}
+	return result, nil
+}
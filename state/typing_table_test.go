@@ -50,3 +50,48 @@ func TestTypingTable(t *testing.T) {
 		t.Fatalf("SelectHighestID: got %d want %d", highest, lastStreamID)
 	}
 }
+
+func TestTypingTableTypingForRooms(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewTypingTable(db)
+	roomA := "!TestTypingTableTypingForRooms_a:localhost"
+	roomB := "!TestTypingTableTypingForRooms_b:localhost"
+	roomC := "!TestTypingTableTypingForRooms_c:localhost"
+	from, err := table.SelectHighestID()
+	if err != nil {
+		t.Fatalf("SelectHighestID: %s", err)
+	}
+	if _, err = table.SetTyping(roomA, []string{"@alice:localhost"}); err != nil {
+		t.Fatalf("failed to SetTyping: %s", err)
+	}
+	if _, err = table.SetTyping(roomB, []string{"@bob:localhost", "@charlie:localhost"}); err != nil {
+		t.Fatalf("failed to SetTyping: %s", err)
+	}
+	to, err := table.SetTyping(roomC, []string{"@doris:localhost"})
+	if err != nil {
+		t.Fatalf("failed to SetTyping: %s", err)
+	}
+	got, err := table.TypingForRooms([]string{roomA, roomB}, from, to)
+	if err != nil {
+		t.Fatalf("TypingForRooms: %s", err)
+	}
+	want := map[string][]string{
+		roomA: {"@alice:localhost"},
+		roomB: {"@bob:localhost", "@charlie:localhost"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TypingForRooms: got %v want %v", got, want)
+	}
+	// rooms which have not changed since the from position are not returned
+	got, err = table.TypingForRooms([]string{roomA, roomB, roomC}, to-1, to)
+	if err != nil {
+		t.Fatalf("TypingForRooms: %s", err)
+	}
+	want = map[string][]string{
+		roomC: {"@doris:localhost"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TypingForRooms: got %v want %v", got, want)
+	}
+}
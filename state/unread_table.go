@@ -51,22 +51,28 @@ func (t *UnreadTable) SelectUnreadCounters(userID, roomID string) (highlightCoun
 	return
 }
 
-func (t *UnreadTable) UpdateUnreadCounters(userID, roomID string, highlightCount, notificationCount *int) error {
+// UpdateUnreadCounters sets whichever of the counts are non-nil for this user in this room. If given
+// a transaction, it will UPSERT inside that transaction.
+func (t *UnreadTable) UpdateUnreadCounters(txn *sqlx.Tx, userID, roomID string, highlightCount, notificationCount *int) error {
+	var db sqlx.Execer = t.db
+	if txn != nil {
+		db = txn
+	}
 	var err error
 	if highlightCount != nil && notificationCount != nil {
-		_, err = t.db.Exec(
+		_, err = db.Exec(
 			`INSERT INTO syncv3_unread(room_id, user_id, notification_count, highlight_count) VALUES($1, $2, $3, $4)
 		ON CONFLICT (room_id, user_id) DO UPDATE SET notification_count = $3, highlight_count = $4`,
 			roomID, userID, *notificationCount, *highlightCount,
 		)
 	} else if highlightCount != nil {
-		_, err = t.db.Exec(
+		_, err = db.Exec(
 			`INSERT INTO syncv3_unread(room_id, user_id, highlight_count) VALUES($1, $2, $3)
 		ON CONFLICT (room_id, user_id) DO UPDATE SET highlight_count = $3`,
 			roomID, userID, *highlightCount,
 		)
 	} else if notificationCount != nil {
-		_, err = t.db.Exec(
+		_, err = db.Exec(
 			`INSERT INTO syncv3_unread(room_id, user_id, notification_count) VALUES($1, $2, $3)
 		ON CONFLICT (room_id, user_id) DO UPDATE SET notification_count = $3`,
 			roomID, userID, *notificationCount,
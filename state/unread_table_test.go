@@ -18,17 +18,17 @@ func TestUnreadTable(t *testing.T) {
 	zero := 0
 
 	// try all kinds of insertions
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomA, &two, &one)) // both
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomB, &two, nil))  // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomC, nil, &two))  // one
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomA, &two, &one)) // both
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomB, &two, nil))  // one
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomC, nil, &two))  // one
 	assertUnread(t, table, userID, roomA, 2, 1)
 	assertUnread(t, table, userID, roomB, 2, 0)
 	assertUnread(t, table, userID, roomC, 0, 2)
 
 	// try all kinds of updates
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomA, &zero, nil))   // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomB, nil, &two))    // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomC, &zero, &zero)) // both
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomA, &zero, nil))   // one
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomB, nil, &two))    // one
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomC, &zero, &zero)) // both
 	assertUnread(t, table, userID, roomA, 0, 1)
 	assertUnread(t, table, userID, roomB, 2, 2)
 	assertUnread(t, table, userID, roomC, 0, 0)
@@ -7,9 +7,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
 )
 
@@ -18,12 +19,20 @@ const AccountDataGlobalRoom = ""
 var ProxyVersion = ""
 var HTTP401 error = fmt.Errorf("HTTP 401")
 
+// HTTP401SoftLogout is returned instead of HTTP401 when the homeserver says the device was soft
+// logged out, meaning the client can log in again without losing its local data.
+var HTTP401SoftLogout error = fmt.Errorf("HTTP 401 (soft logout)")
+
+// ErrUnknownSince is returned by DoSyncV2 when the homeserver rejects the since token, e.g. because
+// it has been restored from a backup and no longer recognises tokens it issued later.
+var ErrUnknownSince = fmt.Errorf("unknown since token")
+
 type Client interface {
 	// WhoAmI asks the homeserver to lookup the access token using the CSAPI /whoami
 	// endpoint. The response must contain a device ID (meaning that we assume the
 	// homeserver supports Matrix >= 1.1.)
 	WhoAmI(accessToken string) (userID, deviceID string, err error)
-	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool) (*SyncResponse, int, error)
+	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool, timeout time.Duration, timelineLimit int) (*SyncResponse, int, error)
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -31,9 +40,12 @@ type Client interface {
 type HTTPClient struct {
 	Client            *http.Client
 	DestinationServer string
+	// FetchPresence requests presence on sync v2 requests which fetch room data, for the presence
+	// extension. Presence is high volume, so it is filtered out unless this is set.
+	FetchPresence bool
 }
 
-// Return sync2.HTTP401 if this request returns 401
+// Return sync2.HTTP401 or sync2.HTTP401SoftLogout if this request returns 401
 func (v *HTTPClient) WhoAmI(accessToken string) (string, string, error) {
 	req, err := http.NewRequest("GET", v.DestinationServer+"/_matrix/client/r0/account/whoami", nil)
 	if err != nil {
@@ -47,7 +59,7 @@ func (v *HTTPClient) WhoAmI(accessToken string) (string, string, error) {
 	}
 	if res.StatusCode != 200 {
 		if res.StatusCode == 401 {
-			return "", "", HTTP401
+			return "", "", http401Error(res)
 		}
 		return "", "", fmt.Errorf("/whoami returned HTTP %d", res.StatusCode)
 	}
@@ -62,8 +74,10 @@ func (v *HTTPClient) WhoAmI(accessToken string) (string, string, error) {
 
 // DoSyncV2 performs a sync v2 request. Returns the sync response and the response status code
 // or an error. Set isFirst=true on the first sync to force a timeout=0 sync to ensure snapiness.
-func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
-	syncURL := v.createSyncURL(since, isFirst, toDeviceOnly)
+// Otherwise, timeout is the long-poll timeout sent to the homeserver. timelineLimit is the timeline
+// limit for incremental syncs: initial syncs only ask for the latest event in each room.
+func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool, timeout time.Duration, timelineLimit int) (*SyncResponse, int, error) {
+	syncURL := v.createSyncURL(since, isFirst, toDeviceOnly, timeout, timelineLimit)
 	req, err := http.NewRequest("GET", syncURL, nil)
 	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
 	req.Header.Set("Authorization", "Bearer "+accessToken)
@@ -89,54 +103,98 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 			return nil, 0, fmt.Errorf("DoSyncV2: response body decode JSON failed: %w", err)
 		}
 		return &svr, 200, nil
+	case 401:
+		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s: %w", res.Status, http401Error(res))
+	case 400, 410:
+		if since != "" && isUnknownSince(res) {
+			return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s: %w", res.Status, ErrUnknownSince)
+		}
+		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	default:
 		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	}
 }
 
-func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) string {
+// http401Error returns HTTP401SoftLogout if the body of the 401 response has soft_logout set,
+// else HTTP401.
+func http401Error(res *http.Response) error {
+	body, err := ioutil.ReadAll(res.Body)
+	if err == nil && gjson.GetBytes(body, "soft_logout").Bool() {
+		return HTTP401SoftLogout
+	}
+	return HTTP401
+}
+
+// isUnknownSince returns true if an error response to a sync with a since token means the
+// homeserver doesn't recognise the token. M_UNKNOWN is not enough, as Synapse uses it for all sorts
+// of errors.
+func isUnknownSince(res *http.Response) bool {
+	if res.StatusCode == 410 {
+		return true
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	return err == nil && gjson.GetBytes(body, "errcode").Str == "M_UNKNOWN_TOKEN"
+}
+
+func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool, timeout time.Duration, timelineLimit int) string {
 	qps := "?"
 	if isFirst { // first time polling for v2-sync in this process
 		qps += "timeout=0"
 	} else {
-		qps += "timeout=30000"
+		qps += "timeout=" + strconv.FormatInt(timeout.Milliseconds(), 10)
 	}
 	if since != "" {
 		qps += "&since=" + since
 	}
 
-	// To reduce the likelihood of a gappy v2 sync, ask for a large timeline by default.
-	// Synapse's default is 10; 50 is the maximum allowed, by my reading of
-	// https://github.com/matrix-org/synapse/blob/89a71e73905ffa1c97ae8be27d521cd2ef3f3a0c/synapse/handlers/sync.py#L576-L577
-	// NB: this is a stopgap to reduce the likelihood of hitting
-	// https://github.com/matrix-org/sliding-sync/issues/18
-	timelineLimit := 50
 	if since == "" {
 		// First time the poller has sync v2-ed for this user
 		timelineLimit = 1
 	}
+	qps += "&filter=" + syncFilter(timelineLimit, toDeviceOnly, v.FetchPresence)
+
+	return v.DestinationServer + "/_matrix/client/r0/sync" + qps
+}
+
+type syncFilterKey struct {
+	timelineLimit int
+	toDeviceOnly  bool
+	fetchPresence bool
+}
+
+// query-escaped filters, as there are only a few distinct filters and they are used on every poll
+var syncFilters sync.Map // syncFilterKey -> string
+
+// syncFilter returns the query-escaped filter for a sync v2 request. Presence is filtered out to
+// reduce the load on the homeserver, unless fetchPresence is set and this poll fetches room data.
+func syncFilter(timelineLimit int, toDeviceOnly, fetchPresence bool) string {
+	key := syncFilterKey{timelineLimit: timelineLimit, toDeviceOnly: toDeviceOnly, fetchPresence: fetchPresence}
+	if filter, ok := syncFilters.Load(key); ok {
+		return filter.(string)
+	}
 	room := map[string]interface{}{}
 	room["timeline"] = map[string]interface{}{"limit": timelineLimit}
 
+	filter := map[string]interface{}{
+		"room": room,
+	}
 	if toDeviceOnly {
 		// no rooms match this filter, so we get everything but room data
 		room["rooms"] = []string{}
 	}
-	filter := map[string]interface{}{
-		"room": room,
+	if toDeviceOnly || !fetchPresence {
+		filter["presence"] = map[string]interface{}{"not_types": []string{"*"}}
 	}
 	filterJSON, _ := json.Marshal(filter)
-	qps += "&filter=" + url.QueryEscape(string(filterJSON))
-
-	return v.DestinationServer + "/_matrix/client/r0/sync" + qps
+	escaped := url.QueryEscape(string(filterJSON))
+	syncFilters.Store(key, escaped)
+	return escaped
 }
 
 type SyncResponse struct {
-	NextBatch   string         `json:"next_batch"`
-	AccountData EventsResponse `json:"account_data"`
-	Presence    struct {
-		Events []gomatrixserverlib.ClientEvent `json:"events,omitempty"`
-	} `json:"presence"`
+	NextBatch   string            `json:"next_batch"`
+	AccountData EventsResponse    `json:"account_data"`
+	Presence    EventsResponse    `json:"presence"`
 	Rooms       SyncRoomsResponse `json:"rooms"`
 	ToDevice    EventsResponse    `json:"to_device"`
 	DeviceLists struct {
@@ -151,6 +209,7 @@ type SyncRoomsResponse struct {
 	Join   map[string]SyncV2JoinResponse   `json:"join"`
 	Invite map[string]SyncV2InviteResponse `json:"invite"`
 	Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
+	Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 }
 
 // JoinResponse represents a /sync response for a room which is under the 'join' or 'peek' key.
@@ -182,6 +241,11 @@ type SyncV2InviteResponse struct {
 	InviteState EventsResponse `json:"invite_state"`
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type SyncV2KnockResponse struct {
+	KnockState EventsResponse `json:"knock_state"`
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type SyncV2LeaveResponse struct {
 	State struct {
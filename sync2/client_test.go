@@ -1,8 +1,13 @@
 package sync2
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestSyncURL(t *testing.T) {
@@ -15,61 +20,191 @@ func TestSyncURL(t *testing.T) {
 		since        string
 		isFirst      bool
 		toDeviceOnly bool
-		wantURL      string
+		timeout      time.Duration
+		// defaults to DefaultPollTimelineLimit
+		timelineLimit int
+		fetchPresence bool
+		wantURL       string
 	}{
 		{
 			since:        "",
 			isFirst:      false,
 			toDeviceOnly: false,
-			wantURL:      wantBaseURL + `?timeout=30000&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":1}}}`),
+			timeout:      DefaultPollTimeout,
+			wantURL:      wantBaseURL + `?timeout=30000&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":1}}}`),
 		},
 		{
 			since:        "",
 			isFirst:      true,
 			toDeviceOnly: false,
-			wantURL:      wantBaseURL + `?timeout=0&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":1}}}`),
+			timeout:      DefaultPollTimeout,
+			wantURL:      wantBaseURL + `?timeout=0&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":1}}}`),
 		},
 		{
 			since:        "",
 			isFirst:      false,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=30000&filter=` + url.QueryEscape(`{"room":{"rooms":[],"timeline":{"limit":1}}}`),
+			timeout:      DefaultPollTimeout,
+			wantURL:      wantBaseURL + `?timeout=30000&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":1}}}`),
 		},
 		{
 			since:        "",
 			isFirst:      true,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=0&filter=` + url.QueryEscape(`{"room":{"rooms":[],"timeline":{"limit":1}}}`),
+			timeout:      DefaultPollTimeout,
+			wantURL:      wantBaseURL + `?timeout=0&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":1}}}`),
 		},
 		{
 			since:        "112233",
 			isFirst:      false,
 			toDeviceOnly: false,
-			wantURL:      wantBaseURL + `?timeout=30000&since=112233&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":50}}}`),
+			timeout:      DefaultPollTimeout,
+			wantURL:      wantBaseURL + `?timeout=30000&since=112233&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50}}}`),
 		},
 		{
 			since:        "112233",
 			isFirst:      true,
 			toDeviceOnly: false,
-			wantURL:      wantBaseURL + `?timeout=0&since=112233&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":50}}}`),
+			timeout:      DefaultPollTimeout,
+			wantURL:      wantBaseURL + `?timeout=0&since=112233&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50}}}`),
 		},
 		{
 			since:        "112233",
 			isFirst:      false,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=30000&since=112233&filter=` + url.QueryEscape(`{"room":{"rooms":[],"timeline":{"limit":50}}}`),
+			timeout:      DefaultPollTimeout,
+			wantURL:      wantBaseURL + `?timeout=30000&since=112233&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50}}}`),
 		},
 		{
 			since:        "112233",
 			isFirst:      true,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=0&since=112233&filter=` + url.QueryEscape(`{"room":{"rooms":[],"timeline":{"limit":50}}}`),
+			timeout:      DefaultPollTimeout,
+			wantURL:      wantBaseURL + `?timeout=0&since=112233&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50}}}`),
+		},
+		{
+			since:        "112233",
+			isFirst:      false,
+			toDeviceOnly: false,
+			timeout:      5 * time.Second,
+			wantURL:      wantBaseURL + `?timeout=5000&since=112233&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50}}}`),
+		},
+		{
+			since:        "112233",
+			isFirst:      true,
+			toDeviceOnly: false,
+			timeout:      5 * time.Second,
+			wantURL:      wantBaseURL + `?timeout=0&since=112233&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50}}}`),
+		},
+		{
+			since:         "112233",
+			isFirst:       false,
+			toDeviceOnly:  false,
+			timeout:       DefaultPollTimeout,
+			timelineLimit: 10,
+			wantURL:       wantBaseURL + `?timeout=30000&since=112233&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":10}}}`),
+		},
+		{
+			// initial syncs only want the latest event in each room
+			since:         "",
+			isFirst:       false,
+			toDeviceOnly:  false,
+			timeout:       DefaultPollTimeout,
+			timelineLimit: 10,
+			wantURL:       wantBaseURL + `?timeout=30000&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":1}}}`),
+		},
+		{
+			// presence is only fetched when enabled, and only by pollers which fetch room data
+			since:         "112233",
+			isFirst:       false,
+			toDeviceOnly:  false,
+			timeout:       DefaultPollTimeout,
+			fetchPresence: true,
+			wantURL:       wantBaseURL + `?timeout=30000&since=112233&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":50}}}`),
+		},
+		{
+			since:         "112233",
+			isFirst:       false,
+			toDeviceOnly:  true,
+			timeout:       DefaultPollTimeout,
+			fetchPresence: true,
+			wantURL:       wantBaseURL + `?timeout=30000&since=112233&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50}}}`),
 		},
 	}
 	for i, tc := range testCases {
-		gotURL := client.createSyncURL(tc.since, tc.isFirst, tc.toDeviceOnly)
+		timelineLimit := tc.timelineLimit
+		if timelineLimit == 0 {
+			timelineLimit = DefaultPollTimelineLimit
+		}
+		client.FetchPresence = tc.fetchPresence
+		gotURL := client.createSyncURL(tc.since, tc.isFirst, tc.toDeviceOnly, tc.timeout, timelineLimit)
 		if gotURL != tc.wantURL {
 			t.Errorf("Case %d/%d: got %v want %v", i+1, len(testCases), gotURL, tc.wantURL)
 		}
 	}
 }
+
+func TestDoSyncV2UnknownSince(t *testing.T) {
+	testCases := []struct {
+		since   string
+		code    int
+		body    string
+		wantErr bool
+	}{
+		{since: "s123", code: 400, body: `{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown since token"}`, wantErr: true},
+		{since: "s123", code: 410, body: `{"errcode":"M_UNKNOWN","error":"Since token has expired"}`, wantErr: true},
+		// Synapse uses M_UNKNOWN for all sorts of errors
+		{since: "s123", code: 400, body: `{"errcode":"M_UNKNOWN","error":"Something went wrong"}`, wantErr: false},
+		{since: "s123", code: 400, body: `{"errcode":"M_INVALID_PARAM","error":"Bad filter"}`, wantErr: false},
+		// an initial sync can't have an unknown since token
+		{since: "", code: 400, body: `{"errcode":"M_UNKNOWN_TOKEN","error":"Something went wrong"}`, wantErr: false},
+		{since: "", code: 410, body: `{"errcode":"M_UNKNOWN","error":"Something went wrong"}`, wantErr: false},
+	}
+	for _, tc := range testCases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.code)
+			w.Write([]byte(tc.body))
+		}))
+		client := HTTPClient{
+			Client:            srv.Client(),
+			DestinationServer: srv.URL,
+		}
+		_, code, err := client.DoSyncV2(context.Background(), "token", tc.since, false, false, DefaultPollTimeout, DefaultPollTimelineLimit)
+		srv.Close()
+		if code != tc.code || err == nil {
+			t.Fatalf("since=%q code=%d body=%s: got code %d err %v want %d and an error", tc.since, tc.code, tc.body, code, err, tc.code)
+		}
+		if gotErr := errors.Is(err, ErrUnknownSince); gotErr != tc.wantErr {
+			t.Errorf("since=%q code=%d body=%s: got ErrUnknownSince=%v want %v", tc.since, tc.code, tc.body, gotErr, tc.wantErr)
+		}
+	}
+}
+
+func TestDoSyncV2SoftLogout(t *testing.T) {
+	testCases := []struct {
+		body    string
+		wantErr error
+	}{
+		{body: `{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token","soft_logout":true}`, wantErr: HTTP401SoftLogout},
+		{body: `{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token"}`, wantErr: HTTP401},
+	}
+	for _, tc := range testCases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(401)
+			w.Write([]byte(tc.body))
+		}))
+		client := HTTPClient{
+			Client:            srv.Client(),
+			DestinationServer: srv.URL,
+		}
+		_, code, err := client.DoSyncV2(context.Background(), "token", "s123", false, false, DefaultPollTimeout, DefaultPollTimelineLimit)
+		_, _, whoamiErr := client.WhoAmI("token")
+		srv.Close()
+		if code != 401 || !errors.Is(err, tc.wantErr) {
+			t.Errorf("body=%s: DoSyncV2 got code %d err %v want 401 and %v", tc.body, code, err, tc.wantErr)
+		}
+		if whoamiErr != tc.wantErr {
+			t.Errorf("body=%s: WhoAmI got err %v want %v", tc.body, whoamiErr, tc.wantErr)
+		}
+	}
+}
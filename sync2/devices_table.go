@@ -42,11 +42,26 @@ func (t *DevicesTable) InsertDevice(txn *sqlx.Tx, userID, deviceID string) error
 	return err
 }
 
-func (t *DevicesTable) UpdateDeviceSince(userID, deviceID, since string) error {
-	_, err := t.db.Exec(`UPDATE syncv3_sync2_devices SET since = $1 WHERE user_id = $2 AND device_id = $3`, since, userID, deviceID)
+// UpdateDeviceSince persists the since token for this device. If given a transaction, it will
+// UPDATE inside that transaction.
+func (t *DevicesTable) UpdateDeviceSince(txn *sqlx.Tx, userID, deviceID, since string) error {
+	var db sqlx.Execer = t.db
+	if txn != nil {
+		db = txn
+	}
+	_, err := db.Exec(`UPDATE syncv3_sync2_devices SET since = $1 WHERE user_id = $2 AND device_id = $3`, since, userID, deviceID)
 	return err
 }
 
+// Since returns the most recently persisted sync v2 since token for this device. The poller does
+// not persist every since token, so this may lag slightly behind the token it is currently using.
+func (t *DevicesTable) Since(userID, deviceID string) (since string, err error) {
+	err = t.db.QueryRow(
+		`SELECT since FROM syncv3_sync2_devices WHERE user_id = $1 AND device_id = $2`, userID, deviceID,
+	).Scan(&since)
+	return
+}
+
 // FindOldDevices fetches the user_id and device_id of all devices which haven't /synced
 // for at least as long as the given inactivityPeriod. Such devices are returned in
 // no particular order.
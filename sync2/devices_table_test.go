@@ -76,7 +76,7 @@ func TestDevicesTableSinceColumn(t *testing.T) {
 
 	t.Log("Update the since column.")
 	sinceValue := "s-1-2-3-4"
-	err = devices.UpdateDeviceSince(alice, aliceDevice, sinceValue)
+	err = devices.UpdateDeviceSince(nil, alice, aliceDevice, sinceValue)
 	if err != nil {
 		t.Fatalf("Failed to update since column: %s", err)
 	}
@@ -133,7 +133,7 @@ func TestTokenForEachDevice(t *testing.T) {
 
 	t.Log("Mark Alice's device with a since token.")
 	sinceValue := "s-1-2-3-4"
-	err := devices.UpdateDeviceSince(alice, aliceDevice, sinceValue)
+	err := devices.UpdateDeviceSince(nil, alice, aliceDevice, sinceValue)
 	if err != nil {
 		t.Fatalf("UpdateDeviceSince returned error: %s", err)
 	}
@@ -0,0 +1,97 @@
+package handler2
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// pollBatch is the transaction for all of the writes from a single sync v2 response, along with the
+// work to do once that transaction has committed.
+type pollBatch struct {
+	txn         *sqlx.Tx
+	afterCommit []func()
+}
+
+type pollBatchCtxKey struct{}
+
+// ProcessBatch persists all of the data from the V2DataReceiver calls made by fn in a single
+// transaction, along with the since token if it is non-empty. Pubsub notifications and in-memory
+// deduplication state are only updated once the transaction has committed, so nothing downstream
+// sees any of the data unless all of it was persisted. Implements sync2.V2DataBatcher.
+func (h *Handler) ProcessBatch(ctx context.Context, pollerID sync2.PollerID, since string, fn func(ctx context.Context) error) error {
+	batch := &pollBatch{}
+	err := sqlutil.WithTransaction(h.Store.DB, func(txn *sqlx.Tx) error {
+		batch.txn = txn
+		if err := fn(context.WithValue(ctx, pollBatchCtxKey{}, batch)); err != nil {
+			return err
+		}
+		if since == "" {
+			return nil
+		}
+		return h.v2Store.DevicesTable.UpdateDeviceSince(txn, pollerID.UserID, pollerID.DeviceID, since)
+	})
+	if err != nil {
+		logger.Err(err).Str("user", pollerID.UserID).Str("device", pollerID.DeviceID).Msg("V2: failed to persist batch, rolled back")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return err
+	}
+	for _, fn := range batch.afterCommit {
+		fn()
+	}
+	return nil
+}
+
+// batchTxn returns the transaction for the batch being processed in ctx, or nil if there is no batch.
+func batchTxn(ctx context.Context) *sqlx.Tx {
+	batch, ok := ctx.Value(pollBatchCtxKey{}).(*pollBatch)
+	if !ok {
+		return nil
+	}
+	return batch.txn
+}
+
+// withSavepoint calls fn with the transaction for the batch being processed in ctx, or nil if there is
+// no batch. Postgres aborts a transaction as soon as any statement in it fails, so writes whose failure
+// is logged rather than returned must use this: if fn fails, the batch is rolled back to how it was
+// before fn was called, and the rest of the batch can still be committed.
+func withSavepoint(ctx context.Context, fn func(txn *sqlx.Tx) error) error {
+	txn := batchTxn(ctx)
+	if txn == nil {
+		return fn(nil)
+	}
+	if _, err := txn.Exec(`SAVEPOINT nonfatal_write`); err != nil {
+		return err
+	}
+	if err := fn(txn); err != nil {
+		if _, rbErr := txn.Exec(`ROLLBACK TO SAVEPOINT nonfatal_write`); rbErr != nil {
+			return fmt.Errorf("%s, and failed to roll back to savepoint: %s", err, rbErr)
+		}
+		return err
+	}
+	_, err := txn.Exec(`RELEASE SAVEPOINT nonfatal_write`)
+	return err
+}
+
+// afterCommit runs fn once the batch being processed in ctx has committed, or immediately if there
+// is no batch. fn is never called if the batch is rolled back.
+func afterCommit(ctx context.Context, fn func()) {
+	batch, ok := ctx.Value(pollBatchCtxKey{}).(*pollBatch)
+	if !ok {
+		fn()
+		return
+	}
+	batch.afterCommit = append(batch.afterCommit, fn)
+}
+
+// notify sends this payload to V2Listeners once the data it refers to has been persisted.
+func (h *Handler) notify(ctx context.Context, payload pubsub.Payload) {
+	afterCommit(ctx, func() {
+		h.v2Pub.Notify(pubsub.ChanV2, payload)
+	})
+}
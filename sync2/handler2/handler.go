@@ -2,6 +2,7 @@ package handler2
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
@@ -189,7 +190,7 @@ func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID) {
 	h.updateMetrics()
 }
 
-func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
+func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
 	err := h.v2Store.TokensTable.Delete(accessTokenHash)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Str("access_token_hash", accessTokenHash).Msg("V2: failed to expire token")
@@ -197,8 +198,19 @@ func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, d
 	}
 	// Notify v3 side so it can remove the connection from ConnMap
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ExpiredToken{
-		UserID:   userID,
-		DeviceID: deviceID,
+		UserID:     userID,
+		DeviceID:   deviceID,
+		SoftLogout: softLogout,
+	})
+}
+
+func (h *Handler) OnPollerLagging(ctx context.Context, userID, deviceID string, lagging, fetchesRoomData bool) {
+	// Notify v3 side so it can warn the device that its data may be delayed
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2PollerLagging{
+		UserID:          userID,
+		DeviceID:        deviceID,
+		Lagging:         lagging,
+		FetchesRoomData: fetchesRoomData,
 	})
 }
 
@@ -214,7 +226,7 @@ func (h *Handler) addPrometheusMetrics() {
 
 // Emits nothing as no downstream components need it.
 func (h *Handler) UpdateDeviceSince(ctx context.Context, userID, deviceID, since string) {
-	err := h.v2Store.DevicesTable.UpdateDeviceSince(userID, deviceID, since)
+	err := h.v2Store.DevicesTable.UpdateDeviceSince(batchTxn(ctx), userID, deviceID, since)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Str("since", since).Msg("V2: failed to persist since token")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -282,7 +294,9 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID, prev
 
 	if len(eventIDToTxnID) > 0 {
 		// persist the txn IDs
-		err := h.Store.TransactionsTable.Insert(userID, deviceID, eventIDToTxnID)
+		err := withSavepoint(ctx, func(txn *sqlx.Tx) error {
+			return h.Store.TransactionsTable.Insert(txn, userID, deviceID, eventIDToTxnID)
+		})
 		if err != nil {
 			logger.Err(err).Str("user", userID).Str("device", deviceID).Int("num_txns", len(eventIDToTxnID)).Msg("failed to persist txn IDs for user")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -290,7 +304,12 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID, prev
 	}
 
 	// Insert new events
-	numNew, latestNIDs, err := h.Store.Accumulate(userID, roomID, prevBatch, timeline)
+	var numNew int
+	var latestNIDs []int64
+	err := sqlutil.WithOptionalTransaction(h.Store.DB, batchTxn(ctx), func(txn *sqlx.Tx) (err error) {
+		numNew, latestNIDs, err = h.Store.Accumulator.Accumulate(txn, userID, roomID, prevBatch, timeline)
+		return err
+	})
 	if err != nil {
 		logger.Err(err).Int("timeline", len(timeline)).Str("room", roomID).Msg("V2: failed to accumulate room")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -299,7 +318,7 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID, prev
 
 	// We've updated the database. Now tell any pubsub listeners what we learned.
 	if numNew != 0 {
-		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Accumulate{
+		h.notify(ctx, &pubsub.V2Accumulate{
 			RoomID:    roomID,
 			PrevBatch: prevBatch,
 			EventNIDs: latestNIDs,
@@ -307,15 +326,17 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID, prev
 	}
 
 	if len(eventIDToTxnID) > 0 || len(eventIDsLackingTxns) > 0 {
-		// The call to h.Store.Accumulate above only tells us about new events' NIDS;
+		// The call to Accumulate above only tells us about new events' NIDS;
 		// for existing events we need to requery the database to fetch them.
 		// Rather than try to reuse work, keep things simple and just fetch NIDs for
 		// all events with txnIDs.
 		var nidsByIDs map[string]int64
 		eventIDsToFetch := append(eventIDsWithTxns, eventIDsLackingTxns...)
-		err = sqlutil.WithTransaction(h.Store.DB, func(txn *sqlx.Tx) error {
-			nidsByIDs, err = h.Store.EventsTable.SelectNIDsByIDs(txn, eventIDsToFetch)
-			return err
+		err = withSavepoint(ctx, func(txn *sqlx.Tx) error {
+			return sqlutil.WithOptionalTransaction(h.Store.DB, txn, func(txn *sqlx.Tx) (err error) {
+				nidsByIDs, err = h.Store.EventsTable.SelectNIDsByIDs(txn, eventIDsToFetch)
+				return err
+			})
 		})
 		if err != nil {
 			logger.Err(err).
@@ -328,45 +349,48 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID, prev
 			return nil // non-fatal if we fail to insert txns
 		}
 
-		for eventID, nid := range nidsByIDs {
-			txnID, ok := eventIDToTxnID[eventID]
-			if ok {
-				h.PendingTxnIDs.SeenTxnID(eventID)
-				h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2TransactionID{
-					EventID:       eventID,
-					RoomID:        roomID,
-					UserID:        userID,
-					DeviceID:      deviceID,
-					TransactionID: txnID,
-					NID:           nid,
-				})
-			} else {
-				allClear, _ := h.PendingTxnIDs.MissingTxnID(eventID, userID, deviceID)
-				if allClear {
+		// the pending transaction ID state must only change once the events are persisted
+		afterCommit(ctx, func() {
+			for eventID, nid := range nidsByIDs {
+				txnID, ok := eventIDToTxnID[eventID]
+				if ok {
+					h.PendingTxnIDs.SeenTxnID(eventID)
 					h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2TransactionID{
 						EventID:       eventID,
 						RoomID:        roomID,
 						UserID:        userID,
 						DeviceID:      deviceID,
-						TransactionID: "",
+						TransactionID: txnID,
 						NID:           nid,
 					})
+				} else {
+					allClear, _ := h.PendingTxnIDs.MissingTxnID(eventID, userID, deviceID)
+					if allClear {
+						h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2TransactionID{
+							EventID:       eventID,
+							RoomID:        roomID,
+							UserID:        userID,
+							DeviceID:      deviceID,
+							TransactionID: "",
+							NID:           nid,
+						})
+					}
 				}
 			}
-		}
+		})
 	}
 	return nil
 }
 
 func (h *Handler) Initialise(ctx context.Context, roomID string, state []json.RawMessage) ([]json.RawMessage, error) {
-	res, err := h.Store.Initialise(roomID, state)
+	res, err := h.Store.Accumulator.Initialise(batchTxn(ctx), roomID, state)
 	if err != nil {
 		logger.Err(err).Int("state", len(state)).Str("room", roomID).Msg("V2: failed to initialise room")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return nil, err
 	}
 	if res.AddedEvents {
-		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Initialise{
+		h.notify(ctx, &pubsub.V2Initialise{
 			RoomID:      roomID,
 			SnapshotNID: res.SnapshotID,
 		})
@@ -390,7 +414,7 @@ func (h *Handler) SetTyping(ctx context.Context, pollerID sync2.PollerID, roomID
 
 	// we don't persist this for long term storage as typing notifs are inherently ephemeral.
 	// So rather than maintaining them forever, they will naturally expire when we terminate.
-	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Typing{
+	h.notify(ctx, &pubsub.V2Typing{
 		RoomID:         roomID,
 		EphemeralEvent: ephEvent,
 	})
@@ -399,7 +423,11 @@ func (h *Handler) SetTyping(ctx context.Context, pollerID sync2.PollerID, roomID
 func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
 	// update our records - we make an artifically new RR event if there are genuine changes
 	// else it returns nil
-	newReceipts, err := h.Store.ReceiptTable.Insert(roomID, ephEvent)
+	var newReceipts []internal.Receipt
+	err := withSavepoint(ctx, func(txn *sqlx.Tx) (err error) {
+		newReceipts, err = h.Store.ReceiptTable.Insert(txn, roomID, ephEvent)
+		return err
+	})
 	if err != nil {
 		logger.Err(err).Str("room", roomID).Msg("failed to store receipts")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -408,20 +436,40 @@ func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType st
 	if len(newReceipts) == 0 {
 		return
 	}
-	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Receipt{
+	h.notify(ctx, &pubsub.V2Receipt{
 		RoomID:   roomID,
 		Receipts: newReceipts,
 	})
 }
 
+func (h *Handler) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	// many pollers see the same presence, so only notify about presence which has changed
+	var changed map[string]json.RawMessage
+	err := withSavepoint(ctx, func(txn *sqlx.Tx) (err error) {
+		changed, err = h.Store.PresenceTable.Insert(txn, events)
+		return err
+	})
+	if err != nil {
+		logger.Err(err).Str("user", userID).Msg("failed to store presence")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+	h.notify(ctx, &pubsub.V2Presence{
+		UserIDToEvent: changed,
+	})
+}
+
 func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error {
-	_, err := h.Store.ToDeviceTable.InsertMessages(userID, deviceID, msgs)
+	_, err := h.Store.ToDeviceTable.InsertMessages(batchTxn(ctx), userID, deviceID, msgs)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Int("msgs", len(msgs)).Msg("V2: failed to store to-device messages")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
-	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2DeviceMessages{
+	h.notify(ctx, &pubsub.V2DeviceMessages{
 		UserID:   userID,
 		DeviceID: deviceID,
 	})
@@ -444,20 +492,24 @@ func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string,
 	if ok && entry.Highlight == hc && entry.Notif == nc {
 		return // dupe
 	}
-	h.unreadMap[key] = struct {
-		Highlight int
-		Notif     int
-	}{
-		Highlight: hc,
-		Notif:     nc,
-	}
+	afterCommit(ctx, func() {
+		h.unreadMap[key] = struct {
+			Highlight int
+			Notif     int
+		}{
+			Highlight: hc,
+			Notif:     nc,
+		}
+	})
 
-	err := h.Store.UnreadTable.UpdateUnreadCounters(userID, roomID, highlightCount, notifCount)
+	err := withSavepoint(ctx, func(txn *sqlx.Tx) error {
+		return h.Store.UnreadTable.UpdateUnreadCounters(txn, userID, roomID, highlightCount, notifCount)
+	})
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update unread counters")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 	}
-	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UnreadCounts{
+	h.notify(ctx, &pubsub.V2UnreadCounts{
 		RoomID:            roomID,
 		UserID:            userID,
 		HighlightCount:    highlightCount,
@@ -481,13 +533,15 @@ func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, even
 			}
 		}
 		dedupedEvents = append(dedupedEvents, events[i])
-		h.accountDataMap.Store(key, thisHash)
+		afterCommit(ctx, func() {
+			h.accountDataMap.Store(key, thisHash)
+		})
 	}
 	if len(dedupedEvents) == 0 {
 		return nil
 	}
 
-	data, err := h.Store.InsertAccountData(userID, roomID, dedupedEvents)
+	data, err := h.Store.InsertAccountData(batchTxn(ctx), userID, roomID, dedupedEvents)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update account data")
 		sentry.CaptureException(err)
@@ -497,7 +551,7 @@ func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, even
 	for _, d := range data {
 		types = append(types, d.Type)
 	}
-	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2AccountData{
+	h.notify(ctx, &pubsub.V2AccountData{
 		UserID: userID,
 		RoomID: roomID,
 		Types:  types,
@@ -506,13 +560,13 @@ func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, even
 }
 
 func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
-	err := h.Store.InvitesTable.InsertInvite(userID, roomID, inviteState)
+	err := h.Store.InvitesTable.InsertInvite(batchTxn(ctx), userID, roomID, inviteState)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert invite")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
-	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InviteRoom{
+	h.notify(ctx, &pubsub.V2InviteRoom{
 		UserID: userID,
 		RoomID: roomID,
 	})
@@ -521,7 +575,7 @@ func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteSta
 
 func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv json.RawMessage) error {
 	// remove any invites for this user if they are rejecting an invite
-	err := h.Store.InvitesTable.RemoveInvite(userID, roomID)
+	err := h.Store.InvitesTable.RemoveInvite(batchTxn(ctx), userID, roomID)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire invite")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -534,7 +588,7 @@ func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv
 	defer h.typingMu.Unlock()
 	delete(h.typingHandler, roomID)
 
-	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2LeaveRoom{
+	h.notify(ctx, &pubsub.V2LeaveRoom{
 		UserID:     userID,
 		RoomID:     roomID,
 		LeaveEvent: leaveEv,
@@ -606,6 +660,28 @@ func (h *Handler) ExpireOldPollers() {
 	}
 }
 
+// ErrUnknownDevice is returned by ResyncDevice if the proxy has never polled for the device.
+var ErrUnknownDevice = fmt.Errorf("unknown device")
+
+// ResyncDevice clears the since token for this device and asks its poller, if it has one, to start
+// again from an initial sync. Devices without a running poller will do an initial sync when their
+// poller is next started. Returns true if a running poller was asked to resync.
+func (h *Handler) ResyncDevice(userID, deviceID string) (bool, error) {
+	// check the device exists first, as the UPDATE silently does nothing for unknown devices
+	if _, err := h.v2Store.DevicesTable.Since(userID, deviceID); err != nil {
+		if err == sql.ErrNoRows {
+			return false, ErrUnknownDevice
+		}
+		return false, fmt.Errorf("failed to load since token: %w", err)
+	}
+	if err := h.v2Store.DevicesTable.UpdateDeviceSince(nil, userID, deviceID, ""); err != nil {
+		return false, fmt.Errorf("failed to clear since token: %w", err)
+	}
+	resynced := h.pMap.Resync(sync2.PollerID{UserID: userID, DeviceID: deviceID})
+	logger.Info().Str("user_id", userID).Str("device_id", deviceID).Bool("poller_running", resynced).Msg("ResyncDevice: cleared since token")
+	return resynced, nil
+}
+
 func fnvHash(event json.RawMessage) uint64 {
 	h := fnv.New64a()
 	h.Write(event)
@@ -3,6 +3,7 @@ package handler2_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"reflect"
 	"sync"
@@ -18,6 +19,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
 )
 
 var postgresURI string
@@ -52,6 +54,10 @@ func (p *mockPollerMap) ExpirePollers([]sync2.PollerID) int {
 	return 0
 }
 
+func (p *mockPollerMap) Resync(pid sync2.PollerID) bool {
+	return false
+}
+
 func (p *mockPollerMap) EnsurePolling(pid sync2.PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) bool {
 	p.calls = append(p.calls, pollInfo{
 		pid:         pid,
@@ -227,3 +233,151 @@ func TestSetTypingConcurrently(t *testing.T) {
 		t.Fatalf("expected only one call to notify, got %d", gotCalls)
 	}
 }
+
+// Test that all of the writes in a batch are committed together with the since token, and that
+// nothing is persisted or notified if the batch fails part way through.
+func TestHandlerProcessBatch(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pMap := &mockPollerMap{}
+	pub := newMockPub()
+	sub := &mockSub{}
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, sub, false, time.Minute)
+	assertNoError(t, err)
+	ctx := context.Background()
+	alice := "@TestHandlerProcessBatch_alice:localhost"
+	deviceID := "ALICE"
+	roomID := "!TestHandlerProcessBatch:localhost"
+	pid := sync2.PollerID{UserID: alice, DeviceID: deviceID}
+	err = sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		return v2Store.DevicesTable.InsertDevice(txn, alice, deviceID)
+	})
+	assertNoError(t, err)
+
+	stateEvents := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	}
+	// sent by someone else, so there is no transaction ID handling
+	message := testutils.NewMessageEvent(t, "@bob:localhost", "hello")
+	toDeviceMsg := json.RawMessage(`{"type":"m.room_key","sender":"@bob:localhost","content":{"session_id":"TestHandlerProcessBatch"}}`)
+	writeAll := func(ctx context.Context) error {
+		if _, err := h.Initialise(ctx, roomID, stateEvents); err != nil {
+			return err
+		}
+		if err := h.Accumulate(ctx, alice, deviceID, roomID, "", []json.RawMessage{message}); err != nil {
+			return err
+		}
+		if err := h.AddToDeviceMessages(ctx, alice, deviceID, []json.RawMessage{toDeviceMsg}); err != nil {
+			return err
+		}
+		if len(pub.calls) != 0 {
+			t.Errorf("got %d notifications before the batch committed, want 0", len(pub.calls))
+		}
+		return nil
+	}
+	assertPersisted := func(want bool) {
+		t.Helper()
+		var nids map[string]int64
+		err := sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) (err error) {
+			nids, err = store.EventsTable.SelectNIDsByIDs(txn, []string{gjson.GetBytes(message, "event_id").Str})
+			return err
+		})
+		assertNoError(t, err)
+		if got := len(nids) == 1; got != want {
+			t.Errorf("message persisted: got %v want %v", got, want)
+		}
+		msgs, _, err := store.ToDeviceTable.Messages(alice, deviceID, 0, 10)
+		assertNoError(t, err)
+		if got := len(msgs) == 1; got != want {
+			t.Errorf("to-device message persisted: got %v want %v", got, want)
+		}
+		since, err := v2Store.DevicesTable.Since(alice, deviceID)
+		assertNoError(t, err)
+		if got := since == "next"; got != want {
+			t.Errorf("since token persisted: got %q, want persisted=%v", since, want)
+		}
+	}
+
+	// the last write in the batch fails, so none of them should be persisted
+	err = h.ProcessBatch(ctx, pid, "next", func(ctx context.Context) error {
+		if err := writeAll(ctx); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed after writing")
+	})
+	if err == nil {
+		t.Fatalf("ProcessBatch returned no error, want the error from the batch")
+	}
+	assertPersisted(false)
+	if len(pub.calls) != 0 {
+		t.Errorf("got %d notifications for a failed batch, want 0: %v", len(pub.calls), pub.calls)
+	}
+
+	// retrying the same batch persists everything and notifies about it
+	err = h.ProcessBatch(ctx, pid, "next", writeAll)
+	assertNoError(t, err)
+	assertPersisted(true)
+	var gotTypes []string
+	for _, payload := range pub.calls {
+		gotTypes = append(gotTypes, payload.Type())
+	}
+	wantTypes := []string{
+		(&pubsub.V2Initialise{}).Type(), (&pubsub.V2Accumulate{}).Type(), (&pubsub.V2DeviceMessages{}).Type(),
+	}
+	if !reflect.DeepEqual(gotTypes, wantTypes) {
+		t.Errorf("got notifications %v want %v", gotTypes, wantTypes)
+	}
+}
+
+// Test that a write whose failure is only logged does not stop the rest of a batch from being
+// committed, even though Postgres aborts a transaction when any statement in it fails.
+func TestHandlerProcessBatchNonFatalFailure(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pMap := &mockPollerMap{}
+	pub := newMockPub()
+	sub := &mockSub{}
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, sub, false, time.Minute)
+	assertNoError(t, err)
+	ctx := context.Background()
+	alice := "@TestHandlerProcessBatchNonFatalFailure_alice:localhost"
+	deviceID := "ALICE"
+	roomID := "!TestHandlerProcessBatchNonFatalFailure:localhost"
+	pid := sync2.PollerID{UserID: alice, DeviceID: deviceID}
+	err = sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		return v2Store.DevicesTable.InsertDevice(txn, alice, deviceID)
+	})
+	assertNoError(t, err)
+
+	stateEvents := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	}
+	message := testutils.NewMessageEvent(t, "@bob:localhost", "hello")
+	err = h.ProcessBatch(ctx, pid, "next", func(ctx context.Context) error {
+		if _, err := h.Initialise(ctx, roomID, stateEvents); err != nil {
+			return err
+		}
+		// Postgres rejects NUL bytes in text, so storing these unread counts fails
+		count := 1
+		h.UpdateUnreadCounts(ctx, "!nul\x00:localhost", alice, &count, &count)
+		return h.Accumulate(ctx, alice, deviceID, roomID, "", []json.RawMessage{message})
+	})
+	assertNoError(t, err)
+
+	var nids map[string]int64
+	err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) (err error) {
+		nids, err = store.EventsTable.SelectNIDsByIDs(txn, []string{gjson.GetBytes(message, "event_id").Str})
+		return err
+	})
+	assertNoError(t, err)
+	if len(nids) != 1 {
+		t.Errorf("message was not persisted after a non-fatal write failed")
+	}
+	since, err := v2Store.DevicesTable.Since(alice, deviceID)
+	assertNoError(t, err)
+	if since != "next" {
+		t.Errorf("got since token %q want %q", since, "next")
+	}
+}
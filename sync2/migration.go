@@ -207,7 +207,7 @@ func runMigration(txn *sqlx.Tx, secret string, whoamiClient Client) error {
 
 func migrateDevice(txn *sqlx.Tx, whoamiClient Client, device *oldDevice) (err error) {
 	gotUserID, gotDeviceID, err := whoamiClient.WhoAmI(device.AccessToken)
-	if err == HTTP401 {
+	if err == HTTP401 || err == HTTP401SoftLogout {
 		userID := device.UserID
 		if userID == "" {
 			userID = "<unknown user>"
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,9 +30,29 @@ type PollerID struct {
 var timeSleep = time.Sleep
 var timeSince = time.Since
 
+// PollerLagThreshold is how long a poller can go without processing a sync response, in addition
+// to the long-poll timeout, before it is considered to be lagging behind the homeserver.
+// Customisable for testing.
+var PollerLagThreshold = time.Minute
+
+// unknownSinceRestartInterval is the minimum time between restarting from an initial sync because
+// the homeserver rejected our since token, as each restart is an expensive initial sync.
+var unknownSinceRestartInterval = time.Minute
+
 // log at most once every duration. Always logs before terminating.
 var logInterval = 30 * time.Second
 
+// DefaultPollTimeout is the long-poll timeout sent to the homeserver if none is configured.
+const DefaultPollTimeout = 30 * time.Second
+
+// DefaultPollTimelineLimit is the timeline limit sent to the homeserver on incremental syncs if none
+// is configured. To reduce the likelihood of a gappy v2 sync, this is large: Synapse's default is 10
+// and 50 is the maximum allowed, by my reading of
+// https://github.com/matrix-org/synapse/blob/89a71e73905ffa1c97ae8be27d521cd2ef3f3a0c/synapse/handlers/sync.py#L576-L577
+// NB: this is a stopgap to reduce the likelihood of hitting
+// https://github.com/matrix-org/sliding-sync/issues/18
+const DefaultPollTimelineLimit = 50
+
 // V2DataReceiver is the receiver for all the v2 sync data the poller gets
 type V2DataReceiver interface {
 	// Update the since token for this device. Called AFTER all other data in this sync response has been processed.
@@ -45,6 +68,8 @@ type V2DataReceiver interface {
 	SetTyping(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage)
 	// Sent when there is a new receipt
 	OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
+	// Sent when there are m.presence events in the `presence` section of the v2 response.
+	OnPresence(ctx context.Context, userID string, events []json.RawMessage)
 	// AddToDeviceMessages adds this chunk of to_device messages. Preserve the ordering.
 	// Return an error to stop the since token advancing.
 	AddToDeviceMessages(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error
@@ -63,8 +88,23 @@ type V2DataReceiver interface {
 	OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	// Sent when the poll loop terminates
 	OnTerminated(ctx context.Context, pollerID PollerID)
-	// Sent when the token gets a 401 response
-	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string)
+	// Sent when the token gets a 401 response. softLogout is true if the homeserver says the device
+	// was soft logged out.
+	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool)
+	// Sent when the poller starts or stops lagging behind the homeserver. fetchesRoomData is true if
+	// the poller fetches room data for all of the user's devices, so they are all affected.
+	OnPollerLagging(ctx context.Context, userID, deviceID string, lagging, fetchesRoomData bool)
+}
+
+// V2DataBatcher is implemented by V2DataReceivers which can persist all of the data in a single sync v2
+// response atomically, instead of each V2DataReceiver call writing to the database separately.
+type V2DataBatcher interface {
+	// ProcessBatch calls fn with a context which must be passed to every V2DataReceiver call made by fn.
+	// If fn returns no error, all of the data from those calls is persisted in a single transaction,
+	// along with the since token if it is non-empty. If fn or the transaction returns an error, none of
+	// the data is persisted and the error is returned. Updates about the data are only sent after it
+	// has been persisted.
+	ProcessBatch(ctx context.Context, pollerID PollerID, since string, fn func(ctx context.Context) error) error
 }
 
 type IPollerMap interface {
@@ -75,21 +115,32 @@ type IPollerMap interface {
 	// ExpirePollers requests that the given pollers are terminated as if their access
 	// tokens had expired. Returns the number of pollers successfully terminated.
 	ExpirePollers(ids []PollerID) int
+	// Resync requests that the running poller for this device starts again from an initial sync.
+	// Returns false if there is no running poller for the device.
+	Resync(pid PollerID) bool
 }
 
 // PollerMap is a map of device ID to Poller
 type PollerMap struct {
 	v2Client                    Client
+	pollTimeout                 time.Duration
+	timelineLimit               int
 	callbacks                   V2DataReceiver
 	pollerMu                    *sync.Mutex
 	Pollers                     map[PollerID]*poller
 	executor                    chan func()
 	executorRunning             bool
+	batchWrites                 bool
+	shareRoomPollers            bool
+	roomPollers                 map[string]PollerID // user ID -> the poller fetching room data, if shareRoomPollers
+	pollHistogramVec            *prometheus.HistogramVec
 	processHistogramVec         *prometheus.HistogramVec
 	timelineSizeHistogramVec    *prometheus.HistogramVec
 	gappyStateSizeVec           *prometheus.HistogramVec
 	numOutstandingSyncReqsGauge prometheus.Gauge
 	totalNumPollsCounter        prometheus.Counter
+	httpOutcomesCounterVec      *prometheus.CounterVec
+	registerer                  prometheus.Registerer
 }
 
 // NewPollerMap makes a new PollerMap. Guarantees that the V2DataReceiver will be called on the same
@@ -116,14 +167,47 @@ type PollerMap struct {
 //   - user resources: notif counts, account data
 //
 // NOT to-device messages,or since tokens.
-func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
+//
+// pollTimeout is the long-poll timeout sent to the homeserver on each sync v2 request, and
+// timelineLimit is the timeline limit sent on each incremental sync v2 request.
+//
+// If batchWrites is true and the V2DataReceiver is a V2DataBatcher, all of the data in each sync v2
+// response is persisted in a single transaction. The whole response is processed in a single call on
+// the executor goroutine, as the transaction may otherwise block on rows written by another poller's
+// uncommitted transaction whilst that poller waits for the executor.
+//
+// If shareRoomPollers is true, only one poller per user fetches room data, as it is the same for all
+// of the user's devices. The user's other pollers only fetch device data e.g to-device messages and
+// OTK counts. If the poller fetching room data stops, another of the user's pollers takes over,
+// starting again from an initial sync.
+//
+// If enablePrometheus is true, metrics are registered with registerer, or with
+// prometheus.DefaultRegisterer if registerer is nil.
+func NewPollerMap(v2Client Client, enablePrometheus bool, registerer prometheus.Registerer, pollTimeout time.Duration, timelineLimit int, batchWrites, shareRoomPollers bool) *PollerMap {
 	pm := &PollerMap{
-		v2Client: v2Client,
-		pollerMu: &sync.Mutex{},
-		Pollers:  make(map[PollerID]*poller),
-		executor: make(chan func(), 0),
+		v2Client:         v2Client,
+		pollTimeout:      pollTimeout,
+		timelineLimit:    timelineLimit,
+		pollerMu:         &sync.Mutex{},
+		Pollers:          make(map[PollerID]*poller),
+		executor:         make(chan func(), 0),
+		batchWrites:      batchWrites,
+		shareRoomPollers: shareRoomPollers,
+		roomPollers:      make(map[string]PollerID),
 	}
 	if enablePrometheus {
+		if registerer == nil {
+			registerer = prometheus.DefaultRegisterer
+		}
+		pm.registerer = registerer
+		pm.pollHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "sync_v2_request_duration_secs",
+			Help:      "Time taken in seconds for sync v2 requests to return, by status code. The code is 0 if there was no response.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120},
+		}, []string{"initial", "first", "code"})
+		registerer.MustRegister(pm.pollHistogramVec)
 		pm.processHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "sliding_sync",
 			Subsystem: "poller",
@@ -131,7 +215,7 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 			Help:      "Time taken in seconds for the sync v2 response to be processed fully",
 			Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
 		}, []string{"initial", "first"})
-		prometheus.MustRegister(pm.processHistogramVec)
+		registerer.MustRegister(pm.processHistogramVec)
 		pm.timelineSizeHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "sliding_sync",
 			Subsystem: "poller",
@@ -139,7 +223,7 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 			Help:      "Number of events seen by the poller in a sync v2 timeline response",
 			Buckets:   []float64{0.0, 1.0, 2.0, 5.0, 10.0, 20.0, 50.0},
 		}, []string{"limited"})
-		prometheus.MustRegister(pm.timelineSizeHistogramVec)
+		registerer.MustRegister(pm.timelineSizeHistogramVec)
 		pm.gappyStateSizeVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "sliding_sync",
 			Subsystem: "poller",
@@ -147,21 +231,28 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 			Help:      "Number of events in a state block during a sync v2 gappy sync",
 			Buckets:   []float64{1.0, 10.0, 100.0, 1000.0, 10000.0},
 		}, nil)
-		prometheus.MustRegister(pm.gappyStateSizeVec)
+		registerer.MustRegister(pm.gappyStateSizeVec)
 		pm.totalNumPollsCounter = prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: "sliding_sync",
 			Subsystem: "poller",
 			Name:      "total_num_polls",
 			Help:      "Total number of poll loops iterated.",
 		})
-		prometheus.MustRegister(pm.totalNumPollsCounter)
+		registerer.MustRegister(pm.totalNumPollsCounter)
 		pm.numOutstandingSyncReqsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: "sliding_sync",
 			Subsystem: "poller",
 			Name:      "num_outstanding_sync_v2_reqs",
 			Help:      "Number of sync v2 requests that have yet to return a response.",
 		})
-		prometheus.MustRegister(pm.numOutstandingSyncReqsGauge)
+		registerer.MustRegister(pm.numOutstandingSyncReqsGauge)
+		pm.httpOutcomesCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "sync_v2_http_outcomes",
+			Help:      "Number of sync v2 requests by the homeserver of the polled user and the outcome: 2xx, 4xx, 5xx or network.",
+		}, []string{"homeserver", "outcome"})
+		registerer.MustRegister(pm.httpOutcomesCounterVec)
 	}
 	return pm
 }
@@ -177,20 +268,26 @@ func (h *PollerMap) Terminate() {
 	for _, p := range h.Pollers {
 		p.Terminate()
 	}
+	if h.pollHistogramVec != nil {
+		h.registerer.Unregister(h.pollHistogramVec)
+	}
 	if h.processHistogramVec != nil {
-		prometheus.Unregister(h.processHistogramVec)
+		h.registerer.Unregister(h.processHistogramVec)
 	}
 	if h.timelineSizeHistogramVec != nil {
-		prometheus.Unregister(h.timelineSizeHistogramVec)
+		h.registerer.Unregister(h.timelineSizeHistogramVec)
 	}
 	if h.gappyStateSizeVec != nil {
-		prometheus.Unregister(h.gappyStateSizeVec)
+		h.registerer.Unregister(h.gappyStateSizeVec)
 	}
 	if h.totalNumPollsCounter != nil {
-		prometheus.Unregister(h.totalNumPollsCounter)
+		h.registerer.Unregister(h.totalNumPollsCounter)
 	}
 	if h.numOutstandingSyncReqsGauge != nil {
-		prometheus.Unregister(h.numOutstandingSyncReqsGauge)
+		h.registerer.Unregister(h.numOutstandingSyncReqsGauge)
+	}
+	if h.httpOutcomesCounterVec != nil {
+		h.registerer.Unregister(h.httpOutcomesCounterVec)
 	}
 	close(h.executor)
 }
@@ -232,12 +329,25 @@ func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 		p.Terminate()
 		// Ensure that we won't recreate this poller on startup. If it reappears later,
 		// we'll make another EnsurePolling call which will recreate the poller.
-		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.accessToken), p.userID, p.deviceID)
+		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.accessToken), p.userID, p.deviceID, false)
 		numTerminated++
 	}
 	return numTerminated
 }
 
+// Resync asks the poller for this device to discard its since token and start again from an initial
+// sync. Any request already in flight completes first, so the resync happens on the following poll.
+func (h *PollerMap) Resync(pid PollerID) bool {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	p, ok := h.Pollers[pid]
+	if !ok || p.terminated.Load() {
+		return false
+	}
+	p.resync.Store(true)
+	return true
+}
+
 // EnsurePolling makes sure there is a poller for this device, making one if need be.
 // Blocks until at least 1 sync is done if and only if the poller was just created.
 // This ensures that calls to the database will return data.
@@ -280,14 +390,27 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 
 	// replace the poller. If we don't need to wait, then we just want to nab to-device events initially.
 	// We don't do that on startup though as we cannot be sure that other pollers will not be using expired tokens.
-	poller = newPoller(pid, accessToken, h.v2Client, h, logger, !needToWait && !isStartup)
+	poller = newPoller(pid, accessToken, h.v2Client, h, logger, !needToWait && !isStartup, h.pollTimeout, h.timelineLimit)
+	poller.pollHistogramVec = h.pollHistogramVec
 	poller.processHistogramVec = h.processHistogramVec
 	poller.timelineSizeVec = h.timelineSizeHistogramVec
 	poller.gappyStateSizeVec = h.gappyStateSizeVec
 	poller.numOutstandingSyncReqs = h.numOutstandingSyncReqsGauge
 	poller.totalNumPolls = h.totalNumPollsCounter
+	poller.httpOutcomes = h.httpOutcomesCounterVec
+	if _, ok := h.callbacks.(V2DataBatcher); ok && h.batchWrites {
+		poller.batcher = h
+	}
+	if h.shareRoomPollers {
+		poller.fetchesRoomData = func() bool {
+			return h.isRoomPoller(pid)
+		}
+	}
 	go poller.Poll(v2since)
 	h.Pollers[pid] = poller
+	if h.shareRoomPollers && !h.hasRoomPoller(pid.UserID) {
+		h.roomPollers[pid.UserID] = pid
+	}
 
 	h.pollerMu.Unlock()
 	if needToWait {
@@ -304,57 +427,65 @@ func (h *PollerMap) execute() {
 	}
 }
 
-func (h *PollerMap) UpdateDeviceSince(ctx context.Context, userID, deviceID, since string) {
-	h.callbacks.UpdateDeviceSince(ctx, userID, deviceID, since)
-}
-func (h *PollerMap) Accumulate(ctx context.Context, userID, deviceID, roomID, prevBatch string, timeline []json.RawMessage) (err error) {
+type executingCtxKey struct{}
+
+// runOnExecutor runs fn on the executor goroutine and waits for it to complete. If ctx shows that
+// we are already on the executor goroutine i.e inside ProcessBatch, fn is run immediately instead.
+func (h *PollerMap) runOnExecutor(ctx context.Context, fn func()) {
+	if ctx.Value(executingCtxKey{}) != nil {
+		fn()
+		return
+	}
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.executor <- func() {
-		err = h.callbacks.Accumulate(ctx, userID, deviceID, roomID, prevBatch, timeline)
+		fn()
 		wg.Done()
 	}
 	wg.Wait()
+}
+
+// ProcessBatch processes an entire sync v2 response in a single call on the executor goroutine.
+// Only called by pollers when the V2DataReceiver is a V2DataBatcher.
+func (h *PollerMap) ProcessBatch(ctx context.Context, pollerID PollerID, since string, fn func(ctx context.Context) error) (err error) {
+	batcher := h.callbacks.(V2DataBatcher)
+	h.runOnExecutor(ctx, func() {
+		err = batcher.ProcessBatch(context.WithValue(ctx, executingCtxKey{}, true), pollerID, since, fn)
+	})
+	return
+}
+
+func (h *PollerMap) UpdateDeviceSince(ctx context.Context, userID, deviceID, since string) {
+	h.callbacks.UpdateDeviceSince(ctx, userID, deviceID, since)
+}
+func (h *PollerMap) Accumulate(ctx context.Context, userID, deviceID, roomID, prevBatch string, timeline []json.RawMessage) (err error) {
+	h.runOnExecutor(ctx, func() {
+		err = h.callbacks.Accumulate(ctx, userID, deviceID, roomID, prevBatch, timeline)
+	})
 	return
 }
 func (h *PollerMap) Initialise(ctx context.Context, roomID string, state []json.RawMessage) (result []json.RawMessage, err error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	h.executor <- func() {
+	h.runOnExecutor(ctx, func() {
 		result, err = h.callbacks.Initialise(ctx, roomID, state)
-		wg.Done()
-	}
-	wg.Wait()
+	})
 	return
 }
 func (h *PollerMap) SetTyping(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	h.executor <- func() {
+	h.runOnExecutor(ctx, func() {
 		h.callbacks.SetTyping(ctx, pollerID, roomID, ephEvent)
-		wg.Done()
-	}
-	wg.Wait()
+	})
 }
 func (h *PollerMap) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) (err error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	h.executor <- func() {
+	h.runOnExecutor(ctx, func() {
 		err = h.callbacks.OnInvite(ctx, userID, roomID, inviteState)
-		wg.Done()
-	}
-	wg.Wait()
+	})
 	return
 }
 
 func (h *PollerMap) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) (err error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	h.executor <- func() {
+	h.runOnExecutor(ctx, func() {
 		err = h.callbacks.OnLeftRoom(ctx, userID, roomID, leaveEvent)
-		wg.Done()
-	}
-	wg.Wait()
+	})
 	return
 }
 
@@ -365,42 +496,81 @@ func (h *PollerMap) AddToDeviceMessages(ctx context.Context, userID, deviceID st
 }
 
 func (h *PollerMap) OnTerminated(ctx context.Context, pollerID PollerID) {
+	if h.shareRoomPollers {
+		h.handOverRoomData(pollerID)
+	}
 	h.callbacks.OnTerminated(ctx, pollerID)
 }
 
-func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
-	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID)
+// isRoomPoller returns true if the poller for this device fetches room data for its user.
+func (h *PollerMap) isRoomPoller(pid PollerID) bool {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	return h.roomPollers[pid.UserID] == pid
+}
+
+// hasRoomPoller returns true if a running poller fetches room data for this user. Must be called
+// with pollerMu held.
+func (h *PollerMap) hasRoomPoller(userID string) bool {
+	pid, ok := h.roomPollers[userID]
+	if !ok {
+		return false
+	}
+	p, ok := h.Pollers[pid]
+	return ok && !p.terminated.Load()
+}
+
+// handOverRoomData picks another running poller for the user to fetch room data, if the terminated
+// poller was fetching room data for its user.
+func (h *PollerMap) handOverRoomData(terminated PollerID) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	// the poller may have already been replaced by a new poller for the same device
+	if h.roomPollers[terminated.UserID] != terminated || h.hasRoomPoller(terminated.UserID) {
+		return
+	}
+	delete(h.roomPollers, terminated.UserID)
+	for pid, p := range h.Pollers {
+		if pid.UserID != terminated.UserID || p.terminated.Load() {
+			continue
+		}
+		p.resyncRooms.Store(true)
+		h.roomPollers[pid.UserID] = pid
+		return
+	}
+}
+
+func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID, softLogout)
+}
+
+func (h *PollerMap) OnPollerLagging(ctx context.Context, userID, deviceID string, lagging, fetchesRoomData bool) {
+	h.callbacks.OnPollerLagging(ctx, userID, deviceID, lagging, fetchesRoomData)
 }
 
 func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	h.executor <- func() {
+	h.runOnExecutor(ctx, func() {
 		h.callbacks.UpdateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount)
-		wg.Done()
-	}
-	wg.Wait()
+	})
 }
 
 func (h *PollerMap) OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) (err error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	h.executor <- func() {
+	h.runOnExecutor(ctx, func() {
 		err = h.callbacks.OnAccountData(ctx, userID, roomID, events)
-		wg.Done()
-	}
-	wg.Wait()
+	})
 	return
 }
 
 func (h *PollerMap) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	h.executor <- func() {
+	h.runOnExecutor(ctx, func() {
 		h.callbacks.OnReceipt(ctx, userID, roomID, ephEventType, ephEvent)
-		wg.Done()
-	}
-	wg.Wait()
+	})
+}
+
+func (h *PollerMap) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	h.runOnExecutor(ctx, func() {
+		h.callbacks.OnPresence(ctx, userID, events)
+	})
 }
 
 func (h *PollerMap) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
@@ -419,8 +589,23 @@ type poller struct {
 	client      Client
 	receiver    V2DataReceiver
 	logger      zerolog.Logger
+	// if set, the data in each sync v2 response is persisted via this batcher
+	batcher V2DataBatcher
 
 	initialToDeviceOnly bool
+	// if set, the poller only fetches room data whilst this returns true, as another poller for the
+	// same user is fetching it instead. See NewPollerMap.
+	fetchesRoomData func() bool
+	// set when this poller takes over fetching room data for its user. It must then start again from
+	// an initial sync, as it skipped the room data before its current since token.
+	resyncRooms *atomic.Bool
+	// set when an operator asks for this device to be resynced. The poller starts again from an
+	// initial sync on its next poll.
+	resync *atomic.Bool
+	// the long-poll timeout sent to the homeserver on each sync v2 request
+	pollTimeout time.Duration
+	// the timeline limit sent to the homeserver on each incremental sync v2 request
+	timelineLimit int
 
 	// E2EE fields: we keep them so we only send callbacks on deltas not all the time
 	fallbackKeyTypes []string
@@ -448,9 +633,10 @@ type poller struct {
 	gappyStateSizeVec      *prometheus.HistogramVec
 	numOutstandingSyncReqs prometheus.Gauge
 	totalNumPolls          prometheus.Counter
+	httpOutcomes           *prometheus.CounterVec
 }
 
-func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataReceiver, logger zerolog.Logger, initialToDeviceOnly bool) *poller {
+func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataReceiver, logger zerolog.Logger, initialToDeviceOnly bool, pollTimeout time.Duration, timelineLimit int) *poller {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	return &poller{
@@ -460,9 +646,13 @@ func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataR
 		client:              client,
 		receiver:            receiver,
 		terminated:          &atomic.Bool{},
+		resyncRooms:         &atomic.Bool{},
+		resync:              &atomic.Bool{},
 		logger:              logger,
 		wg:                  &wg,
 		initialToDeviceOnly: initialToDeviceOnly,
+		pollTimeout:         pollTimeout,
+		timelineLimit:       timelineLimit,
 	}
 }
 
@@ -480,6 +670,10 @@ type pollLoopState struct {
 	failCount       int
 	since           string
 	lastStoredSince time.Time // The time we last stored the since token in the database
+	lastProcessed   time.Time // The time we last successfully processed a sync response
+	lagging         bool      // True if we have told the receiver that this poller is lagging
+	// The time we last restarted from an initial sync because the homeserver rejected our since token
+	lastUnknownSinceRestart time.Time
 }
 
 // Poll will block forever, repeatedly calling v2 sync. Do this in a goroutine.
@@ -518,6 +712,7 @@ func (p *poller) Poll(since string) {
 		since:     since,
 		// Setting time.Time{} results in the first poll loop to immediately store the since token.
 		lastStoredSince: time.Time{},
+		lastProcessed:   time.Now(),
 	}
 	for !p.terminated.Load() {
 		ctx, task := internal.StartTask(ctx, "Poll")
@@ -528,6 +723,8 @@ func (p *poller) Poll(since string) {
 		}
 	}
 	p.maybeLogStats(true)
+	// a poller which has stopped can't be lagging
+	p.setLagging(ctx, &state, false)
 	// always unblock EnsurePolling else we can end up head-of-line blocking other pollers!
 	if state.firstTime {
 		state.firstTime = false
@@ -543,31 +740,68 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		p.totalNumPolls.Inc()
 	}
 	if s.failCount > 0 {
+		// the last attempt failed, so we may be falling behind the homeserver
+		p.setLagging(ctx, s, p.lag(s) > PollerLagThreshold)
 		// don't backoff when doing v2 syncs because the response is only in the cache for a short
 		// period of time (on massive accounts on matrix.org) such that if you wait 2,4,8min between
 		// requests it might force the server to do the work all over again :(
-		waitTime := 3 * time.Second
+		// The wait is jittered so pollers which failed together, e.g. during a homeserver outage, don't
+		// all retry at the same moment.
+		waitTime := jitter(3 * time.Second)
 		p.logger.Warn().Str("duration", waitTime.String()).Int("fail-count", s.failCount).Msg("Poller: waiting before next poll")
 		timeSleep(waitTime)
 	}
 	if p.terminated.Load() {
 		return fmt.Errorf("poller terminated")
 	}
+	if p.resync.CompareAndSwap(true, false) {
+		p.logger.Info().Msg("Poller: resync requested, restarting from an initial sync")
+		s.since = ""
+		s.lastStoredSince = time.Time{}
+	}
+	toDeviceOnly := p.initialToDeviceOnly || (p.fetchesRoomData != nil && !p.fetchesRoomData())
+	// resyncRooms is set before this poller starts fetching room data, so check it after fetchesRoomData
+	if !toDeviceOnly && p.resyncRooms.CompareAndSwap(true, false) {
+		p.logger.Info().Msg("Poller: taking over fetching room data for this user, restarting from an initial sync")
+		s.since = ""
+		s.lastStoredSince = time.Time{}
+	}
 	start := time.Now()
 	spanCtx, region := internal.StartSpan(ctx, "DoSyncV2")
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Inc()
 	}
-	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	stopWatchingLag := p.watchLag(ctx, s)
+	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, toDeviceOnly, p.pollTimeout, p.timelineLimit)
+	stopWatchingLag()
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Dec()
 	}
 	region.End()
-	p.trackRequestDuration(timeSince(start), s.since == "", s.firstTime)
+	p.trackRequestDuration(timeSince(start), s.since == "", s.firstTime, statusCode)
+	p.trackHTTPOutcome(statusCode, err)
 	if p.terminated.Load() {
 		return fmt.Errorf("poller terminated")
 	}
 	if err != nil {
+		if errors.Is(err, ErrUnknownSince) {
+			// Retrying with this since token will never succeed, so start again from an initial sync.
+			// Rooms in the initial sync have a state block. Initialise creates snapshots for rooms we
+			// have never seen, but leaves existing snapshots alone: any state events in the block which
+			// we don't have are instead prepended to the room's timeline, so the state we missed is
+			// Accumulated on top of the existing snapshot.
+			p.logger.Warn().Err(err).Str("since", s.since).Msg("Poller: homeserver rejected since token, restarting from an initial sync")
+			// If the homeserver keeps rejecting our tokens, don't hammer it with initial syncs.
+			if wait := unknownSinceRestartInterval - timeSince(s.lastUnknownSinceRestart); wait > 0 {
+				p.logger.Warn().Str("duration", wait.String()).Msg("Poller: restarted recently, waiting before restarting again")
+				timeSleep(wait)
+			}
+			s.lastUnknownSinceRestart = time.Now()
+			s.since = ""
+			// persist the new since token as soon as we get one
+			s.lastStoredSince = time.Time{}
+			return nil
+		}
 		// check if temporary
 		isFatal := statusCode == 401 || statusCode == 403
 		if !isFatal {
@@ -576,8 +810,9 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 			return nil
 		} else {
 			errMsg := "poller: access token has been invalidated, terminating loop"
-			p.logger.Warn().Msg(errMsg)
-			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			softLogout := errors.Is(err, HTTP401SoftLogout)
+			p.logger.Warn().Bool("soft_logout", softLogout).Msg(errMsg)
+			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID, softLogout)
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
@@ -597,27 +832,24 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		s.failCount += 1
 		return nil
 	}
-	retryErr = p.parseGlobalAccountData(ctx, resp)
-	if shouldRetry(retryErr) {
-		p.logger.Err(retryErr).Msg("Poller: parseGlobalAccountData returned an error")
-		s.failCount += 1
-		return nil
-	}
-	retryErr = p.parseRoomsResponse(ctx, resp)
-	if shouldRetry(retryErr) {
-		p.logger.Err(retryErr).Msg("Poller: parseRoomsResponse returned an error")
-		s.failCount += 1
-		return nil
+	// Persist the since token if it either was more than one minute ago since we
+	// last stored it OR the response contains to-device messages
+	persistSince := timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0
+	if p.batcher != nil {
+		// persist the rest of the response and the since token together, so we either see all
+		// of this response or none of it.
+		var since string
+		if persistSince {
+			since = resp.NextBatch
+		}
+		retryErr = p.batcher.ProcessBatch(ctx, PollerID{UserID: p.userID, DeviceID: p.deviceID}, since, func(ctx context.Context) error {
+			return p.parseResponse(ctx, resp)
+		})
+	} else {
+		retryErr = p.parseResponse(ctx, resp)
 	}
-	// process to-device messages as the LAST retryable data so we don't double-process
-	// to-device msgs on retrys. In other words, if parseToDeviceMessages returns no error
-	// then we for sure are going to increment the since token, so cannot see duplicates.
-	// If parseToDeviceMessages was earlier, a later parse function could force a retry,
-	// causing duplicates. Other parse functions don't have this problem as they are
-	// deduplicated.
-	retryErr = p.parseToDeviceMessages(ctx, resp)
 	if shouldRetry(retryErr) {
-		p.logger.Err(retryErr).Msg("Poller: parseToDeviceMessages returned an error")
+		p.logger.Err(retryErr).Msg("Poller: failed to process response")
 		s.failCount += 1
 		return nil
 	}
@@ -626,10 +858,10 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	wasFirst := s.firstTime
 
 	s.since = resp.NextBatch
-	// Persist the since token if it either was more than one minute ago since we
-	// last stored it OR the response contains to-device messages
-	if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 {
-		p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, s.since)
+	if persistSince {
+		if p.batcher == nil {
+			p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, s.since)
+		}
 		s.lastStoredSince = time.Now()
 	}
 
@@ -637,16 +869,116 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		s.firstTime = false
 		p.wg.Done()
 	}
+	// a slow homeserver can lag behind without any request failing, so check how long this took
+	lagging := p.lag(s) > PollerLagThreshold
+	s.lastProcessed = time.Now()
+	p.setLagging(ctx, s, lagging)
 	p.trackProcessDuration(timeSince(start), wasInitial, wasFirst)
 	p.maybeLogStats(false)
 	return nil
 }
 
-func (p *poller) trackRequestDuration(dur time.Duration, isInitial, isFirst bool) {
+// jitter returns d randomly adjusted by up to ±20%.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*0.4-0.2)*float64(d))
+}
+
+// parseResponse processes everything in the sync v2 response other than E2EE data. If any section
+// returns an error which should be retried, the remaining sections are not processed.
+func (p *poller) parseResponse(ctx context.Context, resp *SyncResponse) error {
+	if err := p.parseGlobalAccountData(ctx, resp); shouldRetry(err) {
+		return fmt.Errorf("parseGlobalAccountData: %w", err)
+	}
+	if err := p.parseRoomsResponse(ctx, resp); shouldRetry(err) {
+		return fmt.Errorf("parseRoomsResponse: %w", err)
+	}
+	p.parsePresence(ctx, resp)
+	// process to-device messages as the LAST retryable data so we don't double-process
+	// to-device msgs on retrys. In other words, if parseToDeviceMessages returns no error
+	// then we for sure are going to increment the since token, so cannot see duplicates.
+	// If parseToDeviceMessages was earlier, a later parse function could force a retry,
+	// causing duplicates. Other parse functions don't have this problem as they are
+	// deduplicated.
+	if err := p.parseToDeviceMessages(ctx, resp); shouldRetry(err) {
+		return fmt.Errorf("parseToDeviceMessages: %w", err)
+	}
+	return nil
+}
+
+// lag returns how far this poller is behind the homeserver. We expect to go up to the long-poll
+// timeout without a response, so only time beyond that since the last processed response counts.
+func (p *poller) lag(s *pollLoopState) time.Duration {
+	return timeSince(s.lastProcessed) - p.pollTimeout
+}
+
+// watchLag marks the poller as lagging if the sync v2 request about to be made is still outstanding
+// when the lag goes beyond PollerLagThreshold, e.g. because the homeserver is hung. Call the returned
+// function once the request returns.
+func (p *poller) watchLag(ctx context.Context, s *pollLoopState) (stop func()) {
+	timer := time.NewTimer(PollerLagThreshold - p.lag(s))
+	stopCh := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-stopCh:
+		case <-timer.C:
+			p.setLagging(ctx, s, true)
+		}
+	}()
+	return func() {
+		timer.Stop()
+		close(stopCh)
+		// wait so s is only modified by the poll loop once this returns
+		<-stopped
+	}
+}
+
+// setLagging tells the receiver if this poller has started or stopped lagging behind the homeserver.
+func (p *poller) setLagging(ctx context.Context, s *pollLoopState, lagging bool) {
+	if lagging == s.lagging {
+		return
+	}
+	s.lagging = lagging
+	// if this poller fetches room data on behalf of the user's other devices, they are lagging too
+	fetchesRoomData := p.fetchesRoomData != nil && p.fetchesRoomData()
+	p.logger.Warn().Bool("lagging", lagging).Bool("fetches_room_data", fetchesRoomData).Time("last_processed", s.lastProcessed).Msg("Poller: lagging status changed")
+	p.receiver.OnPollerLagging(ctx, p.userID, p.deviceID, lagging, fetchesRoomData)
+}
+
+func (p *poller) trackRequestDuration(dur time.Duration, isInitial, isFirst bool, statusCode int) {
 	if p.pollHistogramVec == nil {
 		return
 	}
-	p.pollHistogramVec.WithLabelValues(labels(isInitial, isFirst)...).Observe(float64(dur.Milliseconds()))
+	lvs := append(labels(isInitial, isFirst), strconv.Itoa(statusCode))
+	p.pollHistogramVec.WithLabelValues(lvs...).Observe(dur.Seconds())
+}
+
+// trackHTTPOutcome counts the outcome of a sync v2 request against the homeserver of the polled user,
+// so operators of multi-homeserver deployments can see which homeserver is struggling.
+func (p *poller) trackHTTPOutcome(statusCode int, err error) {
+	if p.httpOutcomes == nil {
+		return
+	}
+	var outcome string
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		outcome = "2xx"
+	case statusCode >= 400 && statusCode < 500:
+		outcome = "4xx"
+	case statusCode >= 500 && statusCode < 600:
+		outcome = "5xx"
+	case err != nil:
+		// no status code, so the request failed or the response could not be read
+		outcome = "network"
+	default:
+		outcome = "other"
+	}
+	homeserver := p.userID
+	if i := strings.Index(p.userID, ":"); i >= 0 {
+		homeserver = p.userID[i+1:]
+	}
+	p.httpOutcomes.WithLabelValues(homeserver, outcome).Inc()
 }
 
 func (p *poller) trackProcessDuration(dur time.Duration, isInitial, isFirst bool) {
@@ -758,6 +1090,15 @@ func (p *poller) parseGlobalAccountData(ctx context.Context, res *SyncResponse)
 	return p.receiver.OnAccountData(ctx, p.userID, AccountDataGlobalRoom, res.AccountData.Events)
 }
 
+func (p *poller) parsePresence(ctx context.Context, res *SyncResponse) {
+	ctx, task := internal.StartTask(ctx, "parsePresence")
+	defer task.End()
+	if len(res.Presence.Events) == 0 {
+		return
+	}
+	p.receiver.OnPresence(ctx, p.userID, res.Presence.Events)
+}
+
 func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) error {
 	ctx, task := internal.StartTask(ctx, "parseRoomsResponse")
 	defer task.End()
@@ -859,6 +1200,14 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 			return fmt.Errorf("OnInvite[%s]: %w", roomID, err)
 		}
 	}
+	// knocks are handled like invites: the knock_state has the same shape as invite_state, and the
+	// user's own membership event tells the v3 side that this is a knock
+	for roomID, roomData := range res.Rooms.Knock {
+		err := p.receiver.OnInvite(ctx, p.userID, roomID, roomData.KnockState.Events)
+		if err != nil {
+			return fmt.Errorf("OnInvite_Knock[%s]: %w", roomID, err)
+		}
+	}
 
 	p.totalReceipts += receiptCalls
 	p.totalStateCalls += stateCalls
@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 )
 
@@ -27,11 +31,7 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 	}
 	initialResponse := &SyncResponse{
 		NextBatch: nextSince,
-		Rooms: struct {
-			Join   map[string]SyncV2JoinResponse   `json:"join"`
-			Invite map[string]SyncV2InviteResponse `json:"invite"`
-			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-		}{
+		Rooms: SyncRoomsResponse{
 			Join: map[string]SyncV2JoinResponse{
 				roomID: {
 					State: EventsResponse{
@@ -49,7 +49,7 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 	})
 	accumulator.incomingProcess = make(chan struct{})
 	accumulator.unblockProcess = make(chan struct{})
-	pm := NewPollerMap(client, false)
+	pm := NewPollerMap(client, false, nil, DefaultPollTimeout, DefaultPollTimelineLimit, false, false)
 	pm.SetCallbacks(accumulator)
 
 	ensurePollingUnblocked := make(chan struct{})
@@ -100,6 +100,136 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 	}
 }
 
+// sharedRoomsClient records which sync v2 requests asked for room data, per access token.
+type sharedRoomsClient struct {
+	mu sync.Mutex
+	// access token -> since tokens of the requests which asked for room data
+	roomDataSinces map[string][]string
+	// access token -> number of requests which only asked for device data
+	deviceOnlyCount map[string]int
+}
+
+func (c *sharedRoomsClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool, timeout time.Duration, timelineLimit int) (*SyncResponse, int, error) {
+	c.mu.Lock()
+	if toDeviceOnly {
+		c.deviceOnlyCount[accessToken]++
+	} else {
+		c.roomDataSinces[accessToken] = append(c.roomDataSinces[accessToken], since)
+	}
+	c.mu.Unlock()
+	// don't spin
+	time.Sleep(time.Millisecond)
+	return &SyncResponse{NextBatch: "next_" + accessToken}, 200, nil
+}
+
+func (c *sharedRoomsClient) WhoAmI(accessToken string) (string, string, error) {
+	return "@alice:localhost", "device_123", nil
+}
+
+func (c *sharedRoomsClient) counts(accessToken string) (roomDataSinces []string, deviceOnly int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.roomDataSinces[accessToken]...), c.deviceOnlyCount[accessToken]
+}
+
+// Test that when sharing room pollers, only one of a user's devices fetches room data, and that
+// another device takes over from an initial sync when that poller stops.
+func TestPollerMapShareRoomPollers(t *testing.T) {
+	userID := "@TestPollerMapShareRoomPollers:localhost"
+	deviceA := PollerID{UserID: userID, DeviceID: "A"}
+	deviceB := PollerID{UserID: userID, DeviceID: "B"}
+	client := &sharedRoomsClient{
+		roomDataSinces:  make(map[string][]string),
+		deviceOnlyCount: make(map[string]int),
+	}
+	accumulator, _ := newMocks(nil)
+	pm := NewPollerMap(client, false, nil, DefaultPollTimeout, DefaultPollTimelineLimit, false, true)
+	pm.SetCallbacks(accumulator)
+	defer pm.Terminate()
+	pm.EnsurePolling(deviceA, "token_a", "", false, zerolog.New(os.Stderr))
+	pm.EnsurePolling(deviceB, "token_b", "", false, zerolog.New(os.Stderr))
+
+	waitFor := func(desc string, fn func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !fn() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", desc)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("both devices to poll", func() bool {
+		roomDataA, _ := client.counts("token_a")
+		_, deviceOnlyB := client.counts("token_b")
+		return len(roomDataA) > 1 && deviceOnlyB > 1
+	})
+	if roomDataB, _ := client.counts("token_b"); len(roomDataB) > 0 {
+		t.Fatalf("device B fetched room data with since tokens %v, want only device A to", roomDataB)
+	}
+
+	// when device A's poller stops, device B takes over from an initial sync
+	pm.ExpirePollers([]PollerID{deviceA})
+	waitFor("device B to fetch room data", func() bool {
+		roomDataB, _ := client.counts("token_b")
+		return len(roomDataB) > 1
+	})
+	roomDataB, _ := client.counts("token_b")
+	if roomDataB[0] != "" {
+		t.Errorf("device B took over room data with since %q, want an initial sync", roomDataB[0])
+	}
+	if roomDataB[1] != "next_token_b" {
+		t.Errorf("device B's next poll used since %q, want next_token_b", roomDataB[1])
+	}
+}
+
+// Test that resyncing a device makes its poller start again from an initial sync after any request
+// already in flight.
+func TestPollerMapResync(t *testing.T) {
+	pid := PollerID{UserID: "@TestPollerMapResync:localhost", DeviceID: "A"}
+	syncRequests := make(chan string)
+	syncResponses := make(chan *SyncResponse)
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		syncRequests <- since
+		return <-syncResponses, 200, nil
+	})
+	pm := NewPollerMap(client, false, nil, DefaultPollTimeout, DefaultPollTimelineLimit, false, false)
+	pm.SetCallbacks(accumulator)
+	defer pm.Terminate()
+
+	if pm.Resync(pid) {
+		t.Fatalf("Resync returned true for a device without a poller")
+	}
+	go pm.EnsurePolling(pid, "token", initialSinceToken, false, zerolog.New(os.Stderr))
+	expectRequest := func(wantSince string) {
+		t.Helper()
+		select {
+		case since := <-syncRequests:
+			if since != wantSince {
+				t.Fatalf("DoSyncV2 called with since %q, want %q", since, wantSince)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for DoSyncV2 with since %q", wantSince)
+		}
+	}
+	respond := func(nextBatch string) {
+		syncResponses <- &SyncResponse{NextBatch: nextBatch}
+	}
+
+	expectRequest(initialSinceToken)
+	respond("1")
+	expectRequest("1")
+	// resync whilst a request is in flight: it should complete, then the poller starts again.
+	if !pm.Resync(pid) {
+		t.Fatalf("Resync returned false for a running poller")
+	}
+	respond("2")
+	expectRequest("")
+	respond("3")
+	expectRequest("3")
+	respond("4")
+}
+
 func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 	nextSince := "next"
 	roomID := "!foo:bar"
@@ -110,11 +240,7 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 	}
 	initialResponse := &SyncResponse{
 		NextBatch: nextSince,
-		Rooms: struct {
-			Join   map[string]SyncV2JoinResponse   `json:"join"`
-			Invite map[string]SyncV2InviteResponse `json:"invite"`
-			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-		}{
+		Rooms: SyncRoomsResponse{
 			Join: map[string]SyncV2JoinResponse{
 				roomID: {
 					State: EventsResponse{
@@ -132,7 +258,7 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 	})
 	accumulator.incomingProcess = make(chan struct{})
 	accumulator.unblockProcess = make(chan struct{})
-	pm := NewPollerMap(client, false)
+	pm := NewPollerMap(client, false, nil, DefaultPollTimeout, DefaultPollTimelineLimit, false, false)
 	pm.SetCallbacks(accumulator)
 
 	ensurePollingUnblocked := make(chan struct{})
@@ -205,7 +331,7 @@ func TestPollerMap_ExpirePollers(t *testing.T) {
 		}
 		return &r, 200, nil
 	})
-	pm := NewPollerMap(client, false)
+	pm := NewPollerMap(client, false, nil, DefaultPollTimeout, DefaultPollTimelineLimit, false, false)
 	pm.SetCallbacks(receiver)
 
 	// Start 5 pollers.
@@ -281,11 +407,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 			joinResp.State.Events = roomState
 			return &SyncResponse{
 				NextBatch: nextSince,
-				Rooms: struct {
-					Join   map[string]SyncV2JoinResponse   `json:"join"`
-					Invite map[string]SyncV2InviteResponse `json:"invite"`
-					Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-				}{
+				Rooms: SyncRoomsResponse{
 					Join: map[string]SyncV2JoinResponse{
 						roomID: joinResp,
 					},
@@ -296,7 +418,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 	})
 	var wg sync.WaitGroup
 	wg.Add(1)
-	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
 	go func() {
 		defer wg.Done()
 		poller.Poll("")
@@ -321,6 +443,36 @@ func TestPollerPollFromNothing(t *testing.T) {
 	}
 }
 
+// Check that the configured poll timeout and timeline limit are passed through to every sync v2 request.
+func TestPollerPollTimeout(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	pollTimeout := 5 * time.Second
+	numSyncs := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numSyncs++
+		if numSyncs <= 3 {
+			return &SyncResponse{
+				NextBatch: fmt.Sprintf("since_%d", numSyncs),
+			}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, pollTimeout, 20)
+	poller.Poll("")
+
+	if len(client.timeouts) != 4 {
+		t.Fatalf("got %d sync requests, want 4", len(client.timeouts))
+	}
+	for i, timeout := range client.timeouts {
+		if timeout != pollTimeout {
+			t.Errorf("request %d: got timeout %v want %v", i, timeout, pollTimeout)
+		}
+		if client.timelineLimits[i] != 20 {
+			t.Errorf("request %d: got timeline limit %d want 20", i, client.timelineLimits[i])
+		}
+	}
+}
+
 // Check that a call to Poll starts polling with an existing since token and accumulates timeline entries
 func TestPollerPollFromExisting(t *testing.T) {
 	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
@@ -372,11 +524,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 			// ToDevice messages in the response)
 			ToDevice:  EventsResponse{Events: toDeviceResponses[sinceInt]},
 			NextBatch: fmt.Sprintf("%d", sinceInt+1),
-			Rooms: struct {
-				Join   map[string]SyncV2JoinResponse   `json:"join"`
-				Invite map[string]SyncV2InviteResponse `json:"invite"`
-				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-			}{
+			Rooms: SyncRoomsResponse{
 				Join: map[string]SyncV2JoinResponse{
 					roomID: joinResp,
 				},
@@ -386,7 +534,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 	})
 	var wg sync.WaitGroup
 	wg.Add(1)
-	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
 	go func() {
 		defer wg.Done()
 		poller.Poll(since)
@@ -429,7 +577,7 @@ func TestPollerPollUpdateDeviceSincePeriodically(t *testing.T) {
 		return <-syncResponses, 200, nil
 	})
 	accumulator.updateSinceCalled = make(chan struct{}, 1)
-	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
 	defer poller.Terminate()
 	go func() {
 		poller.Poll(initialSinceToken)
@@ -569,8 +717,11 @@ func TestPollerBackoff(t *testing.T) {
 		return nil, errorResponses[i].code, errorResponses[i].err
 	})
 	timeSleep = func(d time.Duration) {
-		if d != wantBackoffDuration {
-			t.Errorf("time.Sleep called incorrectly: got %v want %v", d, wantBackoffDuration)
+		// the backoff is jittered by up to 20% either way
+		minBackoff := wantBackoffDuration * 8 / 10
+		maxBackoff := wantBackoffDuration * 12 / 10
+		if d < minBackoff || d > maxBackoff {
+			t.Errorf("time.Sleep called incorrectly: got %v want between %v and %v", d, minBackoff, maxBackoff)
 		}
 		// actually sleep to make sure async actions can happen if any
 		time.Sleep(1 * time.Millisecond)
@@ -580,7 +731,7 @@ func TestPollerBackoff(t *testing.T) {
 	}()
 	var wg sync.WaitGroup
 	wg.Add(1)
-	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
 	go func() {
 		defer wg.Done()
 		poller.Poll("some_since_value")
@@ -600,6 +751,392 @@ func TestPollerBackoff(t *testing.T) {
 	}
 }
 
+// Test that a successful poll resets the poller's failure count, so it doesn't wait before the next
+// poll, and an error after that waits the base amount again.
+func TestPollerBackoffResetsAfterSuccess(t *testing.T) {
+	defer func() { // reset the value after the test runs
+		timeSleep = time.Sleep
+	}()
+	numPolls := 0
+	var sleptBeforePolls []int
+	timeSleep = func(d time.Duration) {
+		// the backoff is jittered by up to 20% either way
+		if d < 3*time.Second*8/10 || d > 3*time.Second*12/10 {
+			t.Errorf("time.Sleep called with %v, want the base backoff of 3s", d)
+		}
+		sleptBeforePolls = append(sleptBeforePolls, numPolls+1)
+	}
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numPolls++
+		switch numPolls {
+		case 1, 3:
+			return nil, 500, fmt.Errorf("internal server error")
+		case 2:
+			return &SyncResponse{NextBatch: "next"}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	poller := newPoller(PollerID{UserID: "@TestPollerBackoffResetsAfterSuccess:localhost", DeviceID: "FOOBAR"}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
+	poller.Poll("some_since_value")
+
+	// each error waits once before the next poll, but the successful poll doesn't
+	wantSleptBeforePolls := []int{2, 4}
+	if !reflect.DeepEqual(sleptBeforePolls, wantSleptBeforePolls) {
+		t.Errorf("slept before polls %v want %v", sleptBeforePolls, wantSleptBeforePolls)
+	}
+}
+
+// Test that the poller restarts from an initial sync when the homeserver rejects its since token,
+// rather than backing off forever.
+func TestPollerRestartsOnUnknownSince(t *testing.T) {
+	pid := PollerID{UserID: "@TestPollerRestartsOnUnknownSince:localhost", DeviceID: "FOOBAR"}
+	roomID := "!foo:bar"
+	roomState := []json.RawMessage{
+		json.RawMessage(`{"event":1}`),
+		json.RawMessage(`{"event":2}`),
+	}
+	defer func() { // reset the value after the test runs
+		timeSleep = time.Sleep
+	}()
+	timeSleep = func(d time.Duration) {
+		t.Errorf("time.Sleep called with %v but the poller should retry immediately", d)
+	}
+	var gotSinces []string
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		gotSinces = append(gotSinces, since)
+		switch len(gotSinces) {
+		case 1:
+			return nil, 400, fmt.Errorf("DoSyncV2: response returned 400 Bad Request: %w", ErrUnknownSince)
+		case 2:
+			var joinResp SyncV2JoinResponse
+			joinResp.State.Events = roomState
+			return &SyncResponse{
+				NextBatch: "next",
+				Rooms: SyncRoomsResponse{
+					Join: map[string]SyncV2JoinResponse{
+						roomID: joinResp,
+					},
+				},
+			}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
+	poller.Poll("from_backup")
+
+	wantSinces := []string{"from_backup", "", "next"}
+	if !reflect.DeepEqual(gotSinces, wantSinces) {
+		t.Errorf("got since tokens %v want %v", gotSinces, wantSinces)
+	}
+	if len(accumulator.states[roomID]) != len(roomState) {
+		t.Errorf("did not re-initialise room state, got %d events want %d", len(accumulator.states[roomID]), len(roomState))
+	}
+	if accumulator.pollerIDToSince[pid] != "next" {
+		t.Errorf("did not persist the new since token, got %s want next", accumulator.pollerIDToSince[pid])
+	}
+}
+
+// Test that the poller waits before restarting from an initial sync again if the homeserver keeps
+// rejecting its since tokens.
+func TestPollerRateLimitsUnknownSinceRestarts(t *testing.T) {
+	pid := PollerID{UserID: "@TestPollerRateLimitsUnknownSinceRestarts:localhost", DeviceID: "FOOBAR"}
+	defer func() { // reset the values after the test runs
+		timeSleep = time.Sleep
+		timeSince = time.Since
+	}()
+	timeSince = time.Since
+	var slept []time.Duration
+	timeSleep = func(d time.Duration) {
+		slept = append(slept, d)
+	}
+	var gotSinces []string
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		gotSinces = append(gotSinces, since)
+		switch len(gotSinces) {
+		case 1, 3:
+			return nil, 400, fmt.Errorf("DoSyncV2: response returned 400 Bad Request: %w", ErrUnknownSince)
+		case 2, 4:
+			return &SyncResponse{NextBatch: fmt.Sprintf("next%d", len(gotSinces))}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
+	poller.Poll("from_backup")
+
+	wantSinces := []string{"from_backup", "", "next2", "", "next4"}
+	if !reflect.DeepEqual(gotSinces, wantSinces) {
+		t.Errorf("got since tokens %v want %v", gotSinces, wantSinces)
+	}
+	// the first restart is immediate, the second waits
+	if len(slept) != 1 {
+		t.Fatalf("got %d sleeps want 1: %v", len(slept), slept)
+	}
+	if slept[0] <= 0 || slept[0] > unknownSinceRestartInterval {
+		t.Errorf("slept for %v, want up to %v", slept[0], unknownSinceRestartInterval)
+	}
+}
+
+// Test that the poller tells the receiver when the device was soft logged out.
+func TestPollerSoftLogout(t *testing.T) {
+	pid := PollerID{UserID: "@TestPollerSoftLogout:localhost", DeviceID: "FOOBAR"}
+	testCases := []struct {
+		err            error
+		wantSoftLogout bool
+	}{
+		{err: fmt.Errorf("DoSyncV2: response returned 401 Unauthorized: %w", HTTP401), wantSoftLogout: false},
+		{err: fmt.Errorf("DoSyncV2: response returned 401 Unauthorized: %w", HTTP401SoftLogout), wantSoftLogout: true},
+	}
+	for _, tc := range testCases {
+		accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+			return nil, 401, tc.err
+		})
+		var gotCalls int
+		var gotSoftLogout bool
+		accumulator.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+			if userID != pid.UserID || deviceID != pid.DeviceID {
+				t.Errorf("OnExpiredToken called for wrong device: %s %s", userID, deviceID)
+			}
+			gotCalls++
+			gotSoftLogout = softLogout
+		}
+		poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
+		poller.Poll("some_since_value")
+		if gotCalls != 1 {
+			t.Fatalf("%v: OnExpiredToken called %d times, want 1", tc.err, gotCalls)
+		}
+		if gotSoftLogout != tc.wantSoftLogout {
+			t.Errorf("%v: got soft logout %v want %v", tc.err, gotSoftLogout, tc.wantSoftLogout)
+		}
+	}
+}
+
+// Test that the poller reports when it is lagging behind the homeserver due to failing or slow
+// requests, and that this clears once it promptly processes a response.
+func TestPollerLagging(t *testing.T) {
+	pid := PollerID{UserID: "@TestPollerLagging:localhost", DeviceID: "FOOBAR"}
+	var elapsed time.Duration
+	defer func() { // reset the values after the test runs
+		timeSleep = time.Sleep
+		timeSince = time.Since
+	}()
+	timeSleep = func(d time.Duration) {}
+	timeSince = func(t time.Time) time.Duration {
+		return elapsed
+	}
+	numCalls := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numCalls++
+		switch numCalls {
+		case 1: // a brief outage isn't lag
+			return nil, 502, fmt.Errorf("bad gateway")
+		case 2: // but an outage going beyond the lag threshold is
+			elapsed = DefaultPollTimeout + PollerLagThreshold + time.Second
+			return nil, 502, fmt.Errorf("bad gateway")
+		case 3: // which clears when we get a prompt response
+			elapsed = 0
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		case 4: // a response which took too long is lag, even though the request succeeded
+			elapsed = DefaultPollTimeout + PollerLagThreshold + time.Second
+			return &SyncResponse{NextBatch: "2"}, 200, nil
+		case 5:
+			elapsed = 0
+			return &SyncResponse{NextBatch: "3"}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	var gotLagging []bool
+	accumulator.onPollerLagging = func(ctx context.Context, userID, deviceID string, lagging bool) {
+		if userID != pid.UserID || deviceID != pid.DeviceID {
+			t.Errorf("OnPollerLagging called for wrong device: %s %s", userID, deviceID)
+		}
+		gotLagging = append(gotLagging, lagging)
+	}
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
+	poller.Poll("")
+	wantLagging := []bool{true, false, true, false}
+	if !reflect.DeepEqual(gotLagging, wantLagging) {
+		t.Errorf("got lagging updates %v want %v", gotLagging, wantLagging)
+	}
+}
+
+// Test that the poller reports that it is lagging whilst a sync v2 request is hung, without waiting
+// for the request to return.
+func TestPollerLaggingWhilstRequestHangs(t *testing.T) {
+	pid := PollerID{UserID: "@TestPollerLaggingWhilstRequestHangs:localhost", DeviceID: "FOOBAR"}
+	defer func(threshold time.Duration) { // reset the values after the test runs
+		PollerLagThreshold = threshold
+		timeSince = time.Since
+	}(PollerLagThreshold)
+	PollerLagThreshold = 50 * time.Millisecond
+	timeSince = time.Since
+	laggingCh := make(chan bool, 10)
+	numCalls := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numCalls++
+		switch numCalls {
+		case 1: // the homeserver hangs until we report that we are lagging
+			select {
+			case lagging := <-laggingCh:
+				if !lagging {
+					t.Errorf("got lagging=false whilst request hung")
+				}
+			case <-time.After(time.Second):
+				t.Errorf("did not report lagging whilst request hung")
+			}
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		case 2: // then promptly responds
+			return &SyncResponse{NextBatch: "2"}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	accumulator.onPollerLagging = func(ctx context.Context, userID, deviceID string, lagging bool) {
+		laggingCh <- lagging
+	}
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, 0, DefaultPollTimelineLimit)
+	poller.Poll("")
+	select {
+	case lagging := <-laggingCh:
+		if lagging {
+			t.Errorf("got lagging=true after prompt response")
+		}
+	default:
+		t.Errorf("did not report no longer lagging after prompt response")
+	}
+}
+
+// Test that sync v2 HTTP outcomes are counted per homeserver.
+func TestPollerHTTPOutcomesPerHomeserver(t *testing.T) {
+	defer func() { // reset the value after the test runs
+		timeSleep = time.Sleep
+	}()
+	timeSleep = func(d time.Duration) {}
+	httpOutcomes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_http_outcomes",
+	}, []string{"homeserver", "outcome"})
+	responses := map[string][]struct {
+		code int
+		err  error
+	}{
+		"@alice:hs1": {
+			{code: 200},
+			{code: 502, err: fmt.Errorf("bad gateway")},
+			{code: 502, err: fmt.Errorf("bad gateway")},
+			{code: 0, err: fmt.Errorf("network error")},
+		},
+		"@bob:hs2": {
+			{code: 200},
+			{code: 200},
+			{code: 429, err: fmt.Errorf("too many requests")},
+		},
+	}
+	for userID, userResponses := range responses {
+		userResponses := userResponses
+		i := 0
+		accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+			if i >= len(userResponses) {
+				return nil, 401, fmt.Errorf("terminated")
+			}
+			res := userResponses[i]
+			i++
+			if res.err != nil {
+				return nil, res.code, res.err
+			}
+			return &SyncResponse{NextBatch: strconv.Itoa(i)}, res.code, nil
+		})
+		poller := newPoller(PollerID{UserID: userID, DeviceID: "FOOBAR"}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
+		poller.httpOutcomes = httpOutcomes
+		poller.Poll("")
+	}
+
+	testCases := []struct {
+		homeserver string
+		outcome    string
+		want       float64
+	}{
+		{homeserver: "hs1", outcome: "2xx", want: 1},
+		{homeserver: "hs1", outcome: "5xx", want: 2},
+		{homeserver: "hs1", outcome: "network", want: 1},
+		// the final 401 which terminates the poller
+		{homeserver: "hs1", outcome: "4xx", want: 1},
+		{homeserver: "hs2", outcome: "2xx", want: 2},
+		{homeserver: "hs2", outcome: "5xx", want: 0},
+		{homeserver: "hs2", outcome: "network", want: 0},
+		{homeserver: "hs2", outcome: "4xx", want: 2},
+	}
+	for _, tc := range testCases {
+		got := testutil.ToFloat64(httpOutcomes.WithLabelValues(tc.homeserver, tc.outcome))
+		if got != tc.want {
+			t.Errorf("homeserver %s outcome %s: got %v want %v", tc.homeserver, tc.outcome, got, tc.want)
+		}
+	}
+}
+
+// Test that the PollerMap registers a sync v2 request duration histogram which is tracked by status code.
+func TestPollerRequestDurationByStatusCode(t *testing.T) {
+	defer func() { // reset the values after the test runs
+		timeSleep = time.Sleep
+		timeSince = time.Since
+	}()
+	timeSleep = func(d time.Duration) {}
+	timeSince = func(t time.Time) time.Duration {
+		return 2 * time.Second
+	}
+	numCalls := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numCalls++
+		switch numCalls {
+		case 1:
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		case 2:
+			return nil, 502, fmt.Errorf("bad gateway")
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	terminated := make(chan struct{})
+	accumulator.onTerminated = func(ctx context.Context, pollerID PollerID) {
+		close(terminated)
+	}
+	registry := prometheus.NewRegistry()
+	pm := NewPollerMap(client, true, registry, DefaultPollTimeout, DefaultPollTimelineLimit, false, false)
+	pm.SetCallbacks(accumulator)
+	pm.EnsurePolling(PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}, "access_token", "", false, zerolog.New(os.Stderr))
+	select {
+	case <-terminated:
+	case <-time.After(time.Second):
+		t.Fatalf("poller did not terminate")
+	}
+
+	metricName := "sliding_sync_poller_sync_v2_request_duration_secs"
+	want := `
+# HELP sliding_sync_poller_sync_v2_request_duration_secs Time taken in seconds for sync v2 requests to return, by status code. The code is 0 if there was no response.
+# TYPE sliding_sync_poller_sync_v2_request_duration_secs histogram
+`
+	for _, code := range []string{"200", "401", "502"} {
+		initial := "0"
+		if code == "200" {
+			initial = "1"
+		}
+		labels := fmt.Sprintf(`code="%s",first="%s",initial="%s"`, code, initial, initial)
+		for _, le := range []string{"0.01", "0.05", "0.1", "0.5", "1"} {
+			want += fmt.Sprintf("%s_bucket{%s,le=\"%s\"} 0\n", metricName, labels, le)
+		}
+		for _, le := range []string{"5", "10", "30", "60", "120", "+Inf"} {
+			want += fmt.Sprintf("%s_bucket{%s,le=\"%s\"} 1\n", metricName, labels, le)
+		}
+		want += fmt.Sprintf("%s_sum{%s} 2\n", metricName, labels)
+		want += fmt.Sprintf("%s_count{%s} 1\n", metricName, labels)
+	}
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), metricName); err != nil {
+		t.Error(err)
+	}
+
+	// Terminate unregisters everything which was registered.
+	pm.Terminate()
+	if n, err := testutil.GatherAndCount(registry); err != nil || n != 0 {
+		t.Errorf("got %d metrics (err=%v) after Terminate, want 0", n, err)
+	}
+}
+
 // Regression test to make sure that if you start polling with an invalid token, we do end up unblocking WaitUntilInitialSync
 // and don't end up blocking forever.
 func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
@@ -610,7 +1147,7 @@ func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
 
 	pollUnblocked := make(chan struct{})
 	waitUntilInitialSyncUnblocked := make(chan struct{})
-	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
 	go func() {
 		poller.Poll("")
 		close(pollUnblocked)
@@ -907,7 +1444,7 @@ func TestPollerResendsOnCallbackError(t *testing.T) {
 			},
 		}
 		receiver := tc.generateReceiver()
-		poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false)
+		poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
 		waitForInitialSync(t, poller)
 		select {
 		case <-waitForStuckPolling:
@@ -979,7 +1516,7 @@ func TestPollerDoesNotResendOnDataError(t *testing.T) {
 			}, 200, nil
 		},
 	}
-	poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false, DefaultPollTimeout, DefaultPollTimelineLimit)
 	waitForInitialSync(t, poller)
 	select {
 	case <-waitForSuccess:
@@ -989,6 +1526,133 @@ func TestPollerDoesNotResendOnDataError(t *testing.T) {
 	poller.Terminate()
 }
 
+// batchingDataReceiver stages every write until the batch it was made in commits.
+type batchingDataReceiver struct {
+	*overrideDataReceiver
+	mu        *sync.Mutex
+	pending   []string
+	committed []string
+	since     string
+	batches   int
+}
+
+func (r *batchingDataReceiver) write(w string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = append(r.pending, w)
+}
+
+func (r *batchingDataReceiver) ProcessBatch(ctx context.Context, pollerID PollerID, since string, fn func(ctx context.Context) error) error {
+	err := fn(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches++
+	if err == nil {
+		r.committed = append(r.committed, r.pending...)
+		if since != "" {
+			r.since = since
+		}
+	}
+	r.pending = nil
+	return err
+}
+
+// Test that when batching is enabled, every write from a poll is committed together with the since
+// token, and that a failure part way through the poll commits none of them.
+func TestPollerMapBatchesWrites(t *testing.T) {
+	defer func() { // reset the value after the test runs
+		timeSleep = time.Sleep
+	}()
+	timeSleep = func(d time.Duration) {}
+	pid := PollerID{UserID: "@TestPollerMapBatchesWrites:localhost", DeviceID: "FOOBAR"}
+	receiver := &batchingDataReceiver{
+		mu: &sync.Mutex{},
+	}
+	failInvite := true
+	receiver.overrideDataReceiver = &overrideDataReceiver{
+		accumulate: func(ctx context.Context, userID, deviceID, roomID, prevBatch string, timeline []json.RawMessage) error {
+			receiver.write("accumulate " + roomID)
+			return nil
+		},
+		onInvite: func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
+			// invites are processed after joined rooms, so this fails after the timeline was written
+			if failInvite {
+				failInvite = false
+				return fmt.Errorf("onInvite error")
+			}
+			receiver.write("invite " + roomID)
+			return nil
+		},
+		addToDeviceMessages: func(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error {
+			receiver.write("to-device")
+			return nil
+		},
+		updateDeviceSince: func(ctx context.Context, userID, deviceID, since string) {
+			t.Errorf("UpdateDeviceSince called with %s, want the since token persisted with the batch", since)
+		},
+	}
+	var sinces []string
+	done := make(chan struct{})
+	client := &mockClient{
+		fn: func(authHeader, since string) (*SyncResponse, int, error) {
+			sinces = append(sinces, since)
+			switch since {
+			case initialSinceToken:
+				return &SyncResponse{
+					NextBatch: "1",
+					Rooms: SyncRoomsResponse{
+						Join: map[string]SyncV2JoinResponse{
+							"!join:localhost": {
+								Timeline: TimelineResponse{
+									Events: []json.RawMessage{
+										[]byte(`{"type":"m.room.message","content":{},"sender":"@alice:localhost","event_id":"$1"}`),
+									},
+								},
+							},
+						},
+						Invite: map[string]SyncV2InviteResponse{
+							"!invite:localhost": {},
+						},
+					},
+					ToDevice: EventsResponse{
+						Events: []json.RawMessage{
+							[]byte(`{"type":"m.room_key","content":{},"sender":"@alice:localhost"}`),
+						},
+					},
+				}, 200, nil
+			case "1":
+				close(done)
+			}
+			return nil, 401, fmt.Errorf("terminated")
+		},
+	}
+	pm := NewPollerMap(client, false, nil, DefaultPollTimeout, DefaultPollTimelineLimit, true, false)
+	pm.SetCallbacks(receiver)
+	go pm.EnsurePolling(pid, "access_token", initialSinceToken, false, zerolog.New(os.Stderr))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the poller to advance, polled with %v", sinces)
+	}
+	pm.Terminate()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if !reflect.DeepEqual(sinces, []string{initialSinceToken, initialSinceToken, "1"}) {
+		t.Errorf("got since tokens %v, want the first poll retried once", sinces)
+	}
+	if receiver.batches != 2 {
+		t.Errorf("got %d batches, want 2", receiver.batches)
+	}
+	wantCommitted := []string{"accumulate !join:localhost", "invite !invite:localhost", "to-device"}
+	if !reflect.DeepEqual(receiver.committed, wantCommitted) {
+		t.Errorf("got committed writes %v want %v", receiver.committed, wantCommitted)
+	}
+	if receiver.since != "1" {
+		t.Errorf("got committed since %q want %q", receiver.since, "1")
+	}
+}
+
 func waitForInitialSync(t *testing.T, poller *poller) {
 	go func() {
 		poller.Poll(initialSinceToken)
@@ -1011,9 +1675,15 @@ func waitForInitialSync(t *testing.T, poller *poller) {
 
 type mockClient struct {
 	fn func(authHeader, since string) (*SyncResponse, int, error)
+	// the timeouts passed to each DoSyncV2 call, in order
+	timeouts []time.Duration
+	// the timeline limits passed to each DoSyncV2 call, in order
+	timelineLimits []int
 }
 
-func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
+func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool, timeout time.Duration, timelineLimit int) (*SyncResponse, int, error) {
+	c.timeouts = append(c.timeouts, timeout)
+	c.timelineLimits = append(c.timelineLimits, timelineLimit)
 	return c.fn(authHeader, since)
 }
 func (c *mockClient) WhoAmI(authHeader string) (string, string, error) {
@@ -1065,11 +1735,13 @@ type overrideDataReceiver struct {
 	updateUnreadCounts  func(ctx context.Context, roomID, userID string, highlightCount, notifCount *int)
 	onAccountData       func(ctx context.Context, userID, roomID string, events []json.RawMessage) error
 	onReceipt           func(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
+	onPresence          func(ctx context.Context, userID string, events []json.RawMessage)
 	onInvite            func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error
 	onLeftRoom          func(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
 	onE2EEData          func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	onTerminated        func(ctx context.Context, pollerID PollerID)
-	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string)
+	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool)
+	onPollerLagging     func(ctx context.Context, userID, deviceID string, lagging bool)
 }
 
 func (s *overrideDataReceiver) Accumulate(ctx context.Context, userID, deviceID, roomID, prevBatch string, timeline []json.RawMessage) error {
@@ -1120,6 +1792,12 @@ func (s *overrideDataReceiver) OnReceipt(ctx context.Context, userID, roomID, ep
 	}
 	s.onReceipt(ctx, userID, roomID, ephEventType, ephEvent)
 }
+func (s *overrideDataReceiver) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	if s.onPresence == nil {
+		return
+	}
+	s.onPresence(ctx, userID, events)
+}
 func (s *overrideDataReceiver) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
 	if s.onInvite == nil {
 		return nil
@@ -1144,11 +1822,17 @@ func (s *overrideDataReceiver) OnTerminated(ctx context.Context, pollerID Poller
 	}
 	s.onTerminated(ctx, pollerID)
 }
-func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
+func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
 	if s.onExpiredToken == nil {
 		return
 	}
-	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID)
+	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID, softLogout)
+}
+func (s *overrideDataReceiver) OnPollerLagging(ctx context.Context, userID, deviceID string, lagging, fetchesRoomData bool) {
+	if s.onPollerLagging == nil {
+		return
+	}
+	s.onPollerLagging(ctx, userID, deviceID, lagging)
 }
 
 func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error)) (*mockDataReceiver, *mockClient) {
@@ -68,6 +68,10 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 type GlobalCache struct {
 	// LoadJoinedRoomsOverride allows tests to mock out the behaviour of LoadJoinedRooms.
 	LoadJoinedRoomsOverride func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, latestNIDs map[string]int64, err error)
+	// LoadRoomStateOverride allows tests to mock out the behaviour of LoadRoomState.
+	LoadRoomStateOverride func(roomIDs []string, requiredStateMap *internal.RequiredStateMap) map[string][]json.RawMessage
+	// LoadSenderMembershipsOverride allows tests to mock out the behaviour of LoadSenderMemberships.
+	LoadSenderMembershipsOverride func(eventIDs []string) map[string]json.RawMessage
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// there are lots of overlapping keys as many users (threads) can be joined to the same room (key)
@@ -187,8 +191,29 @@ func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPos
 	return nil
 }
 
+// LoadSenderMemberships returns the m.room.member event of the sender of each event as it was when the
+// event was sent, keyed by event ID. Events whose sender's membership is unknown are omitted.
+func (c *GlobalCache) LoadSenderMemberships(ctx context.Context, eventIDs []string) map[string]json.RawMessage {
+	if c.LoadSenderMembershipsOverride != nil {
+		return c.LoadSenderMembershipsOverride(eventIDs)
+	}
+	if c.store == nil || len(eventIDs) == 0 {
+		return nil
+	}
+	eventIDToMembership, err := c.store.SenderMembershipsAtEvents(ctx, eventIDs)
+	if err != nil {
+		logger.Err(err).Int("num_events", len(eventIDs)).Msg("failed to load sender memberships")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	return eventIDToMembership
+}
+
 // TODO: remove? Doesn't touch global cache fields
 func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadPosition int64, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
+	if c.LoadRoomStateOverride != nil {
+		return c.LoadRoomStateOverride(roomIDs, requiredStateMap)
+	}
 	if c.store == nil {
 		return nil
 	}
@@ -314,6 +339,16 @@ func (c *GlobalCache) OnNewEvent(
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			metadata.CanonicalAlias = ed.Content.Get("alias").Str
 		}
+	case "m.room.server_acl":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.ServerACL = internal.NewServerACL(ed.Content)
+		}
+	case "m.call.member":
+		if ed.StateKey != nil {
+			metadata.CallMemberships = internal.SetCallMembership(
+				metadata.CallMemberships, *ed.StateKey, ed.Sender, internal.IsActiveCallMembership(ed.Content),
+			)
+		}
 	case "m.room.create":
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			roomType := ed.Content.Get("type")
@@ -348,7 +383,7 @@ func (c *GlobalCache) OnNewEvent(
 
 				if membership == "join" && eventJSON.Get("unsigned.prev_content.membership").Str == "invite" {
 					// invite -> join, retire any outstanding invites
-					err := c.store.InvitesTable.RemoveInvite(*ed.StateKey, ed.RoomID)
+					err := c.store.InvitesTable.RemoveInvite(nil, *ed.StateKey, ed.RoomID)
 					if err != nil {
 						logger.Err(err).Str("user", *ed.StateKey).Str("room", ed.RoomID).Msg("failed to remove accepted invite")
 						internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -382,6 +417,7 @@ func (c *GlobalCache) OnNewEvent(
 	metadata.LatestEventsByType[ed.EventType] = internal.EventMetadata{
 		NID:       ed.NID,
 		Timestamp: ed.Timestamp,
+		Sender:    ed.Sender,
 	}
 	c.roomIDToMetadata[ed.RoomID] = metadata
 }
@@ -167,6 +167,17 @@ func TestGlobalCacheLoadState(t *testing.T) {
 				roomID2: {eventsRoom2[1]},
 			},
 		},
+		{
+			name: "using $ME for another user only returns their member event",
+			me:   bob,
+			requiredState: [][2]string{
+				{"m.room.member", sync3.StateKeyMe},
+			},
+			wantEvents: map[string][]json.RawMessage{
+				roomID:  {events[3]},
+				roomID2: {eventsRoom2[3]},
+			},
+		},
 		{
 			name: "using $ME ignores other member events",
 			me:   "@bogus-user:example.com",
@@ -1,6 +1,7 @@
 package caches
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -70,6 +71,16 @@ func (u *UnreadCountUpdate) Type() string {
 	return fmt.Sprintf("UnreadCountUpdate[%s]", u.RoomID())
 }
 
+// DMUpdate is emitted for each room which became or stopped being a DM because of a change to the
+// m.direct account data event.
+type DMUpdate struct {
+	RoomUpdate
+}
+
+func (u *DMUpdate) Type() string {
+	return fmt.Sprintf("DMUpdate[%s]", u.RoomID())
+}
+
 // AccountDataUpdate represents the (global) `account_data` section of a v2 sync response.
 type AccountDataUpdate struct {
 	AccountData []state.AccountData
@@ -89,6 +100,16 @@ func (u *RoomAccountDataUpdate) Type() string {
 	return fmt.Sprintf("RoomAccountDataUpdate[%s] len=%v", u.RoomID(), len(u.AccountData))
 }
 
+// PresenceUpdate represents a change to the presence of a user who shares a room with this user.
+type PresenceUpdate struct {
+	UserID string
+	Event  json.RawMessage
+}
+
+func (u *PresenceUpdate) Type() string {
+	return fmt.Sprintf("PresenceUpdate[%s]", u.UserID)
+}
+
 type DeviceDataUpdate struct {
 	// no data; just wakes up the connection
 	// data comes via sidechannels e.g the database
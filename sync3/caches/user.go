@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 
@@ -38,9 +40,14 @@ type UserRoomData struct {
 	IsDM              bool
 	IsInvite          bool
 	HasLeft           bool
+	IsMuted           bool // from a room-specific push rule in m.push_rules which never notifies
 	NotificationCount int
 	HighlightCount    int
 	Invite            *InviteData
+	// True if the user knocked on this room and was then refused by someone else
+	KnockDenied bool
+	// The event ID of the user's m.fully_read marker in this room, if any.
+	FullyReadEventID string
 
 	// this field is set by LazyLoadTimelines and is per-function call, and is not persisted in-memory.
 	// The zero value of this safe to use (0 latest nid, no prev batch, no timeline).
@@ -87,6 +94,10 @@ type InviteData struct {
 	Encrypted            bool
 	IsDM                 bool
 	RoomType             string
+	// True if this is a knock rather than an invite, i.e the user's membership is 'knock'
+	IsKnock bool
+	// For restricted rooms, the rooms whose members are allowed to join without an invite
+	AllowedRoomIDs []string
 }
 
 func NewInviteData(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) *InviteData {
@@ -103,18 +114,19 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 			target := j.Get("state_key").Str
 			if userID == target {
 				// this is our invite event; grab the timestamp
-				ts := j.Get("origin_server_ts").Int()
-				id.LastMessageTimestamp = uint64(ts)
+				ts := internal.RecencyTimestamp(j.Get("origin_server_ts").Uint(), time.Now())
+				id.LastMessageTimestamp = ts
 				id.InviteEvent = &EventData{
 					Event:         ev,
 					RoomID:        roomID,
 					EventType:     "m.room.member",
 					StateKey:      &target,
 					Content:       j.Get("content"),
-					Timestamp:     uint64(ts),
+					Timestamp:     ts,
 					AlwaysProcess: true,
 				}
 				id.IsDM = j.Get("is_direct").Bool()
+				id.IsKnock = j.Get("content.membership").Str == "knock"
 			} else if target == j.Get("sender").Str {
 				id.Heroes = append(id.Heroes, internal.Hero{
 					ID:     target,
@@ -132,6 +144,16 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 			id.Encrypted = true
 		case "m.room.create":
 			id.RoomType = j.Get("content.type").Str
+		case "m.room.join_rules":
+			joinRule := j.Get("content.join_rule").Str
+			if joinRule != "restricted" && joinRule != "knock_restricted" {
+				break
+			}
+			for _, allow := range j.Get("content.allow").Array() {
+				if allow.Get("type").Str == "m.room_membership" && allow.Get("room_id").Str != "" {
+					id.AllowedRoomIDs = append(id.AllowedRoomIDs, allow.Get("room_id").Str)
+				}
+			}
 		}
 	}
 	if id.InviteEvent == nil {
@@ -335,6 +357,54 @@ func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomID
 	return result
 }
 
+// TrimTimelineToUnread removes events up to and including the user's m.fully_read marker from the
+// requested timeline in urd, so only unread events remain. The prev_batch is updated so clients can
+// paginate back to the read events. The timeline is unaltered if there is no marker, or if the marker
+// is not in the timeline.
+func (c *UserCache) TrimTimelineToUnread(ctx context.Context, roomID string, urd *UserRoomData) {
+	if urd.FullyReadEventID == "" || !urd.RequestedLatestEvents.TrimToAfter(urd.FullyReadEventID) {
+		return
+	}
+	if c.store == nil {
+		return
+	}
+	// paginate from the earliest unread event, or from the marker if everything has been read
+	fromEventID := urd.FullyReadEventID
+	if len(urd.RequestedLatestEvents.Timeline) > 0 {
+		fromEventID = gjson.GetBytes(urd.RequestedLatestEvents.Timeline[0], "event_id").Str
+	}
+	prevBatch, err := c.store.EventsTable.SelectClosestPrevBatchByID(roomID, fromEventID)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Str("event", fromEventID).Msg("failed to select prev_batch for unread timeline")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	urd.RequestedLatestEvents.PrevBatch = prevBatch
+}
+
+// LoadTimelineAroundEvent replaces the requested timeline in urd with up to limit events either side
+// of the given event. Returns false and leaves the timeline unaltered if the event is not stored or
+// is not visible to the user.
+func (c *UserCache) LoadTimelineAroundEvent(ctx context.Context, loadPos int64, roomID, eventID string, limit int, urd *UserRoomData) bool {
+	if c.store == nil {
+		return false
+	}
+	latestEvents, err := c.store.EventsAroundEvent(c.UserID, roomID, eventID, loadPos, limit)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Str("event", eventID).Msg("failed to load events around event")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return false
+	}
+	if latestEvents == nil {
+		return false
+	}
+	latestEvents.DiscardIgnoredMessages(c.ShouldIgnore)
+	// keep the load position at the latest event, as newer events are not sent live
+	latestEvents.LatestNID = urd.RequestedLatestEvents.LatestNID
+	urd.RequestedLatestEvents = *latestEvents
+	return true
+}
+
 func (c *UserCache) LoadRoomData(roomID string) UserRoomData {
 	c.roomToDataMu.RLock()
 	defer c.roomToDataMu.RUnlock()
@@ -485,6 +555,13 @@ func (c *UserCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	})
 }
 
+func (c *UserCache) OnPresence(ctx context.Context, userID string, presenceEvent json.RawMessage) {
+	c.emitOnUpdate(ctx, &PresenceUpdate{
+		UserID: userID,
+		Event:  presenceEvent,
+	})
+}
+
 func (c *UserCache) emitOnRoomUpdate(ctx context.Context, update RoomUpdate) {
 	c.listenersMu.RLock()
 	var listeners []UserCacheListener
@@ -564,6 +641,10 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 			urd.HighlightCount = 0
 		}
 	}
+	if eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID &&
+		eventData.Content.Get("membership").Str == "join" {
+		urd.KnockDenied = false
+	}
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
 		childRoomID := *eventData.StateKey
@@ -591,7 +672,12 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 	urd := c.LoadRoomData(roomID)
 	urd.IsInvite = true
 	urd.HasLeft = false
+	urd.KnockDenied = false
 	urd.HighlightCount = InvitesAreHighlightsValue
+	if inviteData.IsKnock {
+		// the user is waiting on others, so there is nothing for them to act on
+		urd.HighlightCount = 0
+	}
 	urd.IsDM = inviteData.IsDM
 	urd.Invite = inviteData
 	c.roomToDataMu.Lock()
@@ -612,7 +698,12 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 }
 
 func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent json.RawMessage) {
+	ev := gjson.ParseBytes(leaveEvent)
+	stateKey := ev.Get("state_key").Str
+
 	urd := c.LoadRoomData(roomID)
+	// someone else removing our knock means it was refused. Retracting it ourselves is not a refusal.
+	urd.KnockDenied = urd.Invite != nil && urd.Invite.IsKnock && ev.Get("sender").Str != c.UserID
 	urd.IsInvite = false
 	urd.HasLeft = true
 	urd.Invite = nil
@@ -621,9 +712,6 @@ func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent js
 	c.roomToData[roomID] = urd
 	c.roomToDataMu.Unlock()
 
-	ev := gjson.ParseBytes(leaveEvent)
-	stateKey := ev.Get("state_key").Str
-
 	up := &RoomEventUpdate{
 		RoomUpdate: &roomUpdateCache{
 			roomID: roomID,
@@ -638,7 +726,7 @@ func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent js
 			EventType: ev.Get("type").Str,
 			StateKey:  &stateKey,
 			Content:   ev.Get("content"),
-			Timestamp: ev.Get("origin_server_ts").Uint(),
+			Timestamp: internal.RecencyTimestamp(ev.Get("origin_server_ts").Uint(), time.Now()),
 			Sender:    ev.Get("sender").Str,
 			// if this is an invite rejection we need to make sure we tell the client, and not
 			// skip it because of the lack of a NID (this event may not be in the events table)
@@ -652,6 +740,8 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 	roomUpdates := make(map[string][]state.AccountData)
 	// room_id -> tag_id -> order
 	tagUpdates := make(map[string]map[string]float64)
+	// rooms which became or stopped being DMs
+	var dmChangedRoomIDs []string
 	for _, d := range datas {
 		up := roomUpdates[d.RoomID]
 		up = append(up, d)
@@ -671,6 +761,9 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 			c.roomToDataMu.Lock()
 			for roomID, urd := range c.roomToData {
 				_, exists := dmRoomSet[roomID]
+				if urd.IsDM != exists {
+					dmChangedRoomIDs = append(dmChangedRoomIDs, roomID)
+				}
 				urd.IsDM = exists
 				c.roomToData[roomID] = urd
 				delete(dmRoomSet, roomID)
@@ -680,6 +773,7 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				u := NewUserRoomData()
 				u.IsDM = true
 				c.roomToData[dmRoomID] = u
+				dmChangedRoomIDs = append(dmChangedRoomIDs, dmRoomID)
 			}
 			c.roomToDataMu.Unlock()
 		case "m.tag":
@@ -691,6 +785,38 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				tagUpdates[d.RoomID][k.Str] = v.Get("order").Float()
 				return true
 			})
+		case "m.fully_read":
+			if d.RoomID == state.AccountDataGlobalRoom {
+				continue
+			}
+			c.roomToDataMu.Lock()
+			urd, ok := c.roomToData[d.RoomID]
+			if !ok {
+				urd = NewUserRoomData()
+			}
+			urd.FullyReadEventID = gjson.GetBytes(d.Data, "content.event_id").Str
+			c.roomToData[d.RoomID] = urd
+			c.roomToDataMu.Unlock()
+		case "m.push_rules":
+			if d.RoomID != state.AccountDataGlobalRoom {
+				continue
+			}
+			mutedRoomSet := mutedRoomsFromPushRules(gjson.ParseBytes(d.Data).Get("content"))
+			// this event REPLACES all push rules so reset the mute state on all rooms then update
+			c.roomToDataMu.Lock()
+			for roomID, urd := range c.roomToData {
+				_, exists := mutedRoomSet[roomID]
+				urd.IsMuted = exists
+				c.roomToData[roomID] = urd
+				delete(mutedRoomSet, roomID)
+			}
+			// remaining stuff in mutedRoomSet are new rooms the cache is unaware of
+			for mutedRoomID := range mutedRoomSet {
+				u := NewUserRoomData()
+				u.IsMuted = true
+				c.roomToData[mutedRoomID] = u
+			}
+			c.roomToDataMu.Unlock()
 		case "m.ignored_user_list":
 			if d.RoomID != state.AccountDataGlobalRoom {
 				continue
@@ -737,7 +863,46 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 			c.emitOnRoomUpdate(ctx, roomUpdate)
 		}
 	}
+	// tell connections about rooms which changed DM status, so they can update their lists
+	sort.Strings(dmChangedRoomIDs)
+	for _, roomID := range dmChangedRoomIDs {
+		c.emitOnRoomUpdate(ctx, &DMUpdate{
+			RoomUpdate: c.newRoomUpdate(ctx, roomID),
+		})
+	}
+}
 
+// mutedRoomsFromPushRules returns the set of room IDs which are muted according to the content of
+// an m.push_rules event. A room is muted if there is an enabled override rule which only matches
+// that room and does not notify. This is what clients create when a user mutes a room.
+func mutedRoomsFromPushRules(content gjson.Result) map[string]struct{} {
+	muted := make(map[string]struct{})
+	for _, rule := range content.Get("global.override").Array() {
+		enabled := rule.Get("enabled")
+		if enabled.Exists() && !enabled.Bool() {
+			continue
+		}
+		conditions := rule.Get("conditions").Array()
+		if len(conditions) != 1 {
+			continue
+		}
+		cond := conditions[0]
+		if cond.Get("kind").Str != "event_match" || cond.Get("key").Str != "room_id" {
+			continue
+		}
+		notifies := false
+		for _, action := range rule.Get("actions").Array() {
+			if action.Str == "notify" || action.Get("set_tweak").Exists() {
+				notifies = true
+				break
+			}
+		}
+		if notifies {
+			continue
+		}
+		muted[cond.Get("pattern").Str] = struct{}{}
+	}
+	return muted
 }
 
 func (u *UserCache) ShouldIgnore(userID string) bool {
@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
@@ -123,3 +124,78 @@ func convertIDTxnToEventStub(sender string, roomToEventIDs map[string][][2]strin
 	}
 	return result
 }
+
+func TestUserCacheMutedRooms(t *testing.T) {
+	userID := "@alice:localhost"
+	mutedRoomID := "!muted:localhost"
+	mentionsOnlyRoomID := "!mentions-only:localhost"
+	disabledRoomID := "!disabled:localhost"
+	uc := caches.NewUserCache(userID, nil, nil, &txnIDFetcher{})
+	pushRules := func(mutedRooms ...string) state.AccountData {
+		override := []map[string]interface{}{
+			{
+				"rule_id": ".m.rule.master",
+				"default": true,
+				"enabled": false,
+				"actions": []interface{}{},
+			},
+			{
+				"rule_id": disabledRoomID,
+				"enabled": false,
+				"actions": []interface{}{},
+				"conditions": []map[string]interface{}{
+					{"kind": "event_match", "key": "room_id", "pattern": disabledRoomID},
+				},
+			},
+		}
+		for _, roomID := range mutedRooms {
+			override = append(override, map[string]interface{}{
+				"rule_id": roomID,
+				"enabled": true,
+				"actions": []interface{}{"dont_notify"},
+				"conditions": []map[string]interface{}{
+					{"kind": "event_match", "key": "room_id", "pattern": roomID},
+				},
+			})
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"type": "m.push_rules",
+			"content": map[string]interface{}{
+				"global": map[string]interface{}{
+					"override": override,
+					"room": []map[string]interface{}{
+						{
+							"rule_id": mentionsOnlyRoomID,
+							"enabled": true,
+							"actions": []interface{}{"dont_notify"},
+						},
+					},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal push rules: %s", err)
+		}
+		return state.AccountData{
+			UserID: userID,
+			RoomID: state.AccountDataGlobalRoom,
+			Type:   "m.push_rules",
+			Data:   data,
+		}
+	}
+	assertMuted := func(roomID string, want bool) {
+		t.Helper()
+		if got := uc.LoadRoomData(roomID).IsMuted; got != want {
+			t.Errorf("room %s: got IsMuted=%v want %v", roomID, got, want)
+		}
+	}
+
+	uc.OnAccountData(context.Background(), []state.AccountData{pushRules(mutedRoomID)})
+	assertMuted(mutedRoomID, true)
+	assertMuted(mentionsOnlyRoomID, false)
+	assertMuted(disabledRoomID, false)
+
+	// the push rules event replaces the previous one, so unmuting works
+	uc.OnAccountData(context.Background(), []state.AccountData{pushRules()})
+	assertMuted(mutedRoomID, false)
+}
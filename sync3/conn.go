@@ -57,6 +57,8 @@ type Conn struct {
 	// - Everything after that is new and unseen, and the first element is the one we want to return.
 	serverResponses []Response
 	lastPos         int64
+	// called with the position of each new response whilst the connection is locked, if set
+	onResponse func(pos int64)
 
 	// ensure only 1 incoming request is handled per connection
 	mu                         *sync.Mutex
@@ -73,6 +75,23 @@ func NewConn(connID ConnID, h ConnHandler) *Conn {
 	}
 }
 
+// ResumeAt continues this new connection from pos, as if pos was the last response sent to the
+// client. This lets clients keep using their pos with a connection recreated after a restart.
+func (c *Conn) ResumeAt(pos int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serverResponses = []Response{{Pos: fmt.Sprintf("%d", pos)}}
+	c.lastPos = pos
+}
+
+// SetOnResponse sets a function which is called with the position of each new response, before
+// the response is returned. Requests on this connection are blocked whilst it runs.
+func (c *Conn) SetOnResponse(fn func(pos int64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onResponse = fn
+}
+
 func (c *Conn) Alive() bool {
 	return c.handler.Alive()
 }
@@ -156,9 +175,14 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	// if there is a position and it isn't something we've told the client nor a retransmit, they
 	// are playing games
 	if !isFirstRequest && !isRetransmit && !c.isOutstanding(req.pos) {
-		// the client made up a position, reject them
+		// positions are sequential, so anything up to the last position we sent has been told to the
+		// client and since acknowledged; anything else was made up
+		if req.pos > 0 && req.pos < c.lastPos {
+			logger.Trace().Int64("pos", req.pos).Int64("last_pos", c.lastPos).Msg("stale pos")
+			return nil, internal.ExpiredSessionError(internal.ResetReasonStalePos)
+		}
 		logger.Trace().Int64("pos", req.pos).Msg("unknown pos")
-		return nil, internal.ExpiredSessionError()
+		return nil, internal.ExpiredSessionError(internal.ResetReasonUnknownPos)
 	}
 
 	// purge the response buffer based on the client's new position. Higher pos values are later.
@@ -238,6 +262,9 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	// buffer it
 	c.serverResponses = append(c.serverResponses, *resp)
 	c.lastPos = resp.PosInt()
+	if c.onResponse != nil {
+		c.onResponse(c.lastPos)
+	}
 	if nextUnACKedResponse == nil {
 		nextUnACKedResponse = resp
 	}
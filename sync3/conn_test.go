@@ -244,6 +244,52 @@ func TestConnErrors(t *testing.T) {
 	}
 }
 
+// Test that using a position which was never sent on this connection resets the connection.
+func TestConnUnknownPos(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		return &Response{}, nil
+	}})
+	resp, herr := c.OnIncomingRequest(ctx, &Request{}, time.Now())
+	assertNoError(t, herr)
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: resp.PosInt() + 100}, time.Now())
+	if herr == nil {
+		t.Fatalf("expected error for unknown pos, got none")
+	}
+	if herr.ErrCode != "M_UNKNOWN_POS" || herr.ResetReason != internal.ResetReasonUnknownPos {
+		t.Fatalf("got errcode %q reset_reason %q, want M_UNKNOWN_POS %q", herr.ErrCode, herr.ResetReason, internal.ResetReasonUnknownPos)
+	}
+}
+
+// Test that using a position which was sent on this connection but has since been acknowledged
+// resets the connection, distinctly from positions which were never sent.
+func TestConnStalePos(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		return &Response{}, nil
+	}})
+	resp1, herr := c.OnIncomingRequest(ctx, &Request{}, time.Now())
+	assertNoError(t, herr)
+	resp2, herr := c.OnIncomingRequest(ctx, &Request{pos: resp1.PosInt()}, time.Now())
+	assertNoError(t, herr)
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: resp2.PosInt()}, time.Now())
+	assertNoError(t, herr)
+	// resp1 has now been acknowledged twice over
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: resp1.PosInt()}, time.Now())
+	if herr == nil {
+		t.Fatalf("expected error for stale pos, got none")
+	}
+	if herr.ErrCode != "M_UNKNOWN_POS" || herr.ResetReason != internal.ResetReasonStalePos {
+		t.Fatalf("got errcode %q reset_reason %q, want M_UNKNOWN_POS %q", herr.ErrCode, herr.ResetReason, internal.ResetReasonStalePos)
+	}
+}
+
 func TestConnErrorsNoCache(t *testing.T) {
 	ctx := context.Background()
 	connID := ConnID{
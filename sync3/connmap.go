@@ -5,16 +5,43 @@ import (
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// how long we remember why a connection was closed, so we can tell clients why their connection was reset.
+var closedConnReasonTTL = 24 * time.Hour
+
+// DefaultConnTTL is how long a connection can go without being used before it is reaped.
+const DefaultConnTTL = 30 * time.Minute
+
+// the longest time between sweeps for idle connections.
+var maxReapInterval = time.Minute
+
+// the window over which new connections are counted when rate limiting connection creation.
+const newConnWindow = time.Minute
+
 // ConnMap stores a collection of Conns.
 type ConnMap struct {
 	cache *ttlcache.Cache
+	// map of conn ID to the reason the connection was closed, for recently closed connections.
+	closedConnReasons *ttlcache.Cache
 
 	// map of user_id to active connections. Inspect the ConnID to find the device ID.
 	userIDToConn map[string][]*Conn
 	connIDToConn map[string]*Conn
+	// map of conn ID to the last time the client used the connection.
+	connIDToLastUsed map[string]time.Time
+
+	// how long a connection can go unused before it is reaped.
+	connTTL time.Duration
+	// the maximum number of connections a user can create per newConnWindow, or 0 for no limit.
+	maxNewConnsPerUser int
+	// map of user_id to the times the user created connections within the last newConnWindow, oldest first.
+	userIDToConnCreations map[string][]time.Time
+	// returns the current time. Replaced in tests to advance time.
+	now        func() time.Time
+	reaperStop chan struct{}
 
 	numConns prometheus.Gauge
 	// counters for reasons why connections have expired
@@ -24,15 +51,29 @@ type ConnMap struct {
 	mu *sync.Mutex
 }
 
-func NewConnMap(enablePrometheus bool) *ConnMap {
+// NewConnMap makes a new ConnMap. Connections which are not used for connTTL are reaped. If connTTL
+// is 0, DefaultConnTTL is used. Each user can create at most maxNewConnsPerMinute connections a
+// minute, or any number if 0.
+func NewConnMap(enablePrometheus bool, connTTL time.Duration, maxNewConnsPerMinute int) *ConnMap {
+	if connTTL <= 0 {
+		connTTL = DefaultConnTTL
+	}
 	cm := &ConnMap{
-		userIDToConn: make(map[string][]*Conn),
-		connIDToConn: make(map[string]*Conn),
-		cache:        ttlcache.NewCache(),
-		mu:           &sync.Mutex{},
+		userIDToConn:      make(map[string][]*Conn),
+		connIDToConn:      make(map[string]*Conn),
+		connIDToLastUsed:  make(map[string]time.Time),
+		cache:             ttlcache.NewCache(),
+		closedConnReasons: ttlcache.NewCache(),
+		connTTL:           connTTL,
+		now:               time.Now,
+		reaperStop:        make(chan struct{}),
+		mu:                &sync.Mutex{},
+
+		maxNewConnsPerUser:    maxNewConnsPerMinute,
+		userIDToConnCreations: make(map[string][]time.Time),
 	}
-	cm.cache.SetTTL(30 * time.Minute) // TODO: customisable
-	cm.cache.SetExpirationCallback(cm.closeConnExpires)
+	cm.cache.SetExpirationReasonCallback(cm.closeConnExpires)
+	cm.closedConnReasons.SetTTL(closedConnReasonTTL)
 
 	if enablePrometheus {
 		cm.expiryTimedOutCounter = prometheus.NewCounter(prometheus.CounterOpts{
@@ -57,11 +98,14 @@ func NewConnMap(enablePrometheus bool) *ConnMap {
 		})
 		prometheus.MustRegister(cm.numConns)
 	}
+	go cm.reaper()
 	return cm
 }
 
 func (m *ConnMap) Teardown() {
+	close(m.reaperStop)
 	m.cache.Close()
+	m.closedConnReasons.Close()
 
 	if m.numConns != nil {
 		prometheus.Unregister(m.numConns)
@@ -90,12 +134,15 @@ func (m *ConnMap) updateMetrics(numConns int) {
 	m.numConns.Set(float64(numConns))
 }
 
-// Conns return all connections for this user|device
+// Conns return all connections for this user|device. This does not count as using the connections,
+// so does not stop them from being reaped.
 func (m *ConnMap) Conns(userID, deviceID string) []*Conn {
 	connIDs := m.connIDsForDevice(userID, deviceID)
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	var conns []*Conn
 	for _, connID := range connIDs {
-		c := m.Conn(connID)
+		c := m.getConn(connID)
 		if c != nil {
 			conns = append(conns, c)
 		}
@@ -103,11 +150,15 @@ func (m *ConnMap) Conns(userID, deviceID string) []*Conn {
 	return conns
 }
 
-// Conn returns a connection with this ConnID. Returns nil if no connection exists.
+// Conn returns a connection with this ConnID, marking it as used. Returns nil if no connection exists.
 func (m *ConnMap) Conn(cid ConnID) *Conn {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.getConn(cid)
+	conn := m.getConn(cid)
+	if conn != nil {
+		m.connIDToLastUsed[cid.String()] = m.now()
+	}
+	return conn
 }
 
 // getConn returns a connection with this ConnID. Returns nil if no connection exists. Expires connections if the buffer is full.
@@ -123,6 +174,7 @@ func (m *ConnMap) getConn(cid ConnID) *Conn {
 	}
 	// e.g buffer exceeded, close it and remove it from the cache
 	logger.Info().Str("conn", cid.String()).Msg("closing connection due to dead connection (buffer full)")
+	m.closedConnReasons.Set(cid.String(), internal.ResetReasonEvictedForMemory)
 	m.closeConn(conn)
 	if m.expiryBufferFullCounter != nil {
 		m.expiryBufferFullCounter.Inc()
@@ -130,6 +182,46 @@ func (m *ConnMap) getConn(cid ConnID) *Conn {
 	return nil
 }
 
+// AllowNewConn returns true if this user may create a new connection. Users who create connections
+// too quickly e.g due to a buggy reconnect loop are told to wait for retryAfter, which avoids the cost
+// of repeated initial syncs. Existing connections are unaffected. Call RecordNewConn once the
+// connection is made.
+func (m *ConnMap) AllowNewConn(userID string) (retryAfter time.Duration, ok bool) {
+	if m.maxNewConnsPerUser <= 0 {
+		return 0, true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	creations := pruneConnCreations(m.userIDToConnCreations[userID], now)
+	m.userIDToConnCreations[userID] = creations
+	if len(creations) >= m.maxNewConnsPerUser {
+		// wait until the oldest creation leaves the window
+		return creations[0].Add(newConnWindow).Sub(now), false
+	}
+	return 0, true
+}
+
+// RecordNewConn records that this user created a new connection, counting towards AllowNewConn.
+func (m *ConnMap) RecordNewConn(userID string) {
+	if m.maxNewConnsPerUser <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.userIDToConnCreations[userID] = append(pruneConnCreations(m.userIDToConnCreations[userID], now), now)
+}
+
+// pruneConnCreations removes connection creation times which are no longer in the window.
+func pruneConnCreations(creations []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(creations) && now.Sub(creations[i]) >= newConnWindow {
+		i++
+	}
+	return creations[i:]
+}
+
 // Atomically gets or creates a connection with this connection ID. Calls newConn if a new connection is required.
 func (m *ConnMap) CreateConn(cid ConnID, newConnHandler func() ConnHandler) (*Conn, bool) {
 	// atomically check if a conn exists already and nuke it if it exists
@@ -150,22 +242,79 @@ func (m *ConnMap) CreateConn(cid ConnID, newConnHandler func() ConnHandler) (*Co
 	}
 	h := newConnHandler()
 	conn = NewConn(cid, h)
+	m.closedConnReasons.Remove(cid.String())
 	m.cache.Set(cid.String(), conn)
 	m.connIDToConn[cid.String()] = conn
+	m.connIDToLastUsed[cid.String()] = m.now()
 	m.userIDToConn[cid.UserID] = append(m.userIDToConn[cid.UserID], conn)
 	m.updateMetrics(len(m.connIDToConn))
 	return conn, true
 }
 
-func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) {
+func (m *ConnMap) CloseConnsForDevice(userID, deviceID, resetReason string) {
 	logger.Trace().Str("user", userID).Str("device", deviceID).Msg("closing connections due to CloseConn()")
 	// gather open connections for this user|device
 	connIDs := m.connIDsForDevice(userID, deviceID)
 	for _, cid := range connIDs {
+		m.closedConnReasons.Set(cid.String(), resetReason)
 		m.cache.Remove(cid.String()) // this will fire TTL callbacks which calls closeConn
 	}
 }
 
+// ResetReason returns why the connection with this ConnID no longer exists, as one of the
+// internal.ResetReason constants. If we have no record of the connection, we assume the server
+// restarted.
+func (m *ConnMap) ResetReason(cid ConnID) string {
+	reason, err := m.closedConnReasons.Get(cid.String())
+	if err != nil {
+		return internal.ResetReasonServerRestart
+	}
+	return reason.(string)
+}
+
+// reaper periodically reaps idle connections until the ConnMap is torn down.
+func (m *ConnMap) reaper() {
+	interval := m.connTTL / 2
+	if interval > maxReapInterval {
+		interval = maxReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.reaperStop:
+			return
+		case <-ticker.C:
+			m.reapIdleConns()
+		}
+	}
+}
+
+// reapIdleConns closes all connections which have not been used for connTTL. Clients which return
+// with the pos of a reaped connection are told their connection expired.
+func (m *ConnMap) reapIdleConns() {
+	// Hold mu whilst removing conns so a conn which is used concurrently is either marked as used
+	// before we check it, or fails to be found by Conn() after we remove it. Removing from the cache
+	// fires the expiry callback in a new goroutine, so it is safe to do whilst holding mu.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for connID, lastUsed := range m.connIDToLastUsed {
+		if now.Sub(lastUsed) <= m.connTTL {
+			continue
+		}
+		logger.Info().Str("conn", connID).Msg("reaping idle connection")
+		m.closedConnReasons.Set(connID, internal.ResetReasonExpired)
+		m.cache.Remove(connID) // this will fire TTL callbacks which calls closeConn
+	}
+	// forget users who haven't created connections recently
+	for userID, creations := range m.userIDToConnCreations {
+		if len(pruneConnCreations(creations, now)) == 0 {
+			delete(m.userIDToConnCreations, userID)
+		}
+	}
+}
+
 func (m *ConnMap) connIDsForDevice(userID, deviceID string) []ConnID {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -179,11 +328,11 @@ func (m *ConnMap) connIDsForDevice(userID, deviceID string) []ConnID {
 	return connIDs
 }
 
-func (m *ConnMap) closeConnExpires(connID string, value interface{}) {
+func (m *ConnMap) closeConnExpires(connID string, reason ttlcache.EvictionReason, value interface{}) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	conn := value.(*Conn)
-	logger.Info().Str("conn", connID).Msg("closing connection due to expired TTL in cache")
+	logger.Info().Str("conn", connID).Msg("closing connection due to removal from cache")
 	if m.expiryTimedOutCounter != nil {
 		m.expiryTimedOutCounter.Inc()
 	}
@@ -200,6 +349,7 @@ func (m *ConnMap) closeConn(conn *Conn) {
 	logger.Trace().Str("conn", connKey).Msg("closing connection")
 	// remove conn from all the maps
 	delete(m.connIDToConn, connKey)
+	delete(m.connIDToLastUsed, connKey)
 	h := conn.handler
 	conns := m.userIDToConn[conn.UserID]
 	for i := 0; i < len(conns); i++ {
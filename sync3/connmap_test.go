@@ -0,0 +1,211 @@
+package sync3
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+type aliveConnHandler struct {
+	alive bool
+}
+
+func (c *aliveConnHandler) OnIncomingRequest(ctx context.Context, cid ConnID, req *Request, init bool, start time.Time) (*Response, error) {
+	return &Response{}, nil
+}
+func (c *aliveConnHandler) UserID() string                                     { return "dummy" }
+func (c *aliveConnHandler) Destroy()                                           {}
+func (c *aliveConnHandler) Alive() bool                                        { return c.alive }
+func (c *aliveConnHandler) OnUpdate(ctx context.Context, update caches.Update) {}
+func (c *aliveConnHandler) PublishEventsUpTo(roomID string, nid int64)         {}
+
+// Test that the ConnMap remembers why each connection was closed.
+func TestConnMapResetReason(t *testing.T) {
+	cm := NewConnMap(false, time.Hour, 0)
+	defer cm.Teardown()
+
+	// connections we have never seen are assumed to have been lost in a restart
+	neverSeen := ConnID{UserID: "@alice:localhost", DeviceID: "NEVER_SEEN"}
+	assertResetReason(t, cm, neverSeen, internal.ResetReasonServerRestart)
+
+	// connections which buffer too many updates are evicted
+	evicted := ConnID{UserID: "@alice:localhost", DeviceID: "EVICTED"}
+	handler := &aliveConnHandler{alive: true}
+	cm.CreateConn(evicted, func() ConnHandler { return handler })
+	handler.alive = false
+	if conn := cm.Conn(evicted); conn != nil {
+		t.Fatalf("got conn for dead connection, want nil")
+	}
+	assertResetReason(t, cm, evicted, internal.ResetReasonEvictedForMemory)
+
+	// connections are closed when the device's token expires
+	tokenExpired := ConnID{UserID: "@alice:localhost", DeviceID: "TOKEN_EXPIRED"}
+	cm.CreateConn(tokenExpired, func() ConnHandler { return &aliveConnHandler{alive: true} })
+	cm.CloseConnsForDevice(tokenExpired.UserID, tokenExpired.DeviceID, internal.ResetReasonTokenExpired)
+	assertResetReason(t, cm, tokenExpired, internal.ResetReasonTokenExpired)
+	softLogout := ConnID{UserID: "@alice:localhost", DeviceID: "SOFT_LOGOUT"}
+	cm.CreateConn(softLogout, func() ConnHandler { return &aliveConnHandler{alive: true} })
+	cm.CloseConnsForDevice(softLogout.UserID, softLogout.DeviceID, internal.ResetReasonSoftLogout)
+	assertResetReason(t, cm, softLogout, internal.ResetReasonSoftLogout)
+
+	// recreating the connection forgets why the previous one was closed
+	cm.CreateConn(tokenExpired, func() ConnHandler { return &aliveConnHandler{alive: true} })
+	assertResetReason(t, cm, tokenExpired, internal.ResetReasonServerRestart)
+
+	// unused connections expire
+	now := time.Now()
+	cm.now = func() time.Time { return now }
+	expired := ConnID{UserID: "@alice:localhost", DeviceID: "EXPIRED"}
+	cm.CreateConn(expired, func() ConnHandler { return &aliveConnHandler{alive: true} })
+	now = now.Add(2 * time.Hour)
+	cm.reapIdleConns()
+	assertResetReason(t, cm, expired, internal.ResetReasonExpired)
+	if conn := cm.Conn(expired); conn != nil {
+		t.Fatalf("got conn for expired connection, want nil")
+	}
+}
+
+// Test that connections are only reaped once they have been idle for longer than the TTL.
+func TestConnMapReapsIdleConns(t *testing.T) {
+	ttl := 10 * time.Minute
+	cm := NewConnMap(false, ttl, 0)
+	defer cm.Teardown()
+	now := time.Now()
+	cm.now = func() time.Time { return now }
+
+	idle := ConnID{UserID: "@alice:localhost", DeviceID: "IDLE"}
+	active := ConnID{UserID: "@alice:localhost", DeviceID: "ACTIVE"}
+	idleHandler := newDestroyTrackingConnHandler()
+	cm.CreateConn(idle, func() ConnHandler { return idleHandler })
+	cm.CreateConn(active, func() ConnHandler { return newDestroyTrackingConnHandler() })
+
+	// nothing is reaped before the TTL
+	now = now.Add(ttl - time.Minute)
+	cm.reapIdleConns()
+	if cm.Conn(active) == nil {
+		t.Fatalf("active connection was reaped before the TTL")
+	}
+	if !idleHandler.Alive() {
+		t.Fatalf("idle connection was reaped before the TTL")
+	}
+
+	// advance past the TTL for the idle connection, but not the active one which was just used
+	now = now.Add(2 * time.Minute)
+	cm.reapIdleConns()
+	select {
+	case <-idleHandler.destroyed:
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection was not destroyed when reaped")
+	}
+	if len(cm.Conns(idle.UserID, idle.DeviceID)) != 0 {
+		t.Fatalf("idle connection still exists after being reaped")
+	}
+	if cm.Conn(active) == nil {
+		t.Fatalf("active connection was reaped, but it was used within the TTL")
+	}
+
+	// the client returning with the reaped connection's pos is told to reset
+	if conn := cm.Conn(idle); conn != nil {
+		t.Fatalf("got conn for reaped connection, want nil")
+	}
+	herr := internal.ExpiredSessionError(cm.ResetReason(idle))
+	if herr.ErrCode != "M_UNKNOWN_POS" || herr.ResetReason != internal.ResetReasonExpired {
+		t.Fatalf("got errcode %q reset_reason %q, want M_UNKNOWN_POS %q", herr.ErrCode, herr.ResetReason, internal.ResetReasonExpired)
+	}
+
+	// the client can then make a new connection, which forgets the reset
+	cm.CreateConn(idle, func() ConnHandler { return newDestroyTrackingConnHandler() })
+	if cm.Conn(idle) == nil {
+		t.Fatalf("failed to recreate reaped connection")
+	}
+	assertResetReason(t, cm, idle, internal.ResetReasonServerRestart)
+}
+
+// Test that users who create connections too quickly are throttled, without affecting other users or
+// existing connections.
+func TestConnMapRateLimitsNewConns(t *testing.T) {
+	limit := 5
+	cm := NewConnMap(false, time.Hour, limit)
+	defer cm.Teardown()
+	now := time.Now()
+	cm.now = func() time.Time { return now }
+
+	alice := "@alice:localhost"
+	var existing ConnID
+	for i := 0; i < limit; i++ {
+		if _, ok := cm.AllowNewConn(alice); !ok {
+			t.Fatalf("connection %d was throttled, want allowed", i)
+		}
+		existing = ConnID{UserID: alice, DeviceID: "DEVICE", CID: fmt.Sprintf("%d", i)}
+		cm.CreateConn(existing, func() ConnHandler { return &aliveConnHandler{alive: true} })
+		cm.RecordNewConn(alice)
+		now = now.Add(time.Second)
+	}
+	// alice is now creating connections too quickly
+	for i := 0; i < 10; i++ {
+		retryAfter, ok := cm.AllowNewConn(alice)
+		if ok {
+			t.Fatalf("connection was allowed, want throttled")
+		}
+		// the first connection was made 5s ago, so leaves the window in 55s
+		if want := newConnWindow - time.Duration(limit)*time.Second; retryAfter != want {
+			t.Errorf("got retry after %v want %v", retryAfter, want)
+		}
+	}
+	// existing connections continue to work
+	if cm.Conn(existing) == nil {
+		t.Fatalf("existing connection was removed whilst throttled")
+	}
+	// other users are unaffected
+	if _, ok := cm.AllowNewConn("@bob:localhost"); !ok {
+		t.Fatalf("bob was throttled, want allowed")
+	}
+	// once the oldest connection leaves the window, alice can make another connection but only one
+	now = now.Add(newConnWindow - time.Duration(limit)*time.Second)
+	if _, ok := cm.AllowNewConn(alice); !ok {
+		t.Fatalf("connection was throttled after waiting, want allowed")
+	}
+	cm.RecordNewConn(alice)
+	if _, ok := cm.AllowNewConn(alice); ok {
+		t.Fatalf("connection was allowed, want throttled")
+	}
+	// the reaper forgets users who haven't made connections recently
+	now = now.Add(2 * newConnWindow)
+	cm.reapIdleConns()
+	cm.mu.Lock()
+	numUsers := len(cm.userIDToConnCreations)
+	cm.mu.Unlock()
+	if numUsers != 0 {
+		t.Errorf("got %d users with connection creations, want 0", numUsers)
+	}
+}
+
+type destroyTrackingConnHandler struct {
+	aliveConnHandler
+	destroyed chan struct{}
+}
+
+func newDestroyTrackingConnHandler() *destroyTrackingConnHandler {
+	return &destroyTrackingConnHandler{destroyed: make(chan struct{})}
+}
+
+func (c *destroyTrackingConnHandler) Destroy() { close(c.destroyed) }
+func (c *destroyTrackingConnHandler) Alive() bool {
+	select {
+	case <-c.destroyed:
+		return false
+	default:
+		return true
+	}
+}
+
+func assertResetReason(t *testing.T, cm *ConnMap, cid ConnID, want string) {
+	t.Helper()
+	if got := cm.ResetReason(cid); got != want {
+		t.Errorf("%s: got reset reason %q want %q", cid.String(), got, want)
+	}
+}
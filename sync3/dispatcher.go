@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
@@ -51,6 +52,24 @@ func (d *Dispatcher) IsUserInvited(userID, roomID string) bool {
 	return d.jrt.IsUserInvited(userID, roomID)
 }
 
+// UsersSharingRoomsWith returns the users who are joined to at least one of the rooms the given
+// user is joined to, including the user themselves.
+func (d *Dispatcher) UsersSharingRoomsWith(userID string) []string {
+	userIDs := []string{userID}
+	seen := map[string]struct{}{userID: {}}
+	for _, roomID := range d.jrt.JoinedRoomsForUser(userID) {
+		joinedUserIDs, _ := d.jrt.JoinedUsersForRoom(roomID, nil)
+		for _, joinedUserID := range joinedUserIDs {
+			if _, exists := seen[joinedUserID]; exists {
+				continue
+			}
+			seen[joinedUserID] = struct{}{}
+			userIDs = append(userIDs, joinedUserID)
+		}
+	}
+	return userIDs
+}
+
 // Load joined members into the dispatcher.
 // MUST BE CALLED BEFORE V2 POLL LOOPS START.
 func (d *Dispatcher) Startup(roomToJoinedUsers map[string][]string) error {
@@ -97,7 +116,7 @@ func (d *Dispatcher) newEventData(event json.RawMessage, roomID string, latestPo
 		StateKey:      stateKey,
 		Content:       ev.Get("content"),
 		NID:           latestPos,
-		Timestamp:     ev.Get("origin_server_ts").Uint(),
+		Timestamp:     internal.RecencyTimestamp(ev.Get("origin_server_ts").Uint(), time.Now()),
 		Sender:        ev.Get("sender").Str,
 		TransactionID: ev.Get("unsigned.transaction_id").Str,
 	}
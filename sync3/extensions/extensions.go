@@ -3,8 +3,12 @@ package extensions
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
@@ -17,6 +21,23 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 	TimeFormat: "15:04:05",
 })
 
+// MaxEnabledExtensions is the maximum number of extensions a single connection can enable at once.
+// Customisable for testing.
+var MaxEnabledExtensions = 16
+
+// the JSON keys of all known extensions, taken from the fields of Request
+var knownExtensionNames = func() map[string]struct{} {
+	names := make(map[string]struct{})
+	t := reflect.TypeOf(Request{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}()
+
 type GenericRequest interface {
 	// Name provides a name to identify the kind of request. At present, it's only
 	// used to name opentracing spans; this isn't end-user visible.
@@ -165,11 +186,69 @@ type Request struct {
 	AccountData *AccountDataRequest `json:"account_data"`
 	Typing      *TypingRequest      `json:"typing"`
 	Receipts    *ReceiptsRequest    `json:"receipts"`
+	Spaces      *SpacesRequest      `json:"spaces"`
+	Presence    *PresenceRequest    `json:"presence"`
+	Search      *SearchRequest      `json:"search"`
+
+	// the names of any extensions in the request JSON which we don't know about
+	unknown []string
+}
+
+// UnmarshalJSON decodes the request, remembering the names of any unknown extensions so they can
+// be rejected by Validate rather than silently ignored.
+func (r *Request) UnmarshalJSON(b []byte) error {
+	type request Request // to avoid recursing into this function
+	var req request
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	var names map[string]json.RawMessage
+	if err := json.Unmarshal(b, &names); err != nil {
+		return err
+	}
+	*r = Request(req)
+	r.unknown = nil
+	for name := range names {
+		if _, ok := knownExtensionNames[name]; !ok {
+			r.unknown = append(r.unknown, name)
+		}
+	}
+	sort.Strings(r.unknown)
+	return nil
+}
+
+// Validate returns an error if the request contains extensions which do not exist.
+func (r *Request) Validate() error {
+	if len(r.unknown) > 0 {
+		return fmt.Errorf("unknown extensions: %s", strings.Join(r.unknown, ", "))
+	}
+	return nil
+}
+
+// NumEnabledAfterDelta returns the number of extensions which would be enabled if `next` were
+// applied atop r via ApplyDelta. Neither request is modified.
+func (r Request) NumEnabledAfterDelta(next *Request) int {
+	currFields := r.fields()
+	nextFields := next.fields()
+	num := 0
+	for i := range nextFields {
+		var enabled *bool
+		if !isNil(currFields[i]) {
+			enabled = currFields[i].IsEnabled()
+		}
+		if !isNil(nextFields[i]) && nextFields[i].IsEnabled() != nil {
+			enabled = nextFields[i].IsEnabled()
+		}
+		if enabled != nil && *enabled {
+			num++
+		}
+	}
+	return num
 }
 
 func (r *Request) fields() []GenericRequest {
 	return []GenericRequest{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Spaces, r.Presence, r.Search,
 	}
 }
 
@@ -180,6 +259,20 @@ func (r *Request) setFields(fields []GenericRequest) {
 	r.AccountData = fields[2].(*AccountDataRequest)
 	r.Typing = fields[3].(*TypingRequest)
 	r.Receipts = fields[4].(*ReceiptsRequest)
+	r.Spaces = fields[5].(*SpacesRequest)
+	r.Presence = fields[6].(*PresenceRequest)
+	r.Search = fields[7].(*SearchRequest)
+}
+
+// Specified returns true if any extension is in this request, which means applying it as a delta
+// may change the extensions of the previous request.
+func (r *Request) Specified() bool {
+	for _, f := range r.fields() {
+		if !isNil(f) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r Request) EnabledExtensions() (exts []GenericRequest) {
@@ -242,6 +335,15 @@ func (r *Request) InterpretAsInitial() {
 	if r.Receipts != nil {
 		r.Receipts.InterpretAsInitial()
 	}
+	if r.Spaces != nil {
+		r.Spaces.InterpretAsInitial()
+	}
+	if r.Presence != nil {
+		r.Presence.InterpretAsInitial()
+	}
+	if r.Search != nil {
+		r.Search.InterpretAsInitial()
+	}
 }
 
 // Response represents the top-level `extensions` key in the JSON response.
@@ -253,11 +355,14 @@ type Response struct {
 	AccountData *AccountDataResponse `json:"account_data,omitempty"`
 	Typing      *TypingResponse      `json:"typing,omitempty"`
 	Receipts    *ReceiptsResponse    `json:"receipts,omitempty"`
+	Spaces      *SpacesResponse      `json:"spaces,omitempty"`
+	Presence    *PresenceResponse    `json:"presence,omitempty"`
+	Search      *SearchResponse      `json:"search,omitempty"`
 }
 
 func (r Response) fields() []GenericResponse {
 	return []GenericResponse{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Spaces, r.Presence, r.Search,
 	}
 }
 
@@ -312,6 +417,8 @@ type Handler struct {
 	Store       *state.Storage
 	E2EEFetcher E2EEFetcher
 	GlobalCache *caches.GlobalCache
+	// UsersSharingRooms returns the users who share a room with the given user, including the user.
+	UsersSharingRooms func(userID string) []string
 }
 
 func (h *Handler) HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context) {
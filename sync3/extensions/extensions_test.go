@@ -2,6 +2,7 @@ package extensions
 
 import (
 	"context"
+	"encoding/json"
 	"reflect"
 	"testing"
 
@@ -216,3 +217,63 @@ func TestExtension_ApplyDelta(t *testing.T) {
 		}
 	}
 }
+
+func TestExtensionUnknownNamesRejected(t *testing.T) {
+	var req Request
+	assertNoError(t, json.Unmarshal([]byte(`{"typing":{"enabled":true},"typnig":{"enabled":true},"foo":{}}`), &req))
+	err := req.Validate()
+	if err == nil {
+		t.Fatalf("Validate: got no error for unknown extensions")
+	}
+	if err.Error() != "unknown extensions: foo, typnig" {
+		t.Errorf("Validate: got error %q", err.Error())
+	}
+	if req.Typing == nil || !ExtensionEnabled(req.Typing) {
+		t.Errorf("known extension was not decoded: %+v", req.Typing)
+	}
+
+	req = Request{}
+	assertNoError(t, json.Unmarshal([]byte(`{"typing":{"enabled":true},"receipts":{"enabled":false}}`), &req))
+	assertNoError(t, req.Validate())
+}
+
+func TestExtensionNumEnabledAfterDelta(t *testing.T) {
+	curr := Request{
+		Typing:   &TypingRequest{Core: Core{Enabled: &boolTrue}},
+		Receipts: &ReceiptsRequest{Core: Core{Enabled: &boolTrue}},
+	}
+	testCases := []struct {
+		name string
+		next Request
+		want int
+	}{
+		{
+			name: "no changes",
+			next: Request{},
+			want: 2,
+		},
+		{
+			name: "enable a new extension",
+			next: Request{Spaces: &SpacesRequest{Core: Core{Enabled: &boolTrue}}},
+			want: 3,
+		},
+		{
+			name: "disable an existing extension",
+			next: Request{Typing: &TypingRequest{Core: Core{Enabled: &boolFalse}}},
+			want: 1,
+		},
+		{
+			name: "unspecified enabled flag is sticky",
+			next: Request{Typing: &TypingRequest{Core: Core{Lists: []string{"a"}}}},
+			want: 2,
+		},
+	}
+	for _, tc := range testCases {
+		if got := curr.NumEnabledAfterDelta(&tc.next); got != tc.want {
+			t.Errorf("%s: got %d enabled want %d", tc.name, got, tc.want)
+		}
+	}
+	if !ExtensionEnabled(curr.Typing) || curr.Spaces != nil {
+		t.Errorf("NumEnabledAfterDelta modified the request: %+v", curr)
+	}
+}
@@ -0,0 +1,75 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+// Client created request params. Presence is not scoped to rooms, so the lists and rooms fields
+// are ignored: clients receive the presence of every user they share a room with.
+type PresenceRequest struct {
+	Core
+}
+
+func (r *PresenceRequest) Name() string {
+	return "PresenceRequest"
+}
+
+// Server response
+type PresenceResponse struct {
+	// m.presence events, with at most one event per user.
+	Events []json.RawMessage `json:"events,omitempty"`
+}
+
+func (r *PresenceResponse) HasData(isInitial bool) bool {
+	return len(r.Events) > 0
+}
+
+// add the presence event for this user, replacing any older presence for the same user so only
+// the latest presence for each user is sent.
+func (r *PresenceResponse) add(userID string, ev json.RawMessage) {
+	for i := range r.Events {
+		if gjson.GetBytes(r.Events[i], "sender").Str == userID {
+			r.Events[i] = ev
+			return
+		}
+	}
+	r.Events = append(r.Events, ev)
+}
+
+func (r *PresenceRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.PresenceUpdate)
+	if !ok {
+		return
+	}
+	if res.Presence == nil {
+		res.Presence = &PresenceResponse{}
+	}
+	res.Presence.add(update.UserID, update.Event)
+}
+
+func (r *PresenceRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// incremental syncs get presence changes via AppendLive
+	if !extCtx.IsInitial || extCtx.UsersSharingRooms == nil {
+		return
+	}
+	userIDToEvent, err := extCtx.Store.PresenceTable.Presence(extCtx.UsersSharingRooms(extCtx.UserID))
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch presence")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(userIDToEvent) == 0 {
+		return
+	}
+	res.Presence = &PresenceResponse{
+		Events: make([]json.RawMessage, 0, len(userIDToEvent)),
+	}
+	for _, ev := range userIDToEvent {
+		res.Presence.Events = append(res.Presence.Events, ev)
+	}
+}
@@ -0,0 +1,139 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 50
+	maxSearchContext   = 10
+)
+
+// Client created request params
+type SearchRequest struct {
+	Core
+	RoomID string `json:"room_id"`
+	Query  string `json:"query"`
+	// max number of matching events to return
+	Limit int `json:"limit"`
+	// number of events to return either side of each matching event
+	ContextLimit int `json:"context_limit"`
+
+	// true if the search has been changed and not yet run. Searches are only run once, when
+	// they are specified, rather than on every request.
+	pending bool
+}
+
+func (r *SearchRequest) Name() string {
+	return "SearchRequest"
+}
+
+func (r *SearchRequest) InterpretAsInitial() {
+	r.Core.InterpretAsInitial()
+	r.pending = r.Query != ""
+}
+
+func (r *SearchRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*SearchRequest)
+	if next.Query == "" {
+		return
+	}
+	// a new search, run it on this request
+	r.RoomID = next.RoomID
+	r.Query = next.Query
+	r.Limit = next.Limit
+	r.ContextLimit = next.ContextLimit
+	r.pending = true
+}
+
+type SearchResult struct {
+	Event        json.RawMessage   `json:"event"`
+	EventsBefore []json.RawMessage `json:"events_before,omitempty"`
+	EventsAfter  []json.RawMessage `json:"events_after,omitempty"`
+}
+
+// Server response
+type SearchResponse struct {
+	RoomID string `json:"room_id"`
+	Query  string `json:"query"`
+	// matching events, most recent first
+	Results []SearchResult `json:"results"`
+}
+
+// HasData returns true if a search ran on this request, even if nothing matched, so clients are told
+// there were no results. The query is only set when a search has run.
+func (r *SearchResponse) HasData(isInitial bool) bool {
+	return r.Query != ""
+}
+
+func (r *SearchRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	// searches are one-shot, new events do not update the results.
+}
+
+func (r *SearchRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	if !r.pending {
+		return
+	}
+	r.pending = false
+	if r.RoomID == "" {
+		return
+	}
+	limit := r.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	} else if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	contextLimit := r.ContextLimit
+	if contextLimit > maxSearchContext {
+		contextLimit = maxSearchContext
+	}
+	l := logger.With().Str("user", extCtx.UserID).Str("room", r.RoomID).Logger()
+	to, err := extCtx.Store.LatestEventNID()
+	if err != nil {
+		l.Err(err).Msg("failed to load latest event NID for search")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	events, err := extCtx.Store.SearchRoom(extCtx.UserID, r.RoomID, r.Query, to, limit)
+	if err != nil {
+		l.Err(err).Msg("failed to search room")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	results := make([]SearchResult, len(events))
+	for i, ev := range events {
+		results[i].Event = ev.JSON
+		if contextLimit <= 0 {
+			continue
+		}
+		around, err := extCtx.Store.EventsAroundEvent(extCtx.UserID, r.RoomID, ev.ID, to, contextLimit)
+		if err != nil {
+			l.Err(err).Str("event", ev.ID).Msg("failed to load search result context")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		if around == nil {
+			continue
+		}
+		for j, contextEv := range around.Timeline {
+			if gjson.GetBytes(contextEv, "event_id").Str == ev.ID {
+				results[i].EventsBefore = around.Timeline[:j]
+				results[i].EventsAfter = around.Timeline[j+1:]
+				break
+			}
+		}
+	}
+	res.Search = &SearchResponse{
+		RoomID:  r.RoomID,
+		Query:   r.Query,
+		Results: results,
+	}
+}
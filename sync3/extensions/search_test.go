@@ -0,0 +1,30 @@
+package extensions
+
+import (
+	"testing"
+)
+
+// Test that the search response is only sent on the request which runs the search.
+func TestSearchResponseHasData(t *testing.T) {
+	// the search already ran on an earlier request, so it doesn't run again
+	ext := &SearchRequest{
+		RoomID: roomA,
+		Query:  "cat",
+	}
+	var res Response
+	ext.ProcessInitial(ctx, &res, Context{})
+	if res.HasData(false) {
+		t.Errorf("response has data but the search did not run: %+v", res.Search)
+	}
+	if (&SearchResponse{}).HasData(true) {
+		t.Errorf("empty search response has data")
+	}
+	// a search which ran but matched nothing is still sent, so the client knows there are no results
+	ran := &SearchResponse{
+		RoomID: roomA,
+		Query:  "cat",
+	}
+	if !ran.HasData(false) {
+		t.Errorf("search response with no results has no data")
+	}
+}
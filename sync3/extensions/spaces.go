@@ -0,0 +1,105 @@
+package extensions
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+const spaceRoomType = "m.space"
+
+// Client created request params
+type SpacesRequest struct {
+	Core
+}
+
+func (r *SpacesRequest) Name() string {
+	return "SpacesRequest"
+}
+
+// SpaceSummary is a compact description of a single space the user is joined to.
+type SpaceSummary struct {
+	Name        string `json:"name,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+	NumChildren int    `json:"num_children"`
+}
+
+func newSpaceSummary(metadata *internal.RoomMetadata) *SpaceSummary {
+	return &SpaceSummary{
+		Name:        internal.CalculateRoomName(metadata, 5),
+		Avatar:      internal.CalculateAvatar(metadata),
+		NumChildren: len(metadata.ChildSpaceRooms),
+	}
+}
+
+// Server response
+type SpacesResponse struct {
+	// Map of space room ID to summary. A null value means the user is no longer joined to the space.
+	Spaces map[string]*SpaceSummary `json:"spaces"`
+}
+
+func (r *SpacesResponse) HasData(isInitial bool) bool {
+	if isInitial {
+		return true
+	}
+	return len(r.Spaces) > 0
+}
+
+func (r *SpacesRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.RoomEventUpdate)
+	if !ok {
+		return
+	}
+	metadata := update.GlobalRoomMetadata()
+	if metadata == nil || metadata.RoomType == nil || *metadata.RoomType != spaceRoomType {
+		return
+	}
+	var summary *SpaceSummary
+	switch update.EventData.EventType {
+	case "m.space.child", "m.room.name", "m.room.avatar":
+		summary = newSpaceSummary(metadata)
+	case "m.room.member":
+		if update.EventData.StateKey == nil || *update.EventData.StateKey != extCtx.UserID {
+			return
+		}
+		membership := update.EventData.Content.Get("membership").Str
+		if membership == "join" {
+			summary = newSpaceSummary(metadata)
+		} else if membership != "leave" && membership != "ban" {
+			return
+		}
+		// else leave the summary as nil to indicate the space was removed
+	default:
+		return
+	}
+	if res.Spaces == nil {
+		res.Spaces = &SpacesResponse{
+			Spaces: make(map[string]*SpaceSummary),
+		}
+	}
+	res.Spaces.Spaces[update.RoomID()] = summary
+}
+
+func (r *SpacesRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// the full summary is only sent on initial syncs, subsequent changes are sent live.
+	if !extCtx.IsInitial {
+		return
+	}
+	_, joinedRooms, _, _, err := extCtx.GlobalCache.LoadJoinedRooms(ctx, extCtx.UserID)
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("SpacesRequest: failed to load joined rooms")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	spaces := make(map[string]*SpaceSummary)
+	for roomID, metadata := range joinedRooms {
+		if metadata.RoomType == nil || *metadata.RoomType != spaceRoomType {
+			continue
+		}
+		spaces[roomID] = newSpaceSummary(metadata)
+	}
+	res.Spaces = &SpacesResponse{
+		Spaces: spaces,
+	}
+}
@@ -0,0 +1,124 @@
+package extensions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+func TestSpacesSummary(t *testing.T) {
+	userID := "@alice:localhost"
+	spaceType := "m.space"
+	spaceA := internal.NewRoomMetadata("!space-a:localhost")
+	spaceA.RoomType = &spaceType
+	spaceA.NameEvent = "Space A"
+	spaceA.AvatarEvent = "mxc://localhost/a"
+	spaceA.ChildSpaceRooms = map[string]struct{}{roomA: {}, roomB: {}}
+	room := internal.NewRoomMetadata(roomC)
+	room.NameEvent = "Not a space"
+
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+			spaceA.RoomID: spaceA,
+			room.RoomID:   room,
+		}, nil, nil, nil
+	}
+	ext := &SpacesRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+	}
+	extCtx := Context{
+		Handler: &Handler{
+			GlobalCache: globalCache,
+		},
+		IsInitial: true,
+		UserID:    userID,
+	}
+
+	// the initial sync includes all joined spaces
+	var res Response
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.Spaces == nil {
+		t.Fatalf("spaces response is empty")
+	}
+	want := map[string]*SpaceSummary{
+		spaceA.RoomID: {
+			Name:        "Space A",
+			Avatar:      "mxc://localhost/a",
+			NumChildren: 2,
+		},
+	}
+	if !reflect.DeepEqual(res.Spaces.Spaces, want) {
+		t.Fatalf("got  %+v\nwant %+v", res.Spaces.Spaces, want)
+	}
+
+	// incremental syncs don't resend the summary
+	res = Response{}
+	extCtx.IsInitial = false
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.Spaces != nil {
+		t.Fatalf("got spaces response on incremental sync: %+v", res.Spaces)
+	}
+
+	// joining a new space adds it to the summary
+	spaceB := internal.NewRoomMetadata("!space-b:localhost")
+	spaceB.RoomType = &spaceType
+	spaceB.NameEvent = "Space B"
+	spaceB.ChildSpaceRooms = map[string]struct{}{roomC: {}}
+	ext.AppendLive(ctx, &res, extCtx, &caches.RoomEventUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID:         spaceB.RoomID,
+			globalMetadata: spaceB,
+		},
+		EventData: &caches.EventData{
+			RoomID:    spaceB.RoomID,
+			EventType: "m.room.member",
+			StateKey:  &userID,
+			Content:   gjson.Parse(`{"membership":"join"}`),
+		},
+	})
+	// leaving a space removes it from the summary
+	ext.AppendLive(ctx, &res, extCtx, &caches.RoomEventUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID:         spaceA.RoomID,
+			globalMetadata: spaceA,
+		},
+		EventData: &caches.EventData{
+			RoomID:    spaceA.RoomID,
+			EventType: "m.room.member",
+			StateKey:  &userID,
+			Content:   gjson.Parse(`{"membership":"leave"}`),
+		},
+	})
+	// non-space rooms are ignored
+	ext.AppendLive(ctx, &res, extCtx, &caches.RoomEventUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID:         room.RoomID,
+			globalMetadata: room,
+		},
+		EventData: &caches.EventData{
+			RoomID:    room.RoomID,
+			EventType: "m.room.member",
+			StateKey:  &userID,
+			Content:   gjson.Parse(`{"membership":"join"}`),
+		},
+	})
+	if res.Spaces == nil {
+		t.Fatalf("spaces response is empty")
+	}
+	want = map[string]*SpaceSummary{
+		spaceA.RoomID: nil,
+		spaceB.RoomID: {
+			Name:        "Space B",
+			NumChildren: 1,
+		},
+	}
+	if !reflect.DeepEqual(res.Spaces.Spaces, want) {
+		t.Fatalf("got  %+v\nwant %+v", res.Spaces.Spaces, want)
+	}
+}
@@ -44,6 +44,8 @@ func (r *ToDeviceRequest) ApplyDelta(gnext GenericRequest) {
 type ToDeviceResponse struct {
 	NextBatch string            `json:"next_batch"`
 	Events    []json.RawMessage `json:"events,omitempty"`
+	// the number of to-device messages still waiting after next_batch, which clients can use to size their next fetch.
+	Pending int `json:"pending,omitempty"`
 }
 
 func (r *ToDeviceResponse) HasData(isInitial bool) bool {
@@ -74,6 +76,16 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 			return
 		}
+		// the client may be using a position we never gave it, e.g. if the proxy's database was reset. Resume
+		// from the last position we sent instead, so we don't skip over messages it has never seen.
+		unackPos, err := extCtx.Store.ToDeviceTable.UnackedPosition(extCtx.UserID, extCtx.DeviceID)
+		if err != nil {
+			l.Err(err).Msg("cannot query unacked position")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		} else if from > unackPos {
+			l.Warn().Int64("unacked", unackPos).Int64("recv", from).Msg("Client sent a since value beyond the last position sent, resuming from last position")
+			from = unackPos
+		}
 		// the client is confirming messages up to `from` so delete everything up to and including it.
 		if err = extCtx.Store.ToDeviceTable.DeleteMessagesUpToAndIncluding(extCtx.UserID, extCtx.DeviceID, from); err != nil {
 			l.Err(err).Str("since", r.Since).Msg("failed to delete to-device messages up to this value")
@@ -108,9 +120,20 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 	mapMu.Lock()
 	deviceIDToSinceDebugOnly[extCtx.DeviceID] = upTo
 	mapMu.Unlock()
+	var pending int
+	if len(msgs) == r.Limit {
+		// there may be more messages than we returned, so count them
+		pending, err = extCtx.Store.ToDeviceTable.CountMessages(extCtx.UserID, extCtx.DeviceID, upTo)
+		if err != nil {
+			// not fatal: the client can still fetch the messages, it just doesn't know how many there are
+			l.Warn().Err(err).Int64("from", upTo).Msg("cannot count pending to-device messages")
+			pending = 0
+		}
+	}
 	// we don't need to aggregate here as we're pulling from the DB and not relying on in-memory structs
 	res.ToDevice = &ToDeviceResponse{
 		NextBatch: fmt.Sprintf("%d", upTo),
 		Events:    msgs,
+		Pending:   pending,
 	}
 }
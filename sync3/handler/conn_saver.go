@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// savedConn is a write to the conns table which has yet to be made.
+type savedConn struct {
+	pos int64
+	// nil if the request and state haven't changed since they were last saved, in which case only
+	// the pos is updated
+	request json.RawMessage
+	state   json.RawMessage
+}
+
+// ConnSaver saves connections to the database in the background, so responses aren't held up by
+// database writes. Only the latest write for each connection is made.
+type ConnSaver struct {
+	table   *state.ConnsTable
+	mu      *sync.Mutex
+	pending map[sync3.ConnID]savedConn
+	notify  chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func NewConnSaver(table *state.ConnsTable) *ConnSaver {
+	s := &ConnSaver{
+		table:   table,
+		mu:      &sync.Mutex{},
+		pending: make(map[sync3.ConnID]savedConn),
+		notify:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+// Save the latest pos for this connection, along with the request and state if they are non-nil.
+// Returns immediately.
+func (s *ConnSaver) Save(connID sync3.ConnID, pos int64, request, state json.RawMessage) {
+	s.mu.Lock()
+	prev, exists := s.pending[connID]
+	if request == nil && exists {
+		// keep the unwritten request and state
+		request, state = prev.request, prev.state
+	}
+	s.pending[connID] = savedConn{pos: pos, request: request, state: state}
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+		// the loop has already been told there are writes to make
+	}
+}
+
+// Teardown makes any outstanding writes then stops saving connections.
+func (s *ConnSaver) Teardown() {
+	close(s.stop)
+	<-s.stopped
+}
+
+func (s *ConnSaver) loop() {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.notify:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *ConnSaver) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[sync3.ConnID]savedConn)
+	s.mu.Unlock()
+	for connID, sc := range pending {
+		var err error
+		if sc.request != nil {
+			err = s.table.Upsert(connID.UserID, connID.DeviceID, connID.CID, sc.pos, sc.request, sc.state)
+		} else {
+			err = s.table.UpdatePos(connID.UserID, connID.DeviceID, connID.CID, sc.pos)
+		}
+		if err != nil {
+			logger.Err(err).Str("conn", connID.String()).Msg("failed to save connection")
+		}
+	}
+}
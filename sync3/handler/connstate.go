@@ -3,6 +3,9 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -26,6 +29,13 @@ type ConnState struct {
 	// the only thing that can touch these data structures is the conn goroutine
 	muxedReq *sync3.Request
 	lists    *sync3.InternalRequestLists
+	// the muxed request and snapshot from before the proxy restarted, if this connection is being
+	// resumed. They are restored when the first request on this connection is processed.
+	resumeReq      *sync3.Request
+	resumeSnapshot *ConnSnapshot
+	// true if the muxed request or what the client has been sent may have changed since Snapshot was
+	// last called
+	snapshotChanged bool
 
 	// Confirmed room subscriptions. Entries in this list have been checked for things like
 	// "is the user joined to this room?" whereas subscriptions in muxedReq are untrusted.
@@ -42,6 +52,24 @@ type ConnState struct {
 	anchorLoadPosition int64
 	// roomID -> latest load pos
 	loadPositions map[string]int64
+	// the unread total last sent to the client, or -1 if it has not been sent
+	lastUnreadTotal int
+	// rooms which have been sent in full on this connection, so we know if a room is re-entering the window.
+	sentRooms map[string]struct{}
+	// the origin_server_ts of the last timeline event sent for each room, when annotating day boundaries
+	lastTimelineTimestamps map[string]int64
+	// views registered by the client on this connection
+	views map[string]sync3.View // name -> view
+	// required_state which has yet to be sent, for rooms whose required_state is being sent in chunks
+	requiredStateBacklogs map[string]*requiredStateBacklog // room_id -> backlog
+	// rooms in slow_get_all_rooms lists whose room data has yet to be sent, in sorted order
+	getAllRoomsBacklogs map[string][]string // list key -> room IDs
+	// the state events last sent for each room, for rooms which get state events as diffs
+	sentState map[string]map[[2]string]json.RawMessage // room_id -> (type, state_key) -> event
+
+	// Room data loaded in response to prefetch_ranges which has not yet been sent to the client.
+	// Entries are removed when they are sent or when the room is updated.
+	prefetched map[string]prefetchedRoom // room_id -> room data
 
 	txnIDWaiter *TxnIDWaiter
 	live        *connStateLive
@@ -58,29 +86,51 @@ type ConnState struct {
 	processHistogramVec *prometheus.HistogramVec
 }
 
+// prefetchedRoom is room data loaded for a prefetch hint, along with what was used to load it.
+type prefetchedRoom struct {
+	roomSub        sync3.RoomSubscription
+	bumpEventTypes []string
+	room           sync3.Room
+	loadPosition   int64
+}
+
+// matches returns true if this data would be the same as loading the room with these parameters.
+func (p prefetchedRoom) matches(roomSub sync3.RoomSubscription, bumpEventTypes []string) bool {
+	return reflect.DeepEqual(p.roomSub, roomSub) && reflect.DeepEqual(p.bumpEventTypes, bumpEventTypes)
+}
+
 func NewConnState(
 	userID, deviceID string, userCache *caches.UserCache, globalCache *caches.GlobalCache,
 	ex extensions.HandlerInterface, joinChecker JoinChecker, setupHistVec *prometheus.HistogramVec, histVec *prometheus.HistogramVec,
-	maxPendingEventUpdates int, maxTransactionIDDelay time.Duration,
+	maxPendingEventUpdates int, maxTransactionIDDelay time.Duration, maxOpsPerResponse int,
 ) *ConnState {
 	cs := &ConnState{
-		globalCache:         globalCache,
-		userCache:           userCache,
-		userID:              userID,
-		deviceID:            deviceID,
-		anchorLoadPosition:  -1,
-		loadPositions:       make(map[string]int64),
-		roomSubscriptions:   make(map[string]sync3.RoomSubscription),
-		lists:               sync3.NewInternalRequestLists(),
-		extensionsHandler:   ex,
-		joinChecker:         joinChecker,
-		lazyCache:           NewLazyCache(),
-		setupHistogramVec:   setupHistVec,
-		processHistogramVec: histVec,
+		globalCache:            globalCache,
+		userCache:              userCache,
+		userID:                 userID,
+		deviceID:               deviceID,
+		anchorLoadPosition:     -1,
+		loadPositions:          make(map[string]int64),
+		prefetched:             make(map[string]prefetchedRoom),
+		lastUnreadTotal:        -1,
+		sentRooms:              make(map[string]struct{}),
+		views:                  make(map[string]sync3.View),
+		requiredStateBacklogs:  make(map[string]*requiredStateBacklog),
+		getAllRoomsBacklogs:    make(map[string][]string),
+		sentState:              make(map[string]map[[2]string]json.RawMessage),
+		lastTimelineTimestamps: make(map[string]int64),
+		roomSubscriptions:      make(map[string]sync3.RoomSubscription),
+		lists:                  sync3.NewInternalRequestLists(),
+		extensionsHandler:      ex,
+		joinChecker:            joinChecker,
+		lazyCache:              NewLazyCache(),
+		setupHistogramVec:      setupHistVec,
+		processHistogramVec:    histVec,
 	}
 	cs.live = &connStateLive{
-		ConnState: cs,
-		updates:   make(chan caches.Update, maxPendingEventUpdates),
+		ConnState:         cs,
+		updates:           make(chan caches.Update, maxPendingEventUpdates),
+		maxOpsPerResponse: maxOpsPerResponse,
 	}
 	cs.txnIDWaiter = NewTxnIDWaiter(
 		userID,
@@ -193,9 +243,61 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 // additional locking mechanisms.
 func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request, isInitial bool) (*sync3.Response, error) {
 	start := time.Now()
+	for name, view := range req.SaveViews {
+		if _, exists := s.views[name]; !exists && len(s.views) >= sync3.MaxViews {
+			return nil, &internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("too many views registered: max %d", sync3.MaxViews),
+			}
+		}
+		s.views[name] = view
+	}
+	if req.View != "" {
+		view, ok := s.views[req.View]
+		if !ok {
+			return nil, &internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("unknown view: %s", req.View),
+			}
+		}
+		req.ApplyView(view)
+	}
+	// check this before applying the delta, as ApplyDelta modifies existing extensions in place
+	var prevExtensions extensions.Request
+	if s.resumeReq != nil {
+		prevExtensions = s.resumeReq.Extensions
+	} else if s.muxedReq != nil {
+		prevExtensions = s.muxedReq.Extensions
+	}
+	if numEnabled := prevExtensions.NumEnabledAfterDelta(&req.Extensions); numEnabled > extensions.MaxEnabledExtensions {
+		return nil, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("too many extensions enabled: %d > %d", numEnabled, extensions.MaxEnabledExtensions),
+		}
+	}
+	snapshotChanged := s.muxedReq == nil || changesMuxedRequest(req)
+
+	// work out which rooms we'll return data for and add their relevant subscriptions to the builder
+	// for it to mix together
+	builder := NewRoomsBuilder()
+	// snapshot the rooms the client can currently see in each list, so we can tell them which rooms
+	// entered and left each list
+	var prevVisibleRoomIDs map[string][]string
+	var resumedLists map[string]sync3.ResponseList
+	resumed := s.resumeReq != nil
+	if resumed {
+		// the client won't resend sticky params it sent before the restart, and already has the
+		// rooms it was sent, so restore the connection as it was and only send what has changed.
+		prevVisibleRoomIDs = s.resumeSnapshot.listsByVisibleRoomIDs()
+		resumedLists = s.resume(reqCtx, builder)
+		snapshotChanged = true
+	} else if s.muxedReq != nil {
+		prevVisibleRoomIDs = s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	}
 	// ApplyDelta works fine if s.muxedReq is nil
 	var delta *sync3.RequestDelta
 	s.muxedReq, delta = s.muxedReq.ApplyDelta(req)
+	s.lists.SetSnoozedRooms(s.muxedReq.SnoozedRooms)
 	internal.Logf(reqCtx, "connstate", "new subs=%v unsubs=%v num_lists=%v", len(delta.Subs), len(delta.Unsubs), len(delta.Lists))
 	for key, l := range delta.Lists {
 		listData := ""
@@ -209,28 +311,39 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 		internal.Logf(reqCtx, "connstate", "room sub[%v] %v", roomID, sub)
 	}
 
-	// work out which rooms we'll return data for and add their relevant subscriptions to the builder
-	// for it to mix together
-	builder := NewRoomsBuilder()
 	// works out which rooms are subscribed to but doesn't pull room data
 	s.buildRoomSubscriptions(reqCtx, builder, delta.Subs, delta.Unsubs)
 	// works out how rooms get moved about but doesn't pull room data
 	respLists := s.buildListSubscriptions(reqCtx, builder, delta.Lists)
+	// operations for resumed lists come first, as this request may have changed the lists since
+	for listKey, l := range resumedLists {
+		if _, exists := s.muxedReq.Lists[listKey]; !exists {
+			continue
+		}
+		l.Ops = append(l.Ops, respLists[listKey].Ops...)
+		respLists[listKey] = l
+	}
 
 	// pull room data and set changes on the response
 	response := &sync3.Response{
 		Rooms: s.buildRooms(reqCtx, builder.BuildSubscriptions()), // pull room data
 		Lists: respLists,
 	}
+	// trickle required_state which didn't fit into earlier responses
+	s.sendRequiredStateBacklogs(response)
+
+	// warm up rooms the client expects to request soon. This never adds anything to the response.
+	s.prefetchRooms(reqCtx, req)
 
 	// Handle extensions AFTER processing lists as extensions may need to know which rooms the client
-	// is being notified about (e.g. for room account data)
+	// is being notified about (e.g. for room account data). Extensions don't remember what they sent
+	// before a restart, so they send everything again on resumed connections.
 	extCtx, region := internal.StartSpan(reqCtx, "extensions")
 	response.Extensions = s.extensionsHandler.Handle(extCtx, s.muxedReq.Extensions, extensions.Context{
 		UserID:             s.userID,
 		DeviceID:           s.deviceID,
 		RoomIDToTimeline:   response.RoomIDsToTimelineEventIDs(),
-		IsInitial:          isInitial,
+		IsInitial:          isInitial || resumed,
 		RoomIDsToLists:     s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists),
 		AllSubscribedRooms: keys(s.roomSubscriptions),
 		AllLists:           s.muxedReq.ListKeys(),
@@ -246,10 +359,20 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 		s.trackProcessDuration(time.Since(start), isInitial)
 	}
 
+	s.setUnreadTotal(response)
+
 	// do live tracking if we have nothing to tell the client yet
 	updateCtx, region := internal.StartSpan(reqCtx, "liveUpdate")
 	s.live.liveUpdate(updateCtx, req, s.muxedReq.Extensions, isInitial, response)
 	region.End()
+	response.CaughtUp = s.live.caughtUp()
+	// live events may have removed state from the backlogs
+	s.updateRequiredStateRemaining(response)
+	if req.IncludeStreamOrder {
+		response.FilterStreamOrder()
+	} else {
+		response.StreamOrder = nil
+	}
 
 	// counts are AFTER events are applied, hence after liveUpdate
 	for listKey := range response.Lists {
@@ -258,25 +381,59 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 		response.Lists[listKey] = l
 	}
 
+	// bump stamps are AFTER events are applied, as events can bump rooms
+	s.addBumpStamps(response)
+
+	// list deltas are AFTER events are applied, as events can move rooms in and out of ranges
+	s.addListDeltas(response, prevVisibleRoomIDs)
+
+	// ops are only coalesced once all ops are known, as live updates append ops
+	for listKey, l := range response.Lists {
+		if reqList, ok := s.muxedReq.Lists[listKey]; ok && reqList.ShouldCoalesceOps() {
+			l.Ops = sync3.CoalesceOps(l.Ops)
+			response.Lists[listKey] = l
+		}
+	}
+
+	// flag state events in the timeline now that live events have been appended
+	for roomID, room := range response.Rooms {
+		room.SetTimelineIsState()
+		response.Rooms[roomID] = room
+	}
+
 	// Add membership events for users sending typing notifications. We do this after live update
 	// and initial room loading code so we LL room members in all cases.
 	if response.Extensions.Typing != nil && response.Extensions.Typing.HasData(isInitial) {
 		s.lazyLoadTypingMembers(reqCtx, response)
 	}
+
+	// this must be after all state events are in the response, as it remembers what was sent
+	s.compactStateDiffs(response)
+
+	if snapshotChanged || response.ListOps() > 0 || len(response.Rooms) > 0 {
+		s.snapshotChanged = true
+	}
+
+	// this must be last, so that all events are in the response
+	if req.DedupeEvents {
+		response.DedupeEvents()
+	}
 	return response, nil
 }
 
 func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listKey string, prevReqList, nextReqList *sync3.RequestList) sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "onIncomingListRequest")
 	defer span.End()
-	roomList, overwritten := s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
+	roomList, overwritten := s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, nextReqList.PinnedRooms, sync3.DoNotOverwrite)
 
 	if nextReqList.ShouldGetAllRooms() {
 		if overwritten || prevReqList.FiltersChanged(nextReqList) {
 			// this is either a new list or the filters changed, so we need to splat all the rooms to the client.
-			subID := builder.AddSubscription(nextReqList.RoomSubscription)
+			// Sending the data for every room at once can make a huge response, so only the first batch
+			// is sent now and the rest are sent in subsequent responses.
 			allRoomIDs := roomList.RoomIDs()
-			builder.AddRoomsToSubscription(ctx, subID, allRoomIDs)
+			s.getAllRoomsBacklogs[listKey] = allRoomIDs
+			s.sendSlowGetAllRoomsBatch(ctx, builder, listKey, roomList, nextReqList)
 			return sync3.ResponseList{
 				// send all the room IDs initially so the user knows which rooms in the top-level rooms map
 				// correspond to this list.
@@ -289,9 +446,11 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 				},
 			}
 		}
+		s.sendSlowGetAllRoomsBatch(ctx, builder, listKey, roomList, nextReqList)
+	} else {
+		delete(s.getAllRoomsBacklogs, listKey)
 	}
 
-	// TODO: list deltas
 	var responseOperations []sync3.ResponseOp
 
 	var prevRange sync3.SliceRanges
@@ -309,8 +468,9 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 
 	sortChanged := prevReqList.SortOrderChanged(nextReqList)
 	filtersChanged := prevReqList.FiltersChanged(nextReqList)
-	if sortChanged || filtersChanged {
-		// the sort/filter operations have changed, invalidate everything (if there were previous syncs), re-sort and re-SYNC
+	pinsChanged := prevReqList.PinnedRoomsChanged(nextReqList)
+	if sortChanged || filtersChanged || pinsChanged {
+		// the sort/filter/pin operations have changed, invalidate everything (if there were previous syncs), re-sort and re-SYNC
 		if prevReqList != nil {
 			// there were previous syncs for this list, INVALIDATE the lot
 			logger.Trace().Interface("range", prevRange).Msg("INVALIDATEing because sort/filter ops have changed")
@@ -329,9 +489,10 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		}
 		if filtersChanged {
 			// we need to re-create the list as the rooms may have completely changed
-			roomList, _ = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
+			roomList, _ = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, nextReqList.PinnedRooms, sync3.Overwrite)
 		}
-		// resort as either we changed the sort order or we added/removed a bunch of rooms
+		// resort as either we changed the sort order/pins or we added/removed a bunch of rooms
+		roomList.SetPinnedRooms(nextReqList.PinnedRooms)
 		if err := roomList.Sort(nextReqList.Sort); err != nil {
 			logger.Err(err).Str("key", listKey).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -383,7 +544,7 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		// we need to make a new subscription registering this change to include the new data.
 		timelineChanged := prevReqList.TimelineLimitChanged(nextReqList)
 		reqStateChanged := prevReqList.RoomSubscription.RequiredStateChanged(nextReqList.RoomSubscription)
-		if !sortChanged && !filtersChanged && (timelineChanged || reqStateChanged) {
+		if !sortChanged && !filtersChanged && !pinsChanged && (timelineChanged || reqStateChanged) {
 			var newRS sync3.RoomSubscription
 			if timelineChanged {
 				newRS.TimelineLimit = nextReqList.TimelineLimit
@@ -391,6 +552,7 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 			if reqStateChanged {
 				newRS.RequiredState = nextReqList.RequiredState
 			}
+			newRS.ContentFields = nextReqList.ContentFields
 			newSubID := builder.AddSubscription(newRS)
 			// all the current rooms need to be added to this subscription
 			subslice := nextReqList.Ranges.SliceInto(roomList)
@@ -433,6 +595,7 @@ func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBu
 			// they deleted this list
 			logger.Debug().Str("key", listKey).Msg("list deleted")
 			s.lists.DeleteList(listKey)
+			delete(s.getAllRoomsBacklogs, listKey)
 			continue
 		}
 		result[listKey] = s.onIncomingListRequest(ctx, builder, listKey, list.Prev, list.Curr)
@@ -440,6 +603,30 @@ func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBu
 	return result
 }
 
+// sendSlowGetAllRoomsBatch adds the next batch of rooms from the list's slow_get_all_rooms backlog to
+// the response. Rooms which have left the list since the backlog was made are skipped.
+func (s *ConnState) sendSlowGetAllRoomsBatch(ctx context.Context, builder *RoomsBuilder, listKey string, roomList *sync3.FilteredSortableRooms, reqList *sync3.RequestList) {
+	backlog := s.getAllRoomsBacklogs[listKey]
+	var batch []string
+	for len(backlog) > 0 && len(batch) < SlowGetAllRoomsBatchSize {
+		roomID := backlog[0]
+		backlog = backlog[1:]
+		if _, ok := roomList.IndexOf(roomID); ok {
+			batch = append(batch, roomID)
+		}
+	}
+	if len(backlog) == 0 {
+		delete(s.getAllRoomsBacklogs, listKey)
+	} else {
+		s.getAllRoomsBacklogs[listKey] = backlog
+	}
+	if len(batch) == 0 {
+		return
+	}
+	subID := builder.AddSubscription(reqList.RoomSubscription)
+	builder.AddRoomsToSubscription(ctx, subID, batch)
+}
+
 func (s *ConnState) buildRoomSubscriptions(ctx context.Context, builder *RoomsBuilder, subs, unsubs []string) {
 	ctx, span := internal.StartSpan(ctx, "buildRoomSubscriptions")
 	defer span.End()
@@ -470,11 +657,7 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 	defer span.End()
 	result := make(map[string]sync3.Room)
 
-	var bumpEventTypes []string
-	for _, x := range s.muxedReq.Lists {
-		bumpEventTypes = append(bumpEventTypes, x.BumpEventTypes...)
-	}
-
+	bumpEventTypes := s.bumpEventTypes()
 	for _, bs := range builtSubs {
 		roomIDs := bs.RoomIDs
 		if bs.RoomSubscription.IncludeOldRooms != nil {
@@ -523,6 +706,54 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 	return result
 }
 
+// joinStatus returns the join status of a room the user is not joined to, or the empty string if
+// the user is joined.
+func (s *ConnState) joinStatus(urd caches.UserRoomData) string {
+	if urd.IsInvite && urd.Invite != nil {
+		if !urd.Invite.IsKnock {
+			return sync3.JoinStatusInvited
+		}
+		// a knock is moot if the user can join via a room they are already in
+		for _, allowedRoomID := range urd.Invite.AllowedRoomIDs {
+			if s.joinChecker.IsUserJoined(s.userID, allowedRoomID) {
+				return sync3.JoinStatusJoinEligibleViaSpace
+			}
+		}
+		return sync3.JoinStatusKnocked
+	}
+	if urd.KnockDenied {
+		return sync3.JoinStatusKnockDenied
+	}
+	return ""
+}
+
+// setUnreadTotal sets the unread total on the response if the client wants it and it has changed
+// since it was last sent.
+func (s *ConnState) setUnreadTotal(response *sync3.Response) {
+	if !s.muxedReq.ShouldIncludeUnreadTotal() {
+		// send it again if they turn it back on
+		s.lastUnreadTotal = -1
+		return
+	}
+	total := s.lists.UnreadTotal()
+	if total == s.lastUnreadTotal {
+		return
+	}
+	response.UnreadTotal = &total
+	s.lastUnreadTotal = total
+}
+
+// bumpEventTypes returns the bump event types of all lists.
+func (s *ConnState) bumpEventTypes() []string {
+	var bumpEventTypes []string
+	for _, x := range s.muxedReq.Lists {
+		bumpEventTypes = append(bumpEventTypes, x.BumpEventTypes...)
+	}
+	// sorted so callers can compare them
+	sort.Strings(bumpEventTypes)
+	return bumpEventTypes
+}
+
 func (s *ConnState) lazyLoadTypingMembers(ctx context.Context, response *sync3.Response) {
 	for roomID, typingEvent := range response.Extensions.Typing.Rooms {
 		if !s.lazyCache.IsLazyLoading(roomID) {
@@ -552,10 +783,310 @@ func (s *ConnState) lazyLoadTypingMembers(ctx context.Context, response *sync3.R
 	}
 }
 
+// prefetchRooms loads room data for the prefetch_ranges in this request, so that it can be returned
+// without hitting the database when the client requests these ranges.
+func (s *ConnState) prefetchRooms(ctx context.Context, req *sync3.Request) {
+	hinted := make(map[string]struct{})
+	for listKey, hintList := range req.Lists {
+		if len(hintList.PrefetchRanges) == 0 {
+			continue
+		}
+		reqList, ok := s.muxedReq.Lists[listKey]
+		list := s.lists.Get(listKey)
+		if !ok || list == nil {
+			continue
+		}
+		ctx, span := internal.StartSpan(ctx, "prefetchRooms")
+		bumpEventTypes := s.bumpEventTypes()
+		var roomIDs []string
+		for _, subslice := range hintList.PrefetchRanges.SliceInto(list) {
+			for _, roomID := range subslice.(*sync3.SortableRooms).RoomIDs() {
+				hinted[roomID] = struct{}{}
+				index, _ := list.IndexOf(roomID)
+				if _, inside := reqList.Ranges.Inside(int64(index)); inside {
+					continue // the client already has this room
+				}
+				if p, ok := s.prefetched[roomID]; ok && p.matches(s.entryRoomSubscription(reqList.RoomSubscription, roomID), bumpEventTypes) {
+					continue
+				}
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+		for timelineLimit, limitRoomIDs := range s.groupByEntryTimelineLimit(reqList.RoomSubscription, roomIDs) {
+			roomSub := reqList.RoomSubscription
+			roomSub.TimelineLimit = timelineLimit
+			rooms, loadPositions := s.loadRoomData(ctx, roomSub, bumpEventTypes, limitRoomIDs...)
+			for roomID, room := range rooms {
+				s.prefetched[roomID] = prefetchedRoom{
+					roomSub:        roomSub,
+					bumpEventTypes: bumpEventTypes,
+					room:           room,
+					loadPosition:   loadPositions[roomID],
+				}
+			}
+		}
+		span.End()
+	}
+	if len(hinted) == 0 {
+		return
+	}
+	// only keep rooms the client is still hinting at, to bound the amount of data we hold
+	for roomID := range s.prefetched {
+		if _, ok := hinted[roomID]; !ok {
+			delete(s.prefetched, roomID)
+		}
+	}
+}
+
+// getInitialRoomData returns full room data for these rooms, using prefetched data where possible.
+// Rooms which have been sent on this connection before are loaded with the reentry_timeline_limit, if set.
 func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSubscription, bumpEventTypes []string, roomIDs ...string) map[string]sync3.Room {
+	rooms := make(map[string]sync3.Room, len(roomIDs))
+	loadRoomIDs := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		p, ok := s.prefetched[roomID]
+		delete(s.prefetched, roomID)
+		if ok && p.matches(s.entryRoomSubscription(roomSub, roomID), bumpEventTypes) {
+			rooms[roomID] = p.room
+			s.loadPositions[roomID] = p.loadPosition
+			continue
+		}
+		loadRoomIDs = append(loadRoomIDs, roomID)
+	}
+	for timelineLimit, limitRoomIDs := range s.groupByEntryTimelineLimit(roomSub, loadRoomIDs) {
+		limitRoomSub := roomSub
+		limitRoomSub.TimelineLimit = timelineLimit
+		loadedRooms, loadPositions := s.loadRoomData(ctx, limitRoomSub, bumpEventTypes, limitRoomIDs...)
+		for roomID, room := range loadedRooms {
+			rooms[roomID] = room
+		}
+		// remember what we just loaded so if we see these events down the live stream we know to ignore them.
+		// This means that requesting a direct room subscription causes the connection to jump ahead to whatever
+		// is in the database at the time of the call, rather than gradually converging by consuming live data.
+		// This is fine, so long as we jump ahead on a per-room basis. We need to make sure (ideally) that the
+		// room state is also pinned to the load position here, else you could see weird things in individual
+		// responses such as an updated room.name without the associated m.room.name event (though this will
+		// come through on the next request -> it converges to the right state so it isn't critical).
+		for roomID, loadPosition := range loadPositions {
+			s.loadPositions[roomID] = loadPosition
+		}
+	}
+	for roomID, room := range rooms {
+		s.sentRooms[roomID] = struct{}{}
+		rooms[roomID] = s.chunkRequiredState(roomSub, roomID, room)
+	}
+	return rooms
+}
+
+// requiredStateBacklog is the required_state for a room which has yet to be sent.
+type requiredStateBacklog struct {
+	events    []json.RawMessage
+	chunkSize int
+}
+
+// chunkRequiredState limits the required_state in this newly loaded room to the required_state_chunk_size,
+// if there is one, keeping the rest to be sent in later responses. Non-member state is sent first, then
+// the members who sent timeline events, then all other members.
+func (s *ConnState) chunkRequiredState(roomSub sync3.RoomSubscription, roomID string, room sync3.Room) sync3.Room {
+	// the room has been loaded afresh, so any existing backlog is out of date
+	delete(s.requiredStateBacklogs, roomID)
+	chunkSize := roomSub.RequiredStateChunk()
+	if chunkSize == 0 || len(room.RequiredState) <= chunkSize {
+		return room
+	}
+	timelineSenders := make(map[string]struct{}, len(room.Timeline))
+	for _, ev := range room.Timeline {
+		timelineSenders[gjson.GetBytes(ev, "sender").Str] = struct{}{}
+	}
+	rank := func(ev json.RawMessage) int {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str != "m.room.member" {
+			return 0
+		}
+		if _, ok := timelineSenders[parsed.Get("state_key").Str]; ok {
+			return 1
+		}
+		return 2
+	}
+	events := make([]json.RawMessage, len(room.RequiredState))
+	copy(events, room.RequiredState)
+	sort.SliceStable(events, func(i, j int) bool {
+		return rank(events[i]) < rank(events[j])
+	})
+	room.RequiredState = events[:chunkSize]
+	remaining := len(events) - chunkSize
+	room.RequiredStateRemaining = &remaining
+	s.requiredStateBacklogs[roomID] = &requiredStateBacklog{
+		events:    events[chunkSize:],
+		chunkSize: chunkSize,
+	}
+	return room
+}
+
+// sendRequiredStateBacklogs adds the next chunk of required_state to the response for each room with a
+// backlog. Rooms which were loaded in this response already have their first chunk, and backlogs for
+// rooms which are no longer visible are dropped, as the room will be loaded afresh if it comes back.
+func (s *ConnState) sendRequiredStateBacklogs(response *sync3.Response) {
+	if len(s.requiredStateBacklogs) == 0 {
+		return
+	}
+	visibleRoomIDs := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	for roomID, backlog := range s.requiredStateBacklogs {
+		_, inList := visibleRoomIDs[roomID]
+		_, subscribed := s.roomSubscriptions[roomID]
+		if !inList && !subscribed {
+			delete(s.requiredStateBacklogs, roomID)
+			continue
+		}
+		room, exists := response.Rooms[roomID]
+		if room.Initial {
+			continue
+		}
+		if !exists {
+			// don't reset the client's notification counts
+			if metadata := s.lists.ReadOnlyRoom(roomID); metadata != nil {
+				room.NotificationCount = int64(metadata.NotificationCount)
+				room.HighlightCount = int64(metadata.HighlightCount)
+			}
+		}
+		n := backlog.chunkSize
+		if n > len(backlog.events) {
+			n = len(backlog.events)
+		}
+		room.RequiredState = append(room.RequiredState, backlog.events[:n]...)
+		backlog.events = backlog.events[n:]
+		remaining := len(backlog.events)
+		room.RequiredStateRemaining = &remaining
+		if remaining == 0 {
+			delete(s.requiredStateBacklogs, roomID)
+		}
+		response.Rooms[roomID] = room
+	}
+}
+
+// updateRequiredStateRemaining sets required_state_remaining to the current size of each backlog, for
+// rooms in the response which are having their required_state sent in chunks.
+func (s *ConnState) updateRequiredStateRemaining(response *sync3.Response) {
+	for roomID, room := range response.Rooms {
+		if room.RequiredStateRemaining == nil {
+			continue
+		}
+		remaining := 0
+		if backlog, ok := s.requiredStateBacklogs[roomID]; ok {
+			remaining = len(backlog.events)
+		}
+		room.RequiredStateRemaining = &remaining
+		response.Rooms[roomID] = room
+	}
+}
+
+// compactStateDiffs replaces state events in the timeline of rooms which want compact_state_diffs
+// with diffs from the version of the state event last sent on this connection. It remembers the state
+// events sent for these rooms so later responses can be diffed against them.
+func (s *ConnState) compactStateDiffs(response *sync3.Response) {
+	wantsDiffs := false
+	for _, reqList := range s.muxedReq.Lists {
+		wantsDiffs = wantsDiffs || reqList.ShouldCompactStateDiffs()
+	}
+	for _, roomSub := range s.roomSubscriptions {
+		wantsDiffs = wantsDiffs || roomSub.ShouldCompactStateDiffs()
+	}
+	if !wantsDiffs {
+		if len(s.sentState) > 0 {
+			s.sentState = make(map[string]map[[2]string]json.RawMessage)
+		}
+		return
+	}
+	if len(s.sentState) > 0 {
+		visibleRoomIDs := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+		for roomID := range s.sentState {
+			_, inList := visibleRoomIDs[roomID]
+			_, subscribed := s.roomSubscriptions[roomID]
+			if !inList && !subscribed {
+				// the room will be sent in full if it comes back
+				delete(s.sentState, roomID)
+			}
+		}
+	}
+	for roomID, room := range response.Rooms {
+		if !s.subscriptionForRoom(roomID).ShouldCompactStateDiffs() {
+			delete(s.sentState, roomID)
+			continue
+		}
+		sentState := s.sentState[roomID]
+		if sentState == nil || room.Initial {
+			// the client forgets the room state when it is sent in full, so there's nothing to diff against
+			sentState = make(map[[2]string]json.RawMessage)
+			s.sentState[roomID] = sentState
+		}
+		for _, ev := range room.RequiredState {
+			parsed := gjson.ParseBytes(ev)
+			sentState[[2]string{parsed.Get("type").Str, parsed.Get("state_key").Str}] = ev
+		}
+		for i, ev := range room.Timeline {
+			parsed := gjson.ParseBytes(ev)
+			stateKey := parsed.Get("state_key")
+			if !stateKey.Exists() {
+				continue
+			}
+			key := [2]string{parsed.Get("type").Str, stateKey.Str}
+			if prevEvent, ok := sentState[key]; ok && !room.Initial {
+				room.Timeline[i] = sync3.CompactStateEvent(ev, prevEvent)
+			}
+			sentState[key] = ev
+		}
+		response.Rooms[roomID] = room
+	}
+}
+
+// removeFromRequiredStateBacklog drops the state event with this type and state key from the room's
+// backlog, if it is there. This is called when the client is sent a newer version of the state event,
+// which must not then be overwritten by the older version in the backlog.
+func (s *ConnState) removeFromRequiredStateBacklog(roomID, evType, stateKey string) {
+	backlog, ok := s.requiredStateBacklogs[roomID]
+	if !ok {
+		return
+	}
+	for i, ev := range backlog.events {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str == evType && parsed.Get("state_key").Str == stateKey {
+			backlog.events = append(backlog.events[:i], backlog.events[i+1:]...)
+			break
+		}
+	}
+	if len(backlog.events) == 0 {
+		delete(s.requiredStateBacklogs, roomID)
+	}
+}
+
+// entryRoomSubscription returns the subscription to use when this room enters the window. This is
+// roomSub, with the timeline limit replaced by the reentry_timeline_limit if the room has been sent before.
+func (s *ConnState) entryRoomSubscription(roomSub sync3.RoomSubscription, roomID string) sync3.RoomSubscription {
+	if roomSub.ReentryTimelineLimit == nil {
+		return roomSub
+	}
+	if _, sent := s.sentRooms[roomID]; sent {
+		roomSub.TimelineLimit = *roomSub.ReentryTimelineLimit
+	}
+	return roomSub
+}
+
+// groupByEntryTimelineLimit groups these rooms by the timeline limit to use when they enter the window.
+func (s *ConnState) groupByEntryTimelineLimit(roomSub sync3.RoomSubscription, roomIDs []string) map[int64][]string {
+	groups := make(map[int64][]string)
+	for _, roomID := range roomIDs {
+		timelineLimit := s.entryRoomSubscription(roomSub, roomID).TimelineLimit
+		groups[timelineLimit] = append(groups[timelineLimit], roomID)
+	}
+	return groups
+}
+
+// loadRoomData loads full room data for these rooms from the caches, along with the load position of each room.
+func (s *ConnState) loadRoomData(ctx context.Context, roomSub sync3.RoomSubscription, bumpEventTypes []string, roomIDs ...string) (map[string]sync3.Room, map[string]int64) {
 	ctx, span := internal.StartSpan(ctx, "getInitialRoomData")
 	defer span.End()
 	rooms := make(map[string]sync3.Room, len(roomIDs))
+	loadPositions := make(map[string]int64, len(roomIDs))
 	// We want to grab the user room data and the room metadata for each room ID. We use the globally
 	// highest NID we've seen to act as an anchor for the request. This anchor does not guarantee that
 	// events returned here have already been seen - the position is not globally ordered - so because
@@ -563,6 +1094,22 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// has seen 6, as concurrent room updates cause A and B to race. This is why we then go through the
 	// response to this call to assign new load positions for each room.
 	roomIDToUserRoomData := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit))
+	if roomSub.ShouldOnlyReturnUnreadTimeline() {
+		for roomID, urd := range roomIDToUserRoomData {
+			s.userCache.TrimTimelineToUnread(ctx, roomID, &urd)
+			roomIDToUserRoomData[roomID] = urd
+		}
+	}
+	centerEventNotFound := make(map[string]bool)
+	if roomSub.CenterEventID != "" {
+		for roomID, urd := range roomIDToUserRoomData {
+			if !s.userCache.LoadTimelineAroundEvent(ctx, s.anchorLoadPosition, roomID, roomSub.CenterEventID, int(roomSub.TimelineLimit), &urd) {
+				centerEventNotFound[roomID] = true
+				continue
+			}
+			roomIDToUserRoomData[roomID] = urd
+		}
+	}
 	roomMetadatas := s.globalCache.LoadRooms(ctx, roomIDs...)
 	// prepare lazy loading data structures, txn IDs
 	roomToUsersInTimeline := make(map[string][]string, len(roomIDToUserRoomData))
@@ -580,14 +1127,29 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		}
 		roomToUsersInTimeline[roomID] = userIDs
 		roomToTimeline[roomID] = urd.RequestedLatestEvents.Timeline
-		// remember what we just loaded so if we see these events down the live stream we know to ignore them.
-		// This means that requesting a direct room subscription causes the connection to jump ahead to whatever
-		// is in the database at the time of the call, rather than gradually converging by consuming live data.
-		// This is fine, so long as we jump ahead on a per-room basis. We need to make sure (ideally) that the
-		// room state is also pinned to the load position here, else you could see weird things in individual
-		// responses such as an updated room.name without the associated m.room.name event (though this will
-		// come through on the next request -> it converges to the right state so it isn't critical).
-		s.loadPositions[roomID] = urd.RequestedLatestEvents.LatestNID
+		if roomSub.ShouldAnnotateMembershipChanges() {
+			roomToTimeline[roomID] = sync3.AnnotateMembershipChanges(roomToTimeline[roomID])
+		}
+		if s.muxedReq.ShouldAnnotateDayBoundaries() {
+			// the event before this timeline is unknown, so the first event is never flagged
+			roomToTimeline[roomID], s.lastTimelineTimestamps[roomID] = sync3.AnnotateDayBoundaries(
+				roomToTimeline[roomID], 0, s.muxedReq.DayBoundaryUTCOffset(),
+			)
+		}
+		loadPositions[roomID] = urd.RequestedLatestEvents.LatestNID
+	}
+	if roomSub.ShouldIncludeSenderMembership() {
+		// load the memberships for every room at once
+		var eventIDs []string
+		for _, timeline := range roomToTimeline {
+			for _, ev := range timeline {
+				eventIDs = append(eventIDs, gjson.GetBytes(ev, "event_id").Str)
+			}
+		}
+		memberships := s.globalCache.LoadSenderMemberships(ctx, eventIDs)
+		for roomID, timeline := range roomToTimeline {
+			roomToTimeline[roomID] = sync3.AnnotateSenderMemberships(timeline, memberships)
+		}
 	}
 	roomToTimeline = s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, roomToTimeline)
 	rsm := roomSub.RequiredStateMap(s.userID)
@@ -596,7 +1158,8 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// since we'll be using the invite_state only.
 	loadRoomIDs := make([]string, 0, len(roomIDs))
 	for _, roomID := range roomIDs {
-		if !s.joinChecker.IsUserInvited(s.userID, roomID) {
+		// knocks are not tracked by the join checker, so also check the user's room data
+		if !s.joinChecker.IsUserInvited(s.userID, roomID) && !roomIDToUserRoomData[roomID].IsInvite {
 			loadRoomIDs = append(loadRoomIDs, roomID)
 		}
 	}
@@ -608,6 +1171,33 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	if roomIDToState == nil { // e.g no required_state
 		roomIDToState = make(map[string][]json.RawMessage)
 	}
+	// the first view state is only loaded here, when rooms first appear, and never updated live.
+	var roomIDToFirstViewState map[string][]json.RawMessage
+	if len(roomSub.FirstViewState) > 0 {
+		fvsm := sync3.RoomSubscription{RequiredState: roomSub.FirstViewState}.RequiredStateMap(s.userID)
+		roomIDToFirstViewState = s.globalCache.LoadRoomState(ctx, loadRoomIDs, s.anchorLoadPosition, fvsm, roomToUsersInTimeline)
+	}
+	var latestEventSenders map[string]*sync3.LatestEventSender
+	if roomSub.ShouldIncludeLatestEventSender() {
+		roomToSender := make(map[string]string, len(roomIDs))
+		for _, roomID := range roomIDs {
+			metadata := roomMetadatas[roomID]
+			// only joined rooms, as other users cannot see the timeline
+			if metadata == nil || s.joinStatus(roomIDToUserRoomData[roomID]) != "" {
+				continue
+			}
+			ev, ok := metadata.LatestBumpEvent(bumpEventTypes)
+			if !ok || ev.Sender == "" {
+				continue
+			}
+			// don't leak who sent events from before we joined
+			if roomListsMeta := s.lists.ReadOnlyRoom(roomID); roomListsMeta != nil && ev.NID < roomListsMeta.JoinTiming.NID {
+				continue
+			}
+			roomToSender[roomID] = ev.Sender
+		}
+		latestEventSenders = s.loadLatestEventSenders(ctx, s.anchorLoadPosition, roomToSender)
+	}
 	for _, roomID := range roomIDs {
 		userRoomData, ok := roomIDToUserRoomData[roomID]
 		if !ok {
@@ -630,6 +1220,9 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			if requiredState == nil {
 				requiredState = make([]json.RawMessage, 0)
 			}
+		} else {
+			// the stripped state is all we can see, so satisfy required_state from that
+			requiredState = filterStrippedState(inviteState, rsm)
 		}
 
 		// Get the highest timestamp, determined by bumpEventTypes,
@@ -662,20 +1255,52 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			}
 		}
 
+		timeline := roomSub.FilterTimeline(roomToTimeline[roomID])
+		var relations map[string]sync3.RelationsSummary
+		if roomSub.ShouldAggregateRelations() {
+			// aggregate over the unfiltered timeline, so clients can filter out reactions but still see counts
+			relations = sync3.AggregateRelations(roomToTimeline[roomID], timeline)
+		}
+		joinStatus := s.joinStatus(userRoomData)
+		var serverACL *internal.ServerACL
+		if roomSub.ShouldIncludeServerACL() && joinStatus == "" {
+			// only joined rooms, as other users cannot see the room state
+			serverACL = metadata.ServerACL
+		}
+		var callMembers *[]string
+		var latestEventSender *sync3.LatestEventSender
+		if joinStatus == "" {
+			if userIDs := metadata.CallMembers(); len(userIDs) > 0 {
+				callMembers = &userIDs
+			}
+			latestEventSender = latestEventSenders[roomID]
+		}
+
 		rooms[roomID] = sync3.Room{
-			Name:              internal.CalculateRoomName(metadata, 5), // TODO: customisable?
-			AvatarChange:      sync3.NewAvatarChange(internal.CalculateAvatar(metadata)),
-			NotificationCount: int64(userRoomData.NotificationCount),
-			HighlightCount:    int64(userRoomData.HighlightCount),
-			Timeline:          roomToTimeline[roomID],
-			RequiredState:     requiredState,
-			InviteState:       inviteState,
-			Initial:           true,
-			IsDM:              userRoomData.IsDM,
-			JoinedCount:       metadata.JoinCount,
-			InvitedCount:      &metadata.InviteCount,
-			PrevBatch:         userRoomData.RequestedLatestEvents.PrevBatch,
-			Timestamp:         maxTs,
+			Name:                internal.CalculateRoomName(metadata, 5), // TODO: customisable?
+			AvatarChange:        sync3.NewAvatarChange(internal.CalculateAvatar(metadata)),
+			NotificationCount:   int64(userRoomData.NotificationCount),
+			HighlightCount:      int64(userRoomData.HighlightCount),
+			Timeline:            roomSub.ProjectContent(timeline),
+			RequiredState:       roomSub.ProjectContent(requiredState),
+			FirstViewState:      roomSub.ProjectContent(roomIDToFirstViewState[roomID]),
+			InviteState:         inviteState,
+			Initial:             true,
+			IsDM:                userRoomData.IsDM || (s.muxedReq.ShouldInferDMs() && metadata.LooksLikeDM()),
+			IsMuted:             userRoomData.IsMuted,
+			JoinedCount:         metadata.JoinCount,
+			InvitedCount:        &metadata.InviteCount,
+			PrevBatch:           userRoomData.RequestedLatestEvents.PrevBatch,
+			TimelineComplete:    userRoomData.RequestedLatestEvents.TimelineComplete,
+			Timestamp:           maxTs,
+			JoinStatus:          joinStatus,
+			Relations:           relations,
+			ServerACL:           serverACL,
+			CallMembers:         callMembers,
+			LatestEventSender:   latestEventSender,
+			Heroes:              sync3.NewHeroes(metadata),
+			SpaceChildCount:     sync3.NewSpaceChildCount(metadata),
+			CenterEventNotFound: centerEventNotFound[roomID],
 		}
 	}
 
@@ -684,7 +1309,177 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			s.lazyCache.Add(roomID, userIDs...)
 		}
 	}
-	return rooms
+	return rooms, loadPositions
+}
+
+// filterStrippedState returns the stripped state events which match the required state map.
+func filterStrippedState(strippedState []json.RawMessage, rsm *internal.RequiredStateMap) []json.RawMessage {
+	var result []json.RawMessage
+	for _, ev := range strippedState {
+		parsed := gjson.ParseBytes(ev)
+		if rsm.Include(parsed.Get("type").Str, parsed.Get("state_key").Str) {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// loadLatestEventSenders resolves the display names of the given room ID -> sender user ID map at
+// loadPosition.
+func (s *ConnState) loadLatestEventSenders(ctx context.Context, loadPosition int64, roomToSender map[string]string) map[string]*sync3.LatestEventSender {
+	if len(roomToSender) == 0 {
+		return nil
+	}
+	roomIDs := make([]string, 0, len(roomToSender))
+	var requiredState [][2]string
+	for roomID, sender := range roomToSender {
+		roomIDs = append(roomIDs, roomID)
+		requiredState = append(requiredState, [2]string{"m.room.member", sender})
+	}
+	rsm := sync3.RoomSubscription{RequiredState: requiredState}.RequiredStateMap(s.userID)
+	roomIDToState := s.globalCache.LoadRoomState(ctx, roomIDs, loadPosition, rsm, nil)
+	result := make(map[string]*sync3.LatestEventSender, len(roomToSender))
+	for roomID, sender := range roomToSender {
+		var memberEvent json.RawMessage
+		// the state includes the members of the other rooms too, so pick out the sender
+		for _, ev := range roomIDToState[roomID] {
+			if gjson.GetBytes(ev, "state_key").Str == sender {
+				memberEvent = ev
+				break
+			}
+		}
+		result[roomID] = sync3.NewLatestEventSender(sender, memberEvent)
+	}
+	return result
+}
+
+// addBumpStamps tells the client the timestamps used to sort rooms in recency sorted lists, for all
+// rooms in the response which are in those lists. This lets clients reproduce our ordering.
+func (s *ConnState) addBumpStamps(response *sync3.Response) {
+	for listKey, reqList := range s.muxedReq.Lists {
+		if !reqList.SortsByRecency() {
+			continue
+		}
+		list := s.lists.Get(listKey)
+		if list == nil {
+			continue
+		}
+		roomIDs := make(map[string]struct{})
+		for _, op := range response.Lists[listKey].Ops {
+			for _, roomID := range op.IncludedRoomIDs() {
+				roomIDs[roomID] = struct{}{}
+			}
+		}
+		for roomID := range response.Rooms {
+			index, ok := list.IndexOf(roomID)
+			if !ok {
+				continue
+			}
+			if _, inside := reqList.Ranges.Inside(int64(index)); inside || reqList.ShouldGetAllRooms() {
+				roomIDs[roomID] = struct{}{}
+			}
+		}
+		if len(roomIDs) == 0 {
+			continue
+		}
+		bumpStamps := make(map[string]uint64, len(roomIDs))
+		for roomID := range roomIDs {
+			room := s.lists.ReadOnlyRoom(roomID)
+			if room == nil {
+				continue
+			}
+			bumpStamps[roomID] = room.GetLastInterestedEventTimestamp(listKey)
+		}
+		resList, ok := response.Lists[listKey]
+		if !ok {
+			resList.Count = s.lists.Count(listKey)
+		}
+		resList.BumpStamps = bumpStamps
+		if response.Lists == nil {
+			response.Lists = make(map[string]sync3.ResponseList)
+		}
+		response.Lists[listKey] = resList
+	}
+}
+
+// addListDeltas sets the room IDs which entered and left each list's ranges on lists which asked for
+// them, by comparing the rooms visible in each list now against prevVisibleRoomIDs.
+func (s *ConnState) addListDeltas(response *sync3.Response, prevVisibleRoomIDs map[string][]string) {
+	var wantDeltas []string
+	for listKey, reqList := range s.muxedReq.Lists {
+		if reqList.ShouldIncludeDeltas() {
+			wantDeltas = append(wantDeltas, listKey)
+		}
+	}
+	if len(wantDeltas) == 0 {
+		return
+	}
+	// list key -> room IDs visible in that list
+	invert := func(listsByRoomIDs map[string][]string) map[string]map[string]struct{} {
+		roomIDsByList := make(map[string]map[string]struct{})
+		for roomID, listKeys := range listsByRoomIDs {
+			for _, listKey := range listKeys {
+				if roomIDsByList[listKey] == nil {
+					roomIDsByList[listKey] = make(map[string]struct{})
+				}
+				roomIDsByList[listKey][roomID] = struct{}{}
+			}
+		}
+		return roomIDsByList
+	}
+	prev := invert(prevVisibleRoomIDs)
+	curr := invert(s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists))
+	for _, listKey := range wantDeltas {
+		l := response.Lists[listKey]
+		l.Added, l.Removed = nil, nil
+		for roomID := range curr[listKey] {
+			if _, ok := prev[listKey][roomID]; !ok {
+				l.Added = append(l.Added, roomID)
+			}
+		}
+		for roomID := range prev[listKey] {
+			if _, ok := curr[listKey][roomID]; !ok {
+				l.Removed = append(l.Removed, roomID)
+			}
+		}
+		sort.Strings(l.Added)
+		sort.Strings(l.Removed)
+		response.Lists[listKey] = l
+	}
+}
+
+// subscriptionForRoom returns the combination of all room subscriptions and lists which currently
+// include this room, which determines how live events in this room are returned. Returns the zero
+// value if nothing includes this room, meaning no filtering or projection is applied.
+func (s *ConnState) subscriptionForRoom(roomID string) sync3.RoomSubscription {
+	var subs []sync3.RoomSubscription
+	if sub, ok := s.roomSubscriptions[roomID]; ok {
+		subs = append(subs, sub)
+	}
+	for listKey, reqList := range s.muxedReq.Lists {
+		list := s.lists.Get(listKey)
+		if list == nil {
+			continue
+		}
+		index, ok := list.IndexOf(roomID)
+		if !ok {
+			continue
+		}
+		if !reqList.ShouldGetAllRooms() {
+			if _, inside := reqList.Ranges.Inside(int64(index)); !inside {
+				continue
+			}
+		}
+		subs = append(subs, reqList.RoomSubscription)
+	}
+	if len(subs) == 0 {
+		return sync3.RoomSubscription{}
+	}
+	combined := subs[0]
+	for _, sub := range subs[1:] {
+		combined = combined.Combine(sub)
+	}
+	return combined
 }
 
 func (s *ConnState) trackSetupDuration(dur time.Duration, isInitial bool) {
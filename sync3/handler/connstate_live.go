@@ -9,12 +9,17 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/tidwall/gjson"
 )
 
 // the amount of time to try to insert into a full buffer before giving up.
 // Customisable for testing
 var BufferWaitTime = time.Second * 5
 
+// the maximum number of rooms whose data is sent in one response for slow_get_all_rooms lists.
+// Customisable for testing
+var SlowGetAllRoomsBatchSize = 100
+
 // Contains code for processing live updates. Split out from connstate because they concern different
 // code paths. Relies on ConnState for various list/sort/subscription operations.
 type connStateLive struct {
@@ -25,6 +30,10 @@ type connStateLive struct {
 	// saying the client is dead and clean up the conn.
 	updates    chan caches.Update
 	bufferFull bool
+	// The soft limit on the number of list operations to send in a single response. Once reached,
+	// remaining updates are left on the updates channel to be processed in subsequent responses. The
+	// ops of a single update are never split. 0 means no limit.
+	maxOpsPerResponse int
 }
 
 // Called when there is an update from the user cache. This callback fires when the server gets a new event and determines this connection MAY be
@@ -61,7 +70,7 @@ func (s *connStateLive) liveUpdate(
 	// block until we get a new event, with appropriate timeout
 	startTime := time.Now()
 	hasLiveStreamed := false
-	for response.ListOps() == 0 && len(response.Rooms) == 0 && !response.Extensions.HasData(isInitial) {
+	for response.ListOps() == 0 && len(response.Rooms) == 0 && !response.Extensions.HasData(isInitial) && response.UnreadTotal == nil {
 		hasLiveStreamed = true
 		timeToWait := time.Duration(req.TimeoutMSecs()) * time.Millisecond
 		timeWaited := time.Since(startTime)
@@ -83,7 +92,7 @@ func (s *connStateLive) liveUpdate(
 		case update := <-s.updates:
 			s.processUpdate(ctx, update, response, ex)
 			// if there's more updates and we don't have lots stacked up already, go ahead and process another
-			for len(s.updates) > 0 && response.ListOps() < 50 {
+			for len(s.updates) > 0 && !s.opsLimitReached(response) {
 				update = <-s.updates
 				s.processUpdate(ctx, update, response, ex)
 			}
@@ -96,12 +105,13 @@ func (s *connStateLive) liveUpdate(
 	// due to natural circumstances, B) it isn't an initial request and C) there is in fact some data there.
 	numQueuedUpdates := len(s.updates)
 	if !hasLiveStreamed && !isInitial && numQueuedUpdates > 0 {
-		for i := 0; i < numQueuedUpdates; i++ {
+		numProcessed := 0
+		for ; numProcessed < numQueuedUpdates && !s.opsLimitReached(response); numProcessed++ {
 			update := <-s.updates
 			s.processUpdate(ctx, update, response, ex)
 		}
-		log.Debug().Int("num_queued", numQueuedUpdates).Msg("liveUpdate: caught up")
-		internal.Logf(ctx, "connstate", "liveUpdate caught up %d updates", numQueuedUpdates)
+		log.Debug().Int("num_queued", numQueuedUpdates).Int("num_processed", numProcessed).Msg("liveUpdate: caught up")
+		internal.Logf(ctx, "connstate", "liveUpdate caught up %d/%d updates", numProcessed, numQueuedUpdates)
 	}
 
 	log.Trace().Bool("live_streamed", hasLiveStreamed).Msg("liveUpdate: returning")
@@ -111,9 +121,29 @@ func (s *connStateLive) liveUpdate(
 	// TODO: op consolidation
 }
 
+// caughtUp returns true if there are no updates waiting to be sent to the client. This is false
+// whenever updates have been deferred to a subsequent response e.g due to maxOpsPerResponse.
+func (s *connStateLive) caughtUp() bool {
+	return len(s.updates) == 0
+}
+
+// opsLimitReached returns true if the response has enough list operations that we should stop
+// processing updates. The limit bounds how many updates are batched into one response, not the ops of
+// a single update. Updates are always processed in their entirety, so every op for a given update
+// ends up in the same response: this means the client never sees half of a DELETE/INSERT pair and
+// its view of the lists stays consistent with ours. A single update moves one room, which is at most
+// a DELETE and an INSERT for each range of each list, so the limit may be exceeded by that many ops.
+func (s *connStateLive) opsLimitReached(response *sync3.Response) bool {
+	if s.maxOpsPerResponse <= 0 {
+		return false
+	}
+	return response.ListOps() >= s.maxOpsPerResponse
+}
+
 func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update, response *sync3.Response, ex extensions.Request) {
 	internal.Logf(ctx, "liveUpdate", "process live update %s", update.Type())
 	s.processLiveUpdate(ctx, update, response)
+	s.setUnreadTotal(response)
 	// pass event to extensions AFTER processing
 	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
 	s.extensionsHandler.HandleLiveUpdate(ctx, update, ex, &response.Extensions, extensions.Context{
@@ -132,6 +162,14 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 	internal.AssertWithContext(ctx, "processLiveUpdate: request list length != internal list length", s.lists.Len() == len(s.muxedReq.Lists))
 	roomUpdate, _ := up.(caches.RoomUpdate)
 	roomEventUpdate, _ := up.(*caches.RoomEventUpdate)
+	if roomUpdate != nil {
+		// any prefetched data for this room is now out of date
+		delete(s.prefetched, roomUpdate.RoomID())
+	}
+	if _, isDMUpdate := up.(*caches.DMUpdate); isDMUpdate && s.lists.ReadOnlyRoom(roomUpdate.RoomID()) == nil {
+		// m.direct can refer to rooms the user isn't in, which must not be added to lists
+		return false
+	}
 	if roomEventUpdate != nil {
 		// if this is a room event update we may not want to process this event, for a few reasons.
 		if !roomEventUpdate.EventData.AlwaysProcess {
@@ -215,8 +253,13 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 
 		r.HighlightCount = int64(userRoomData.HighlightCount)
 		r.NotificationCount = int64(userRoomData.NotificationCount)
+		r.JoinStatus = s.joinStatus(*userRoomData)
 		if roomEventUpdate != nil && roomEventUpdate.EventData.Event != nil {
-			r.NumLive++
+			roomSub := s.subscriptionForRoom(roomEventUpdate.RoomID())
+			includeInTimeline := roomSub.IncludeTimelineEvent(roomEventUpdate.EventData.EventType)
+			if includeInTimeline {
+				r.NumLive++
+			}
 			advancedPastEvent := false
 			if !roomEventUpdate.EventData.AlwaysProcess {
 				if roomEventUpdate.EventData.NID <= s.loadPositions[roomEventUpdate.RoomID()] {
@@ -225,23 +268,54 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				}
 				s.loadPositions[roomEventUpdate.RoomID()] = roomEventUpdate.EventData.NID
 			}
+			if roomSub.ShouldIncludeLatestEventSender() && r.JoinStatus == "" && bumpsRoom(roomEventUpdate.EventData.EventType, bumpEventTypes) {
+				roomID := roomEventUpdate.RoomID()
+				r.LatestEventSender = s.loadLatestEventSenders(ctx, s.loadPositions[roomID], map[string]string{
+					roomID: roomEventUpdate.EventData.Sender,
+				})[roomID]
+			}
 			// we only append to the timeline if we haven't already got this event. This can happen when:
 			// - 2 live events for a room mid-connection
 			// - next request bumps a room from outside to inside the window
 			// - the initial:true room from BuildSubscriptions contains the latest live events in the timeline as it's pulled from the DB
 			// - we then process the live events in turn which adds them again.
-			if !advancedPastEvent {
+			if !advancedPastEvent && includeInTimeline {
+				timeline := []json.RawMessage{roomEventUpdate.EventData.Event}
+				if roomSub.ShouldAnnotateMembershipChanges() {
+					timeline = sync3.AnnotateMembershipChanges(timeline)
+				}
+				if roomSub.ShouldIncludeSenderMembership() {
+					eventID := gjson.GetBytes(roomEventUpdate.EventData.Event, "event_id").Str
+					timeline = sync3.AnnotateSenderMemberships(timeline, s.globalCache.LoadSenderMemberships(ctx, []string{eventID}))
+				}
+				if s.muxedReq.ShouldAnnotateDayBoundaries() {
+					roomID := roomEventUpdate.RoomID()
+					timeline, s.lastTimelineTimestamps[roomID] = sync3.AnnotateDayBoundaries(
+						timeline, s.lastTimelineTimestamps[roomID], s.muxedReq.DayBoundaryUTCOffset(),
+					)
+				}
 				roomIDtoTimeline := s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, map[string][]json.RawMessage{
-					roomEventUpdate.RoomID(): {roomEventUpdate.EventData.Event},
+					roomEventUpdate.RoomID(): timeline,
 				})
-				r.Timeline = append(r.Timeline, roomIDtoTimeline[roomEventUpdate.RoomID()]...)
 				roomID := roomEventUpdate.RoomID()
+				if roomEventUpdate.EventData.StateKey != nil {
+					s.removeFromRequiredStateBacklog(roomID, roomEventUpdate.EventData.EventType, *roomEventUpdate.EventData.StateKey)
+				}
+				contentFields := roomSub.ContentFields
+				for _, ev := range roomIDtoTimeline[roomID] {
+					r.Timeline = append(r.Timeline, internal.ProjectEventContent(ev, contentFields))
+				}
+				// live events are processed in stream position order, so remember it across rooms
+				response.StreamOrder = append(response.StreamOrder, sync3.StreamOrderEntry{
+					RoomID:  roomID,
+					EventID: gjson.GetBytes(roomEventUpdate.EventData.Event, "event_id").Str,
+				})
 				sender := roomEventUpdate.EventData.Sender
 				if s.lazyCache.IsLazyLoading(roomID) && !s.lazyCache.IsSet(roomID, sender) {
 					// load the state event
 					memberEvent := s.globalCache.LoadStateEvent(context.Background(), roomID, s.loadPositions[roomID], "m.room.member", sender)
 					if memberEvent != nil {
-						r.RequiredState = append(r.RequiredState, memberEvent)
+						r.RequiredState = append(r.RequiredState, internal.ProjectEventContent(memberEvent, contentFields))
 						s.lazyCache.AddUser(roomID, sender)
 					}
 				}
@@ -260,11 +334,13 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				metadata := roomUpdate.GlobalRoomMetadata()
 				metadata.RemoveHero(s.userID)
 				thisRoom.Name = internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+				thisRoom.Heroes = sync3.NewHeroes(metadata)
 			}
 			if delta.RoomAvatarChanged {
 				metadata := roomUpdate.GlobalRoomMetadata()
 				metadata.RemoveHero(s.userID)
 				thisRoom.AvatarChange = sync3.NewAvatarChange(internal.CalculateAvatar(metadata))
+				thisRoom.Heroes = sync3.NewHeroes(metadata)
 			}
 			if delta.InviteCountChanged {
 				thisRoom.InvitedCount = &roomUpdate.GlobalRoomMetadata().InviteCount
@@ -272,6 +348,20 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			if delta.JoinCountChanged {
 				thisRoom.JoinedCount = roomUpdate.GlobalRoomMetadata().JoinCount
 			}
+			if delta.ServerACLChanged && s.joinStatus(*roomUpdate.UserRoomMetadata()) == "" &&
+				s.subscriptionForRoom(roomUpdate.RoomID()).ShouldIncludeServerACL() {
+				thisRoom.ServerACL = roomUpdate.GlobalRoomMetadata().ServerACL
+			}
+			if delta.CallMembersChanged && s.joinStatus(*roomUpdate.UserRoomMetadata()) == "" {
+				callMembers := roomUpdate.GlobalRoomMetadata().CallMembers()
+				if callMembers == nil {
+					callMembers = []string{}
+				}
+				thisRoom.CallMembers = &callMembers
+			}
+			if roomEventUpdate != nil && roomEventUpdate.EventData.EventType == "m.space.child" {
+				thisRoom.SpaceChildCount = sync3.NewSpaceChildCount(roomUpdate.GlobalRoomMetadata())
+			}
 
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
@@ -340,13 +430,8 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 
 		metadata := rup.GlobalRoomMetadata().CopyHeroes()
 		metadata.RemoveHero(s.userID)
-		// TODO: if we change a room from being a DM to not being a DM, we should call
-		// SetRoom and recalculate avatars. To do that we'd need to
-		//  - listen to m.direct global account data events
-		//   - compute the symmetric difference between old and new
-		//   - call SetRooms for each room in the difference.
-		// I'm assuming this happens so rarely that we can ignore this for now. PRs
-		// welcome if you a strong opinion to the contrary.
+		// DM changes arrive as a DMUpdate for each room in the symmetric difference of the old
+		// and new m.direct, so this re-evaluates is_dm filters.
 		delta = s.lists.SetRoom(sync3.RoomConnMetadata{
 			RoomMetadata:                  *metadata,
 			UserRoomData:                  *rup.UserRoomMetadata(),
@@ -438,3 +523,17 @@ func (s *connStateLive) resort(
 	}
 	return ops, hasUpdates
 }
+
+// bumpsRoom returns true if an event of this type bumps rooms in lists with these bump_event_types.
+// All events bump rooms if no types are given.
+func bumpsRoom(eventType string, bumpEventTypes []string) bool {
+	if len(bumpEventTypes) == 0 {
+		return true
+	}
+	for _, t := range bumpEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
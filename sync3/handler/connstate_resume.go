@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// ConnSnapshot is what the client has been sent on a connection, which is saved alongside the muxed
+// request so the connection can be resumed after the proxy restarts without sending everything again.
+type ConnSnapshot struct {
+	// room_id -> the load position of the room when the client was last sent it
+	SentRooms map[string]int64 `json:"sent_rooms"`
+	// list key -> the room IDs the client can see in each range of the list, in the order of the
+	// list's ranges. slow_get_all_rooms lists have a single range covering the whole list.
+	Lists map[string][][]string `json:"lists"`
+}
+
+// listsByVisibleRoomIDs returns the lists each room was visible in, in the same form as
+// InternalRequestLists.ListsByVisibleRoomIDs.
+func (cs *ConnSnapshot) listsByVisibleRoomIDs() map[string][]string {
+	result := make(map[string][]string)
+	for listKey, ranges := range cs.Lists {
+		for _, roomIDs := range ranges {
+			for _, roomID := range roomIDs {
+				result[roomID] = append(result[roomID], listKey)
+			}
+		}
+	}
+	return result
+}
+
+// Resume this new connection using the muxed request and snapshot of a connection from before the
+// proxy restarted. They are restored when the first request on this connection is processed, and
+// the client is only sent the list operations and rooms which changed whilst the proxy was down.
+func (s *ConnState) Resume(resumeReq *sync3.Request, snapshot *ConnSnapshot) {
+	s.resumeReq = resumeReq
+	s.resumeSnapshot = snapshot
+}
+
+// Snapshot returns the muxed request and what the client has been sent on this connection, so the
+// connection can be resumed after a restart. Returns nil if neither may have changed since the last
+// call. Must only be called whilst requests on the connection are blocked.
+func (s *ConnState) Snapshot() (*sync3.Request, *ConnSnapshot) {
+	if !s.snapshotChanged || s.muxedReq == nil {
+		return nil, nil
+	}
+	s.snapshotChanged = false
+	snapshot := &ConnSnapshot{
+		SentRooms: make(map[string]int64, len(s.sentRooms)),
+		Lists:     make(map[string][][]string, len(s.muxedReq.Lists)),
+	}
+	for roomID := range s.sentRooms {
+		snapshot.SentRooms[roomID] = s.loadPositions[roomID]
+	}
+	for listKey, reqList := range s.muxedReq.Lists {
+		snapshot.Lists[listKey] = s.visibleRoomIDsByRange(listKey, reqList)
+	}
+	return s.muxedReq, snapshot
+}
+
+// visibleRoomIDsByRange returns the room IDs in each range of this list.
+func (s *ConnState) visibleRoomIDsByRange(listKey string, reqList sync3.RequestList) [][]string {
+	roomList := s.lists.Get(listKey)
+	if roomList == nil {
+		return nil
+	}
+	if reqList.ShouldGetAllRooms() {
+		return [][]string{roomList.RoomIDs()}
+	}
+	ranges := make([][]string, len(reqList.Ranges))
+	for i := range reqList.Ranges {
+		subslice := sync3.SliceRanges{reqList.Ranges[i]}.SliceInto(roomList)
+		if len(subslice) > 0 {
+			ranges[i] = subslice[0].(*sync3.SortableRooms).RoomIDs()
+		}
+	}
+	return ranges
+}
+
+// resume restores the muxed request and lists of the connection being resumed. Rooms which were
+// not sent before the restart, or which have changed since, are added to the builder. Lists only
+// get operations for ranges whose rooms are different to the ones in the snapshot.
+func (s *ConnState) resume(ctx context.Context, builder *RoomsBuilder) map[string]sync3.ResponseList {
+	snapshot := s.resumeSnapshot
+	s.muxedReq, _ = s.muxedReq.ApplyDelta(s.resumeReq)
+	s.resumeReq, s.resumeSnapshot = nil, nil
+	s.lists.SetSnoozedRooms(s.muxedReq.SnoozedRooms)
+
+	for roomID := range snapshot.SentRooms {
+		s.sentRooms[roomID] = struct{}{}
+	}
+	// load() set load positions to the latest event in each room, which is newer than the one in
+	// the snapshot if the room changed whilst we were down.
+	needsSending := func(roomID string) bool {
+		loadPosition, sent := snapshot.SentRooms[roomID]
+		return !sent || s.loadPositions[roomID] > loadPosition
+	}
+
+	for roomID, sub := range s.muxedReq.RoomSubscriptions {
+		if !s.joinChecker.IsUserJoined(s.userID, roomID) {
+			continue
+		}
+		s.roomSubscriptions[roomID] = sub
+		if needsSending(roomID) {
+			subID := builder.AddSubscription(sub)
+			builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+		}
+	}
+
+	result := make(map[string]sync3.ResponseList, len(s.muxedReq.Lists))
+	for listKey, reqList := range s.muxedReq.Lists {
+		roomList, _ := s.lists.AssignList(ctx, listKey, reqList.Filters, reqList.Sort, reqList.PinnedRooms, sync3.Overwrite)
+		roomList.SetPinnedRooms(reqList.PinnedRooms)
+		if err := roomList.Sort(reqList.Sort); err != nil {
+			logger.Err(err).Str("key", listKey).Msg("cannot sort list")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+
+		prevRanges := snapshot.Lists[listKey]
+		var ops []sync3.ResponseOp
+		var sendRoomIDs []string
+		for i, roomIDs := range s.visibleRoomIDsByRange(listKey, reqList) {
+			for _, roomID := range roomIDs {
+				if needsSending(roomID) {
+					sendRoomIDs = append(sendRoomIDs, roomID)
+				}
+			}
+			var prevRoomIDs []string
+			if i < len(prevRanges) {
+				prevRoomIDs = prevRanges[i]
+			}
+			if sameRoomIDs(prevRoomIDs, roomIDs) {
+				continue
+			}
+			var start int64
+			if !reqList.ShouldGetAllRooms() {
+				start = reqList.Ranges[i][0]
+			}
+			if len(roomIDs) == 0 {
+				// the list has shrunk so the client has rooms in this range which are no longer in it
+				ops = append(ops, &sync3.ResponseOpRange{
+					Operation: sync3.OpInvalidate,
+					Range:     [2]int64{start, start + int64(len(prevRoomIDs)) - 1},
+				})
+				continue
+			}
+			ops = append(ops, &sync3.ResponseOpRange{
+				Operation: sync3.OpSync,
+				Range:     [2]int64{start, start + int64(len(roomIDs)) - 1},
+				RoomIDs:   roomIDs,
+			})
+		}
+
+		if reqList.ShouldGetAllRooms() {
+			s.getAllRoomsBacklogs[listKey] = sendRoomIDs
+			s.sendSlowGetAllRoomsBatch(ctx, builder, listKey, roomList, &reqList)
+		} else if len(sendRoomIDs) > 0 {
+			subID := builder.AddSubscription(reqList.RoomSubscription)
+			builder.AddRoomsToSubscription(ctx, subID, sendRoomIDs)
+		}
+		result[listKey] = sync3.ResponseList{
+			Ops: ops,
+			// count will be filled in later
+		}
+	}
+	return result
+}
+
+// changesMuxedRequest returns false if this request only contains params which aren't sticky, e.g.
+// a long poll, so it cannot change the muxed request.
+func changesMuxedRequest(req *sync3.Request) bool {
+	return req.Lists != nil || req.RoomSubscriptions != nil || req.UnsubscribeRooms != nil ||
+		req.SnoozedRooms != nil || req.IncludeUnreadTotal != nil || req.DayBoundaryUTCOffsetMins != nil ||
+		req.InferDMs != nil || req.Extensions.Specified()
+}
+
+func sameRoomIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
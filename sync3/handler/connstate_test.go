@@ -1,19 +1,24 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 type NopExtensionHandler struct{}
@@ -111,7 +116,7 @@ func TestConnStateInitial(t *testing.T) {
 		}
 		return result
 	}
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
 	if userID != cs.UserID() {
 		t.Fatalf("UserID returned wrong value, got %v want %v", cs.UserID(), userID)
 	}
@@ -276,7 +281,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 	userCache.LazyRoomDataOverride = mockLazyRoomOverride
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
 
 	// request first page
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
@@ -455,7 +460,7 @@ func TestBumpToOutsideRange(t *testing.T) {
 	userCache.LazyRoomDataOverride = mockLazyRoomOverride
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
 	// Ask for A,B
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -566,7 +571,7 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	}
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
 	// subscribe to room D
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		RoomSubscriptions: map[string]sync3.RoomSubscription{
@@ -690,6 +695,3293 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	})
 }
 
+// Test that content_fields on a room subscription projects the content of initial and live timeline events.
+func TestConnStateContentFieldsProjection(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateContentFieldsProjection_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	initialEvent := testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{
+		"msgtype":        "m.text",
+		"body":           "a",
+		"format":         "org.matrix.custom.html",
+		"formatted_body": "<b>a</b>",
+	})
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		result := make(map[string]caches.UserRoomData)
+		for _, roomID := range roomIDs {
+			u := caches.NewUserRoomData()
+			u.RequestedLatestEvents.Timeline = []json.RawMessage{initialEvent}
+			result[roomID] = u
+		}
+		return result
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	assertProjected := func(ev json.RawMessage, wantBody string) {
+		t.Helper()
+		content := gjson.GetBytes(ev, "content")
+		if len(content.Map()) != 2 {
+			t.Errorf("want 2 keys in content, got %v", content.Raw)
+		}
+		if content.Get("body").Str != wantBody {
+			t.Errorf("got body %v want %v", content.Get("body").Str, wantBody)
+		}
+		if content.Get("msgtype").Str != "m.text" {
+			t.Errorf("got msgtype %v want m.text", content.Get("msgtype").Str)
+		}
+		if gjson.GetBytes(ev, "event_id").Str == "" {
+			t.Errorf("projection removed non-content fields: %v", string(ev))
+		}
+	}
+
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 20,
+				ContentFields: []string{"body", "msgtype"},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	timeline := res.Rooms[roomA.RoomID].Timeline
+	if len(timeline) != 1 {
+		t.Fatalf("got %d timeline events, want 1", len(timeline))
+	}
+	assertProjected(timeline[0], "a")
+
+	newEvent := testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{
+		"msgtype":        "m.text",
+		"body":           "b",
+		"format":         "org.matrix.custom.html",
+		"formatted_body": "<b>b</b>",
+	}, testutils.WithTimestamp(gomatrixserverlib.Timestamp(timestampNow+1000).Time()))
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, newEvent, 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	timeline = res.Rooms[roomA.RoomID].Timeline
+	if len(timeline) != 1 {
+		t.Fatalf("got %d timeline events, want 1", len(timeline))
+	}
+	assertProjected(timeline[0], "b")
+}
+
+// Test that a list-level timeline_event_types filters the timeline of every room in the list, both
+// initially and for live events, without affecting which events bump rooms.
+func TestConnStateListTimelineEventTypes(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateListTimelineEventTypes_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+			}, map[string]internal.EventMetadata{
+				// neither room has a bump event yet, so they are sorted by join time
+				roomA.RoomID: {NID: 1, Timestamp: 2},
+				roomB.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	initialMessage := testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "hi"})
+	initialCall := testutils.NewEvent(t, "m.call.invite", userID, map[string]interface{}{"call_id": "1"})
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		result := make(map[string]caches.UserRoomData)
+		for _, roomID := range roomIDs {
+			u := caches.NewUserRoomData()
+			u.RequestedLatestEvents.Timeline = []json.RawMessage{initialMessage, initialCall}
+			result[roomID] = u
+		}
+		return result
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	assertTimelineTypes := func(res *sync3.Response, roomID string, wantTypes []string) {
+		t.Helper()
+		var gotTypes []string
+		for _, ev := range res.Rooms[roomID].Timeline {
+			gotTypes = append(gotTypes, gjson.GetBytes(ev, "type").Str)
+		}
+		if !reflect.DeepEqual(gotTypes, wantTypes) {
+			t.Errorf("room %s: got timeline types %v want %v", roomID, gotTypes, wantTypes)
+		}
+	}
+
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit:      20,
+				TimelineEventTypes: []string{"m.call.invite"},
+			},
+			Sort:           []string{sync3.SortByRecency},
+			BumpEventTypes: []string{"m.room.message"},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{roomA.RoomID, roomB.RoomID},
+					},
+				},
+			},
+		},
+	})
+	assertTimelineTypes(res, roomA.RoomID, []string{"m.call.invite"})
+	assertTimelineTypes(res, roomB.RoomID, []string{"m.call.invite"})
+
+	// a message in room B bumps it to the top, but isn't included in its timeline
+	newMessage := testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "bump"}, testutils.WithTimestamp(gomatrixserverlib.Timestamp(timestampNow+1000).Time()))
+	dispatcher.OnNewEvent(context.Background(), roomB.RoomID, newMessage, 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{
+						Operation: "DELETE",
+						Index:     intPtr(1),
+					},
+					&sync3.ResponseOpSingle{
+						Operation: "INSERT",
+						Index:     intPtr(0),
+						RoomID:    roomB.RoomID,
+					},
+				},
+			},
+		},
+	})
+	assertTimelineTypes(res, roomB.RoomID, nil)
+
+	// a call event in room A is included in its timeline
+	newCall := testutils.NewEvent(t, "m.call.invite", userID, map[string]interface{}{"call_id": "2"}, testutils.WithTimestamp(gomatrixserverlib.Timestamp(timestampNow+2000).Time()))
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, newCall, 3)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertTimelineTypes(res, roomA.RoomID, []string{"m.call.invite"})
+	if res.Rooms[roomA.RoomID].NumLive != 1 {
+		t.Errorf("got num_live %d want 1", res.Rooms[roomA.RoomID].NumLive)
+	}
+}
+
+// Test that events which arrive whilst the client is disconnected are returned in the order the
+// proxy received them across rooms when the client reconnects, if requested.
+func TestConnStateStreamOrderOnReconnect(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateStreamOrderOnReconnect_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 10,
+			},
+			Sort: []string{sync3.SortByName},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(res.StreamOrder) != 0 {
+		t.Fatalf("got stream order on initial sync: %v", res.StreamOrder)
+	}
+
+	// events arrive in A, B, A whilst the client is disconnected
+	var wantOrder []sync3.StreamOrderEntry
+	for i, roomID := range []string{roomA.RoomID, roomB.RoomID, roomA.RoomID} {
+		ev := testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": fmt.Sprintf("%d", i)}, testutils.WithTimestamp(gomatrixserverlib.Timestamp(timestampNow+gomatrixserverlib.Timestamp((i+1)*1000)).Time()))
+		dispatcher.OnNewEvent(context.Background(), roomID, ev, int64(i+2))
+		wantOrder = append(wantOrder, sync3.StreamOrderEntry{
+			RoomID:  roomID,
+			EventID: gjson.GetBytes(ev, "event_id").Str,
+		})
+	}
+
+	// the client reconnects and gets all missed events in the order the proxy received them
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		IncludeStreamOrder: true,
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if !reflect.DeepEqual(res.StreamOrder, wantOrder) {
+		t.Fatalf("got stream order %v want %v", res.StreamOrder, wantOrder)
+	}
+	// which is consistent with the per-room timelines
+	roomIDToEventIDs := res.RoomIDsToTimelineEventIDs()
+	wantRoomA := []string{wantOrder[0].EventID, wantOrder[2].EventID}
+	if !reflect.DeepEqual(roomIDToEventIDs[roomA.RoomID], wantRoomA) {
+		t.Errorf("got room A timeline %v want %v", roomIDToEventIDs[roomA.RoomID], wantRoomA)
+	}
+
+	// the stream order is not sticky
+	ev := testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "later"}, testutils.WithTimestamp(gomatrixserverlib.Timestamp(timestampNow+10000).Time()))
+	dispatcher.OnNewEvent(context.Background(), roomB.RoomID, ev, 10)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(res.Rooms[roomB.RoomID].Timeline) != 1 {
+		t.Fatalf("got %d timeline events in room B, want 1", len(res.Rooms[roomB.RoomID].Timeline))
+	}
+	if len(res.StreamOrder) != 0 {
+		t.Fatalf("got stream order when not requested: %v", res.StreamOrder)
+	}
+}
+
+// Test that a connection cannot enable more than the maximum number of extensions, and that
+// rejected requests do not change which extensions are enabled.
+func TestConnStateMaxEnabledExtensions(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMaxEnabledExtensions_alice:localhost"
+	deviceID := "yep"
+	defer func(max int) {
+		extensions.MaxEnabledExtensions = max
+	}(extensions.MaxEnabledExtensions)
+	extensions.MaxEnabledExtensions = 2
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, nil, nil, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+	enabled := true
+
+	// enabling extensions up to the limit works
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Extensions: extensions.Request{
+			Typing:   &extensions.TypingRequest{Core: extensions.Core{Enabled: &enabled}},
+			Receipts: &extensions.ReceiptsRequest{Core: extensions.Core{Enabled: &enabled}},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	// but enabling any more is an error
+	_, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Extensions: extensions.Request{
+			Spaces: &extensions.SpacesRequest{Core: extensions.Core{Enabled: &enabled}},
+		},
+	}, false, time.Now())
+	herr, ok := err.(*internal.HandlerError)
+	if !ok || herr.StatusCode != 400 {
+		t.Fatalf("OnIncomingRequest: got error %v want a 400 HandlerError", err)
+	}
+	if cs.muxedReq.Extensions.Spaces != nil {
+		t.Fatalf("rejected extension was enabled")
+	}
+}
+
+// Test that the bump stamps returned for recency sorted lists match the ordering the server uses,
+// taking bump_event_types into account.
+func TestConnStateBumpStamps(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateBumpStamps_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow)
+	roomC := newRoomMetadata("!c:localhost", timestampNow)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 3},
+				roomB.RoomID: {NID: 1, Timestamp: 2},
+				roomC.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	// asserts that the bump stamps are what we expect, and that they agree with the order of the list
+	assertBumpStamps := func(res *sync3.Response, wantStamps map[string]uint64) {
+		t.Helper()
+		gotStamps := res.Lists["recent"].BumpStamps
+		if !reflect.DeepEqual(gotStamps, wantStamps) {
+			t.Errorf("got bump stamps %v want %v", gotStamps, wantStamps)
+		}
+		roomIDs := cs.lists.Get("recent").RoomIDs()
+		for i := 1; i < len(roomIDs); i++ {
+			prev := cs.lists.ReadOnlyRoom(roomIDs[i-1]).GetLastInterestedEventTimestamp("recent")
+			curr := cs.lists.ReadOnlyRoom(roomIDs[i]).GetLastInterestedEventTimestamp("recent")
+			if prev < curr {
+				t.Errorf("room %s at index %d has bump stamp %d, higher than %d at index %d", roomIDs[i], i, curr, prev, i-1)
+			}
+		}
+		if res.Lists["names"].BumpStamps != nil {
+			t.Errorf("got bump stamps for a list not sorted by recency")
+		}
+	}
+
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"recent": {
+				Sort:           []string{sync3.SortByRecency},
+				BumpEventTypes: []string{"m.room.message"},
+				Ranges: sync3.SliceRanges([][2]int64{
+					{0, 2},
+				}),
+			},
+			"names": {
+				Sort: []string{sync3.SortByName},
+				Ranges: sync3.SliceRanges([][2]int64{
+					{0, 2},
+				}),
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertBumpStamps(res, map[string]uint64{
+		roomA.RoomID: 3,
+		roomB.RoomID: 2,
+		roomC.RoomID: 1,
+	})
+
+	bumps := []struct {
+		roomID     string
+		eventType  string
+		timestamp  gomatrixserverlib.Timestamp
+		wantStamps map[string]uint64
+	}{
+		{
+			// a message bumps room C to the top
+			roomID:     roomC.RoomID,
+			eventType:  "m.room.message",
+			timestamp:  timestampNow + 1000,
+			wantStamps: map[string]uint64{roomC.RoomID: uint64(timestampNow + 1000)},
+		},
+		{
+			// a reaction is not a bump event, so room B keeps its old stamp
+			roomID:     roomB.RoomID,
+			eventType:  "m.reaction",
+			timestamp:  timestampNow + 2000,
+			wantStamps: map[string]uint64{roomB.RoomID: 2},
+		},
+		{
+			// a message bumps room A above room C
+			roomID:     roomA.RoomID,
+			eventType:  "m.room.message",
+			timestamp:  timestampNow + 3000,
+			wantStamps: map[string]uint64{roomA.RoomID: uint64(timestampNow + 3000)},
+		},
+	}
+	for i, bump := range bumps {
+		ev := testutils.NewEvent(t, bump.eventType, userID, map[string]interface{}{}, testutils.WithTimestamp(bump.timestamp.Time()))
+		dispatcher.OnNewEvent(context.Background(), bump.roomID, ev, int64(i+2))
+		res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		assertBumpStamps(res, bump.wantStamps)
+	}
+	wantOrder := []string{roomA.RoomID, roomC.RoomID, roomB.RoomID}
+	if gotOrder := cs.lists.Get("recent").RoomIDs(); !reflect.DeepEqual(gotOrder, wantOrder) {
+		t.Errorf("got order %v want %v", gotOrder, wantOrder)
+	}
+}
+
+// Test that prefetch_ranges load room data without sending it, and that the data is then sent from
+// memory when the client requests those ranges.
+func TestConnStatePrefetchRanges(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStatePrefetchRanges_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	rooms := []internal.RoomMetadata{
+		newRoomMetadata("!a:localhost", timestampNow),
+		newRoomMetadata("!b:localhost", timestampNow-1000),
+		newRoomMetadata("!c:localhost", timestampNow-2000),
+		newRoomMetadata("!d:localhost", timestampNow-3000),
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	startupRooms := make(map[string]internal.RoomMetadata)
+	startupMembers := make(map[string][]string)
+	for _, room := range rooms {
+		startupRooms[room.RoomID] = room
+		startupMembers[room.RoomID] = []string{userID}
+	}
+	globalCache.Startup(startupRooms)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(startupMembers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: uint64(len(rooms) - i)}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	var loadedRoomIDs []string
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		loadedRoomIDs = append(loadedRoomIDs, roomIDs...)
+		return mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	assertLoaded := func(wantRoomIDs []string) {
+		t.Helper()
+		sort.Strings(loadedRoomIDs)
+		if !reflect.DeepEqual(loadedRoomIDs, wantRoomIDs) {
+			t.Errorf("loaded rooms %v want %v", loadedRoomIDs, wantRoomIDs)
+		}
+		loadedRoomIDs = nil
+	}
+
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertLoaded([]string{rooms[0].RoomID, rooms[1].RoomID})
+
+	// prefetching produces no ops and no rooms, but loads the rooms
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			PrefetchRanges: sync3.SliceRanges([][2]int64{
+				{2, 3},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.ListOps() != 0 || len(res.Rooms) != 0 {
+		t.Errorf("prefetch returned data: %v", serialise(t, *res))
+	}
+	assertLoaded([]string{rooms[2].RoomID, rooms[3].RoomID})
+
+	// requesting the prefetched range returns the rooms without loading them again
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 3},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 4,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{2, 3},
+						RoomIDs:   []string{rooms[2].RoomID, rooms[3].RoomID},
+					},
+				},
+			},
+		},
+	})
+	for _, room := range rooms[2:] {
+		if len(res.Rooms[room.RoomID].Timeline) != 1 {
+			t.Errorf("room %s: got timeline %v want 1 event", room.RoomID, res.Rooms[room.RoomID].Timeline)
+		}
+	}
+	assertLoaded(nil)
+}
+
+// Test that pinned rooms stay at the top of the list in the order given, and that the list is
+// resent when the pins change.
+func TestConnStatePinnedRooms(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStatePinnedRooms_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	roomC := newRoomMetadata("!c:localhost", timestampNow-2000)
+	roomD := newRoomMetadata("!d:localhost", timestampNow-3000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+		roomD.RoomID: roomD,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+		roomD.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+				roomD.RoomID: &roomD,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 1, Timestamp: 1},
+				roomC.RoomID: {NID: 1, Timestamp: 1},
+				roomD.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	assertOrder := func(wantRoomIDs []string) {
+		t.Helper()
+		if gotRoomIDs := cs.lists.Get("a").RoomIDs(); !reflect.DeepEqual(gotRoomIDs, wantRoomIDs) {
+			t.Errorf("got order %v want %v", gotRoomIDs, wantRoomIDs)
+		}
+	}
+	sendMessage := func(roomID string, ts gomatrixserverlib.Timestamp, nid int64) *sync3.Response {
+		t.Helper()
+		ev := testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "hi"}, testutils.WithTimestamp(ts.Time()))
+		dispatcher.OnNewEvent(context.Background(), roomID, ev, nid)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+
+	// the two oldest rooms are pinned, so are at the top in the order given
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:        []string{sync3.SortByRecency},
+			PinnedRooms: []string{roomD.RoomID, roomC.RoomID},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 3},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 4,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 3},
+						RoomIDs:   []string{roomD.RoomID, roomC.RoomID, roomA.RoomID, roomB.RoomID},
+					},
+				},
+			},
+		},
+	})
+
+	// bumping an unpinned room moves it to the top of the unpinned rooms only
+	res = sendMessage(roomB.RoomID, timestampNow+1000, 2)
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 4,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{
+						Operation: "DELETE",
+						Index:     intPtr(3),
+					},
+					&sync3.ResponseOpSingle{
+						Operation: "INSERT",
+						Index:     intPtr(2),
+						RoomID:    roomB.RoomID,
+					},
+				},
+			},
+		},
+	})
+	assertOrder([]string{roomD.RoomID, roomC.RoomID, roomB.RoomID, roomA.RoomID})
+
+	// bumping the second pinned room does not move it above the first
+	sendMessage(roomC.RoomID, timestampNow+2000, 3)
+	assertOrder([]string{roomD.RoomID, roomC.RoomID, roomB.RoomID, roomA.RoomID})
+
+	// unpinning resends the list in recency order
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			PinnedRooms: []string{},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 4,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "INVALIDATE",
+						Range:     [2]int64{0, 3},
+					},
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 3},
+						RoomIDs:   []string{roomC.RoomID, roomB.RoomID, roomA.RoomID, roomD.RoomID},
+					},
+				},
+			},
+		},
+	})
+}
+
+// Test that the unread total is the sum of notification counts across all rooms, excluding muted
+// rooms, and is sent whenever it changes.
+func TestConnStateUnreadTotal(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateUnreadTotal_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	mutedRoom := newRoomMetadata("!muted:localhost", timestampNow-2000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID:     roomA,
+		roomB.RoomID:     roomB,
+		mutedRoom.RoomID: mutedRoom,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID:     {userID},
+		roomB.RoomID:     {userID},
+		mutedRoom.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID:     &roomA,
+				roomB.RoomID:     &roomB,
+				mutedRoom.RoomID: &mutedRoom,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID:     {NID: 1, Timestamp: 1},
+				roomB.RoomID:     {NID: 1, Timestamp: 1},
+				mutedRoom.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+
+	pushRules, err := json.Marshal(map[string]interface{}{
+		"type": "m.push_rules",
+		"content": map[string]interface{}{
+			"global": map[string]interface{}{
+				"override": []map[string]interface{}{
+					{
+						"rule_id": mutedRoom.RoomID,
+						"enabled": true,
+						"actions": []interface{}{"dont_notify"},
+						"conditions": []map[string]interface{}{
+							{"kind": "event_match", "key": "room_id", "pattern": mutedRoom.RoomID},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal push rules: %s", err)
+	}
+	userCache.OnAccountData(context.Background(), []state.AccountData{
+		{
+			UserID: userID,
+			RoomID: state.AccountDataGlobalRoom,
+			Type:   "m.push_rules",
+			Data:   pushRules,
+		},
+	})
+	setNotificationCount := func(roomID string, count int) {
+		highlightCount := 0
+		userCache.OnUnreadCounts(context.Background(), roomID, &highlightCount, &count)
+	}
+	setNotificationCount(roomA.RoomID, 2)
+	setNotificationCount(roomB.RoomID, 3)
+	setNotificationCount(mutedRoom.RoomID, 5)
+
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+	assertUnreadTotal := func(res *sync3.Response, want *int) {
+		t.Helper()
+		if want == nil {
+			if res.UnreadTotal != nil {
+				t.Errorf("got unread total %d want none", *res.UnreadTotal)
+			}
+			return
+		}
+		if res.UnreadTotal == nil {
+			t.Errorf("got no unread total want %d", *want)
+		} else if *res.UnreadTotal != *want {
+			t.Errorf("got unread total %d want %d", *res.UnreadTotal, *want)
+		}
+	}
+
+	includeUnreadTotal := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		IncludeUnreadTotal: &includeUnreadTotal,
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertUnreadTotal(res, intPtr(5))
+
+	// the total is sent when it changes, and the flag is sticky
+	setNotificationCount(roomA.RoomID, 1)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertUnreadTotal(res, intPtr(4))
+
+	// changes in muted rooms do not affect the total, so it isn't sent
+	setNotificationCount(mutedRoom.RoomID, 10)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertUnreadTotal(res, nil)
+
+	setNotificationCount(roomB.RoomID, 0)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertUnreadTotal(res, intPtr(1))
+}
+
+// Test that knocked rooms have a join status which is updated live when the knock is refused.
+func TestConnStateKnockJoinStatus(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateKnockJoinStatus_alice:localhost"
+	adminID := "@TestConnStateKnockJoinStatus_admin:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	spaceRoom := newRoomMetadata("!space:localhost", timestampNow)
+	knockRoomID := "!knock:localhost"
+	restrictedRoomID := "!restricted:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		spaceRoom.RoomID: spaceRoom,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		spaceRoom.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				spaceRoom.RoomID: &spaceRoom,
+			}, map[string]internal.EventMetadata{
+				spaceRoom.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	// return the real room data, as that is where knocks are tracked
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		result := make(map[string]caches.UserRoomData)
+		for _, roomID := range roomIDs {
+			result[roomID] = userCache.LoadRoomData(roomID)
+		}
+		return result
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 10},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if status := res.Rooms[spaceRoom.RoomID].JoinStatus; status != "" {
+		t.Errorf("joined room: got join status %q want none", status)
+	}
+	assertJoinStatus := func(roomID, wantStatus string) {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		room, ok := res.Rooms[roomID]
+		if !ok {
+			t.Fatalf("room %s not in response", roomID)
+		}
+		if room.JoinStatus != wantStatus {
+			t.Errorf("room %s: got join status %q want %q", roomID, room.JoinStatus, wantStatus)
+		}
+	}
+
+	// knock on a room
+	userCache.OnInvite(context.Background(), knockRoomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", adminID, map[string]interface{}{"creator": adminID}),
+		testutils.NewStateEvent(t, "m.room.join_rules", "", adminID, map[string]interface{}{"join_rule": "knock"}),
+		testutils.NewStateEvent(t, "m.room.member", userID, userID, map[string]interface{}{"membership": "knock"}),
+	})
+	assertJoinStatus(knockRoomID, sync3.JoinStatusKnocked)
+
+	// the knock is refused by the admin
+	userCache.OnLeftRoom(context.Background(), knockRoomID, testutils.NewStateEvent(t, "m.room.member", userID, adminID, map[string]interface{}{"membership": "leave"}))
+	assertJoinStatus(knockRoomID, sync3.JoinStatusKnockDenied)
+
+	// knocking on a room we could join via a space we are in
+	userCache.OnInvite(context.Background(), restrictedRoomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", adminID, map[string]interface{}{"creator": adminID}),
+		testutils.NewStateEvent(t, "m.room.join_rules", "", adminID, map[string]interface{}{
+			"join_rule": "knock_restricted",
+			"allow": []map[string]interface{}{
+				{"type": "m.room_membership", "room_id": spaceRoom.RoomID},
+			},
+		}),
+		testutils.NewStateEvent(t, "m.room.member", userID, userID, map[string]interface{}{"membership": "knock"}),
+	})
+	assertJoinStatus(restrictedRoomID, sync3.JoinStatusJoinEligibleViaSpace)
+}
+
+// Test that rooms re-entering the window are loaded with the reentry_timeline_limit, whereas rooms
+// appearing for the first time are loaded with the timeline_limit.
+func TestConnStateReentryTimelineLimit(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateReentryTimelineLimit_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	rooms := []internal.RoomMetadata{
+		newRoomMetadata("!a:localhost", timestampNow),
+		newRoomMetadata("!b:localhost", timestampNow-1000),
+		newRoomMetadata("!c:localhost", timestampNow-2000),
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	startupRooms := make(map[string]internal.RoomMetadata)
+	startupMembers := make(map[string][]string)
+	for _, room := range rooms {
+		startupRooms[room.RoomID] = room
+		startupMembers[room.RoomID] = []string{userID}
+	}
+	globalCache.Startup(startupRooms)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(startupMembers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: uint64(len(rooms) - i)}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	loadedTimelineLimits := make(map[string]int)
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		for _, roomID := range roomIDs {
+			loadedTimelineLimits[roomID] = maxTimelineEvents
+		}
+		return mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	assertLoaded := func(want map[string]int) {
+		t.Helper()
+		if !reflect.DeepEqual(loadedTimelineLimits, want) {
+			t.Errorf("loaded rooms with timeline limits %v want %v", loadedTimelineLimits, want)
+		}
+		loadedTimelineLimits = make(map[string]int)
+	}
+	requestRange := func(r [2]int64) *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Ranges: sync3.SliceRanges([][2]int64{r}),
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+
+	reentryTimelineLimit := int64(1)
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit:        5,
+				ReentryTimelineLimit: &reentryTimelineLimit,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertLoaded(map[string]int{rooms[0].RoomID: 5, rooms[1].RoomID: 5})
+
+	// room C appears for the first time as room A leaves the window
+	res := requestRange([2]int64{1, 2})
+	if res.ListOps() == 0 {
+		t.Errorf("moving the window returned no ops: %v", serialise(t, *res))
+	}
+	assertLoaded(map[string]int{rooms[2].RoomID: 5})
+
+	// room A re-enters the window
+	res = requestRange([2]int64{0, 1})
+	if _, ok := res.Rooms[rooms[0].RoomID]; !ok {
+		t.Errorf("room A was not returned on re-entry: %v", serialise(t, *res))
+	}
+	assertLoaded(map[string]int{rooms[0].RoomID: 1})
+
+	// ongoing requests for the same window do not reload any rooms
+	requestRange([2]int64{0, 1})
+	assertLoaded(map[string]int{})
+}
+
+// Test that aggregate_relations only aggregates reactions and edits for events in the returned
+// timeline, and not for older events outside of the timeline_limit.
+func TestConnStateAggregateRelations(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateAggregateRelations_alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	deviceID := "yep"
+	room := newRoomMetadata("!a:localhost", gomatrixserverlib.Timestamp(1632131678061))
+	reaction := func(sender string, target json.RawMessage, key string) json.RawMessage {
+		return testutils.NewEvent(t, "m.reaction", sender, map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.annotation",
+				"event_id": gjson.GetBytes(target, "event_id").Str,
+				"key":      key,
+			},
+		})
+	}
+	edit := func(sender string, target json.RawMessage, body string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", sender, map[string]interface{}{
+			"body":          "* " + body,
+			"m.new_content": map[string]interface{}{"body": body},
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.replace",
+				"event_id": gjson.GetBytes(target, "event_id").Str,
+			},
+		})
+	}
+	oldMsg := testutils.NewMessageEvent(t, bob, "old message")
+	newMsg := testutils.NewMessageEvent(t, userID, "new message")
+	aliceEdit := edit(userID, newMsg, "edited message")
+	allEvents := []json.RawMessage{
+		oldMsg,
+		reaction(charlie, oldMsg, "🎉"),
+		newMsg,
+		reaction(bob, oldMsg, "👍"), // in the timeline, but relates to an event outside of it
+		reaction(bob, newMsg, "👍"),
+		reaction(charlie, newMsg, "👍"),
+		reaction(bob, newMsg, "👍"), // duplicate reactions are only counted once
+		reaction(bob, newMsg, "😀"),
+		aliceEdit,
+		edit(bob, newMsg, "not alice"), // only the original sender can edit
+	}
+	timelineLimit := 8
+
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{room.RoomID: room})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{room.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{room.RoomID: &room}, map[string]internal.EventMetadata{
+			room.RoomID: {NID: 1, Timestamp: 1},
+		}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		result := make(map[string]caches.UserRoomData)
+		for _, roomID := range roomIDs {
+			u := caches.NewUserRoomData()
+			u.RequestedLatestEvents.Timeline = allEvents[len(allEvents)-maxTimelineEvents:]
+			result[roomID] = u
+		}
+		return result
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	aggregateRelations := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit:      int64(timelineLimit),
+				TimelineEventTypes: []string{"m.room.message"},
+				AggregateRelations: &aggregateRelations,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 0},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	gotRoom := res.Rooms[room.RoomID]
+	// reactions are filtered out of the timeline, but are still aggregated
+	if len(gotRoom.Timeline) != 3 {
+		t.Errorf("got %d timeline events, want 3: %v", len(gotRoom.Timeline), gotRoom.Timeline)
+	}
+	wantRelations := map[string]sync3.RelationsSummary{
+		gjson.GetBytes(newMsg, "event_id").Str: {
+			Annotations: []sync3.AnnotationCount{
+				{Type: "m.reaction", Key: "👍", Count: 2},
+				{Type: "m.reaction", Key: "😀", Count: 1},
+			},
+			Replace: &sync3.ReplaceSummary{
+				EventID:        gjson.GetBytes(aliceEdit, "event_id").Str,
+				Sender:         userID,
+				OriginServerTS: gjson.GetBytes(aliceEdit, "origin_server_ts").Int(),
+			},
+		},
+	}
+	if !reflect.DeepEqual(gotRoom.Relations, wantRelations) {
+		t.Errorf("got relations %v want %v", serialise(t, gotRoom.Relations), serialise(t, wantRelations))
+	}
+}
+
+// Test that timeline_unread_only only returns events after the user's m.fully_read marker, and
+// returns the normal timeline for rooms without a marker or whose marker is not in the timeline.
+func TestConnStateTimelineUnreadOnly(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateTimelineUnreadOnly_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	rooms := []internal.RoomMetadata{
+		newRoomMetadata("!read:localhost", timestampNow),
+		newRoomMetadata("!no-marker:localhost", timestampNow-1000),
+		newRoomMetadata("!old-marker:localhost", timestampNow-2000),
+	}
+	timelines := make(map[string][]json.RawMessage)
+	for _, room := range rooms {
+		for i := 0; i < 5; i++ {
+			timelines[room.RoomID] = append(timelines[room.RoomID], testutils.NewMessageEvent(t, userID, fmt.Sprintf("%d", i)))
+		}
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	startupRooms := make(map[string]internal.RoomMetadata)
+	startupMembers := make(map[string][]string)
+	for _, room := range rooms {
+		startupRooms[room.RoomID] = room
+		startupMembers[room.RoomID] = []string{userID}
+	}
+	globalCache.Startup(startupRooms)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(startupMembers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: uint64(len(rooms) - i)}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		result := make(map[string]caches.UserRoomData)
+		for _, roomID := range roomIDs {
+			u := userCache.LoadRoomData(roomID)
+			u.RequestedLatestEvents.Timeline = timelines[roomID][len(timelines[roomID])-maxTimelineEvents:]
+			result[roomID] = u
+		}
+		return result
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	fullyRead := func(roomID string, ev json.RawMessage) state.AccountData {
+		return state.AccountData{
+			UserID: userID,
+			RoomID: roomID,
+			Type:   "m.fully_read",
+			Data:   testutils.NewAccountData(t, "m.fully_read", map[string]interface{}{"event_id": gjson.GetBytes(ev, "event_id").Str}),
+		}
+	}
+	userCache.OnAccountData(context.Background(), []state.AccountData{
+		// the user has read up to the 3rd event
+		fullyRead(rooms[0].RoomID, timelines[rooms[0].RoomID][2]),
+		// the user has read up to the 1st event, which is outside of the timeline_limit
+		fullyRead(rooms[2].RoomID, timelines[rooms[2].RoomID][0]),
+	})
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	unreadOnly := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit:      4,
+				TimelineUnreadOnly: &unreadOnly,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 2},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	wantTimelines := map[string][]json.RawMessage{
+		rooms[0].RoomID: timelines[rooms[0].RoomID][3:],
+		rooms[1].RoomID: timelines[rooms[1].RoomID][1:],
+		rooms[2].RoomID: timelines[rooms[2].RoomID][1:],
+	}
+	for roomID, want := range wantTimelines {
+		got := res.Rooms[roomID].Timeline
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("room %s: got timeline %v want %v", roomID, serialise(t, got), serialise(t, want))
+		}
+	}
+}
+
+func TestConnStateSavedViews(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateSavedViews_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	rooms := []internal.RoomMetadata{
+		newRoomMetadata("!a:localhost", timestampNow),
+		newRoomMetadata("!b:localhost", timestampNow-1000),
+		newRoomMetadata("!c:localhost", timestampNow-2000),
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	startupRooms := make(map[string]internal.RoomMetadata)
+	startupMembers := make(map[string][]string)
+	for _, room := range rooms {
+		startupRooms[room.RoomID] = room
+		startupMembers[room.RoomID] = []string{userID}
+	}
+	globalCache.Startup(startupRooms)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: uint64(len(rooms) - i)}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	newConnState := func() *ConnState {
+		dispatcher := sync3.NewDispatcher()
+		dispatcher.Startup(startupMembers)
+		userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+		userCache.LazyRoomDataOverride = mockLazyRoomOverride
+		dispatcher.Register(context.Background(), userCache.UserID, userCache)
+		dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+		return NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+	}
+
+	view := sync3.View{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 2,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			rooms[2].RoomID: {
+				TimelineLimit: 1,
+			},
+		},
+	}
+	fullBody := func() *sync3.Request {
+		return &sync3.Request{
+			Lists:             view.Lists,
+			RoomSubscriptions: view.RoomSubscriptions,
+		}
+	}
+
+	// one connection registers the view and references it, the other sends the full body
+	viewConn := newConnState()
+	fullConn := newConnState()
+	viewRes, err := viewConn.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		SaveViews: map[string]sync3.View{"home": view},
+		View:      "home",
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	fullRes, err := fullConn.OnIncomingRequest(context.Background(), ConnID, fullBody(), false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(fullRes.Rooms) != 3 {
+		t.Fatalf("full body returned %d rooms, want 3: %v", len(fullRes.Rooms), serialise(t, *fullRes))
+	}
+	if got, want := serialise(t, *viewRes), serialise(t, *fullRes); got != want {
+		t.Errorf("view response differs from full body response:\ngot  %s\nwant %s", got, want)
+	}
+
+	// referencing the view again on a later request behaves like resending the full body
+	viewRes, err = viewConn.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		View: "home",
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	fullRes, err = fullConn.OnIncomingRequest(context.Background(), ConnID, fullBody(), false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got, want := serialise(t, *viewRes), serialise(t, *fullRes); got != want {
+		t.Errorf("view response differs from full body response:\ngot  %s\nwant %s", got, want)
+	}
+
+	// referencing an unknown view is an error
+	_, err = viewConn.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		View: "unknown",
+	}, false, time.Now())
+	if err == nil {
+		t.Fatalf("OnIncomingRequest with an unknown view returned no error")
+	}
+	herr, ok := err.(*internal.HandlerError)
+	if !ok || herr.StatusCode != 400 {
+		t.Errorf("OnIncomingRequest with an unknown view returned %v, want a 400 HandlerError", err)
+	}
+}
+
+// Test that when a filter change removes rooms, the remaining rooms keep their relative order even
+// when they compare equal, and that the list is only invalidated and resynced.
+func TestConnStateFilterChangeKeepsOrder(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateFilterChangeKeepsOrder_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	// every room has the same timestamp so they all compare equal when sorting by recency
+	var rooms []internal.RoomMetadata
+	for i := 0; i < 10; i++ {
+		room := newRoomMetadata(fmt.Sprintf("!%d:localhost", i), timestampNow)
+		if i%3 == 0 {
+			room.NameEvent = fmt.Sprintf("Removed %d", i)
+		}
+		rooms = append(rooms, room)
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	startupRooms := make(map[string]internal.RoomMetadata)
+	startupMembers := make(map[string][]string)
+	for _, room := range rooms {
+		startupRooms[room.RoomID] = room
+		startupMembers[room.RoomID] = []string{userID}
+	}
+	globalCache.Startup(startupRooms)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(startupMembers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	ranges := sync3.SliceRanges([][2]int64{{0, int64(len(rooms) - 1)}})
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: ranges,
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	initialOrder := res.Lists["a"].Ops[0].(*sync3.ResponseOpRange).RoomIDs
+	if len(initialOrder) != len(rooms) {
+		t.Fatalf("got %d rooms want %d", len(initialOrder), len(rooms))
+	}
+	var wantOrder []string
+	for _, roomID := range initialOrder {
+		if !strings.HasPrefix(globalCache.LoadRooms(context.Background(), roomID)[roomID].NameEvent, "Removed") {
+			wantOrder = append(wantOrder, roomID)
+		}
+	}
+
+	// toggle the filter repeatedly, as any instability would show up as a different order
+	for i := 0; i < 5; i++ {
+		res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: ranges,
+				Filters: &sync3.RequestFilters{
+					RoomNameFilter: "room",
+				},
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		checkResponse(t, true, res, &sync3.Response{
+			Lists: map[string]sync3.ResponseList{
+				"a": {
+					Count: len(wantOrder),
+					Ops: []sync3.ResponseOp{
+						&sync3.ResponseOpRange{
+							Operation: "INVALIDATE",
+							Range:     [2]int64{0, int64(len(rooms) - 1)},
+						},
+						&sync3.ResponseOpRange{
+							Operation: "SYNC",
+							Range:     [2]int64{0, int64(len(wantOrder) - 1)},
+							RoomIDs:   wantOrder,
+						},
+					},
+				},
+			},
+		})
+		res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:    []string{sync3.SortByRecency},
+				Ranges:  ranges,
+				Filters: &sync3.RequestFilters{},
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+	}
+}
+
+func TestConnStateServerACL(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateServerACL_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomA.ServerACL = internal.NewServerACL(gjson.Parse(`{"allow":["*"],"deny":["evil.example.com"]}`))
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	rooms := []internal.RoomMetadata{roomA, roomB}
+	globalCache := caches.NewGlobalCache(nil)
+	startupRooms := make(map[string]internal.RoomMetadata)
+	startupMembers := make(map[string][]string)
+	for _, room := range rooms {
+		startupRooms[room.RoomID] = room
+		startupMembers[room.RoomID] = []string{userID}
+	}
+	globalCache.Startup(startupRooms)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(startupMembers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	includeServerACL := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit:    1,
+				IncludeServerACL: &includeServerACL,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	wantACL := &internal.ServerACL{
+		Allow:           []string{"*"},
+		Deny:            []string{"evil.example.com"},
+		AllowIPLiterals: true,
+	}
+	if got := res.Rooms[roomA.RoomID].ServerACL; !reflect.DeepEqual(got, wantACL) {
+		t.Errorf("room A: got server ACL %+v want %+v", got, wantACL)
+	}
+	if got := res.Rooms[roomB.RoomID].ServerACL; got != nil {
+		t.Errorf("room B: got server ACL %+v want none", got)
+	}
+
+	// room B gets a server ACL, which updates live
+	aclEvent := testutils.NewStateEvent(t, "m.room.server_acl", "", "@admin:localhost", map[string]interface{}{
+		"allow":             []string{"*"},
+		"deny":              []string{"evil.example.com", "*.evil.example.com"},
+		"allow_ip_literals": false,
+	}, testutils.WithTimestamp(timestampNow.Time().Add(time.Second)))
+	dispatcher.OnNewEvent(context.Background(), roomB.RoomID, aclEvent, 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	wantACL = &internal.ServerACL{
+		Allow:           []string{"*"},
+		Deny:            []string{"evil.example.com", "*.evil.example.com"},
+		AllowIPLiterals: false,
+	}
+	if got := res.Rooms[roomB.RoomID].ServerACL; !reflect.DeepEqual(got, wantACL) {
+		t.Errorf("room B: got server ACL %+v want %+v", got, wantACL)
+	}
+}
+
+func TestConnStateRequiredStateChunks(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateRequiredStateChunks_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	room := newRoomMetadata("!a:localhost", timestampNow)
+	createEvent := testutils.NewStateEvent(t, "m.room.create", "", userID, map[string]interface{}{"creator": userID})
+	var memberEvents []json.RawMessage
+	for i := 0; i < 25; i++ {
+		memberID := fmt.Sprintf("@member%d:localhost", i)
+		memberEvents = append(memberEvents, testutils.NewStateEvent(t, "m.room.member", memberID, memberID, map[string]interface{}{
+			"membership": "join",
+		}))
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{room.RoomID: room})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{room.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{room.RoomID: &room}, map[string]internal.EventMetadata{room.RoomID: {NID: 1, Timestamp: 1}}, nil, nil
+	}
+	globalCache.LoadRoomStateOverride = func(roomIDs []string, requiredStateMap *internal.RequiredStateMap) map[string][]json.RawMessage {
+		// members first, to check that they are sent after the other state
+		return map[string][]json.RawMessage{
+			room.RoomID: append(append([]json.RawMessage{}, memberEvents...), createEvent),
+		}
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	checkRequiredState := func(res *sync3.Response, want []json.RawMessage, wantRemaining int) {
+		t.Helper()
+		got := res.Rooms[room.RoomID]
+		if !reflect.DeepEqual(got.RequiredState, want) {
+			t.Errorf("got required_state %v want %v", serialise(t, got.RequiredState), serialise(t, want))
+		}
+		if got.RequiredStateRemaining == nil || *got.RequiredStateRemaining != wantRemaining {
+			t.Errorf("got required_state_remaining %v want %d", got.RequiredStateRemaining, wantRemaining)
+		}
+	}
+
+	chunkSize := int64(10)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit:          1,
+				RequiredState:          [][2]string{{"m.room.create", ""}, {"m.room.member", "*"}},
+				RequiredStateChunkSize: &chunkSize,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 0},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	// non-member state is sent first
+	checkRequiredState(res, append([]json.RawMessage{createEvent}, memberEvents[:9]...), 16)
+
+	// new messages still flow whilst the members trickle in, and members who change mid-way
+	// are not sent again with their old state
+	message := testutils.NewMessageEvent(t, userID, "hello", testutils.WithTimestamp(timestampNow.Time().Add(time.Second)))
+	dispatcher.OnNewEvent(context.Background(), room.RoomID, message, 2)
+	rename := testutils.NewStateEvent(t, "m.room.member", "@member24:localhost", "@member24:localhost", map[string]interface{}{
+		"membership":  "join",
+		"displayname": "Renamed",
+	}, testutils.WithTimestamp(timestampNow.Time().Add(2*time.Second)))
+	dispatcher.OnNewEvent(context.Background(), room.RoomID, rename, 3)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkRequiredState(res, memberEvents[9:19], 5)
+	if got, want := res.Rooms[room.RoomID].Timeline, []json.RawMessage{message, rename}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got timeline %v want %v", serialise(t, got), serialise(t, want))
+	}
+
+	// the last chunk marks the required_state as complete
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkRequiredState(res, memberEvents[19:24], 0)
+
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got, ok := res.Rooms[room.RoomID]; ok {
+		t.Errorf("got room after all required_state was sent: %v", serialise(t, got))
+	}
+}
+
+// Test that an event with a timestamp far in the future doesn't pin its room to the top of a list
+// sorted by recency.
+func TestConnStateClockSkew(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateClockSkew_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 2, Timestamp: 2},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	sendEvent := func(roomID string, ts time.Time, nid int64) {
+		t.Helper()
+		ev := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(ts))
+		dispatcher.OnNewEvent(context.Background(), roomID, ev, nid)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := cs.OnIncomingRequest(ctx, ConnID, req, false, time.Now()); err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+	}
+	checkOrder := func(want []string) {
+		t.Helper()
+		got := cs.lists.Get("a").RoomIDs()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got order %v want %v", got, want)
+		}
+	}
+
+	// B sends an event from a year in the future, which bumps it to the top
+	sendEvent(roomB.RoomID, time.Now().Add(365*24*time.Hour), 3)
+	checkOrder([]string{roomB.RoomID, roomA.RoomID})
+
+	// A then sends an event at the current time, which must bump it above B
+	sendEvent(roomA.RoomID, time.Now().Add(time.Second), 4)
+	checkOrder([]string{roomA.RoomID, roomB.RoomID})
+}
+
+// Test that the added/removed room IDs for a list match the rooms which enter and leave the list
+// according to its positional ops.
+func TestConnStateListDeltas(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateListDeltas_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	roomC := newRoomMetadata("!c:localhost", timestampNow-2000)
+	roomD := newRoomMetadata("!d:localhost", timestampNow-3000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+		roomD.RoomID: roomD,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+		roomD.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+				roomD.RoomID: &roomD,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 2, Timestamp: 2},
+				roomC.RoomID: {NID: 3, Timestamp: 3},
+				roomD.RoomID: {NID: 4, Timestamp: 4},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	includeDeltas := true
+	// the client's positional view of the list, built purely from ops
+	var window []string
+	applyOps := func(rangeEnd int64, ops []sync3.ResponseOp) {
+		for int64(len(window)) <= rangeEnd {
+			window = append(window, "")
+		}
+		window = window[:rangeEnd+1]
+		for _, op := range ops {
+			switch o := op.(type) {
+			case *sync3.ResponseOpRange:
+				for i := o.Range[0]; i <= o.Range[1] && i <= rangeEnd; i++ {
+					if o.Operation == sync3.OpInvalidate {
+						window[i] = ""
+					} else if i-o.Range[0] < int64(len(o.RoomIDs)) {
+						window[i] = o.RoomIDs[i-o.Range[0]]
+					}
+				}
+			case *sync3.ResponseOpSingle:
+				i := *o.Index
+				if o.Operation == sync3.OpDelete {
+					window = append(window[:i], window[i+1:]...)
+					window = append(window, "")
+				} else {
+					copy(window[i+1:], window[i:len(window)-1])
+					window[i] = o.RoomID
+				}
+			}
+		}
+	}
+	roomSet := func() map[string]bool {
+		set := make(map[string]bool)
+		for _, roomID := range window {
+			if roomID != "" {
+				set[roomID] = true
+			}
+		}
+		return set
+	}
+	doRequest := func(rangeEnd int64, wantAdded, wantRemoved []string) {
+		t.Helper()
+		// expire the context after 10ms so we don't wait forevar
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		before := roomSet()
+		res, err := cs.OnIncomingRequest(ctx, ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:          []string{sync3.SortByRecency},
+				Ranges:        sync3.SliceRanges([][2]int64{{0, rangeEnd}}),
+				IncludeDeltas: &includeDeltas,
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		list := res.Lists["a"]
+		applyOps(rangeEnd, list.Ops)
+		after := roomSet()
+		var opsAdded, opsRemoved []string
+		for roomID := range after {
+			if !before[roomID] {
+				opsAdded = append(opsAdded, roomID)
+			}
+		}
+		for roomID := range before {
+			if !after[roomID] {
+				opsRemoved = append(opsRemoved, roomID)
+			}
+		}
+		sort.Strings(opsAdded)
+		sort.Strings(opsRemoved)
+		if !reflect.DeepEqual(list.Added, opsAdded) || !reflect.DeepEqual(list.Removed, opsRemoved) {
+			t.Errorf("deltas don't match ops %s: added=%v removed=%v, ops added=%v removed=%v", serialise(t, list.Ops), list.Added, list.Removed, opsAdded, opsRemoved)
+		}
+		if !reflect.DeepEqual(list.Added, wantAdded) || !reflect.DeepEqual(list.Removed, wantRemoved) {
+			t.Errorf("got added=%v removed=%v, want added=%v removed=%v", list.Added, list.Removed, wantAdded, wantRemoved)
+		}
+	}
+	bump := func(roomID string, ts gomatrixserverlib.Timestamp, nid int64) {
+		newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(ts.Time()))
+		dispatcher.OnNewEvent(context.Background(), roomID, newEvent, nid)
+	}
+
+	// initial window is A,B
+	doRequest(1, []string{roomA.RoomID, roomB.RoomID}, nil)
+	// D is bumped into the window, pushing B out
+	bump(roomD.RoomID, timestampNow+1000, 5)
+	doRequest(1, []string{roomD.RoomID}, []string{roomB.RoomID})
+	// A moves within the window, so nothing enters or leaves it
+	bump(roomA.RoomID, timestampNow+2000, 6)
+	doRequest(1, nil, nil)
+	// widening the range brings B back
+	doRequest(2, []string{roomB.RoomID}, nil)
+}
+
+func TestConnStateCallMembers(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCallMembers_alice:localhost"
+	bobID := "@TestConnStateCallMembers_bob:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	rooms := []internal.RoomMetadata{roomA}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{roomA.RoomID: roomA})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{roomA.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &rooms[0],
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 0},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got := res.Rooms[roomA.RoomID].CallMembers; got != nil {
+		t.Errorf("got call members %v want none", *got)
+	}
+
+	nid := int64(1)
+	sendCallMember := func(stateKey, sender string, content map[string]interface{}, want []string) {
+		t.Helper()
+		nid++
+		ev := testutils.NewStateEvent(t, "m.call.member", stateKey, sender, content, testutils.WithTimestamp(timestampNow.Time().Add(time.Duration(nid)*time.Second)))
+		dispatcher.OnNewEvent(context.Background(), roomA.RoomID, ev, nid)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		got := res.Rooms[roomA.RoomID].CallMembers
+		if got == nil {
+			t.Fatalf("call members were not updated, want %v", want)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("got call members %v want %v", *got, want)
+		}
+	}
+	// alice joins the call on one device, with one event per device
+	sendCallMember("_"+userID+"_DEVICE", userID, map[string]interface{}{
+		"application": "m.call",
+		"call_id":     "",
+		"device_id":   "DEVICE",
+	}, []string{userID})
+	// bob joins the call with an older client, with one event per user
+	sendCallMember(bobID, bobID, map[string]interface{}{
+		"memberships": []map[string]interface{}{
+			{"application": "m.call", "call_id": "", "device_id": "BOB_DEVICE"},
+		},
+	}, []string{userID, bobID})
+	// alice leaves the call
+	sendCallMember("_"+userID+"_DEVICE", userID, map[string]interface{}{}, []string{bobID})
+	// bob leaves the call, so nobody is in it
+	sendCallMember(bobID, bobID, map[string]interface{}{
+		"memberships": []map[string]interface{}{},
+	}, []string{})
+}
+
+func TestConnStateCompactStateDiffs(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCompactStateDiffs_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	room := newRoomMetadata("!a:localhost", timestampNow)
+	// a large power levels event, where only one user's power level will change
+	users := map[string]interface{}{userID: 100}
+	for i := 0; i < 100; i++ {
+		users[fmt.Sprintf("@user%d:localhost", i)] = 50
+	}
+	plEvent := testutils.NewStateEvent(t, "m.room.power_levels", "", userID, map[string]interface{}{
+		"users": users,
+	})
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": "A"})
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{room.RoomID: room})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{room.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{room.RoomID: &room}, map[string]internal.EventMetadata{room.RoomID: {NID: 1, Timestamp: 1}}, nil, nil
+	}
+	globalCache.LoadRoomStateOverride = func(roomIDs []string, requiredStateMap *internal.RequiredStateMap) map[string][]json.RawMessage {
+		return map[string][]json.RawMessage{
+			room.RoomID: {plEvent, nameEvent},
+		}
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	compactStateDiffs := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit:     1,
+				RequiredState:     [][2]string{{"m.room.power_levels", ""}, {"m.room.name", ""}},
+				CompactStateDiffs: &compactStateDiffs,
+			},
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 0},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got := len(res.Rooms[room.RoomID].RequiredState); got != 2 {
+		t.Fatalf("got %d required_state events want 2", got)
+	}
+
+	sendStateEvent := func(ev json.RawMessage, nid int64) json.RawMessage {
+		t.Helper()
+		dispatcher.OnNewEvent(context.Background(), room.RoomID, ev, nid)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		timeline := res.Rooms[room.RoomID].Timeline
+		if len(timeline) != 1 {
+			t.Fatalf("got %d timeline events want 1", len(timeline))
+		}
+		return timeline[0]
+	}
+
+	// change one user's power level, which should be sent as a diff
+	users["@user5:localhost"] = 100
+	newPLEvent := testutils.NewStateEvent(t, "m.room.power_levels", "", userID, map[string]interface{}{
+		"users": users,
+	}, testutils.WithTimestamp(timestampNow.Time().Add(time.Second)))
+	got := sendStateEvent(newPLEvent, 2)
+	if len(got) >= len(newPLEvent)/4 {
+		t.Errorf("diff is %d bytes, not much smaller than the %d byte event: %s", len(got), len(newPLEvent), string(got))
+	}
+	parsed := gjson.ParseBytes(got)
+	if parsed.Get("content").Exists() {
+		t.Errorf("diffed event has content: %s", string(got))
+	}
+	if parsed.Get("event_id").Str != gjson.GetBytes(newPLEvent, "event_id").Str || parsed.Get("state_key").Str != "" {
+		t.Errorf("diffed event is missing event fields: %s", string(got))
+	}
+	if base := parsed.Get("unsigned.content_diff_base").Str; base != gjson.GetBytes(plEvent, "event_id").Str {
+		t.Errorf("got content_diff_base %s want %s", base, gjson.GetBytes(plEvent, "event_id").Str)
+	}
+	var gotDiff []sync3.ContentPatchOp
+	if err = json.Unmarshal([]byte(parsed.Get("unsigned.content_diff").Raw), &gotDiff); err != nil {
+		t.Fatalf("failed to unmarshal content_diff: %s", err)
+	}
+	wantDiff := []sync3.ContentPatchOp{
+		{Op: "replace", Path: "/users/@user5:localhost", Value: json.RawMessage(`100`)},
+	}
+	if !reflect.DeepEqual(gotDiff, wantDiff) {
+		t.Errorf("got content_diff %+v want %+v", gotDiff, wantDiff)
+	}
+
+	// changing a small event is sent in full, as the diff would be larger
+	newNameEvent := testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": "B"},
+		testutils.WithTimestamp(timestampNow.Time().Add(2*time.Second)))
+	if got = sendStateEvent(newNameEvent, 3); !bytes.Equal(got, newNameEvent) {
+		t.Errorf("got %s want full event %s", string(got), string(newNameEvent))
+	}
+
+	// later diffs are against the most recently sent version of the event
+	users["@user6:localhost"] = 0
+	newerPLEvent := testutils.NewStateEvent(t, "m.room.power_levels", "", userID, map[string]interface{}{
+		"users": users,
+	}, testutils.WithTimestamp(timestampNow.Time().Add(3*time.Second)))
+	got = sendStateEvent(newerPLEvent, 4)
+	if base := gjson.GetBytes(got, "unsigned.content_diff_base").Str; base != gjson.GetBytes(newPLEvent, "event_id").Str {
+		t.Errorf("got content_diff_base %s want %s", base, gjson.GetBytes(newPLEvent, "event_id").Str)
+	}
+	if diff := gjson.GetBytes(got, "unsigned.content_diff").Raw; diff != `[{"op":"replace","path":"/users/@user6:localhost","value":0}]` {
+		t.Errorf("got content_diff %s", diff)
+	}
+}
+
+func TestConnStateInferDMs(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateInferDMs_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	// a two person room with no name, which isn't in m.direct
+	dmRoom := newRoomMetadata("!dm:localhost", timestampNow)
+	dmRoom.NameEvent = ""
+	dmRoom.JoinCount = 2
+	// a two person room with a name
+	namedRoom := newRoomMetadata("!named:localhost", timestampNow-1000)
+	namedRoom.JoinCount = 2
+	// a three person room with no name
+	groupRoom := newRoomMetadata("!group:localhost", timestampNow-2000)
+	groupRoom.NameEvent = ""
+	groupRoom.JoinCount = 2
+	groupRoom.InviteCount = 1
+	// a room in m.direct
+	mDirectRoom := newRoomMetadata("!mdirect:localhost", timestampNow-3000)
+	mDirectRoom.JoinCount = 5
+	rooms := []internal.RoomMetadata{dmRoom, namedRoom, groupRoom, mDirectRoom}
+	globalCache := caches.NewGlobalCache(nil)
+	startupRooms := make(map[string]internal.RoomMetadata)
+	startupMembers := make(map[string][]string)
+	for _, room := range rooms {
+		startupRooms[room.RoomID] = room
+		startupMembers[room.RoomID] = []string{userID}
+	}
+	globalCache.Startup(startupRooms)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(startupMembers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+		result := mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+		if urd, ok := result[mDirectRoom.RoomID]; ok {
+			urd.IsDM = true
+			result[mDirectRoom.RoomID] = urd
+		}
+		return result
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+
+	for _, inferDMs := range []bool{false, true} {
+		inferDMs := inferDMs
+		cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+				Sort: []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges([][2]int64{
+					{0, int64(len(rooms) - 1)},
+				}),
+			}},
+			InferDMs: &inferDMs,
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		wantDMs := map[string]bool{
+			dmRoom.RoomID:      inferDMs,
+			namedRoom.RoomID:   false,
+			groupRoom.RoomID:   false,
+			mDirectRoom.RoomID: true,
+		}
+		for roomID, want := range wantDMs {
+			if got := res.Rooms[roomID].IsDM; got != want {
+				t.Errorf("infer_dms=%v room %s: got is_dm %v want %v", inferDMs, roomID, got, want)
+			}
+		}
+		cs.Destroy()
+	}
+}
+
+func TestConnStateLatestEventSender(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateLatestEventSender_alice:localhost"
+	deviceID := "yep"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	room := newRoomMetadata("!a:localhost", timestampNow)
+	room.LatestEventsByType["m.room.message"] = internal.EventMetadata{NID: 2, Timestamp: uint64(timestampNow), Sender: bob}
+	room.LatestEventsByType["m.reaction"] = internal.EventMetadata{NID: 3, Timestamp: uint64(timestampNow), Sender: charlie}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{room.RoomID: room})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{room.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{room.RoomID: &room}, map[string]internal.EventMetadata{room.RoomID: {NID: 1, Timestamp: 1}}, nil, nil
+	}
+	globalCache.LoadRoomStateOverride = func(roomIDs []string, requiredStateMap *internal.RequiredStateMap) map[string][]json.RawMessage {
+		return map[string][]json.RawMessage{
+			room.RoomID: {
+				testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{"membership": "join", "displayname": "Bob"}),
+				testutils.NewStateEvent(t, "m.room.member", charlie, charlie, map[string]interface{}{"membership": "join", "displayname": "Charlie"}),
+			},
+		}
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	includeLatestEventSender := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit:            1,
+				IncludeLatestEventSender: &includeLatestEventSender,
+			},
+			BumpEventTypes: []string{"m.room.message"},
+			Sort:           []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 0},
+			}),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	// the reaction is more recent, but it doesn't bump the room
+	want := &sync3.LatestEventSender{UserID: bob, DisplayName: "Bob"}
+	if got := res.Rooms[room.RoomID].LatestEventSender; !reflect.DeepEqual(got, want) {
+		t.Errorf("initial: got latest_event_sender %+v want %+v", got, want)
+	}
+
+	// the sender tracks live bumping events
+	dispatcher.OnNewEvent(context.Background(), room.RoomID, testutils.NewMessageEvent(t, charlie, "hello",
+		testutils.WithTimestamp(timestampNow.Time().Add(time.Second))), 4)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	want = &sync3.LatestEventSender{UserID: charlie, DisplayName: "Charlie"}
+	if got := res.Rooms[room.RoomID].LatestEventSender; !reflect.DeepEqual(got, want) {
+		t.Errorf("live: got latest_event_sender %+v want %+v", got, want)
+	}
+
+	// events which don't bump the room leave the sender alone
+	dispatcher.OnNewEvent(context.Background(), room.RoomID, testutils.NewEvent(t, "m.reaction", bob, map[string]interface{}{},
+		testutils.WithTimestamp(timestampNow.Time().Add(2*time.Second))), 5)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got := res.Rooms[room.RoomID].LatestEventSender; got != nil {
+		t.Errorf("non-bumping event: got latest_event_sender %+v want none", got)
+	}
+}
+
+// Test that rooms move between is_dm lists when m.direct changes.
+func TestConnStateDMFilterLive(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateDMFilterLive_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	rooms := []internal.RoomMetadata{roomA, roomB}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{roomA.RoomID: roomA, roomB.RoomID: roomB})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{roomA.RoomID: {userID}, roomB.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	isDM := true
+	notDM := false
+	newList := func(filterDMs *bool) sync3.RequestList {
+		return sync3.RequestList{
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 10},
+			}),
+			Filters: &sync3.RequestFilters{IsDM: filterDMs},
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"dms":   newList(&isDM),
+			"rooms": newList(&notDM),
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Lists["dms"].Count != 0 || res.Lists["rooms"].Count != 2 {
+		t.Fatalf("got dms=%d rooms=%d want dms=0 rooms=2", res.Lists["dms"].Count, res.Lists["rooms"].Count)
+	}
+
+	setDMs := func(roomIDs ...string) *sync3.Response {
+		t.Helper()
+		content, err := json.Marshal(map[string]interface{}{
+			"type":    "m.direct",
+			"content": map[string]interface{}{"@bob:localhost": roomIDs},
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal m.direct: %s", err)
+		}
+		userCache.OnAccountData(context.Background(), []state.AccountData{
+			{
+				UserID: userID,
+				RoomID: state.AccountDataGlobalRoom,
+				Type:   "m.direct",
+				Data:   content,
+			},
+		})
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	assertOps := func(res *sync3.Response, listKey string, wantCount int, wantOps []sync3.ResponseOp) {
+		t.Helper()
+		if got := res.Lists[listKey].Count; got != wantCount {
+			t.Errorf("list %s: got count %d want %d", listKey, got, wantCount)
+		}
+		if got, want := serialise(t, res.Lists[listKey].Ops), serialise(t, wantOps); got != want {
+			t.Errorf("list %s: got ops %s want %s", listKey, got, want)
+		}
+	}
+
+	// room A becomes a DM. Rooms the user isn't joined to are ignored.
+	res = setDMs(roomA.RoomID, "!unknown:localhost")
+	assertOps(res, "dms", 1, []sync3.ResponseOp{
+		&sync3.ResponseOpSingle{Operation: sync3.OpDelete, Index: intPtr(0)},
+		&sync3.ResponseOpSingle{Operation: sync3.OpInsert, Index: intPtr(0), RoomID: roomA.RoomID},
+	})
+	assertOps(res, "rooms", 1, []sync3.ResponseOp{
+		&sync3.ResponseOpSingle{Operation: sync3.OpDelete, Index: intPtr(0)},
+	})
+
+	// and stops being one
+	res = setDMs()
+	assertOps(res, "dms", 0, []sync3.ResponseOp{
+		&sync3.ResponseOpSingle{Operation: sync3.OpDelete, Index: intPtr(0)},
+	})
+	assertOps(res, "rooms", 2, []sync3.ResponseOp{
+		&sync3.ResponseOpSingle{Operation: sync3.OpDelete, Index: intPtr(1)},
+		&sync3.ResponseOpSingle{Operation: sync3.OpInsert, Index: intPtr(0), RoomID: roomA.RoomID},
+	})
+}
+
+// Test that wildcard required_state includes members who join after the initial sync.
+func TestConnStateWildcardRequiredStateNewMembers(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateWildcardRequiredStateNewMembers_alice:localhost"
+	deviceID := "yep"
+	bob := "@bob:localhost"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	room := newRoomMetadata("!a:localhost", timestampNow)
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": "A"})
+	// the current state of the room, which bob joins below
+	roomState := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", userID, map[string]interface{}{"creator": userID}),
+		testutils.NewJoinEvent(t, userID),
+		nameEvent,
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{room.RoomID: room})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{room.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{room.RoomID: &room}, map[string]internal.EventMetadata{room.RoomID: {NID: 1, Timestamp: 1}}, nil, nil
+	}
+	globalCache.LoadRoomStateOverride = func(roomIDs []string, requiredStateMap *internal.RequiredStateMap) map[string][]json.RawMessage {
+		var state []json.RawMessage
+		for _, ev := range roomState {
+			parsed := gjson.ParseBytes(ev)
+			if requiredStateMap.Include(parsed.Get("type").Str, parsed.Get("state_key").Str) {
+				state = append(state, ev)
+			}
+		}
+		return map[string][]json.RawMessage{room.RoomID: state}
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	newRequest := func(requiredState [][2]string) *sync3.Request {
+		return &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+					RequiredState: requiredState,
+				},
+				Sort: []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges([][2]int64{
+					{0, 0},
+				}),
+			}},
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, newRequest([][2]string{{"m.room.member", sync3.Wildcard}}), false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got, want := res.Rooms[room.RoomID].RequiredState, roomState[1:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("initial: got required_state %v want %v", serialise(t, got), serialise(t, want))
+	}
+
+	// bob joins, which is sent in the timeline rather than as required_state
+	bobJoin := testutils.NewJoinEvent(t, bob, testutils.WithTimestamp(timestampNow.Time().Add(time.Second)))
+	roomState = append(roomState, bobJoin)
+	dispatcher.OnNewEvent(context.Background(), room.RoomID, bobJoin, 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got, want := res.Rooms[room.RoomID].Timeline, []json.RawMessage{bobJoin}; !reflect.DeepEqual(got, want) {
+		t.Errorf("live: got timeline %v want %v", serialise(t, got), serialise(t, want))
+	}
+	if got := res.Rooms[room.RoomID].RequiredState; len(got) > 0 {
+		t.Errorf("live: got required_state %v want none", serialise(t, got))
+	}
+
+	// asking for more state reloads the room, which now includes bob via the wildcard
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, newRequest([][2]string{{"m.room.member", sync3.Wildcard}, {"m.room.name", ""}}), false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got, want := res.Rooms[room.RoomID].RequiredState, []json.RawMessage{roomState[1], nameEvent, bobJoin}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expanded: got required_state %v want %v", serialise(t, got), serialise(t, want))
+	}
+}
+
+// Test that slow_get_all_rooms sends every room, in sorted order, in batches across responses.
+func TestConnStateSlowGetAllRoomsBatches(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateSlowGetAllRoomsBatches_alice:localhost"
+	deviceID := "yep"
+	defer func(batchSize int) {
+		SlowGetAllRoomsBatchSize = batchSize
+	}(SlowGetAllRoomsBatchSize)
+	SlowGetAllRoomsBatchSize = 2
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	globalCache := caches.NewGlobalCache(nil)
+	dispatcher := sync3.NewDispatcher()
+	rooms := make(map[string]*internal.RoomMetadata)
+	roomMetadata := make(map[string]internal.RoomMetadata)
+	joinedUsers := make(map[string][]string)
+	var roomIDs []string
+	for i := 0; i < 5; i++ {
+		// room 0 is most recent
+		room := newRoomMetadata(fmt.Sprintf("!%d:localhost", i), timestampNow-gomatrixserverlib.Timestamp(i*1000))
+		rooms[room.RoomID] = &room
+		roomMetadata[room.RoomID] = room
+		joinedUsers[room.RoomID] = []string{userID}
+		roomIDs = append(roomIDs, room.RoomID)
+	}
+	globalCache.Startup(roomMetadata)
+	dispatcher.Startup(joinedUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinTimings = make(map[string]internal.EventMetadata)
+		for roomID := range rooms {
+			joinTimings[roomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+		}
+		return 1, rooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	slowGetAllRooms := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+			},
+			Sort:            []string{sync3.SortByRecency},
+			SlowGetAllRooms: &slowGetAllRooms,
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	// all the room IDs are sent up front, but only the first batch of room data
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: len(roomIDs),
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: sync3.OpSync,
+						Range:     [2]int64{0, int64(len(roomIDs) - 1)},
+						RoomIDs:   roomIDs,
+					},
+				},
+			},
+		},
+	})
+	var gotRoomIDs []string
+	for {
+		if len(res.Rooms) > SlowGetAllRoomsBatchSize {
+			t.Fatalf("got %d rooms in one response, want at most %d", len(res.Rooms), SlowGetAllRoomsBatchSize)
+		}
+		batch := make([]string, 0, len(res.Rooms))
+		for roomID := range res.Rooms {
+			batch = append(batch, roomID)
+		}
+		sort.Strings(batch)
+		gotRoomIDs = append(gotRoomIDs, batch...)
+		if len(gotRoomIDs) == len(roomIDs) {
+			break
+		}
+		if len(res.Rooms) == 0 {
+			t.Fatalf("got no rooms but only %d of %d rooms have been sent", len(gotRoomIDs), len(roomIDs))
+		}
+		res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+	}
+	if !reflect.DeepEqual(gotRoomIDs, roomIDs) {
+		t.Errorf("got rooms %v want %v", gotRoomIDs, roomIDs)
+	}
+
+	// live updates are still sent once all the rooms have been sent
+	dispatcher.OnNewEvent(context.Background(), roomIDs[4], testutils.NewMessageEvent(t, userID, "hello",
+		testutils.WithTimestamp(timestampNow.Time().Add(time.Second))), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if _, ok := res.Rooms[roomIDs[4]]; !ok || len(res.Rooms) != 1 {
+		t.Errorf("live: got rooms %v want only %s", res.Rooms, roomIDs[4])
+	}
+}
+
+// Test that a burst of reorders is split across multiple responses when there are more ops than
+// the configured limit, and that applying the ops from each response in turn leaves the client with
+// the same list as the server.
+func TestConnStateMaxOpsPerResponse(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMaxOpsPerResponse_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	numRooms := 10
+	maxOps := 4
+	var roomIDs []string
+	roomIDToRoom := make(map[string]internal.RoomMetadata)
+	joinTimings := make(map[string]internal.EventMetadata)
+	for i := 0; i < numRooms; i++ {
+		// room 0 is most recent, room 9 is least recent
+		room := newRoomMetadata(fmt.Sprintf("!%d:localhost", i), timestampNow-gomatrixserverlib.Timestamp(i*1000))
+		roomIDs = append(roomIDs, room.RoomID)
+		roomIDToRoom[room.RoomID] = room
+		joinTimings[room.RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(roomIDToRoom)
+	dispatcher := sync3.NewDispatcher()
+	joinedUsers := make(map[string][]string)
+	for _, roomID := range roomIDs {
+		joinedUsers[roomID] = []string{userID}
+	}
+	dispatcher.Startup(joinedUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings2 map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		for roomID, room := range roomIDToRoom {
+			room := room
+			joinedRooms[roomID] = &room
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, maxOps)
+
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, int64(numRooms - 1)},
+			}),
+		}},
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: numRooms,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, int64(numRooms - 1)},
+						RoomIDs:   roomIDs,
+					},
+				},
+			},
+		},
+	})
+	clientList := append([]string{}, roomIDs...)
+
+	// bump the bottom half of the list to the top one by one: each bump is a DELETE/INSERT pair
+	var wantList []string
+	numBumps := 5
+	for i := 0; i < numBumps; i++ {
+		roomID := roomIDs[numRooms-1-i]
+		newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp((timestampNow + gomatrixserverlib.Timestamp((i+1)*1000)).Time()))
+		dispatcher.OnNewEvent(context.Background(), roomID, newEvent, int64(i+2))
+		wantList = append([]string{roomID}, wantList...)
+	}
+	wantList = append(wantList, roomIDs[:numRooms-numBumps]...)
+
+	// keep syncing until the client has caught up
+	numResponses := 0
+	totalOps := 0
+	for {
+		res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		ops := res.Lists["a"].Ops
+		if len(ops) == 0 {
+			break
+		}
+		numResponses++
+		totalOps += len(ops)
+		if len(ops) > maxOps {
+			t.Fatalf("response %d has %d ops, want at most %d", numResponses, len(ops), maxOps)
+		}
+		if len(ops)%2 != 0 {
+			t.Fatalf("response %d has an odd number of ops, a DELETE/INSERT pair was split: %v", numResponses, serialise(t, ops))
+		}
+		// apply the ops to the client's view of the list
+		for _, op := range ops {
+			single, ok := op.(*sync3.ResponseOpSingle)
+			if !ok {
+				t.Fatalf("unexpected op: %v", serialise(t, op))
+			}
+			switch single.Operation {
+			case sync3.OpDelete:
+				clientList = append(clientList[:*single.Index], clientList[*single.Index+1:]...)
+			case sync3.OpInsert:
+				clientList = append(clientList[:*single.Index], append([]string{single.RoomID}, clientList[*single.Index:]...)...)
+			default:
+				t.Fatalf("unexpected op: %v", serialise(t, op))
+			}
+		}
+		if len(clientList) != numRooms {
+			t.Fatalf("client list has %d rooms after response %d, want %d: %v", len(clientList), numResponses, numRooms, clientList)
+		}
+	}
+	if totalOps != numBumps*2 {
+		t.Errorf("got %d ops in total, want %d", totalOps, numBumps*2)
+	}
+	if numResponses != 3 {
+		t.Errorf("ops were sent in %d responses, want 3", numResponses)
+	}
+	if !reflect.DeepEqual(clientList, wantList) {
+		t.Errorf("client list out of sync with server:\ngot  %v\nwant %v", clientList, wantList)
+	}
+}
+
+func TestConnStateCaughtUp(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCaughtUp_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	numRooms := 5
+	maxOps := 2
+	var roomIDs []string
+	roomIDToRoom := make(map[string]internal.RoomMetadata)
+	joinTimings := make(map[string]internal.EventMetadata)
+	joinedUsers := make(map[string][]string)
+	for i := 0; i < numRooms; i++ {
+		room := newRoomMetadata(fmt.Sprintf("!%d:localhost", i), timestampNow-gomatrixserverlib.Timestamp(i*1000))
+		roomIDs = append(roomIDs, room.RoomID)
+		roomIDToRoom[room.RoomID] = room
+		joinTimings[room.RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+		joinedUsers[room.RoomID] = []string{userID}
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(roomIDToRoom)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(joinedUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings2 map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		for roomID, room := range roomIDToRoom {
+			room := room
+			joinedRooms[roomID] = &room
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, maxOps)
+
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, int64(numRooms - 1)},
+			}),
+		}},
+	}
+	// nothing is pending after the initial sync
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if !res.CaughtUp {
+		t.Fatalf("initial response not caught up")
+	}
+
+	// bump 3 rooms to the top, which is 3 DELETE/INSERT pairs. With at most 2 ops per response,
+	// the first two responses defer updates and the third sends the last of them.
+	for i := 0; i < 3; i++ {
+		roomID := roomIDs[numRooms-1-i]
+		newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp((timestampNow + gomatrixserverlib.Timestamp((i+1)*1000)).Time()))
+		dispatcher.OnNewEvent(context.Background(), roomID, newEvent, int64(i+2))
+	}
+	wantCaughtUp := []bool{false, false, true}
+	for i, want := range wantCaughtUp {
+		res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		if len(res.Lists["a"].Ops) == 0 {
+			t.Fatalf("response %d has no ops", i)
+		}
+		if res.CaughtUp != want {
+			t.Errorf("response %d: got caught_up=%v want %v", i, res.CaughtUp, want)
+		}
+	}
+
+	// an idle connection remains caught up
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(res.Lists["a"].Ops) != 0 {
+		t.Fatalf("idle response has ops: %v", serialise(t, res.Lists["a"].Ops))
+	}
+	if !res.CaughtUp {
+		t.Errorf("idle response not caught up")
+	}
+}
+
+// Test that a request with a short timeout returns an empty response promptly when no data arrives.
+func TestConnStateShortTimeout(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateShortTimeout_alice:localhost"
+	deviceID := "yep"
+	room := newRoomMetadata("!a:localhost", gomatrixserverlib.Timestamp(1632131678061))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{room.RoomID: room})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{room.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{room.RoomID: &room}, map[string]internal.EventMetadata{
+			room.RoomID: {NID: 1, Timestamp: 1},
+		}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 1000)
+
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 10},
+			}),
+		}},
+	}
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	req.SetTimeoutMSecs(200)
+	start := time.Now()
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	took := time.Since(start)
+	if took < 200*time.Millisecond {
+		t.Errorf("returned after %v, before the timeout", took)
+	}
+	if took > 2*time.Second {
+		t.Errorf("took %v to return, want close to the timeout of 200ms", took)
+	}
+	if len(res.Lists["a"].Ops) != 0 || len(res.Rooms) != 0 {
+		t.Errorf("got non-empty response: %v", serialise(t, res))
+	}
+}
+
+// Test that lists which set coalesce_ops get an UPDATE rather than a DELETE and INSERT at the same index.
+func TestConnStateCoalesceOps(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCoalesceOps_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	roomC := newRoomMetadata("!c:localhost", timestampNow-2000)
+	roomD := newRoomMetadata("!d:localhost", timestampNow-3000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+		roomD.RoomID: roomD,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+		roomD.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+				roomD.RoomID: &roomD,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 2, Timestamp: 2},
+				roomC.RoomID: {NID: 3, Timestamp: 3},
+				roomD.RoomID: {NID: 4, Timestamp: 4},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	coalesceOps := true
+	// both lists only track index 1
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"coalesced": {
+				Sort:        []string{sync3.SortByRecency},
+				Ranges:      sync3.SliceRanges([][2]int64{{1, 1}}),
+				CoalesceOps: &coalesceOps,
+			},
+			"uncoalesced": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges([][2]int64{{1, 1}}),
+			},
+		},
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	for _, listKey := range []string{"coalesced", "uncoalesced"} {
+		if got, want := serialise(t, res.Lists[listKey].Ops), serialise(t, []sync3.ResponseOp{
+			&sync3.ResponseOpRange{Operation: sync3.OpSync, Range: [2]int64{1, 1}, RoomIDs: []string{roomB.RoomID}},
+		}); got != want {
+			t.Errorf("list %s: got ops %s want %s", listKey, got, want)
+		}
+	}
+
+	// D is bumped to the top, so A shifts into index 1 without the room at index 1 moving in the window
+	// A,B,C,D -> D,A,B,C
+	newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Time().Add(time.Second)))
+	dispatcher.OnNewEvent(context.Background(), roomD.RoomID, newEvent, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	res, err = cs.OnIncomingRequest(ctx, ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got, want := serialise(t, res.Lists["coalesced"].Ops), serialise(t, []sync3.ResponseOp{
+		&sync3.ResponseOpSingle{Operation: sync3.OpUpdate, Index: intPtr(1), RoomID: roomA.RoomID},
+	}); got != want {
+		t.Errorf("coalesced: got ops %s want %s", got, want)
+	}
+	if got, want := serialise(t, res.Lists["uncoalesced"].Ops), serialise(t, []sync3.ResponseOp{
+		&sync3.ResponseOpSingle{Operation: sync3.OpDelete, Index: intPtr(1)},
+		&sync3.ResponseOpSingle{Operation: sync3.OpInsert, Index: intPtr(1), RoomID: roomA.RoomID},
+	}); got != want {
+		t.Errorf("uncoalesced: got ops %s want %s", got, want)
+	}
+}
+
+// Test that shrinking a list's ranges INVALIDATEs the indexes which are no longer tracked.
+func TestConnStateShrinkRangesInvalidates(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateShrinkRangesInvalidates_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	roomC := newRoomMetadata("!c:localhost", timestampNow-2000)
+	roomD := newRoomMetadata("!d:localhost", timestampNow-3000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+		roomD.RoomID: roomD,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+		roomD.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+				roomD.RoomID: &roomD,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 2, Timestamp: 2},
+				roomC.RoomID: {NID: 3, Timestamp: 3},
+				roomD.RoomID: {NID: 4, Timestamp: 4},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	doRequest := func(ranges sync3.SliceRanges, wantOps []sync3.ResponseOp) {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: ranges,
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		if got, want := serialise(t, res.Lists["a"].Ops), serialise(t, wantOps); got != want {
+			t.Errorf("ranges %v: got ops %s want %s", ranges, got, want)
+		}
+	}
+	doRequest(sync3.SliceRanges{{0, 3}}, []sync3.ResponseOp{
+		&sync3.ResponseOpRange{Operation: sync3.OpSync, Range: [2]int64{0, 3}, RoomIDs: []string{roomA.RoomID, roomB.RoomID, roomC.RoomID, roomD.RoomID}},
+	})
+	// the client must drop C and D from its list
+	doRequest(sync3.SliceRanges{{0, 1}}, []sync3.ResponseOp{
+		&sync3.ResponseOpRange{Operation: sync3.OpInvalidate, Range: [2]int64{2, 3}},
+	})
+	// shrinking from the start drops A
+	doRequest(sync3.SliceRanges{{1, 1}}, []sync3.ResponseOp{
+		&sync3.ResponseOpRange{Operation: sync3.OpInvalidate, Range: [2]int64{0, 0}},
+	})
+}
+
+// Test that a list with empty ranges is kept without a window, whereas omitting a list deletes it
+// along with its per-list state.
+func TestConnStateEmptyRangesVersusOmittedList(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateEmptyRangesVersusOmittedList_alice:localhost"
+	deviceID := "yep"
+	defer func(batchSize int) {
+		SlowGetAllRoomsBatchSize = batchSize
+	}(SlowGetAllRoomsBatchSize)
+	SlowGetAllRoomsBatchSize = 1
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	roomC := newRoomMetadata("!c:localhost", timestampNow-2000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 2, Timestamp: 2},
+				roomC.RoomID: {NID: 3, Timestamp: 3},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+	userCache.LazyRoomDataOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 0)
+
+	slowGetAllRooms := true
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges{{0, 1}},
+			},
+			"b": {
+				Sort:            []string{sync3.SortByRecency},
+				SlowGetAllRooms: &slowGetAllRooms,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if _, ok := cs.getAllRoomsBacklogs["b"]; !ok {
+		t.Fatalf("list 'b' has no slow_get_all_rooms backlog")
+	}
+
+	// "a" has empty ranges so is kept with no window, "b" is omitted so is deleted
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{Operation: sync3.OpInvalidate, Range: [2]int64{0, 1}},
+				},
+			},
+		},
+	})
+	if cs.lists.Get("a") == nil {
+		t.Errorf("list 'a' with empty ranges was deleted")
+	}
+	if cs.lists.Get("b") != nil {
+		t.Errorf("omitted list 'b' was not deleted")
+	}
+	if _, ok := cs.getAllRoomsBacklogs["b"]; ok {
+		t.Errorf("deleted list 'b' still has a slow_get_all_rooms backlog")
+	}
+	for _, roomID := range []string{roomA.RoomID, roomB.RoomID, roomC.RoomID} {
+		if _, ok := cs.lists.ReadOnlyRoom(roomID).LastInterestedEventTimestamps["b"]; ok {
+			t.Errorf("room %s still has a timestamp for deleted list 'b'", roomID)
+		}
+	}
+}
+
+// Test that a connection resumed from a snapshot is not re-initialised: only list ranges whose rooms
+// changed get ops, and only rooms which changed or were never sent are sent again.
+func TestConnStateResume(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateResume_alice:localhost"
+	deviceID := "yep"
+	timestampNow := gomatrixserverlib.Timestamp(1632131678061)
+	rooms := []internal.RoomMetadata{
+		newRoomMetadata("!a:localhost", timestampNow),
+		newRoomMetadata("!b:localhost", timestampNow-1000),
+		newRoomMetadata("!c:localhost", timestampNow-2000),
+	}
+	latestNIDs := map[string]int64{
+		rooms[0].RoomID: 10,
+		rooms[1].RoomID: 11,
+		rooms[2].RoomID: 12,
+	}
+	newConnState := func() *ConnState {
+		globalCache := caches.NewGlobalCache(nil)
+		startupRooms := make(map[string]internal.RoomMetadata)
+		startupMembers := make(map[string][]string)
+		for _, room := range rooms {
+			startupRooms[room.RoomID] = room
+			startupMembers[room.RoomID] = []string{userID}
+		}
+		globalCache.Startup(startupRooms)
+		dispatcher := sync3.NewDispatcher()
+		dispatcher.Startup(startupMembers)
+		globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+			joinedRooms = make(map[string]*internal.RoomMetadata)
+			joinTimings = make(map[string]internal.EventMetadata)
+			loadPositions = make(map[string]int64)
+			for i := range rooms {
+				joinedRooms[rooms[i].RoomID] = &rooms[i]
+				joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+				loadPositions[rooms[i].RoomID] = latestNIDs[rooms[i].RoomID]
+			}
+			return 100, joinedRooms, joinTimings, loadPositions, nil
+		}
+		userCache := caches.NewUserCache(userID, globalCache, nil, &NopTransactionFetcher{})
+		userCache.LazyRoomDataOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]caches.UserRoomData {
+			result := mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+			for roomID, urd := range result {
+				urd.RequestedLatestEvents.LatestNID = latestNIDs[roomID]
+				result[roomID] = urd
+			}
+			return result
+		}
+		dispatcher.Register(context.Background(), userCache.UserID, userCache)
+		dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+		return NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, 1000)
+	}
+	// resume a new connection from a snapshot, as if the proxy had restarted
+	resume := func(muxedReq *sync3.Request, snapshot *ConnSnapshot) *ConnState {
+		t.Helper()
+		if muxedReq == nil {
+			t.Fatalf("Snapshot returned nothing")
+		}
+		// the snapshot is saved as JSON, so make sure it survives being saved
+		var req sync3.Request
+		if err := json.Unmarshal([]byte(serialise(t, muxedReq)), &req); err != nil {
+			t.Fatalf("failed to unmarshal muxed request: %s", err)
+		}
+		var resumeSnapshot ConnSnapshot
+		if err := json.Unmarshal([]byte(serialise(t, snapshot)), &resumeSnapshot); err != nil {
+			t.Fatalf("failed to unmarshal snapshot: %s", err)
+		}
+		resumed := newConnState()
+		resumed.Resume(&req, &resumeSnapshot)
+		return resumed
+	}
+	longPoll := func(cs *ConnState) *sync3.Response {
+		t.Helper()
+		req := &sync3.Request{}
+		req.SetTimeoutMSecs(10)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+
+	cs := newConnState()
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}, true, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{rooms[0].RoomID, rooms[1].RoomID},
+					},
+				},
+			},
+		},
+	})
+	muxedReq, snapshot := cs.Snapshot()
+	// long polls which return nothing don't change the snapshot
+	longPoll(cs)
+	if req, _ := cs.Snapshot(); req != nil {
+		t.Errorf("Snapshot returned a snapshot after an empty long poll")
+	}
+
+	// nothing changed whilst the proxy was down, so nothing is sent again
+	cs = resume(muxedReq, snapshot)
+	res = longPoll(cs)
+	if res.ListOps() != 0 || len(res.Rooms) != 0 {
+		t.Errorf("resumed connection with no changes got non-empty response: %v", serialise(t, res))
+	}
+	if res.Lists["a"].Count != 3 {
+		t.Errorf("resumed connection got count %d want 3", res.Lists["a"].Count)
+	}
+
+	// room C gets a new event whilst the proxy is down, moving it into the range
+	rooms[2].LastMessageTimestamp = uint64(timestampNow + 1000)
+	latestNIDs[rooms[2].RoomID] = 13
+	cs = resume(cs.Snapshot())
+	res = longPoll(cs)
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{rooms[2].RoomID, rooms[0].RoomID},
+					},
+				},
+			},
+		},
+	})
+	if len(res.Rooms) != 1 {
+		t.Errorf("resumed connection got rooms %v want only room C", keys(res.Rooms))
+	}
+	if _, ok := res.Rooms[rooms[2].RoomID]; !ok {
+		t.Errorf("resumed connection did not send room C: %v", serialise(t, res))
+	}
+}
+
 func checkResponse(t *testing.T, checkRoomIDsOnly bool, got, want *sync3.Response) {
 	t.Helper()
 	if len(got.Lists) != len(want.Lists) {
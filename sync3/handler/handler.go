@@ -12,6 +12,7 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -34,6 +35,10 @@ import (
 
 const DefaultSessionID = "default"
 
+// DefaultMaintenanceRetryAfter is how long clients are told to wait before retrying new connections
+// in maintenance mode, if no other duration is given.
+const DefaultMaintenanceRetryAfter = 30 * time.Second
+
 var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
 	Out:        os.Stderr,
 	TimeFormat: "15:04:05",
@@ -55,10 +60,24 @@ type SyncLiveHandler struct {
 	// > (2) when multiple goroutines read, write, and overwrite entries for disjoint sets of keys.
 	userCaches *sync.Map // map[user_id]*UserCache
 	Dispatcher *sync3.Dispatcher
+	// the pollers which are currently lagging behind the homeserver
+	laggingPollers *sync.Map // map[sync2.PollerID]struct{}
+	// the lagging pollers which fetch room data for all of their user's devices
+	laggingRoomPollers *sync.Map // map[user_id]sync2.PollerID
 
 	GlobalCache            *caches.GlobalCache
 	maxPendingEventUpdates int
 	maxTransactionIDDelay  time.Duration
+	maxOpsPerResponse      int
+	exposeV2Since          bool
+	// if non-zero, connections are saved to the database so they can be resumed after a restart if
+	// they were used within this duration
+	persistConnsTTL time.Duration
+	// saves connections in the background, if persistConnsTTL is non-zero
+	connSaver *ConnSaver
+	// how long clients should wait before retrying new connections, in milliseconds. Non-zero
+	// when in maintenance mode.
+	maintenanceRetryAfterMs *atomic.Int64
 
 	setupHistVec *prometheus.HistogramVec
 	histVec      *prometheus.HistogramVec
@@ -68,24 +87,46 @@ type SyncLiveHandler struct {
 func NewSync3Handler(
 	store *state.Storage, storev2 *sync2.Storage, v2Client sync2.Client, secret string,
 	pub pubsub.Notifier, sub pubsub.Listener, enablePrometheus bool, maxPendingEventUpdates int,
-	maxTransactionIDDelay time.Duration,
+	maxTransactionIDDelay time.Duration, maxOpsPerResponse int, exposeV2Since bool, connTTL time.Duration,
+	maxNewConnsPerMinute int, persistConns bool,
 ) (*SyncLiveHandler, error) {
 	logger.Info().Msg("creating handler")
 	sh := &SyncLiveHandler{
 		V2:                     v2Client,
 		Storage:                store,
 		V2Store:                storev2,
-		ConnMap:                sync3.NewConnMap(enablePrometheus),
+		ConnMap:                sync3.NewConnMap(enablePrometheus, connTTL, maxNewConnsPerMinute),
 		userCaches:             &sync.Map{},
+		laggingPollers:         &sync.Map{},
+		laggingRoomPollers:     &sync.Map{},
 		Dispatcher:             sync3.NewDispatcher(),
 		GlobalCache:            caches.NewGlobalCache(store),
 		maxPendingEventUpdates: maxPendingEventUpdates,
 		maxTransactionIDDelay:  maxTransactionIDDelay,
+		maxOpsPerResponse:      maxOpsPerResponse,
+		exposeV2Since:          exposeV2Since,
+
+		maintenanceRetryAfterMs: &atomic.Int64{},
 	}
 	sh.Extensions = &extensions.Handler{
-		Store:       store,
-		E2EEFetcher: sh,
-		GlobalCache: sh.GlobalCache,
+		Store:             store,
+		E2EEFetcher:       sh,
+		GlobalCache:       sh.GlobalCache,
+		UsersSharingRooms: sh.Dispatcher.UsersSharingRoomsWith,
+	}
+
+	if persistConns {
+		sh.persistConnsTTL = connTTL
+		if sh.persistConnsTTL <= 0 {
+			sh.persistConnsTTL = sync3.DefaultConnTTL
+		}
+		// connections which weren't used recently enough can't be resumed
+		deleted, err := store.ConnsTable.DeleteUpdatedBefore(time.Now().Add(-sh.persistConnsTTL))
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete expired connections: %s", err)
+		}
+		logger.Info().Int64("deleted", deleted).Msg("deleted expired connections")
+		sh.connSaver = NewConnSaver(store.ConnsTable)
 	}
 
 	if enablePrometheus {
@@ -100,6 +141,27 @@ func NewSync3Handler(
 	return sh, nil
 }
 
+// SetMaintenanceMode enables or disables maintenance mode. In maintenance mode, requests for new
+// connections are rejected with a retryable error telling clients to retry after retryAfter. Existing
+// connections are unaffected, so they can drain. If retryAfter is 0, DefaultMaintenanceRetryAfter is used.
+func (h *SyncLiveHandler) SetMaintenanceMode(enabled bool, retryAfter time.Duration) {
+	if !enabled {
+		h.maintenanceRetryAfterMs.Store(0)
+		logger.Info().Msg("maintenance mode disabled")
+		return
+	}
+	if retryAfter <= 0 {
+		retryAfter = DefaultMaintenanceRetryAfter
+	}
+	h.maintenanceRetryAfterMs.Store(retryAfter.Milliseconds())
+	logger.Info().Dur("retry_after", retryAfter).Msg("maintenance mode enabled")
+}
+
+// InMaintenanceMode returns true if new connections are being rejected.
+func (h *SyncLiveHandler) InMaintenanceMode() bool {
+	return h.maintenanceRetryAfterMs.Load() > 0
+}
+
 func (h *SyncLiveHandler) Startup(storeSnapshot *state.StartupSnapshot) error {
 	if err := h.Dispatcher.Startup(storeSnapshot.AllJoinedMembers); err != nil {
 		return fmt.Errorf("failed to load sync3.Dispatcher: %s", err)
@@ -125,6 +187,10 @@ func (h *SyncLiveHandler) Listen() {
 
 // used in tests to close postgres connections
 func (h *SyncLiveHandler) Teardown() {
+	// make any outstanding connection writes whilst we can still talk to the DB
+	if h.connSaver != nil {
+		h.connSaver.Teardown()
+	}
 	// tear down DB conns
 	h.Storage.Teardown()
 	h.V2Sub.Teardown()
@@ -181,11 +247,14 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				Err:        err,
 			}
 		}
-		if herr.ErrCode != "M_UNKNOWN_POS" {
+		if herr.RetryAfterMs > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt((herr.RetryAfterMs+999)/1000, 10))
+		} else if herr.ErrCode != "M_UNKNOWN_POS" {
 			// artificially wait a bit before sending back the error
 			// this guards against tightlooping when the client hammers the server with invalid requests,
 			// but not for M_UNKNOWN_POS which we expect to send back after expiring a client's connection.
-			// We want to recover rapidly in that scenario, hence not sleeping.
+			// We want to recover rapidly in that scenario, hence not sleeping. Errors with a retry
+			// delay already tell the client how long to back off for.
 			time.Sleep(time.Second)
 		}
 		w.WriteHeader(herr.StatusCode)
@@ -219,6 +288,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 			return &internal.HandlerError{
 				StatusCode: 400,
 				Err:        err,
+				ErrCode:    "M_INVALID_PARAM",
 			}
 		}
 	}
@@ -226,15 +296,6 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		c.Str("txn_id", requestBody.TxnID)
 		return c
 	})
-	for listKey, l := range requestBody.Lists {
-		if l.Ranges != nil && !l.Ranges.Valid() {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        fmt.Errorf("list[%v] invalid ranges %v", listKey, l.Ranges),
-			}
-		}
-	}
-
 	logErrorOrWarning := func(msg string, herr *internal.HandlerError) {
 		if herr.StatusCode >= 500 {
 			hlog.FromRequest(req).Err(herr).Msg(msg)
@@ -243,14 +304,20 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		}
 	}
 
-	conn, herr := h.setupConnection(req, &requestBody, req.URL.Query().Get("pos") != "")
-	if herr != nil {
-		logErrorOrWarning("failed to get or create Conn", herr)
-		return herr
+	containsPos := req.URL.Query().Get("pos") != ""
+	if retryAfterMs := h.maintenanceRetryAfterMs.Load(); retryAfterMs > 0 && !containsPos {
+		// let existing connections drain, but don't make any new ones
+		return internal.MaintenanceError(time.Duration(retryAfterMs) * time.Millisecond)
 	}
 	// set pos and timeout if specified
 	cpos, herr := parseIntFromQuery(req.URL, "pos")
 	if herr != nil {
+		// we never send positions like this, so tell the client to start again rather than retrying
+		return internal.ExpiredSessionError(internal.ResetReasonUnknownPos)
+	}
+	conn, herr := h.setupConnection(req, &requestBody, containsPos)
+	if herr != nil {
+		logErrorOrWarning("failed to get or create Conn", herr)
 		return herr
 	}
 	requestBody.SetPos(cpos)
@@ -275,6 +342,17 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		logErrorOrWarning("failed to OnIncomingRequest", herr)
 		return herr
 	}
+	if h.exposeV2Since && requestBody.IncludeV2Since {
+		// Only ever return the since token for the device making this request. Since tokens are
+		// per-device, so there is no risk of handing out another device's position.
+		since, err := h.V2Store.DevicesTable.Since(conn.UserID, conn.DeviceID)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to load v2 since token")
+		} else {
+			resp.V2Since = since
+		}
+	}
+	resp.StaleData = h.isLagging(conn.UserID, conn.DeviceID)
 	// for logging
 	var numToDeviceEvents int
 	if resp.Extensions.ToDevice != nil {
@@ -373,6 +451,10 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 		DeviceID: token.DeviceID,
 		CID:      syncReq.ConnID,
 	}
+	// the state of the connection being resumed, if any
+	var resumeReq *sync3.Request
+	var resumeSnapshot *ConnSnapshot
+	var resumePos int64
 	// client thinks they have a connection
 	if containsPos {
 		// Lookup the connection
@@ -382,7 +464,25 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 			return conn, nil
 		}
 		// conn doesn't exist, we probably nuked it.
-		return nil, internal.ExpiredSessionError()
+		resetReason := h.ConnMap.ResetReason(connID)
+		if resetReason != internal.ResetReasonServerRestart || h.persistConnsTTL == 0 {
+			return nil, internal.ExpiredSessionError(resetReason)
+		}
+		// we may have restarted, in which case we can resume the connection from the database
+		resumeReq, resumeSnapshot, resumePos = h.loadConn(connID, req.URL, log)
+		if resumeReq == nil {
+			return nil, internal.ExpiredSessionError(resetReason)
+		}
+		log.Info().Int64("pos", resumePos).Msg("resuming connection")
+	}
+
+	// check this before doing any work for the new connection, as that work is what we're protecting.
+	// Resumed connections are not new, so they are not limited.
+	if resumeReq == nil {
+		if retryAfter, ok := h.ConnMap.AllowNewConn(token.UserID); !ok {
+			log.Warn().Dur("retry_after", retryAfter).Msg("user is creating connections too quickly")
+			return nil, internal.RateLimitedError(retryAfter)
+		}
 	}
 
 	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
@@ -416,14 +516,30 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 	// because we *either* do the existing check *or* make a new conn. It's important for CreateConn
 	// to check for an existing connection though, as it's possible for the client to call /sync
 	// twice for a new connection.
+	var cs *ConnState
 	conn, created := h.ConnMap.CreateConn(connID, func() sync3.ConnHandler {
-		return NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs = NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay, h.maxOpsPerResponse)
+		if resumeReq != nil {
+			cs.Resume(resumeReq, resumeSnapshot)
+		}
+		return cs
 	})
 	if created {
 		log.Info().Msg("created new connection")
+		if resumeReq == nil {
+			h.ConnMap.RecordNewConn(token.UserID)
+		}
 	} else {
 		log.Info().Msg("using existing connection")
 	}
+	if created && resumeReq != nil {
+		conn.ResumeAt(resumePos)
+	}
+	if created && h.persistConnsTTL > 0 {
+		conn.SetOnResponse(func(pos int64) {
+			h.saveConn(connID, pos, cs)
+		})
+	}
 	return conn, nil
 }
 
@@ -431,11 +547,12 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(accessToken string, logger
 	// We don't recognise the given accessToken. Ask the homeserver who owns it.
 	userID, deviceID, err := h.V2.WhoAmI(accessToken)
 	if err != nil {
-		if err == sync2.HTTP401 {
+		if err == sync2.HTTP401 || err == sync2.HTTP401SoftLogout {
 			return nil, &internal.HandlerError{
 				StatusCode: 401,
 				Err:        fmt.Errorf("/whoami returned HTTP 401"),
 				ErrCode:    "M_UNKNOWN_TOKEN",
+				SoftLogout: err == sync2.HTTP401SoftLogout,
 			}
 		}
 		log.Warn().Err(err).Msg("failed to get user ID from device ID")
@@ -444,6 +561,16 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(accessToken string, logger
 			Err:        err,
 		}
 	}
+	// Tokens are stored against the device /whoami returns, so tokens without a device e.g. for
+	// appservices would share one device's since token and to-device inbox.
+	if deviceID == "" {
+		logger.Warn().Str("user", userID).Msg("/whoami returned no device ID for access token")
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusForbidden,
+			Err:        fmt.Errorf("access token is not associated with a device"),
+			ErrCode:    "M_FORBIDDEN",
+		}
+	}
 
 	var token *sync2.Token
 	err = sqlutil.WithTransaction(h.V2Store.DB, func(txn *sqlx.Tx) error {
@@ -521,6 +648,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(context.Background(), []state.AccountData{ignoreEvent[0]})
 	}
 
+	// select the push rules account data event and set muted room status
+	pushRulesEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.push_rules"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load push rules for user %s: %w", userID, err)
+	}
+	if len(pushRulesEvent) == 1 {
+		uc.OnAccountData(context.Background(), []state.AccountData{pushRulesEvent[0]})
+	}
+
 	// select all room tag account data and set it
 	tagEvents, err := h.Storage.RoomAccountDatasWithType(userID, "m.tag")
 	if err != nil {
@@ -530,6 +666,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(context.Background(), tagEvents)
 	}
 
+	// select all fully read markers and set them
+	fullyReadEvents, err := h.Storage.RoomAccountDatasWithType(userID, "m.fully_read")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fully read markers %s", err)
+	}
+	if len(fullyReadEvents) > 0 {
+		uc.OnAccountData(context.Background(), fullyReadEvents)
+	}
+
 	// select outstanding invites
 	invites, err := h.Storage.InvitesTable.SelectAllInvitesForUser(userID)
 	if err != nil {
@@ -752,6 +897,21 @@ func (h *SyncLiveHandler) OnReceipt(p *pubsub.V2Receipt) {
 	}
 }
 
+func (h *SyncLiveHandler) OnPresence(p *pubsub.V2Presence) {
+	ctx, task := internal.StartTask(context.Background(), "OnPresence")
+	defer task.End()
+	// only send presence to users who share a room with the user whose presence changed
+	for userID, ev := range p.UserIDToEvent {
+		for _, sharedUserID := range h.Dispatcher.UsersSharingRoomsWith(userID) {
+			userCache, ok := h.userCaches.Load(sharedUserID)
+			if !ok {
+				continue
+			}
+			userCache.(*caches.UserCache).OnPresence(ctx, userID, ev)
+		}
+	}
+}
+
 func (h *SyncLiveHandler) OnTyping(p *pubsub.V2Typing) {
 	ctx, task := internal.StartTask(context.Background(), "OnTyping")
 	defer task.End()
@@ -782,7 +942,91 @@ func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 
 func (h *SyncLiveHandler) OnExpiredToken(p *pubsub.V2ExpiredToken) {
 	h.EnsurePoller.OnExpiredToken(p)
-	h.ConnMap.CloseConnsForDevice(p.UserID, p.DeviceID)
+	resetReason := internal.ResetReasonTokenExpired
+	if p.SoftLogout {
+		resetReason = internal.ResetReasonSoftLogout
+	}
+	h.ConnMap.CloseConnsForDevice(p.UserID, p.DeviceID, resetReason)
+}
+
+func (h *SyncLiveHandler) OnPollerLagging(p *pubsub.V2PollerLagging) {
+	pid := sync2.PollerID{UserID: p.UserID, DeviceID: p.DeviceID}
+	if p.Lagging {
+		h.laggingPollers.Store(pid, struct{}{})
+		if p.FetchesRoomData {
+			h.laggingRoomPollers.Store(p.UserID, pid)
+		}
+	} else {
+		h.laggingPollers.Delete(pid)
+		if roomPID, ok := h.laggingRoomPollers.Load(p.UserID); ok && roomPID.(sync2.PollerID) == pid {
+			h.laggingRoomPollers.Delete(p.UserID)
+		}
+	}
+}
+
+// isLagging returns true if the data for this device may be delayed, because either its own poller
+// or the poller fetching room data for its user is lagging behind the homeserver.
+func (h *SyncLiveHandler) isLagging(userID, deviceID string) bool {
+	if _, ok := h.laggingPollers.Load(sync2.PollerID{UserID: userID, DeviceID: deviceID}); ok {
+		return true
+	}
+	_, ok := h.laggingRoomPollers.Load(userID)
+	return ok
+}
+
+// loadConn returns the saved muxed request and snapshot for this connection, if the connection was
+// saved with the pos in the URL and was used recently enough to be resumed. Returns nil if it cannot
+// be resumed.
+func (h *SyncLiveHandler) loadConn(connID sync3.ConnID, u *url.URL, log zerolog.Logger) (*sync3.Request, *ConnSnapshot, int64) {
+	pos, herr := parseIntFromQuery(u, "pos")
+	if herr != nil {
+		return nil, nil, 0
+	}
+	savedPos, reqJSON, stateJSON, err := h.Storage.ConnsTable.Select(connID.UserID, connID.DeviceID, connID.CID, time.Now().Add(-h.persistConnsTTL))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Err(err).Msg("failed to load saved connection")
+		}
+		return nil, nil, 0
+	}
+	if savedPos != pos {
+		// we only keep the latest position, so can't tell if older positions are retransmits
+		log.Info().Int64("pos", pos).Int64("saved_pos", savedPos).Msg("cannot resume connection at a different pos")
+		return nil, nil, 0
+	}
+	var req sync3.Request
+	if err := json.Unmarshal(reqJSON, &req); err != nil {
+		log.Err(err).Msg("failed to unmarshal saved connection")
+		return nil, nil, 0
+	}
+	var snapshot ConnSnapshot
+	if err := json.Unmarshal(stateJSON, &snapshot); err != nil {
+		log.Err(err).Msg("failed to unmarshal saved connection state")
+		return nil, nil, 0
+	}
+	return &req, &snapshot, pos
+}
+
+// saveConn saves the latest pos for this connection, along with the muxed request and snapshot if
+// they have changed, so it can be resumed after a restart. Called whilst requests on the connection
+// are blocked, so the database writes happen in the background.
+func (h *SyncLiveHandler) saveConn(connID sync3.ConnID, pos int64, cs *ConnState) {
+	muxedReq, snapshot := cs.Snapshot()
+	if muxedReq == nil {
+		h.connSaver.Save(connID, pos, nil, nil)
+		return
+	}
+	reqJSON, err := json.Marshal(muxedReq)
+	if err != nil {
+		logger.Err(err).Str("conn", connID.String()).Msg("failed to marshal connection")
+		return
+	}
+	stateJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		logger.Err(err).Str("conn", connID.String()).Msg("failed to marshal connection state")
+		return
+	}
+	h.connSaver.Save(connID, pos, reqJSON, stateJSON)
 }
 
 func parseIntFromQuery(u *url.URL, param string) (result int64, err *internal.HandlerError) {
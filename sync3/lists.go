@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"context"
+	"sort"
 	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -38,6 +39,8 @@ type RoomDelta struct {
 	InviteCountChanged       bool
 	NotificationCountChanged bool
 	HighlightCountChanged    bool
+	ServerACLChanged         bool
+	CallMembersChanged       bool
 	Lists                    []RoomListDelta
 }
 
@@ -45,8 +48,9 @@ type RoomDelta struct {
 // JSON 'lists'. It contains all the internal metadata for rooms and controls access and updatings of said
 // lists.
 type InternalRequestLists struct {
-	allRooms map[string]*RoomConnMetadata
-	lists    map[string]*FilteredSortableRooms
+	allRooms     map[string]*RoomConnMetadata
+	lists        map[string]*FilteredSortableRooms
+	snoozedRooms map[string]int64
 }
 
 func NewInternalRequestLists() *InternalRequestLists {
@@ -67,6 +71,8 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		}
 		delta.InviteCountChanged = !existing.SameInviteCount(&r.RoomMetadata)
 		delta.JoinCountChanged = !existing.SameJoinCount(&r.RoomMetadata)
+		delta.ServerACLChanged = !existing.SameServerACL(&r.RoomMetadata)
+		delta.CallMembersChanged = !existing.SameCallMembers(&r.RoomMetadata)
 		delta.RoomNameChanged = !existing.SameRoomName(&r.RoomMetadata)
 		if delta.RoomNameChanged {
 			// update the canonical name to allow room name sorting to continue to work
@@ -84,6 +90,8 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 			//           to conclude.
 			r.CanonicalisedName = existing.CanonicalisedName
 		}
+		// snoozes are per-conn data which aren't present on updates, so preserve them
+		r.SnoozedUntil = existing.SnoozedUntil
 		delta.RoomAvatarChanged = !existing.SameRoomAvatar(&r.RoomMetadata)
 		if delta.RoomAvatarChanged {
 			r.ResolvedAvatarURL = internal.CalculateAvatar(&r.RoomMetadata)
@@ -115,13 +123,14 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		r.ResolvedAvatarURL = internal.CalculateAvatar(&r.RoomMetadata)
 		// We'll automatically use the LastInterestedEventTimestamps provided by the
 		// caller, so that recency sorts work.
+		r.SnoozedUntil = s.snoozedRooms[r.RoomID]
 	}
 	// filter.Include may call on this room ID in the RoomFinder, so make sure it finds it.
 	s.allRooms[r.RoomID] = &r
 
 	for listKey, list := range s.lists {
 		_, alreadyExists := list.roomIDToIndex[r.RoomID]
-		shouldExist := list.filter.Include(&r, s)
+		shouldExist := list.filter.Include(&r, s, listKey)
 		if shouldExist && r.HasLeft {
 			shouldExist = false
 		}
@@ -150,7 +159,29 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 	return delta
 }
 
+// SetSnoozedRooms updates which rooms have their notifications snoozed, given a map of room
+// ID to snooze expiry in unix milliseconds. Rooms not in the map are unsnoozed. This does not
+// resort any lists: new positions are calculated when the rooms are next updated.
+func (s *InternalRequestLists) SetSnoozedRooms(snoozedRooms map[string]int64) {
+	s.snoozedRooms = snoozedRooms
+	for roomID, r := range s.allRooms {
+		r.SnoozedUntil = snoozedRooms[roomID]
+	}
+}
+
 // Remove a room from all lists e.g retired an invite, left a room
+// UnreadTotal returns the sum of the notification counts of all rooms, excluding muted rooms.
+func (s *InternalRequestLists) UnreadTotal() int {
+	total := 0
+	for _, r := range s.allRooms {
+		if r.IsMuted {
+			continue
+		}
+		total += r.NotificationCount
+	}
+	return total
+}
+
 func (s *InternalRequestLists) RemoveRoom(roomID string) {
 	delete(s.allRooms, roomID)
 	// TODO: update lists?
@@ -224,25 +255,40 @@ func (s *InternalRequestLists) ListsByVisibleRoomIDs(muxedReqLists map[string]Re
 
 // Assign a new list at the given key. If Overwrite, any existing list is replaced. If DoNotOverwrite, the existing
 // list is returned if one exists, else a new list is created. Returns the list and true if the list was overwritten.
-func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, filters *RequestFilters, sort []string, shouldOverwrite OverwriteVal) (*FilteredSortableRooms, bool) {
+func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, filters *RequestFilters, sortBy, pinnedRoomIDs []string, shouldOverwrite OverwriteVal) (*FilteredSortableRooms, bool) {
 	if shouldOverwrite == DoNotOverwrite {
 		_, exists := s.lists[listKey]
 		if exists {
 			return s.lists[listKey], false
 		}
 	}
-	roomIDs := make([]string, len(s.allRooms))
-	i := 0
+	// The sort is stable, so seed the new list with the existing list's order. This means rooms which
+	// compare equal keep their relative order when the filters change, rather than being shuffled by
+	// map iteration order. Rooms which are not in the existing list follow, ordered by room ID.
+	roomIDs := make([]string, 0, len(s.allRooms))
+	seen := make(map[string]struct{}, len(s.allRooms))
+	if existing, exists := s.lists[listKey]; exists {
+		for _, roomID := range existing.roomIDs {
+			if _, ok := s.allRooms[roomID]; ok {
+				roomIDs = append(roomIDs, roomID)
+				seen[roomID] = struct{}{}
+			}
+		}
+	}
+	numSeeded := len(roomIDs)
 	for roomID := range s.allRooms {
-		roomIDs[i] = roomID
-		i++
+		if _, ok := seen[roomID]; !ok {
+			roomIDs = append(roomIDs, roomID)
+		}
 	}
+	sort.Strings(roomIDs[numSeeded:])
 
 	roomList := NewFilteredSortableRooms(s, listKey, roomIDs, filters)
-	if sort != nil {
-		err := roomList.Sort(sort)
+	roomList.SetPinnedRooms(pinnedRoomIDs)
+	if sortBy != nil {
+		err := roomList.Sort(sortBy)
 		if err != nil {
-			logger.Err(err).Strs("sort_by", sort).Msg("failed to sort")
+			logger.Err(err).Strs("sort_by", sortBy).Msg("failed to sort")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
 	}
@@ -14,13 +14,20 @@ import (
 type SliceRanges [][2]int64
 
 func (r SliceRanges) Valid() bool {
+	return r.Validate() == nil
+}
+
+// Validate returns an error describing the first invalid range, if any. Ranges must not be
+// negative, must go from start to end, and must not overlap: overlapping ranges are rejected
+// rather than merged, as clients should not be asking for the same rooms twice.
+func (r SliceRanges) Validate() error {
 	for i, sr := range r {
+		if sr[0] < 0 {
+			return fmt.Errorf("range %v has a negative index", sr)
+		}
 		// always goes from start to end
 		if sr[1] < sr[0] {
-			return false
-		}
-		if sr[0] < 0 {
-			return false
+			return fmt.Errorf("range %v has start > end", sr)
 		}
 		// cannot have overlapping ranges
 		for j := i + 1; j < len(r); j++ {
@@ -28,17 +35,17 @@ func (r SliceRanges) Valid() bool {
 			// check both ranges with each other
 			for _, val := range sr {
 				if testRange[0] <= val && val <= testRange[1] {
-					return false
+					return fmt.Errorf("ranges %v and %v overlap", sr, testRange)
 				}
 			}
 			for _, val := range testRange {
 				if sr[0] <= val && val <= sr[1] {
-					return false
+					return fmt.Errorf("ranges %v and %v overlap", sr, testRange)
 				}
 			}
 		}
 	}
-	return true
+	return nil
 }
 
 // Inside returns true if i is inside the range
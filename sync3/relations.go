@@ -0,0 +1,106 @@
+package sync3
+
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	RelTypeAnnotation = "m.annotation"
+	RelTypeReplace    = "m.replace"
+)
+
+// RelationsSummary aggregates the reactions and edits to a single event.
+type RelationsSummary struct {
+	Annotations []AnnotationCount `json:"m.annotation,omitempty"`
+	Replace     *ReplaceSummary   `json:"m.replace,omitempty"`
+}
+
+// AnnotationCount is the number of users who annotated an event with this key e.g a reaction emoji.
+type AnnotationCount struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// ReplaceSummary describes the most recent edit of an event.
+type ReplaceSummary struct {
+	EventID        string `json:"event_id"`
+	Sender         string `json:"sender"`
+	OriginServerTS int64  `json:"origin_server_ts"`
+}
+
+// AggregateRelations summarises the annotations and edits in timeline which relate to events in visible,
+// keyed by the event ID of the related event. Relations to events outside of visible are ignored, which
+// bounds the work to the size of the timeline rather than the size of the room. The timeline must be in
+// chronological order. Returns nil if there are no relations to visible events.
+func AggregateRelations(timeline, visible []json.RawMessage) map[string]RelationsSummary {
+	// event_id -> sender for all visible events
+	visibleSenders := make(map[string]string, len(visible))
+	for _, ev := range visible {
+		parsed := gjson.ParseBytes(ev)
+		visibleSenders[parsed.Get("event_id").Str] = parsed.Get("sender").Str
+	}
+	var result map[string]RelationsSummary
+	// target event ID -> annotation type|key|sender, so each user is only counted once per key
+	seenAnnotations := make(map[string]map[[3]string]struct{})
+	for _, ev := range timeline {
+		parsed := gjson.ParseBytes(ev)
+		relatesTo := parsed.Get(`content.m\.relates_to`)
+		targetEventID := relatesTo.Get("event_id").Str
+		targetSender, ok := visibleSenders[targetEventID]
+		if targetEventID == "" || !ok {
+			continue
+		}
+		sender := parsed.Get("sender").Str
+		summary := result[targetEventID]
+		switch relatesTo.Get("rel_type").Str {
+		case RelTypeAnnotation:
+			annotation := [3]string{parsed.Get("type").Str, relatesTo.Get("key").Str, sender}
+			if annotation[1] == "" {
+				continue
+			}
+			if seenAnnotations[targetEventID] == nil {
+				seenAnnotations[targetEventID] = make(map[[3]string]struct{})
+			}
+			if _, seen := seenAnnotations[targetEventID][annotation]; seen {
+				continue
+			}
+			seenAnnotations[targetEventID][annotation] = struct{}{}
+			found := false
+			for i := range summary.Annotations {
+				if summary.Annotations[i].Type == annotation[0] && summary.Annotations[i].Key == annotation[1] {
+					summary.Annotations[i].Count++
+					found = true
+					break
+				}
+			}
+			if !found {
+				summary.Annotations = append(summary.Annotations, AnnotationCount{
+					Type:  annotation[0],
+					Key:   annotation[1],
+					Count: 1,
+				})
+			}
+		case RelTypeReplace:
+			// only the original sender can edit an event
+			if sender != targetSender {
+				continue
+			}
+			// the timeline is in chronological order, so later edits replace earlier ones
+			summary.Replace = &ReplaceSummary{
+				EventID:        parsed.Get("event_id").Str,
+				Sender:         sender,
+				OriginServerTS: parsed.Get("origin_server_ts").Int(),
+			}
+		default:
+			continue
+		}
+		if result == nil {
+			result = make(map[string]RelationsSummary)
+		}
+		result[targetEventID] = summary
+	}
+	return result
+}
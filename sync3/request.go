@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/tidwall/gjson"
 )
 
 var (
@@ -24,6 +26,7 @@ var (
 
 	DefaultTimelineLimit = int64(20)
 	DefaultTimeoutMSecs  = 10 * 1000 // 10s
+	MaxTimeoutMSecs      = 30 * 1000 // 30s
 )
 
 type Request struct {
@@ -33,6 +36,35 @@ type Request struct {
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
+	// If set, return the sync v2 since token for this device in the response. Not sticky.
+	// Ignored unless the server has been configured to expose v2 since tokens.
+	IncludeV2Since bool `json:"include_v2_since,omitempty"`
+	// If set, return the order in which the proxy received the live events in the response, across
+	// all rooms. Useful when reconnecting to replay missed events in server order. Not sticky.
+	IncludeStreamOrder bool `json:"include_stream_order,omitempty"`
+	// If set, event JSON which appears more than once in the response is only sent once, in
+	// shared_events, and referenced elsewhere. Not sticky.
+	DedupeEvents bool `json:"dedupe_events,omitempty"`
+	// Map of room ID to the unix timestamp in milliseconds when notifications for that room stop
+	// being snoozed. Snoozed rooms are treated as having no notifications when sorting by
+	// notification level. Sticky: when specified, the map replaces any previous snoozes.
+	SnoozedRooms map[string]int64 `json:"snoozed_rooms,omitempty"`
+	// If true, return the total notification count across all rooms the user is in, excluding
+	// muted rooms, whenever it changes. Sticky.
+	IncludeUnreadTotal *bool `json:"include_unread_total,omitempty"`
+	// If set, timeline events which are the first event of their day are annotated with
+	// unsigned.day_boundary, with days calculated in the timezone this many minutes ahead of UTC.
+	// Sticky.
+	DayBoundaryUTCOffsetMins *int `json:"day_boundary_utc_offset_mins,omitempty"`
+	// If true, rooms which aren't in m.direct are returned with is_dm if they look like DMs, see
+	// RoomMetadata.LooksLikeDM. This does not affect the is_dm filter. Sticky.
+	InferDMs *bool `json:"infer_dms,omitempty"`
+	// Named views to register on this connection, replacing any existing views with the same names.
+	SaveViews map[string]View `json:"save_views,omitempty"`
+	// The name of a view registered on this connection. The view's lists and room subscriptions are
+	// used as if they were sent in this request, unless the request sends a list or room subscription
+	// with the same key. Not sticky.
+	View string `json:"view,omitempty"`
 
 	// set via query params or inferred
 	pos          int64
@@ -46,9 +78,104 @@ func (r *Request) Validate() error {
 	if len(r.TxnID) > 64 {
 		return fmt.Errorf("txn_id is too long: %d > 64", len(r.TxnID))
 	}
+	if r.DayBoundaryUTCOffsetMins != nil && (*r.DayBoundaryUTCOffsetMins < -maxUTCOffsetMins || *r.DayBoundaryUTCOffsetMins > maxUTCOffsetMins) {
+		return fmt.Errorf("day_boundary_utc_offset_mins out of range: %d", *r.DayBoundaryUTCOffsetMins)
+	}
+	if err := r.Extensions.Validate(); err != nil {
+		return err
+	}
+	for listKey, l := range r.Lists {
+		if err := l.Ranges.Validate(); err != nil {
+			return fmt.Errorf("list[%v] invalid ranges: %s", listKey, err)
+		}
+		if err := l.PrefetchRanges.Validate(); err != nil {
+			return fmt.Errorf("list[%v] invalid prefetch_ranges: %s", listKey, err)
+		}
+		if l.CenterEventID != "" {
+			return fmt.Errorf("list[%v] center_event_id is only allowed in room_subscriptions", listKey)
+		}
+	}
+	for name, view := range r.SaveViews {
+		for listKey, l := range view.Lists {
+			if err := l.Ranges.Validate(); err != nil {
+				return fmt.Errorf("view[%v] list[%v] invalid ranges: %s", name, listKey, err)
+			}
+			if l.CenterEventID != "" {
+				return fmt.Errorf("view[%v] list[%v] center_event_id is only allowed in room_subscriptions", name, listKey)
+			}
+		}
+	}
 	return nil
 }
 
+// maxUTCOffsetMins is the largest offset from UTC of any timezone, in minutes.
+const maxUTCOffsetMins = 14 * 60
+
+// ShouldAnnotateDayBoundaries returns true if timeline events should be annotated with day boundaries.
+func (r *Request) ShouldAnnotateDayBoundaries() bool {
+	return r.DayBoundaryUTCOffsetMins != nil
+}
+
+// DayBoundaryUTCOffset returns the timezone offset from UTC used to calculate day boundaries.
+func (r *Request) DayBoundaryUTCOffset() time.Duration {
+	if r.DayBoundaryUTCOffsetMins == nil {
+		return 0
+	}
+	return time.Duration(*r.DayBoundaryUTCOffsetMins) * time.Minute
+}
+
+// MaxViews is the maximum number of views which can be registered on a connection.
+const MaxViews = 32
+
+// A View is a named set of lists and room subscriptions. Clients with elaborate layouts can register a
+// view once then reference it by name, rather than sending the same lists on every request.
+type View struct {
+	Lists             map[string]RequestList      `json:"lists,omitempty"`
+	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions,omitempty"`
+}
+
+// ApplyView adds the lists and room subscriptions in this view to the request. Lists and room
+// subscriptions already in the request take precedence over those in the view.
+func (r *Request) ApplyView(view View) {
+	if len(view.Lists) > 0 {
+		lists := make(map[string]RequestList, len(view.Lists)+len(r.Lists))
+		for listKey, list := range view.Lists {
+			lists[listKey] = list
+		}
+		for listKey, list := range r.Lists {
+			lists[listKey] = list
+		}
+		r.Lists = lists
+	}
+	if len(view.RoomSubscriptions) > 0 {
+		subs := make(map[string]RoomSubscription, len(view.RoomSubscriptions)+len(r.RoomSubscriptions))
+		for roomID, sub := range view.RoomSubscriptions {
+			subs[roomID] = sub
+		}
+		for roomID, sub := range r.RoomSubscriptions {
+			subs[roomID] = sub
+		}
+		r.RoomSubscriptions = subs
+	}
+}
+
+func (r *Request) ShouldIncludeUnreadTotal() bool {
+	return r.IncludeUnreadTotal != nil && *r.IncludeUnreadTotal
+}
+
+// ShouldInferDMs returns true if rooms which look like DMs should be returned with is_dm.
+func (r *Request) ShouldInferDMs() bool {
+	return r.InferDMs != nil && *r.InferDMs
+}
+
+// RequestList is a sliding window over the user's rooms. A request which omits "lists" entirely leaves
+// every list unchanged. A request which sends "lists" deletes any existing list it omits, as does
+// setting Deleted. Deleting a list stops tracking it and frees its state, and a deleted list which is
+// sent again is treated as a new list.
+//
+// Omitting "ranges" from a list keeps the previous ranges. Sending "ranges": [] keeps the list alive
+// with no window: its count is still sent and room data is still tracked, but no rooms are sent
+// until the list is given ranges again. To stop tracking a list, omit it from "lists" or set Deleted.
 type RequestList struct {
 	RoomSubscription
 	Ranges          SliceRanges     `json:"ranges"`
@@ -57,12 +184,44 @@ type RequestList struct {
 	SlowGetAllRooms *bool           `json:"slow_get_all_rooms,omitempty"`
 	Deleted         bool            `json:"deleted,omitempty"`
 	BumpEventTypes  []string        `json:"bump_event_types"`
+	// Ranges the client expects to request soon. The server loads room data for these ranges but does
+	// not send it, so it can be returned quickly when requested. Not sticky.
+	PrefetchRanges SliceRanges `json:"prefetch_ranges,omitempty"`
+	// Rooms which are always sorted at the top of the list, in this order, regardless of the sort.
+	PinnedRooms []string `json:"pinned_rooms,omitempty"`
+	// If true, the response includes the room IDs which entered and left this list's ranges, for
+	// clients which track the set of rooms in a list rather than their positions. Sticky.
+	IncludeDeltas *bool `json:"include_deltas,omitempty"`
+	// If true, a DELETE followed by an INSERT at the same index is sent as a single UPDATE op, for
+	// clients which understand UPDATE ops. Sticky.
+	CoalesceOps *bool `json:"coalesce_ops,omitempty"`
 }
 
+// ShouldGetAllRooms returns true if ranges should be ignored and every room in the list sent, in sorted
+// order. The room data is sent in batches across several responses. This is expensive, so should only
+// be used to warm up a client's cache when it first syncs.
 func (rl *RequestList) ShouldGetAllRooms() bool {
 	return rl.SlowGetAllRooms != nil && *rl.SlowGetAllRooms
 }
 
+func (rl *RequestList) ShouldIncludeDeltas() bool {
+	return rl.IncludeDeltas != nil && *rl.IncludeDeltas
+}
+
+func (rl *RequestList) ShouldCoalesceOps() bool {
+	return rl.CoalesceOps != nil && *rl.CoalesceOps
+}
+
+// SortsByRecency returns true if any of the sort operations for this list is by_recency.
+func (rl *RequestList) SortsByRecency() bool {
+	for _, sortBy := range rl.Sort {
+		if sortBy == SortByRecency {
+			return true
+		}
+	}
+	return false
+}
+
 func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 	prevLen := 0
 	if rl != nil {
@@ -87,6 +246,22 @@ func (rl *RequestList) TimelineLimitChanged(next *RequestList) bool {
 	return limit != int(next.TimelineLimit)
 }
 
+func (rl *RequestList) PinnedRoomsChanged(next *RequestList) bool {
+	var prev []string
+	if rl != nil {
+		prev = rl.PinnedRooms
+	}
+	if len(prev) != len(next.PinnedRooms) {
+		return true
+	}
+	for i := range prev {
+		if prev[i] != next.PinnedRooms[i] {
+			return true
+		}
+	}
+	return false
+}
+
 func (rl *RequestList) FiltersChanged(next *RequestList) bool {
 	var prev *RequestFilters
 	if rl != nil {
@@ -266,7 +441,15 @@ func (r *Request) SetPos(pos int64) {
 func (r *Request) TimeoutMSecs() int {
 	return r.timeoutMSecs
 }
+
+// SetTimeoutMSecs sets how long to wait for live data before returning an empty response. The
+// timeout is clamped between 0 and MaxTimeoutMSecs.
 func (r *Request) SetTimeoutMSecs(timeout int) {
+	if timeout < 0 {
+		timeout = 0
+	} else if timeout > MaxTimeoutMSecs {
+		timeout = MaxTimeoutMSecs
+	}
 	r.timeoutMSecs = timeout
 }
 
@@ -328,6 +511,23 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 	// conn ID isn't sticky, always use the nextReq value. This is only useful for logging,
 	// as the conn ID is used primarily in conn_map.go
 	result.ConnID = nextReq.ConnID
+	// snoozes are sticky, and replaced wholesale when specified
+	result.SnoozedRooms = r.SnoozedRooms
+	if nextReq.SnoozedRooms != nil {
+		result.SnoozedRooms = nextReq.SnoozedRooms
+	}
+	result.IncludeUnreadTotal = r.IncludeUnreadTotal
+	if nextReq.IncludeUnreadTotal != nil {
+		result.IncludeUnreadTotal = nextReq.IncludeUnreadTotal
+	}
+	result.DayBoundaryUTCOffsetMins = r.DayBoundaryUTCOffsetMins
+	if nextReq.DayBoundaryUTCOffsetMins != nil {
+		result.DayBoundaryUTCOffsetMins = nextReq.DayBoundaryUTCOffsetMins
+	}
+	result.InferDMs = r.InferDMs
+	if nextReq.InferDMs != nil {
+		result.InferDMs = nextReq.InferDMs
+	}
 
 	listKeys := make(set)
 	for k := range nextReq.Lists {
@@ -342,7 +542,11 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		existingList, existingOk := r.Lists[listKey]
 		nextList, nextOk := nextReq.Lists[listKey]
 		if !nextOk {
-			// copy over what they said before (sticky), no diffs to make
+			if nextReq.Lists != nil {
+				// they sent lists without this one, so it has been deleted
+				continue
+			}
+			// they didn't send any lists, so copy over what they said before (sticky), no diffs to make
 			calculatedLists[listKey] = existingList
 			continue
 		}
@@ -394,18 +598,93 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if bumpEventTypes == nil {
 			bumpEventTypes = existingList.BumpEventTypes
 		}
+		contentFields := nextList.ContentFields
+		if contentFields == nil {
+			contentFields = existingList.ContentFields
+		}
+		timelineEventTypes := nextList.TimelineEventTypes
+		if timelineEventTypes == nil {
+			timelineEventTypes = existingList.TimelineEventTypes
+		}
+		firstViewState := nextList.FirstViewState
+		if firstViewState == nil {
+			firstViewState = existingList.FirstViewState
+		}
+		reentryTimelineLimit := nextList.ReentryTimelineLimit
+		if reentryTimelineLimit == nil {
+			reentryTimelineLimit = existingList.ReentryTimelineLimit
+		}
+		aggregateRelations := nextList.AggregateRelations
+		if aggregateRelations == nil {
+			aggregateRelations = existingList.AggregateRelations
+		}
+		timelineUnreadOnly := nextList.TimelineUnreadOnly
+		if timelineUnreadOnly == nil {
+			timelineUnreadOnly = existingList.TimelineUnreadOnly
+		}
+		annotateMembershipChanges := nextList.AnnotateMembershipChanges
+		if annotateMembershipChanges == nil {
+			annotateMembershipChanges = existingList.AnnotateMembershipChanges
+		}
+		includeServerACL := nextList.IncludeServerACL
+		if includeServerACL == nil {
+			includeServerACL = existingList.IncludeServerACL
+		}
+		requiredStateChunkSize := nextList.RequiredStateChunkSize
+		if requiredStateChunkSize == nil {
+			requiredStateChunkSize = existingList.RequiredStateChunkSize
+		}
+		compactStateDiffs := nextList.CompactStateDiffs
+		if compactStateDiffs == nil {
+			compactStateDiffs = existingList.CompactStateDiffs
+		}
+		includeSenderMembership := nextList.IncludeSenderMembership
+		if includeSenderMembership == nil {
+			includeSenderMembership = existingList.IncludeSenderMembership
+		}
+		includeLatestEventSender := nextList.IncludeLatestEventSender
+		if includeLatestEventSender == nil {
+			includeLatestEventSender = existingList.IncludeLatestEventSender
+		}
+		pinnedRooms := nextList.PinnedRooms
+		if pinnedRooms == nil {
+			pinnedRooms = existingList.PinnedRooms
+		}
+		includeDeltas := nextList.IncludeDeltas
+		if includeDeltas == nil {
+			includeDeltas = existingList.IncludeDeltas
+		}
+		coalesceOps := nextList.CoalesceOps
+		if coalesceOps == nil {
+			coalesceOps = existingList.CoalesceOps
+		}
 
 		calculatedLists[listKey] = RequestList{
 			RoomSubscription: RoomSubscription{
-				RequiredState:   reqState,
-				TimelineLimit:   timelineLimit,
-				IncludeOldRooms: includeOldRooms,
+				RequiredState:             reqState,
+				TimelineLimit:             timelineLimit,
+				IncludeOldRooms:           includeOldRooms,
+				ContentFields:             contentFields,
+				TimelineEventTypes:        timelineEventTypes,
+				FirstViewState:            firstViewState,
+				ReentryTimelineLimit:      reentryTimelineLimit,
+				AggregateRelations:        aggregateRelations,
+				TimelineUnreadOnly:        timelineUnreadOnly,
+				AnnotateMembershipChanges: annotateMembershipChanges,
+				IncludeServerACL:          includeServerACL,
+				RequiredStateChunkSize:    requiredStateChunkSize,
+				CompactStateDiffs:         compactStateDiffs,
+				IncludeSenderMembership:   includeSenderMembership,
+				IncludeLatestEventSender:  includeLatestEventSender,
 			},
 			Ranges:          rooms,
 			Sort:            sort,
 			Filters:         filters,
 			SlowGetAllRooms: slowGetAllRooms,
 			BumpEventTypes:  bumpEventTypes,
+			PinnedRooms:     pinnedRooms,
+			IncludeDeltas:   includeDeltas,
+			CoalesceOps:     coalesceOps,
 		}
 	}
 	result.Lists = calculatedLists
@@ -485,17 +764,23 @@ type RequestFilters struct {
 	IsDM           *bool     `json:"is_dm"`
 	IsEncrypted    *bool     `json:"is_encrypted"`
 	IsInvite       *bool     `json:"is_invite"`
+	IsMuted        *bool     `json:"is_muted"`
 	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
 	RoomNameFilter string    `json:"room_name_like"`
 	Tags           []string  `json:"tags"`
 	NotTags        []string  `json:"not_tags"`
+	// Only include rooms whose latest bumping event, according to the list's bump_event_types, has
+	// a timestamp within [active_since, active_before), in unix milliseconds. Either bound may be
+	// omitted. Rooms move in and out of the list as new events change their timestamp.
+	ActiveSince  *int64 `json:"active_since"`
+	ActiveBefore *int64 `json:"active_before"`
 
 	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
 }
 
-func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
+func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder, listKey string) bool {
 	// we always exclude old rooms from lists, but may include them in the `rooms` section if they opt-in
 	if r.UpgradedRoomID != nil {
 		// should we exclude this room? If we have _joined_ the successor room then yes because
@@ -517,6 +802,18 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
 		return false
 	}
+	if rf.IsMuted != nil && *rf.IsMuted != r.IsMuted {
+		return false
+	}
+	if rf.ActiveSince != nil || rf.ActiveBefore != nil {
+		ts := int64(r.GetLastInterestedEventTimestamp(listKey))
+		if rf.ActiveSince != nil && ts < *rf.ActiveSince {
+			return false
+		}
+		if rf.ActiveBefore != nil && ts >= *rf.ActiveBefore {
+			return false
+		}
+	}
 	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(internal.CalculateRoomName(&r.RoomMetadata, 5)), strings.ToLower(rf.RoomNameFilter)) {
 		return false
 	}
@@ -563,6 +860,99 @@ type RoomSubscription struct {
 	RequiredState   [][2]string       `json:"required_state"`
 	TimelineLimit   int64             `json:"timeline_limit"`
 	IncludeOldRooms *RoomSubscription `json:"include_old_rooms"`
+	// If set, only these paths of the event `content` will be returned for timeline and
+	// required_state events. Paths are relative to `content` e.g "body". If unset, the
+	// full content is returned.
+	ContentFields []string `json:"content_fields,omitempty"`
+	// If set, only events of these types will be returned in the timeline. When set on a list,
+	// this applies to every room in the list. The timeline_limit is applied before filtering.
+	// This does not affect which events bump rooms, see bump_event_types.
+	TimelineEventTypes []string `json:"timeline_event_types,omitempty"`
+	// State to send once when the room first appears, in the same format as required_state e.g
+	// the create, name, topic, encryption and power levels events. Unlike required_state, this is
+	// not updated afterwards: it is only sent again if the room leaves and re-enters the window.
+	FirstViewState [][2]string `json:"first_view_state,omitempty"`
+	// If set, the timeline limit to use when a room re-enters the window after previously being sent
+	// on this connection, instead of timeline_limit. Clients likely still have the recent events for
+	// these rooms, so can ask for fewer of them. Live updates are unaffected.
+	ReentryTimelineLimit *int64 `json:"reentry_timeline_limit,omitempty"`
+	// If true, reactions and edits are aggregated for the events in the returned timeline. Only
+	// relations within the timeline are considered, so older relations are not counted.
+	AggregateRelations *bool `json:"aggregate_relations,omitempty"`
+	// If true, the timeline only contains events after the user's m.fully_read marker when a room is
+	// loaded, with older events available via prev_batch. Rooms without a marker, or whose marker is
+	// older than the timeline, return the timeline as normal.
+	TimelineUnreadOnly *bool `json:"timeline_unread_only,omitempty"`
+	// If true, m.room.member timeline events are annotated with unsigned.membership_change, which
+	// says whether the event is a join, leave, invite, ban, knock or profile_update.
+	AnnotateMembershipChanges *bool `json:"annotate_membership_changes,omitempty"`
+	// If true, joined rooms include the content of their m.room.server_acl state event in server_acl.
+	IncludeServerACL *bool `json:"include_server_acl,omitempty"`
+	// If set, at most this many required_state events are sent when a room is loaded. The rest are
+	// sent in chunks of this size in subsequent responses, alongside any live updates, with
+	// required_state_remaining on the room counting down to 0 when all required_state has been sent.
+	// Useful when wildcards match thousands of room members.
+	RequiredStateChunkSize *int64 `json:"required_state_chunk_size,omitempty"`
+	// If true, a state event in the timeline which replaces a state event previously sent on this
+	// connection has its content replaced by unsigned.content_diff, a JSON patch from the content of
+	// the event in unsigned.content_diff_base. Events are sent in full if the diff would be larger.
+	CompactStateDiffs *bool `json:"compact_state_diffs,omitempty"`
+	// If true, timeline events are annotated with unsigned.sender_membership, the membership, display
+	// name and avatar of the sender when the event was sent, rather than their current profile.
+	IncludeSenderMembership *bool `json:"include_sender_membership,omitempty"`
+	// If true, joined rooms include latest_event_sender, the user ID and display name of the sender of
+	// the most recent event matching bump_event_types, for room list previews.
+	IncludeLatestEventSender *bool `json:"include_latest_event_sender,omitempty"`
+	// If set, the timeline is centred on this event when the room is first sent, with up to
+	// timeline_limit events before and after it, for permalinks. Only allowed in room_subscriptions:
+	// requests which set it on a list are rejected.
+	CenterEventID string `json:"center_event_id,omitempty"`
+}
+
+// RequiredStateChunk returns the number of required_state events to send per response, or 0 if all
+// required_state should be sent at once.
+func (rs RoomSubscription) RequiredStateChunk() int {
+	if rs.RequiredStateChunkSize == nil || *rs.RequiredStateChunkSize <= 0 {
+		return 0
+	}
+	return int(*rs.RequiredStateChunkSize)
+}
+
+// ShouldIncludeSenderMembership returns true if timeline events should be annotated with the
+// sender's membership at the time.
+func (rs RoomSubscription) ShouldIncludeSenderMembership() bool {
+	return rs.IncludeSenderMembership != nil && *rs.IncludeSenderMembership
+}
+
+// ShouldIncludeLatestEventSender returns true if rooms should include the sender of the latest
+// bumping event.
+func (rs RoomSubscription) ShouldIncludeLatestEventSender() bool {
+	return rs.IncludeLatestEventSender != nil && *rs.IncludeLatestEventSender
+}
+
+// ShouldCompactStateDiffs returns true if state events in the timeline should be sent as diffs.
+func (rs RoomSubscription) ShouldCompactStateDiffs() bool {
+	return rs.CompactStateDiffs != nil && *rs.CompactStateDiffs
+}
+
+// ShouldIncludeServerACL returns true if the server ACL should be included in joined rooms.
+func (rs RoomSubscription) ShouldIncludeServerACL() bool {
+	return rs.IncludeServerACL != nil && *rs.IncludeServerACL
+}
+
+// ShouldOnlyReturnUnreadTimeline returns true if read events should be removed from the timeline.
+func (rs RoomSubscription) ShouldOnlyReturnUnreadTimeline() bool {
+	return rs.TimelineUnreadOnly != nil && *rs.TimelineUnreadOnly
+}
+
+// ShouldAnnotateMembershipChanges returns true if membership events should be annotated.
+func (rs RoomSubscription) ShouldAnnotateMembershipChanges() bool {
+	return rs.AnnotateMembershipChanges != nil && *rs.AnnotateMembershipChanges
+}
+
+// ShouldAggregateRelations returns true if relations should be aggregated for the timeline.
+func (rs RoomSubscription) ShouldAggregateRelations() bool {
+	return rs.AggregateRelations != nil && *rs.AggregateRelations
 }
 
 func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
@@ -600,8 +990,79 @@ func (rs RoomSubscription) combineRecursive(other RoomSubscription, checkOldRoom
 	} else {
 		result.TimelineLimit = other.TimelineLimit
 	}
+	// only use the re-entry limit if both subscriptions want one, else one of them wants the full
+	// timeline_limit on re-entry.
+	if rs.ReentryTimelineLimit != nil && other.ReentryTimelineLimit != nil {
+		result.ReentryTimelineLimit = rs.ReentryTimelineLimit
+		if *other.ReentryTimelineLimit > *rs.ReentryTimelineLimit {
+			result.ReentryTimelineLimit = other.ReentryTimelineLimit
+		}
+	}
+	// likewise, only chunk required_state if both subscriptions want it, using the larger chunks
+	if rs.RequiredStateChunk() > 0 && other.RequiredStateChunk() > 0 {
+		result.RequiredStateChunkSize = rs.RequiredStateChunkSize
+		if *other.RequiredStateChunkSize > *rs.RequiredStateChunkSize {
+			result.RequiredStateChunkSize = other.RequiredStateChunkSize
+		}
+	}
+	// only send state diffs if both subscriptions want them, else one of them wants full events
+	if rs.ShouldCompactStateDiffs() && other.ShouldCompactStateDiffs() {
+		result.CompactStateDiffs = rs.CompactStateDiffs
+	}
+	// only trim read events if both subscriptions want it, else one of them wants the full timeline
+	if rs.ShouldOnlyReturnUnreadTimeline() && other.ShouldOnlyReturnUnreadTimeline() {
+		result.TimelineUnreadOnly = rs.TimelineUnreadOnly
+	}
+	// aggregate relations if either subscription wants them
+	if rs.ShouldAggregateRelations() {
+		result.AggregateRelations = rs.AggregateRelations
+	} else if other.ShouldAggregateRelations() {
+		result.AggregateRelations = other.AggregateRelations
+	}
+	// likewise, annotate membership changes if either subscription wants them
+	if rs.ShouldAnnotateMembershipChanges() {
+		result.AnnotateMembershipChanges = rs.AnnotateMembershipChanges
+	} else if other.ShouldAnnotateMembershipChanges() {
+		result.AnnotateMembershipChanges = other.AnnotateMembershipChanges
+	}
+	// likewise, include the sender's membership if either subscription wants it
+	if rs.ShouldIncludeSenderMembership() {
+		result.IncludeSenderMembership = rs.IncludeSenderMembership
+	} else if other.ShouldIncludeSenderMembership() {
+		result.IncludeSenderMembership = other.IncludeSenderMembership
+	}
+	// likewise, include the latest event sender if either subscription wants it
+	if rs.ShouldIncludeLatestEventSender() {
+		result.IncludeLatestEventSender = rs.IncludeLatestEventSender
+	} else if other.ShouldIncludeLatestEventSender() {
+		result.IncludeLatestEventSender = other.IncludeLatestEventSender
+	}
+	// likewise, include the server ACL if either subscription wants it
+	if rs.ShouldIncludeServerACL() {
+		result.IncludeServerACL = rs.IncludeServerACL
+	} else if other.ShouldIncludeServerACL() {
+		result.IncludeServerACL = other.IncludeServerACL
+	}
+	// centre the timeline if either subscription wants it. Lists cannot set center_event_id, and a
+	// room only has one room subscription, so at most one of them has it set.
+	result.CenterEventID = rs.CenterEventID
+	if result.CenterEventID == "" {
+		result.CenterEventID = other.CenterEventID
+	}
 	// combine together required_state fields, we'll union them later
 	result.RequiredState = append(rs.RequiredState, other.RequiredState...)
+	if len(rs.FirstViewState) > 0 || len(other.FirstViewState) > 0 {
+		result.FirstViewState = append(append([][2]string{}, rs.FirstViewState...), other.FirstViewState...)
+	}
+	// only project content if both subscriptions want it projected, else one of them wants the
+	// full content which is a superset of any projection.
+	if len(rs.ContentFields) > 0 && len(other.ContentFields) > 0 {
+		result.ContentFields = unionStrings(rs.ContentFields, other.ContentFields)
+	}
+	// likewise, only filter the timeline if both subscriptions want it filtered.
+	if len(rs.TimelineEventTypes) > 0 && len(other.TimelineEventTypes) > 0 {
+		result.TimelineEventTypes = unionStrings(rs.TimelineEventTypes, other.TimelineEventTypes)
+	}
 
 	if checkOldRooms {
 		// set include_old_rooms if it is unset
@@ -664,6 +1125,64 @@ func (rs RoomSubscription) RequiredStateMap(userID string) *internal.RequiredSta
 	)
 }
 
+// ProjectContent projects the content of the given events according to ContentFields. Returns
+// the input slice unaltered if there is no projection.
+func (rs RoomSubscription) ProjectContent(events []json.RawMessage) []json.RawMessage {
+	if len(rs.ContentFields) == 0 || len(events) == 0 {
+		return events
+	}
+	result := make([]json.RawMessage, len(events))
+	for i := range events {
+		result[i] = internal.ProjectEventContent(events[i], rs.ContentFields)
+	}
+	return result
+}
+
+// IncludeTimelineEvent returns true if an event of this type should be included in the timeline
+// according to TimelineEventTypes.
+func (rs RoomSubscription) IncludeTimelineEvent(eventType string) bool {
+	if len(rs.TimelineEventTypes) == 0 {
+		return true
+	}
+	for _, t := range rs.TimelineEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterTimeline removes events from the timeline whose types are not in TimelineEventTypes.
+// Returns the input slice unaltered if there is no filter.
+func (rs RoomSubscription) FilterTimeline(events []json.RawMessage) []json.RawMessage {
+	if len(rs.TimelineEventTypes) == 0 || len(events) == 0 {
+		return events
+	}
+	result := make([]json.RawMessage, 0, len(events))
+	for _, ev := range events {
+		if rs.IncludeTimelineEvent(gjson.GetBytes(ev, "type").Str) {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// helper to union two string slices, preserving the order in which they were first seen
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	result := make([]string, 0, len(a)+len(b))
+	for _, arr := range [][]string{a, b} {
+		for _, s := range arr {
+			if _, ok := seen[s]; ok {
+				continue
+			}
+			seen[s] = struct{}{}
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 // helper to find `null` or literal string matches
 func nullableStringExists(arr []*string, input *string) bool {
 	if len(arr) == 0 {
@@ -1131,3 +1131,214 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 func listPtr(l RequestList) *RequestList {
 	return &l
 }
+
+func TestRequestSetTimeoutMSecs(t *testing.T) {
+	testCases := []struct {
+		timeout int
+		want    int
+	}{
+		{timeout: 0, want: 0},
+		{timeout: 20, want: 20},
+		{timeout: DefaultTimeoutMSecs, want: DefaultTimeoutMSecs},
+		{timeout: MaxTimeoutMSecs, want: MaxTimeoutMSecs},
+		{timeout: MaxTimeoutMSecs + 1, want: MaxTimeoutMSecs},
+		{timeout: -5, want: 0},
+	}
+	for _, tc := range testCases {
+		var r Request
+		r.SetTimeoutMSecs(tc.timeout)
+		if got := r.TimeoutMSecs(); got != tc.want {
+			t.Errorf("SetTimeoutMSecs(%d): got %d want %d", tc.timeout, got, tc.want)
+		}
+	}
+}
+
+func TestRequestValidateRanges(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ranges  SliceRanges
+		wantErr string // empty if valid
+	}{
+		{
+			name:   "valid",
+			ranges: SliceRanges{{0, 5}, {10, 20}},
+		},
+		{
+			name:    "start > end",
+			ranges:  SliceRanges{{5, 2}},
+			wantErr: "list[a] invalid ranges: range [5 2] has start > end",
+		},
+		{
+			name:    "negative bounds",
+			ranges:  SliceRanges{{-1, 5}},
+			wantErr: "list[a] invalid ranges: range [-1 5] has a negative index",
+		},
+		{
+			name:    "overlapping",
+			ranges:  SliceRanges{{0, 10}, {5, 20}},
+			wantErr: "list[a] invalid ranges: ranges [0 10] and [5 20] overlap",
+		},
+	}
+	for _, tc := range testCases {
+		req := Request{
+			Lists: map[string]RequestList{
+				"a": {Ranges: tc.ranges},
+			},
+		}
+		err := req.Validate()
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: got error %s, want none", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%s: got error %v, want %s", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRequestValidateCenterEventID(t *testing.T) {
+	centered := RoomSubscription{CenterEventID: "$event"}
+	testCases := []struct {
+		name    string
+		req     Request
+		wantErr string // empty if valid
+	}{
+		{
+			name: "room subscription",
+			req: Request{
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a:localhost": centered,
+				},
+			},
+		},
+		{
+			name: "list",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {RoomSubscription: centered},
+				},
+			},
+			wantErr: "list[a] center_event_id is only allowed in room_subscriptions",
+		},
+		{
+			name: "saved view list",
+			req: Request{
+				SaveViews: map[string]View{
+					"v": {
+						Lists: map[string]RequestList{
+							"a": {RoomSubscription: centered},
+						},
+					},
+				},
+			},
+			wantErr: "view[v] list[a] center_event_id is only allowed in room_subscriptions",
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.req.Validate()
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: got error %s, want none", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%s: got error %v, want %s", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRequestApplyDeltaEmptyRangesVersusDeleted(t *testing.T) {
+	var initial Request
+	if err := json.Unmarshal([]byte(`{"lists":{"a":{"ranges":[[0,10]]},"b":{"ranges":[[0,5]]}}}`), &initial); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	current, _ := (*Request)(nil).ApplyDelta(&initial)
+
+	// empty ranges keep the list alive but with no window, omitting b's ranges leaves them unchanged
+	var emptyRanges Request
+	if err := json.Unmarshal([]byte(`{"lists":{"a":{"ranges":[]},"b":{}}}`), &emptyRanges); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	current, delta := current.ApplyDelta(&emptyRanges)
+	a, ok := current.Lists["a"]
+	if !ok {
+		t.Fatalf("list 'a' with empty ranges was removed")
+	}
+	if a.Ranges == nil || len(a.Ranges) != 0 {
+		t.Errorf("list 'a' got ranges %v want empty", a.Ranges)
+	}
+	if delta.Lists["a"].Curr == nil {
+		t.Errorf("list 'a' with empty ranges has a nil Curr delta")
+	}
+	if b := current.Lists["b"]; !reflect.DeepEqual(b.Ranges, SliceRanges{{0, 5}}) {
+		t.Errorf("list 'b' got ranges %v want [[0 5]]", b.Ranges)
+	}
+
+	// omitting ranges keeps the previous (empty) ranges
+	current, _ = current.ApplyDelta(&Request{Lists: map[string]RequestList{"a": {}, "b": {}}})
+	if a := current.Lists["a"]; a.Ranges == nil || len(a.Ranges) != 0 {
+		t.Errorf("list 'a' got ranges %v want empty", a.Ranges)
+	}
+
+	// deleted removes the list
+	current, delta = current.ApplyDelta(&Request{Lists: map[string]RequestList{"a": {Deleted: true}, "b": {}}})
+	if _, ok := current.Lists["a"]; ok {
+		t.Errorf("deleted list 'a' still exists")
+	}
+	if d := delta.Lists["a"]; d.Prev == nil || d.Curr != nil {
+		t.Errorf("deleted list 'a' got delta %+v want Prev set and nil Curr", d)
+	}
+	if _, ok := current.Lists["b"]; !ok {
+		t.Errorf("list 'b' was removed")
+	}
+}
+
+func TestRequestApplyDeltaEmptyRangesVersusOmitted(t *testing.T) {
+	var initial Request
+	if err := json.Unmarshal([]byte(`{"lists":{"a":{"ranges":[[0,10]]},"b":{"ranges":[[0,5]]}}}`), &initial); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	current, _ := (*Request)(nil).ApplyDelta(&initial)
+
+	// omitting "lists" keeps every list
+	current, delta := current.ApplyDelta(&Request{})
+	for _, listKey := range []string{"a", "b"} {
+		if _, ok := current.Lists[listKey]; !ok {
+			t.Errorf("list '%s' was removed when lists were omitted", listKey)
+		}
+		if delta.Lists[listKey].Curr == nil {
+			t.Errorf("list '%s' has a nil Curr delta when lists were omitted", listKey)
+		}
+	}
+
+	// empty ranges keep "a" alive with no window, omitting "b" deletes it
+	var next Request
+	if err := json.Unmarshal([]byte(`{"lists":{"a":{"ranges":[]}}}`), &next); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	current, delta = current.ApplyDelta(&next)
+	if a, ok := current.Lists["a"]; !ok || a.Ranges == nil || len(a.Ranges) != 0 {
+		t.Errorf("list 'a' got %+v (exists=%v) want empty ranges", a, ok)
+	}
+	if delta.Lists["a"].Curr == nil {
+		t.Errorf("list 'a' with empty ranges has a nil Curr delta")
+	}
+	if _, ok := current.Lists["b"]; ok {
+		t.Errorf("omitted list 'b' still exists")
+	}
+	if d := delta.Lists["b"]; d.Prev == nil || d.Curr != nil {
+		t.Errorf("omitted list 'b' got delta %+v want Prev set and nil Curr", d)
+	}
+
+	// sending "b" again makes a new list
+	current, delta = current.ApplyDelta(&Request{Lists: map[string]RequestList{"a": {}, "b": {}}})
+	if d := delta.Lists["b"]; d.Prev != nil || d.Curr == nil {
+		t.Errorf("re-added list 'b' got delta %+v want nil Prev and Curr set", d)
+	}
+	if b := current.Lists["b"]; b.Ranges != nil {
+		t.Errorf("re-added list 'b' got ranges %v want none", b.Ranges)
+	}
+}
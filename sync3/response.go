@@ -1,7 +1,9 @@
 package sync3
 
 import (
+	"bytes"
 	"encoding/json"
+	"sort"
 	"strconv"
 
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
@@ -13,6 +15,9 @@ const (
 	OpInvalidate = "INVALIDATE"
 	OpInsert     = "INSERT"
 	OpDelete     = "DELETE"
+	// OpUpdate replaces the room at an index with another room. It is only sent to lists which set
+	// coalesce_ops, as it is equivalent to a DELETE then an INSERT at the same index.
+	OpUpdate = "UPDATE"
 )
 
 type Response struct {
@@ -23,11 +28,40 @@ type Response struct {
 
 	Pos   string `json:"pos"`
 	TxnID string `json:"txn_id,omitempty"`
+	// The sync v2 since token for the requesting device, if requested via include_v2_since.
+	V2Since string `json:"v2_since,omitempty"`
+	// True if the server has nothing more pending for this connection once the client has
+	// processed this response, i.e no updates were deferred to a later response.
+	CaughtUp bool `json:"caught_up,omitempty"`
+	// True if the poller for this device is lagging behind the homeserver, so data may be delayed.
+	StaleData bool `json:"stale_data,omitempty"`
+	// The live timeline events in this response across all rooms, in the order the proxy received
+	// them. Only set if requested via include_stream_order.
+	StreamOrder []StreamOrderEntry `json:"stream_order,omitempty"`
+	// The total notification count across all rooms, excluding muted rooms. Only set if requested
+	// via include_unread_total, and only when it has changed since it was last sent.
+	UnreadTotal *int `json:"unread_total,omitempty"`
+	// Event JSON which appears more than once in this response, keyed by reference. Only set if
+	// requested via dedupe_events. See DedupeEvents.
+	SharedEvents map[string]json.RawMessage `json:"shared_events,omitempty"`
+}
+
+// StreamOrderEntry identifies an event in the timeline of a room in the response.
+type StreamOrderEntry struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
 }
 
 type ResponseList struct {
 	Ops   []ResponseOp `json:"ops,omitempty"`
 	Count int          `json:"count"`
+	// For recency sorted lists, a map of room ID to the timestamp the server used to sort the
+	// room, for rooms in this response. This takes bump_event_types into account.
+	BumpStamps map[string]uint64 `json:"bump_stamps,omitempty"`
+	// If include_deltas is set, the room IDs which entered and left the list's ranges since the
+	// previous response, sorted by room ID. A room which moves within the ranges appears in neither.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
 }
 
 func (r *Response) PosInt() int64 {
@@ -57,18 +91,120 @@ func (r *Response) RoomIDsToTimelineEventIDs() map[string][]string {
 	return includedRoomIDs
 }
 
+// sharedEventRefPrefix is how every reference to an event in SharedEvents starts.
+var sharedEventRefPrefix = []byte(`{"$shared":`)
+
+// DedupeEvents moves event JSON which appears more than once across the rooms in this response into
+// SharedEvents, replacing each occurrence with a reference of the form {"$shared":"<key>"}.
+// Clients can reverse this with ExpandSharedEvents.
+func (r *Response) DedupeEvents() {
+	counts := make(map[string]int)
+	r.mapEvents(func(ev json.RawMessage) json.RawMessage {
+		counts[string(ev)]++
+		return ev
+	})
+	keys := make(map[string]string)
+	r.mapEvents(func(ev json.RawMessage) json.RawMessage {
+		if counts[string(ev)] < 2 {
+			return ev
+		}
+		key, ok := keys[string(ev)]
+		if !ok {
+			key = strconv.Itoa(len(keys))
+			keys[string(ev)] = key
+			if r.SharedEvents == nil {
+				r.SharedEvents = make(map[string]json.RawMessage)
+			}
+			r.SharedEvents[key] = ev
+		}
+		return json.RawMessage(`{"$shared":"` + key + `"}`)
+	})
+}
+
+// ExpandSharedEvents replaces references to SharedEvents with the event JSON they refer to.
+func (r *Response) ExpandSharedEvents() {
+	if len(r.SharedEvents) == 0 {
+		return
+	}
+	r.mapEvents(func(ev json.RawMessage) json.RawMessage {
+		if !bytes.HasPrefix(ev, sharedEventRefPrefix) {
+			return ev
+		}
+		shared, ok := r.SharedEvents[gjson.GetBytes(ev, "$shared").Str]
+		if !ok {
+			return ev
+		}
+		return shared
+	})
+	r.SharedEvents = nil
+}
+
+// mapEvents replaces every event in every room with the result of fn, visiting rooms in room ID
+// order. Event slices are copied rather than modified, as they may be shared with the caches.
+func (r *Response) mapEvents(fn func(ev json.RawMessage) json.RawMessage) {
+	roomIDs := make([]string, 0, len(r.Rooms))
+	for roomID := range r.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	mapSlice := func(events []json.RawMessage) []json.RawMessage {
+		if events == nil {
+			return nil
+		}
+		result := make([]json.RawMessage, len(events))
+		for i := range events {
+			result[i] = fn(events[i])
+		}
+		return result
+	}
+	for _, roomID := range roomIDs {
+		room := r.Rooms[roomID]
+		room.RequiredState = mapSlice(room.RequiredState)
+		room.FirstViewState = mapSlice(room.FirstViewState)
+		room.Timeline = mapSlice(room.Timeline)
+		room.InviteState = mapSlice(room.InviteState)
+		r.Rooms[roomID] = room
+	}
+}
+
+// FilterStreamOrder removes entries from StreamOrder for events which are not in the timeline of
+// their room in this response e.g because the room was replaced with an initial snapshot.
+func (r *Response) FilterStreamOrder() {
+	if len(r.StreamOrder) == 0 {
+		return
+	}
+	roomIDToEventIDs := r.RoomIDsToTimelineEventIDs()
+	filtered := r.StreamOrder[:0]
+	for _, entry := range r.StreamOrder {
+		for _, eventID := range roomIDToEventIDs[entry.RoomID] {
+			if eventID == entry.EventID {
+				filtered = append(filtered, entry)
+				break
+			}
+		}
+	}
+	r.StreamOrder = filtered
+}
+
 // Custom unmarshal so we can dynamically create the right ResponseOp for Ops
 func (r *Response) UnmarshalJSON(b []byte) error {
 	temporary := struct {
 		Rooms map[string]Room `json:"rooms"`
 		Lists map[string]struct {
-			Ops   []json.RawMessage `json:"ops"`
-			Count int               `json:"count"`
+			Ops        []json.RawMessage `json:"ops"`
+			Count      int               `json:"count"`
+			BumpStamps map[string]uint64 `json:"bump_stamps"`
 		} `json:"lists"`
 		Extensions extensions.Response `json:"extensions"`
 
-		Pos   string `json:"pos"`
-		TxnID string `json:"txn_id,omitempty"`
+		Pos          string                     `json:"pos"`
+		TxnID        string                     `json:"txn_id,omitempty"`
+		V2Since      string                     `json:"v2_since,omitempty"`
+		CaughtUp     bool                       `json:"caught_up,omitempty"`
+		StaleData    bool                       `json:"stale_data,omitempty"`
+		StreamOrder  []StreamOrderEntry         `json:"stream_order,omitempty"`
+		UnreadTotal  *int                       `json:"unread_total,omitempty"`
+		SharedEvents map[string]json.RawMessage `json:"shared_events,omitempty"`
 	}{}
 	if err := json.Unmarshal(b, &temporary); err != nil {
 		return err
@@ -76,12 +212,19 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 	r.Rooms = temporary.Rooms
 	r.Pos = temporary.Pos
 	r.TxnID = temporary.TxnID
+	r.V2Since = temporary.V2Since
+	r.CaughtUp = temporary.CaughtUp
+	r.StaleData = temporary.StaleData
+	r.StreamOrder = temporary.StreamOrder
+	r.UnreadTotal = temporary.UnreadTotal
+	r.SharedEvents = temporary.SharedEvents
 	r.Extensions = temporary.Extensions
 	r.Lists = make(map[string]ResponseList, len(temporary.Lists))
 
 	for listKey, l := range temporary.Lists {
 		var list ResponseList
 		list.Count = l.Count
+		list.BumpStamps = l.BumpStamps
 		for _, op := range l.Ops {
 			if gjson.GetBytes(op, "range").Exists() {
 				var oper ResponseOpRange
@@ -135,6 +278,30 @@ func (r *ResponseOpSingle) Op() string {
 	return r.Operation
 }
 
+// CoalesceOps replaces each DELETE which is immediately followed by an INSERT at the same index with
+// a single UPDATE. Applying the returned ops results in the same list as applying the given ops.
+func CoalesceOps(ops []ResponseOp) []ResponseOp {
+	var result []ResponseOp
+	for i := 0; i < len(ops); i++ {
+		del, isDelete := ops[i].(*ResponseOpSingle)
+		if isDelete && del.Operation == OpDelete && del.Index != nil && i+1 < len(ops) {
+			ins, isInsert := ops[i+1].(*ResponseOpSingle)
+			if isInsert && ins.Operation == OpInsert && ins.Index != nil && *ins.Index == *del.Index {
+				index := *ins.Index
+				result = append(result, &ResponseOpSingle{
+					Operation: OpUpdate,
+					Index:     &index,
+					RoomID:    ins.RoomID,
+				})
+				i++
+				continue
+			}
+		}
+		result = append(result, ops[i])
+	}
+	return result
+}
+
 func (r *ResponseOpSingle) IncludedRoomIDs() []string {
 	if r.Op() == OpDelete || r.RoomID == "" {
 		return nil // the room is being excluded
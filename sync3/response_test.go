@@ -0,0 +1,153 @@
+package sync3
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestResponseDedupeEvents(t *testing.T) {
+	// every room shares the same encryption event and bot membership, but has a unique message
+	encryption := json.RawMessage(`{"type":"m.room.encryption","state_key":"","content":{"algorithm":"m.megolm.v1.aes-sha2"}}`)
+	botMember := json.RawMessage(`{"type":"m.room.member","state_key":"@bot:localhost","content":{"membership":"join","displayname":"Bot"}}`)
+	makeRooms := func() map[string]Room {
+		rooms := make(map[string]Room)
+		for i := 0; i < 10; i++ {
+			roomID := fmt.Sprintf("!%d:localhost", i)
+			rooms[roomID] = Room{
+				Name:          roomID,
+				RequiredState: []json.RawMessage{encryption, botMember},
+				Timeline: []json.RawMessage{
+					json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","content":{"body":"%d"}}`, i)),
+					botMember,
+				},
+			}
+		}
+		return rooms
+	}
+	original, err := json.Marshal(Response{Rooms: makeRooms()})
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+
+	res := Response{Rooms: makeRooms()}
+	res.DedupeEvents()
+	if len(res.SharedEvents) != 2 {
+		t.Errorf("got %d shared events, want 2: %v", len(res.SharedEvents), res.SharedEvents)
+	}
+	deduped, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	if len(deduped) >= len(original) {
+		t.Errorf("deduped response is %d bytes, not smaller than original %d bytes", len(deduped), len(original))
+	}
+
+	// unique events are left alone
+	for roomID, room := range res.Rooms {
+		if !reflect.DeepEqual(room.Timeline[0], makeRooms()[roomID].Timeline[0]) {
+			t.Errorf("room %s: unique event was modified: %s", roomID, string(room.Timeline[0]))
+		}
+	}
+
+	var roundTripped Response
+	if err = json.Unmarshal(deduped, &roundTripped); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	roundTripped.ExpandSharedEvents()
+	if roundTripped.SharedEvents != nil {
+		t.Errorf("shared events were not removed after expanding")
+	}
+	wantRooms := makeRooms()
+	for roomID, wantRoom := range wantRooms {
+		gotRoom := roundTripped.Rooms[roomID]
+		for i := range wantRoom.RequiredState {
+			if string(gotRoom.RequiredState[i]) != string(wantRoom.RequiredState[i]) {
+				t.Errorf("room %s: required_state[%d] got %s want %s", roomID, i, gotRoom.RequiredState[i], wantRoom.RequiredState[i])
+			}
+		}
+		for i := range wantRoom.Timeline {
+			if string(gotRoom.Timeline[i]) != string(wantRoom.Timeline[i]) {
+				t.Errorf("room %s: timeline[%d] got %s want %s", roomID, i, gotRoom.Timeline[i], wantRoom.Timeline[i])
+			}
+		}
+	}
+}
+
+func TestCoalesceOps(t *testing.T) {
+	index := func(i int) *int {
+		return &i
+	}
+	testCases := []struct {
+		name string
+		ops  []ResponseOp
+		want []ResponseOp
+	}{
+		{
+			name: "delete then insert at the same index",
+			ops: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: index(3)},
+				&ResponseOpSingle{Operation: OpInsert, Index: index(3), RoomID: "!a"},
+			},
+			want: []ResponseOp{
+				&ResponseOpSingle{Operation: OpUpdate, Index: index(3), RoomID: "!a"},
+			},
+		},
+		{
+			name: "delete then insert at different indexes",
+			ops: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: index(3)},
+				&ResponseOpSingle{Operation: OpInsert, Index: index(0), RoomID: "!a"},
+			},
+			want: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: index(3)},
+				&ResponseOpSingle{Operation: OpInsert, Index: index(0), RoomID: "!a"},
+			},
+		},
+		{
+			name: "insert then delete at the same index",
+			ops: []ResponseOp{
+				&ResponseOpSingle{Operation: OpInsert, Index: index(3), RoomID: "!a"},
+				&ResponseOpSingle{Operation: OpDelete, Index: index(3)},
+			},
+			want: []ResponseOp{
+				&ResponseOpSingle{Operation: OpInsert, Index: index(3), RoomID: "!a"},
+				&ResponseOpSingle{Operation: OpDelete, Index: index(3)},
+			},
+		},
+		{
+			name: "multiple windows",
+			ops: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: index(12)},
+				&ResponseOpSingle{Operation: OpInsert, Index: index(12), RoomID: "!b"},
+				&ResponseOpSingle{Operation: OpDelete, Index: index(7)},
+				&ResponseOpSingle{Operation: OpDelete, Index: index(2)},
+				&ResponseOpSingle{Operation: OpInsert, Index: index(0), RoomID: "!a"},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{20, 20}, RoomIDs: []string{"!c"}},
+			},
+			want: []ResponseOp{
+				&ResponseOpSingle{Operation: OpUpdate, Index: index(12), RoomID: "!b"},
+				&ResponseOpSingle{Operation: OpDelete, Index: index(7)},
+				&ResponseOpSingle{Operation: OpDelete, Index: index(2)},
+				&ResponseOpSingle{Operation: OpInsert, Index: index(0), RoomID: "!a"},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{20, 20}, RoomIDs: []string{"!c"}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		got := CoalesceOps(tc.ops)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %s want %s", tc.name, serialiseOps(t, got), serialiseOps(t, tc.want))
+		}
+	}
+}
+
+func serialiseOps(t *testing.T, ops []ResponseOp) string {
+	t.Helper()
+	b, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatalf("failed to marshal ops: %s", err)
+	}
+	return string(b)
+}
@@ -2,29 +2,294 @@ package sync3
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
+// timeNow is a variable so tests can control when snoozes expire.
+var timeNow = time.Now
+
 type Room struct {
 	Name              string            `json:"name,omitempty"`
 	AvatarChange      AvatarChange      `json:"avatar,omitempty"`
 	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
+	FirstViewState    []json.RawMessage `json:"first_view_state,omitempty"`
 	Timeline          []json.RawMessage `json:"timeline,omitempty"`
+	TimelineIsState   []bool            `json:"timeline_is_state,omitempty"`
 	InviteState       []json.RawMessage `json:"invite_state,omitempty"`
 	NotificationCount int64             `json:"notification_count"`
 	HighlightCount    int64             `json:"highlight_count"`
 	Initial           bool              `json:"initial,omitempty"`
 	IsDM              bool              `json:"is_dm,omitempty"`
+	IsMuted           bool              `json:"is_muted,omitempty"`
 	JoinedCount       int               `json:"joined_count,omitempty"`
 	InvitedCount      *int              `json:"invited_count,omitempty"`
 	PrevBatch         string            `json:"prev_batch,omitempty"`
+	TimelineComplete  bool              `json:"timeline_complete,omitempty"`
 	NumLive           int               `json:"num_live,omitempty"`
 	Timestamp         uint64            `json:"timestamp,omitempty"`
+	JoinStatus        string            `json:"join_status,omitempty"`
+	// event_id -> aggregated relations, for events in the timeline. Only set if aggregate_relations is enabled.
+	Relations map[string]RelationsSummary `json:"relations,omitempty"`
+	// The content of the m.room.server_acl state event. Only set if include_server_acl is enabled.
+	ServerACL *internal.ServerACL `json:"server_acl,omitempty"`
+	// The users in a call in this room, according to m.call.member state. Omitted if nobody is in a
+	// call when the room is first sent, and an empty list when the last user leaves a call.
+	CallMembers *[]string `json:"call_members,omitempty"`
+	// The number of required_state events still to be sent in later responses, when required_state
+	// is being sent in chunks. 0 means this response completes the required_state.
+	RequiredStateRemaining *int `json:"required_state_remaining,omitempty"`
+	// The sender of the most recent event which bumps this room. Only set if include_latest_event_sender
+	// is enabled.
+	LatestEventSender *LatestEventSender `json:"latest_event_sender,omitempty"`
+	// The members used to calculate the room name, excluding the syncing user, like m.heroes in a v2
+	// room summary. Lets clients render names and avatars for rooms without an m.room.name.
+	Heroes []Hero `json:"heroes,omitempty"`
+	// The number of rooms in this space, according to m.space.child state. Only set for spaces.
+	SpaceChildCount *int `json:"space_child_count,omitempty"`
+	// True if center_event_id was requested but the event could not be found, in which case the
+	// timeline contains the most recent events instead.
+	CenterEventNotFound bool `json:"center_event_not_found,omitempty"`
+}
+
+// Hero is a member of a room used to calculate its name and avatar.
+type Hero struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// NewHeroes returns the heroes for this room metadata, or nil if there are none.
+func NewHeroes(metadata *internal.RoomMetadata) []Hero {
+	if len(metadata.Heroes) == 0 {
+		return nil
+	}
+	heroes := make([]Hero, len(metadata.Heroes))
+	for i, h := range metadata.Heroes {
+		heroes[i] = Hero{
+			UserID:      h.ID,
+			DisplayName: h.Name,
+			AvatarURL:   h.Avatar,
+		}
+	}
+	return heroes
+}
+
+// NewSpaceChildCount returns the number of children for this room metadata, or nil if the room is
+// not a space.
+func NewSpaceChildCount(metadata *internal.RoomMetadata) *int {
+	if !metadata.IsSpace() {
+		return nil
+	}
+	count := len(metadata.ChildSpaceRooms)
+	return &count
+}
+
+// LatestEventSender identifies who sent the latest event in a room, for "Alice: hello" style previews.
+type LatestEventSender struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+}
+
+// NewLatestEventSender returns the latest event sender for userID, using the display name in their
+// m.room.member event if it is not nil.
+func NewLatestEventSender(userID string, memberEvent json.RawMessage) *LatestEventSender {
+	return &LatestEventSender{
+		UserID:      userID,
+		DisplayName: gjson.GetBytes(memberEvent, "content.displayname").Str,
+	}
+}
+
+// Join statuses for rooms the user is not joined to. Joined rooms have no join status.
+const (
+	JoinStatusInvited              = "invited"
+	JoinStatusKnocked              = "knocked"
+	JoinStatusKnockDenied          = "knock_denied"
+	JoinStatusJoinEligibleViaSpace = "join_eligible_via_space"
+)
+
+// SetTimelineIsState flags which events in the timeline are state events, such that
+// TimelineIsState[i] is true if and only if Timeline[i] has a state_key. This must be called
+// once the timeline is complete.
+func (r *Room) SetTimelineIsState() {
+	if len(r.Timeline) == 0 {
+		r.TimelineIsState = nil
+		return
+	}
+	r.TimelineIsState = make([]bool, len(r.Timeline))
+	for i, ev := range r.Timeline {
+		r.TimelineIsState[i] = gjson.GetBytes(ev, "state_key").Exists()
+	}
+}
+
+// Membership changes which annotate m.room.member timeline events in unsigned.membership_change.
+const (
+	MembershipChangeJoin   = "join"
+	MembershipChangeLeave  = "leave"
+	MembershipChangeInvite = "invite"
+	MembershipChangeBan    = "ban"
+	MembershipChangeKnock  = "knock"
+	// The user changed their display name or avatar whilst remaining joined.
+	MembershipChangeProfileUpdate = "profile_update"
+)
+
+// AnnotateMembershipChanges sets unsigned.membership_change on each m.room.member event in the
+// timeline to one of the MembershipChange constants, by comparing it with the prior membership. The
+// prior membership is taken from unsigned.prev_content, else from an earlier event in the timeline.
+// Joins which change nothing are not annotated. Returns a copy if any events were annotated, else the
+// input slice unaltered.
+func AnnotateMembershipChanges(timeline []json.RawMessage) []json.RawMessage {
+	var result []json.RawMessage
+	// state_key -> content of the latest membership event in the timeline
+	var priorContents map[string]gjson.Result
+	for i, ev := range timeline {
+		parsed := gjson.ParseBytes(ev)
+		stateKey := parsed.Get("state_key")
+		if parsed.Get("type").Str != "m.room.member" || !stateKey.Exists() {
+			continue
+		}
+		content := parsed.Get("content")
+		prior := parsed.Get("unsigned.prev_content")
+		if !prior.Exists() {
+			prior = priorContents[stateKey.Str]
+		}
+		if priorContents == nil {
+			priorContents = make(map[string]gjson.Result)
+		}
+		priorContents[stateKey.Str] = content
+
+		change := membershipChange(prior, content)
+		if change == "" {
+			continue
+		}
+		annotated, err := sjson.SetBytes(ev, "unsigned.membership_change", change)
+		if err != nil {
+			logger.Warn().Err(err).Str("event", parsed.Get("event_id").Str).Msg("failed to annotate membership change")
+			continue
+		}
+		if result == nil {
+			result = make([]json.RawMessage, len(timeline))
+			copy(result, timeline)
+		}
+		result[i] = annotated
+	}
+	if result == nil {
+		return timeline
+	}
+	return result
+}
+
+// AnnotateSenderMemberships sets unsigned.sender_membership on each timeline event to the membership,
+// display name and avatar of its sender when the event was sent, taken from memberships which maps
+// event IDs to the sender's m.room.member event at the time. Events without a membership are left
+// alone. Returns a copy if any events were annotated, else the input slice unaltered.
+func AnnotateSenderMemberships(timeline []json.RawMessage, memberships map[string]json.RawMessage) []json.RawMessage {
+	var result []json.RawMessage
+	for i, ev := range timeline {
+		eventID := gjson.GetBytes(ev, "event_id").Str
+		membership, ok := memberships[eventID]
+		if !ok {
+			continue
+		}
+		content := gjson.GetBytes(membership, "content")
+		senderMembership := map[string]string{
+			"membership": content.Get("membership").Str,
+		}
+		for _, field := range []string{"displayname", "avatar_url"} {
+			if value := content.Get(field); value.Type == gjson.String {
+				senderMembership[field] = value.Str
+			}
+		}
+		annotated, err := sjson.SetBytes(ev, "unsigned.sender_membership", senderMembership)
+		if err != nil {
+			logger.Warn().Err(err).Str("event", eventID).Msg("failed to annotate sender membership")
+			continue
+		}
+		if result == nil {
+			result = make([]json.RawMessage, len(timeline))
+			copy(result, timeline)
+		}
+		result[i] = annotated
+	}
+	if result == nil {
+		return timeline
+	}
+	return result
+}
+
+// membershipChange returns the MembershipChange between these two m.room.member contents, or the
+// empty string if nothing changed.
+func membershipChange(prior, content gjson.Result) string {
+	membership := content.Get("membership").Str
+	switch membership {
+	case "join":
+		if prior.Get("membership").Str != "join" {
+			return MembershipChangeJoin
+		}
+		if prior.Get("displayname").Str != content.Get("displayname").Str ||
+			prior.Get("avatar_url").Str != content.Get("avatar_url").Str {
+			return MembershipChangeProfileUpdate
+		}
+		return ""
+	case "leave":
+		return MembershipChangeLeave
+	case "invite":
+		return MembershipChangeInvite
+	case "ban":
+		return MembershipChangeBan
+	case "knock":
+		return MembershipChangeKnock
+	}
+	return ""
 }
 
+// AnnotateDayBoundaries sets unsigned.day_boundary to true on each timeline event which is the first
+// event of its day, where days are calculated from origin_server_ts in the timezone utcOffset from UTC.
+// prevTS is the origin_server_ts of the event before the timeline, or 0 if it is unknown, in which case
+// the first event in the timeline is never flagged. The timeline must be in chronological order. Returns
+// a copy if any events were annotated, else the input slice unaltered, along with the origin_server_ts
+// of the last event in the timeline (or prevTS if the timeline is empty).
+func AnnotateDayBoundaries(timeline []json.RawMessage, prevTS int64, utcOffset time.Duration) ([]json.RawMessage, int64) {
+	var result []json.RawMessage
+	day := func(ts int64) int64 {
+		local := ts + utcOffset.Milliseconds()
+		d := local / dayMillis
+		if local < 0 && local%dayMillis != 0 {
+			d-- // round towards negative infinity
+		}
+		return d
+	}
+	for i, ev := range timeline {
+		ts := gjson.GetBytes(ev, "origin_server_ts").Int()
+		isBoundary := prevTS != 0 && day(ts) != day(prevTS)
+		prevTS = ts
+		if !isBoundary {
+			continue
+		}
+		annotated, err := sjson.SetBytes(ev, "unsigned.day_boundary", true)
+		if err != nil {
+			logger.Warn().Err(err).Str("event", gjson.GetBytes(ev, "event_id").Str).Msg("failed to annotate day boundary")
+			continue
+		}
+		if result == nil {
+			result = make([]json.RawMessage, len(timeline))
+			copy(result, timeline)
+		}
+		result[i] = annotated
+	}
+	if result == nil {
+		return timeline, prevTS
+	}
+	return result, prevTS
+}
+
+const dayMillis = int64(24 * time.Hour / time.Millisecond)
+
 // RoomConnMetadata represents a room as seen by one specific connection (hence one
 // specific device).
 type RoomConnMetadata struct {
@@ -53,6 +318,15 @@ type RoomConnMetadata struct {
 	// list. See also the description of this in the React SDK docs:
 	//     https://github.com/matrix-org/matrix-react-sdk/blob/526645c79160ab1ad4b4c3845de27d51263a405e/docs/room-list-store.md#tag-sorting-algorithm-recent
 	LastInterestedEventTimestamps map[string]uint64
+
+	// SnoozedUntil is the unix timestamp in milliseconds until which notifications in this
+	// room are snoozed by the connection. Zero means the room is not snoozed.
+	SnoozedUntil int64
+}
+
+// IsSnoozed returns true if notifications in this room are currently snoozed by the connection.
+func (r *RoomConnMetadata) IsSnoozed() bool {
+	return r.SnoozedUntil > 0 && timeNow().UnixMilli() < r.SnoozedUntil
 }
 
 func (r *RoomConnMetadata) GetLastInterestedEventTimestamp(listKey string) uint64 {
@@ -6,6 +6,7 @@ import (
 	"github.com/tidwall/gjson"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestAvatarChangeMarshalling(t *testing.T) {
@@ -72,3 +73,176 @@ func TestAvatarChangeMarshalling(t *testing.T) {
 		})
 	}
 }
+
+func TestRoomSetTimelineIsState(t *testing.T) {
+	room := Room{
+		Timeline: []json.RawMessage{
+			json.RawMessage(`{"type":"m.room.message","event_id":"$a","content":{"body":"a"}}`),
+			json.RawMessage(`{"type":"m.room.topic","state_key":"","event_id":"$b","content":{"topic":"b"}}`),
+			json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","event_id":"$c","content":{"membership":"join"}}`),
+			json.RawMessage(`{"type":"m.reaction","event_id":"$d","content":{}}`),
+		},
+	}
+	room.SetTimelineIsState()
+	want := []bool{false, true, true, false}
+	if !reflect.DeepEqual(room.TimelineIsState, want) {
+		t.Fatalf("got %v want %v", room.TimelineIsState, want)
+	}
+
+	room.Timeline = nil
+	room.SetTimelineIsState()
+	if room.TimelineIsState != nil {
+		t.Fatalf("got %v for an empty timeline, want nil", room.TimelineIsState)
+	}
+}
+
+func TestAnnotateMembershipChanges(t *testing.T) {
+	timeline := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","event_id":"$invite","content":{"membership":"invite"}}`),
+		json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","event_id":"$join","content":{"membership":"join","displayname":"Bob"}}`),
+		json.RawMessage(`{"type":"m.room.message","event_id":"$msg","content":{"body":"hello"}}`),
+		// the prior membership comes from the previous event in the timeline
+		json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","event_id":"$rename","content":{"membership":"join","displayname":"Robert"}}`),
+		// the prior membership comes from prev_content
+		json.RawMessage(`{"type":"m.room.member","state_key":"@charlie:localhost","event_id":"$avatar","content":{"membership":"join","avatar_url":"mxc://new"},"unsigned":{"prev_content":{"membership":"join","avatar_url":"mxc://old"}}}`),
+		// joins which change nothing are not annotated
+		json.RawMessage(`{"type":"m.room.member","state_key":"@charlie:localhost","event_id":"$noop","content":{"membership":"join","avatar_url":"mxc://new"}}`),
+		json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","event_id":"$ban","content":{"membership":"ban"}}`),
+		json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","event_id":"$unban","content":{"membership":"leave"}}`),
+	}
+	original := make([]json.RawMessage, len(timeline))
+	copy(original, timeline)
+	got := AnnotateMembershipChanges(timeline)
+	want := []string{
+		MembershipChangeInvite, MembershipChangeJoin, "", MembershipChangeProfileUpdate, MembershipChangeProfileUpdate,
+		"", MembershipChangeBan, MembershipChangeLeave,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events want %d", len(got), len(want))
+	}
+	for i := range want {
+		change := gjson.GetBytes(got[i], "unsigned.membership_change")
+		if change.Str != want[i] {
+			t.Errorf("event %s: got membership_change %q want %q", gjson.GetBytes(got[i], "event_id").Str, change.Str, want[i])
+		}
+		if want[i] == "" && change.Exists() {
+			t.Errorf("event %s: got membership_change %q want none", gjson.GetBytes(got[i], "event_id").Str, change.Str)
+		}
+	}
+	if !reflect.DeepEqual(timeline, original) {
+		t.Errorf("input timeline was modified")
+	}
+
+	// timelines without membership events are returned as-is
+	noMembers := []json.RawMessage{json.RawMessage(`{"type":"m.room.message","event_id":"$msg","content":{"body":"hello"}}`)}
+	if got := AnnotateMembershipChanges(noMembers); &got[0] != &noMembers[0] {
+		t.Errorf("timeline without membership events was copied")
+	}
+}
+
+func TestAnnotateSenderMemberships(t *testing.T) {
+	timeline := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.message","event_id":"$before","sender":"@alice:localhost","content":{"body":"hello"}}`),
+		json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","event_id":"$rename","sender":"@alice:localhost","content":{"membership":"join","displayname":"Alicia"}}`),
+		json.RawMessage(`{"type":"m.room.message","event_id":"$unknown","sender":"@alice:localhost","content":{"body":"world"}}`),
+	}
+	original := make([]json.RawMessage, len(timeline))
+	copy(original, timeline)
+	// alice renamed after sending $before, so it carries her old name
+	oldJoin := json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","content":{"membership":"join","displayname":"Alice","avatar_url":"mxc://alice"}}`)
+	got := AnnotateSenderMemberships(timeline, map[string]json.RawMessage{
+		"$before": oldJoin,
+		"$rename": oldJoin,
+	})
+	for _, i := range []int{0, 1} {
+		senderMembership := gjson.GetBytes(got[i], "unsigned.sender_membership")
+		if senderMembership.Get("membership").Str != "join" || senderMembership.Get("displayname").Str != "Alice" ||
+			senderMembership.Get("avatar_url").Str != "mxc://alice" {
+			t.Errorf("event %d: got sender_membership %s", i, senderMembership.Raw)
+		}
+	}
+	if gjson.GetBytes(got[2], "unsigned.sender_membership").Exists() {
+		t.Errorf("event without a membership was annotated: %s", string(got[2]))
+	}
+	if !reflect.DeepEqual(timeline, original) {
+		t.Errorf("input timeline was modified")
+	}
+
+	// timelines without known memberships are returned as-is
+	if got := AnnotateSenderMemberships(timeline, nil); &got[0] != &timeline[0] {
+		t.Errorf("timeline without memberships was copied")
+	}
+}
+
+func TestAnnotateDayBoundaries(t *testing.T) {
+	// 2023-03-01 21:00 UTC, which is 23:00 in UTC+2
+	base := time.Date(2023, 3, 1, 21, 0, 0, 0, time.UTC)
+	ts := func(d time.Duration) int64 {
+		return base.Add(d).UnixMilli()
+	}
+	timeline := []json.RawMessage{
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","event_id":"$2330","origin_server_ts":%d}`, ts(30*time.Minute))),
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","event_id":"$0030","origin_server_ts":%d}`, ts(90*time.Minute))),
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","event_id":"$0130","origin_server_ts":%d}`, ts(150*time.Minute))),
+		// midnight UTC, but not midnight in UTC+2
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","event_id":"$0230","origin_server_ts":%d}`, ts(210*time.Minute))),
+	}
+	original := make([]json.RawMessage, len(timeline))
+	copy(original, timeline)
+
+	testCases := []struct {
+		name      string
+		prevTS    int64
+		utcOffset time.Duration
+		want      []string
+	}{
+		{
+			name:      "UTC+2 with a known previous event",
+			prevTS:    ts(0),
+			utcOffset: 2 * time.Hour,
+			want:      []string{"$0030"},
+		},
+		{
+			name:      "UTC with a known previous event",
+			prevTS:    ts(0),
+			utcOffset: 0,
+			want:      []string{"$0230"},
+		},
+		{
+			name:      "UTC+2 with a previous event on the day before",
+			prevTS:    ts(-24 * time.Hour),
+			utcOffset: 2 * time.Hour,
+			want:      []string{"$2330", "$0030"},
+		},
+		{
+			name:      "UTC+2 with an unknown previous event",
+			prevTS:    0,
+			utcOffset: 2 * time.Hour,
+			want:      []string{"$0030"},
+		},
+		{
+			name:      "UTC-5 is never across a day boundary",
+			prevTS:    ts(0),
+			utcOffset: -5 * time.Hour,
+			want:      nil,
+		},
+	}
+	for _, tc := range testCases {
+		got, lastTS := AnnotateDayBoundaries(timeline, tc.prevTS, tc.utcOffset)
+		var gotFlagged []string
+		for _, ev := range got {
+			if gjson.GetBytes(ev, "unsigned.day_boundary").Bool() {
+				gotFlagged = append(gotFlagged, gjson.GetBytes(ev, "event_id").Str)
+			}
+		}
+		if !reflect.DeepEqual(gotFlagged, tc.want) {
+			t.Errorf("%s: got day boundaries %v want %v", tc.name, gotFlagged, tc.want)
+		}
+		if lastTS != ts(210*time.Minute) {
+			t.Errorf("%s: got last timestamp %d want %d", tc.name, lastTS, ts(210*time.Minute))
+		}
+		if !reflect.DeepEqual(timeline, original) {
+			t.Fatalf("%s: input timeline was modified", tc.name)
+		}
+	}
+}
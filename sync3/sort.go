@@ -18,6 +18,7 @@ type SortableRooms struct {
 	listKey       string
 	roomIDs       []string
 	roomIDToIndex map[string]int // room_id -> index in rooms
+	pinned        map[string]int // room_id -> position in the pinned rooms
 }
 
 func NewSortableRooms(finder RoomFinder, listKey string, rooms []string) *SortableRooms {
@@ -86,10 +87,29 @@ func (s *SortableRooms) Subslice(i, j int64) Subslicer {
 	}
 }
 
+// SetPinnedRooms sets the rooms which are always sorted first, in the order given. Rooms which are
+// not in this list are ignored. This does not resort the list.
+func (s *SortableRooms) SetPinnedRooms(roomIDs []string) {
+	s.pinned = make(map[string]int, len(roomIDs))
+	for i, roomID := range roomIDs {
+		if _, exists := s.pinned[roomID]; !exists {
+			s.pinned[roomID] = i
+		}
+	}
+}
+
+// Sort the rooms by each of the sortBy orders in priority order: earlier orders dominate and later
+// orders break ties, e.g rooms with the same timestamp are ordered by name with [by_recency, by_name].
+// Rooms which are equal under every order are sorted by room ID, so the order only depends on the
+// rooms and not on the order they were added. This means a new connection sees the same order as an
+// existing one, and resorting an unchanged list never moves rooms.
 func (s *SortableRooms) Sort(sortBy []string) error {
 	// TODO: find a way to plumb a context into this assert
 	internal.Assert("sortBy is not empty", len(sortBy) != 0)
 	comparators := []func(i, j int) int{}
+	if len(s.pinned) > 0 {
+		comparators = append(comparators, s.comparatorPinned)
+	}
 	for _, sort := range sortBy {
 		switch sort {
 		case SortByHighlightCount:
@@ -116,8 +136,8 @@ func (s *SortableRooms) Sort(sortBy []string) error {
 			}
 			// continue to next comparator as these are equal
 		}
-		// the two items are identical
-		return false
+		// the two items are identical, so tiebreak on room ID to be deterministic
+		return s.roomIDs[i] < s.roomIDs[j]
 	})
 	for i := range s.roomIDs {
 		s.roomIDToIndex[s.roomIDs[i]] = i
@@ -134,6 +154,23 @@ func (s *SortableRooms) resolveRooms(i, j int) (ri, rj *RoomConnMetadata) {
 	return
 }
 
+func (s *SortableRooms) comparatorPinned(i, j int) int {
+	pi, pinnedI := s.pinned[s.roomIDs[i]]
+	pj, pinnedJ := s.pinned[s.roomIDs[j]]
+	if pinnedI && pinnedJ {
+		if pi < pj {
+			return 1
+		}
+		return -1
+	}
+	if pinnedI {
+		return 1
+	} else if pinnedJ {
+		return -1
+	}
+	return 0
+}
+
 func (s *SortableRooms) comparatorSortByName(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
 	if ri.CanonicalisedName == rj.CanonicalisedName {
@@ -171,18 +208,27 @@ func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 
 func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
+	// muted and snoozed rooms never float up, so treat them as having no highlights or notifications
+	hci, nci := ri.HighlightCount, ri.NotificationCount
+	if ri.IsMuted || ri.IsSnoozed() {
+		hci, nci = 0, 0
+	}
+	hcj, ncj := rj.HighlightCount, rj.NotificationCount
+	if rj.IsMuted || rj.IsSnoozed() {
+		hcj, ncj = 0, 0
+	}
 	// highlight rooms come first
-	if ri.HighlightCount > 0 && rj.HighlightCount > 0 {
+	if hci > 0 && hcj > 0 {
 		return 0
 	}
-	if ri.HighlightCount > 0 {
+	if hci > 0 {
 		return 1
-	} else if rj.HighlightCount > 0 {
+	} else if hcj > 0 {
 		return -1
 	}
 
 	// then notification count
-	if ri.NotificationCount > 0 && rj.NotificationCount > 0 {
+	if nci > 0 && ncj > 0 {
 		// when we are comparing rooms with notif counts, sort encrypted rooms above unencrypted rooms
 		// as the client needs to calculate highlight counts (so it's possible that notif counts are
 		// actually highlight counts!) - this is the "Lite" description in MSC3575
@@ -193,9 +239,9 @@ func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
 		}
 		return 0
 	}
-	if ri.NotificationCount > 0 {
+	if nci > 0 {
 		return 1
-	} else if rj.NotificationCount > 0 {
+	} else if ncj > 0 {
 		return -1
 	}
 	// no highlight or notifs get grouped together
@@ -227,7 +273,7 @@ func NewFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []strin
 	}
 	for _, roomID := range roomIDs {
 		r := finder.ReadOnlyRoom(roomID)
-		if filter.Include(r, finder) {
+		if filter.Include(r, finder, listKey) {
 			filteredRooms = append(filteredRooms, roomID)
 		}
 	}
@@ -239,7 +285,7 @@ func NewFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []strin
 
 func (f *FilteredSortableRooms) Add(roomID string) bool {
 	r := f.finder.ReadOnlyRoom(roomID)
-	if !f.filter.Include(r, f.finder) {
+	if !f.filter.Include(r, f.finder, f.listKey) {
 		return false
 	}
 	return f.SortableRooms.Add(roomID)
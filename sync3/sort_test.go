@@ -1,9 +1,11 @@
 package sync3
 
 import (
+	"context"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
@@ -200,6 +202,96 @@ func TestSortByMultipleOperations(t *testing.T) {
 	}
 }
 
+// Test that later sort orders break ties, and that rooms which tie on every order don't move.
+func TestSortTiebreaks(t *testing.T) {
+	const listKey = "my_list"
+	roomZeta := "!zeta:localhost"
+	roomAlpha := "!alpha:localhost"
+	roomNewest := "!newest:localhost"
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomZeta,
+			},
+			UserRoomData: caches.UserRoomData{
+				CanonicalisedName: "zeta",
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 500},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomAlpha,
+			},
+			UserRoomData: caches.UserRoomData{
+				CanonicalisedName: "alpha",
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 500},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomNewest,
+			},
+			UserRoomData: caches.UserRoomData{
+				CanonicalisedName: "newest",
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 900},
+		},
+	}
+	f := newFinder(rooms)
+	testCases := []struct {
+		initialRoomIDs []string
+		sortBy         []string
+		wantRoomIDs    []string
+	}{
+		// the same timestamp falls back to the name, regardless of the starting order
+		{
+			initialRoomIDs: []string{roomZeta, roomAlpha, roomNewest},
+			sortBy:         []string{SortByRecency, SortByName},
+			wantRoomIDs:    []string{roomNewest, roomAlpha, roomZeta},
+		},
+		{
+			initialRoomIDs: []string{roomAlpha, roomNewest, roomZeta},
+			sortBy:         []string{SortByRecency, SortByName},
+			wantRoomIDs:    []string{roomNewest, roomAlpha, roomZeta},
+		},
+		// the name only breaks ties, it doesn't override the timestamp
+		{
+			initialRoomIDs: []string{roomAlpha, roomNewest, roomZeta},
+			sortBy:         []string{SortByName, SortByRecency},
+			wantRoomIDs:    []string{roomAlpha, roomNewest, roomZeta},
+		},
+		// without a tiebreak, rooms with the same timestamp are sorted by room ID, regardless of the
+		// starting order, so new connections see the same order as existing ones
+		{
+			initialRoomIDs: []string{roomZeta, roomAlpha, roomNewest},
+			sortBy:         []string{SortByRecency},
+			wantRoomIDs:    []string{roomNewest, roomAlpha, roomZeta},
+		},
+		{
+			initialRoomIDs: []string{roomAlpha, roomZeta, roomNewest},
+			sortBy:         []string{SortByRecency},
+			wantRoomIDs:    []string{roomNewest, roomAlpha, roomZeta},
+		},
+		{
+			initialRoomIDs: []string{roomZeta, roomNewest, roomAlpha},
+			sortBy:         []string{SortByNotificationLevel, SortByRecency},
+			wantRoomIDs:    []string{roomNewest, roomAlpha, roomZeta},
+		},
+	}
+	for _, tc := range testCases {
+		sr := NewSortableRooms(f, listKey, tc.initialRoomIDs)
+		// sorting again must not move anything, else the ops would flap between requests
+		for i := 0; i < 2; i++ {
+			if err := sr.Sort(tc.sortBy); err != nil {
+				t.Fatalf("Sort: %s", err)
+			}
+			if !reflect.DeepEqual(sr.RoomIDs(), tc.wantRoomIDs) {
+				t.Errorf("Sort %v from %v (pass %d): got %v want %v", tc.sortBy, tc.initialRoomIDs, i, sr.RoomIDs(), tc.wantRoomIDs)
+			}
+		}
+	}
+}
+
 // Test that if you remove a room, it updates the lookup map.
 func TestSortableRoomsRemove(t *testing.T) {
 	const listKey = "my_list"
@@ -387,3 +479,276 @@ func TestSortByNotificationLevel(t *testing.T) {
 		t.Errorf("want: %v", wantRoomIDs)
 	}
 }
+
+func TestMutedRooms(t *testing.T) {
+	const listKey = "my_list"
+	roomMutedHC := "!muted-highlight-count:localhost"
+	roomNC := "!notif-count:localhost"
+	roomMuted := "!muted:localhost"
+	roomPlain := "!plain:localhost"
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomMutedHC,
+			},
+			UserRoomData: caches.UserRoomData{
+				IsMuted:           true,
+				HighlightCount:    1,
+				NotificationCount: 1,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 4},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomNC,
+			},
+			UserRoomData: caches.UserRoomData{
+				NotificationCount: 1,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 1},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomMuted,
+			},
+			UserRoomData: caches.UserRoomData{
+				IsMuted: true,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 3},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomPlain,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 2},
+		},
+	}
+	f := newFinder(rooms)
+
+	// muted rooms never float up, even with highlights
+	sr := NewSortableRooms(f, listKey, []string{roomMutedHC, roomNC, roomMuted, roomPlain})
+	if err := sr.Sort([]string{SortByNotificationLevel, SortByRecency}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	wantRoomIDs := []string{roomNC, roomMutedHC, roomMuted, roomPlain}
+	if !reflect.DeepEqual(sr.RoomIDs(), wantRoomIDs) {
+		t.Errorf("got:  %v", sr.RoomIDs())
+		t.Errorf("want: %v", wantRoomIDs)
+	}
+
+	// muted rooms can be filtered in or out
+	isMuted := true
+	notMuted := false
+	testCases := []struct {
+		filter      *RequestFilters
+		wantRoomIDs []string
+	}{
+		{
+			filter:      &RequestFilters{IsMuted: &notMuted},
+			wantRoomIDs: []string{roomNC, roomPlain},
+		},
+		{
+			filter:      &RequestFilters{IsMuted: &isMuted},
+			wantRoomIDs: []string{roomMutedHC, roomMuted},
+		},
+		{
+			filter:      &RequestFilters{},
+			wantRoomIDs: []string{roomMutedHC, roomNC, roomMuted, roomPlain},
+		},
+	}
+	for _, tc := range testCases {
+		fsr := NewFilteredSortableRooms(f, listKey, []string{roomMutedHC, roomNC, roomMuted, roomPlain}, tc.filter)
+		if !reflect.DeepEqual(fsr.RoomIDs(), tc.wantRoomIDs) {
+			t.Errorf("filter %+v got %v want %v", *tc.filter, fsr.RoomIDs(), tc.wantRoomIDs)
+		}
+	}
+}
+
+func TestSnoozedRooms(t *testing.T) {
+	const listKey = "my_list"
+	roomSnoozed := "!snoozed:localhost"
+	roomPlain := "!plain:localhost"
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	lists := NewInternalRequestLists()
+	lists.SetSnoozedRooms(map[string]int64{
+		roomSnoozed: now.Add(time.Hour).UnixMilli(),
+	})
+	lists.SetRoom(RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID: roomSnoozed,
+		},
+		LastInterestedEventTimestamps: map[string]uint64{listKey: 1},
+	})
+	lists.SetRoom(RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID: roomPlain,
+		},
+		LastInterestedEventTimestamps: map[string]uint64{listKey: 2},
+	})
+	// the snoozed room gets a notification, which must not clear the snooze
+	lists.SetRoom(RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID: roomSnoozed,
+		},
+		UserRoomData: caches.UserRoomData{
+			HighlightCount:    1,
+			NotificationCount: 1,
+		},
+	})
+	sortBy := []string{SortByNotificationLevel, SortByRecency}
+	assertOrder := func(wantRoomIDs []string) {
+		t.Helper()
+		sr := NewSortableRooms(lists, listKey, []string{roomSnoozed, roomPlain})
+		if err := sr.Sort(sortBy); err != nil {
+			t.Fatalf("Sort: %s", err)
+		}
+		if !reflect.DeepEqual(sr.RoomIDs(), wantRoomIDs) {
+			t.Errorf("got:  %v", sr.RoomIDs())
+			t.Errorf("want: %v", wantRoomIDs)
+		}
+	}
+
+	// the snoozed room doesn't float up
+	assertOrder([]string{roomPlain, roomSnoozed})
+
+	// until the snooze expires
+	now = now.Add(time.Hour)
+	assertOrder([]string{roomSnoozed, roomPlain})
+
+	// snoozing again and then unsnoozing makes it float up immediately
+	lists.SetSnoozedRooms(map[string]int64{
+		roomSnoozed: now.Add(time.Hour).UnixMilli(),
+	})
+	assertOrder([]string{roomPlain, roomSnoozed})
+	lists.SetSnoozedRooms(nil)
+	assertOrder([]string{roomSnoozed, roomPlain})
+}
+
+func TestActivityFilters(t *testing.T) {
+	const listKey = "my_list"
+	roomOld := "!old:localhost"
+	roomRecent := "!recent:localhost"
+	roomNew := "!new:localhost"
+	roomQuiet := "!quiet:localhost"
+	lists := NewInternalRequestLists()
+	for roomID, ts := range map[string]uint64{
+		roomOld:    100,
+		roomRecent: 200,
+		roomNew:    300,
+		roomQuiet:  0, // no activity at all
+	} {
+		lists.SetRoom(RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomID,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: ts},
+		})
+	}
+	allRoomIDs := []string{roomOld, roomRecent, roomNew, roomQuiet}
+
+	since := int64(150)
+	before := int64(300)
+	testCases := []struct {
+		filter      *RequestFilters
+		wantRoomIDs []string
+	}{
+		{
+			filter:      &RequestFilters{ActiveSince: &since},
+			wantRoomIDs: []string{roomRecent, roomNew},
+		},
+		{
+			filter:      &RequestFilters{ActiveBefore: &before},
+			wantRoomIDs: []string{roomOld, roomRecent, roomQuiet},
+		},
+		{
+			filter:      &RequestFilters{ActiveSince: &since, ActiveBefore: &before},
+			wantRoomIDs: []string{roomRecent},
+		},
+	}
+	for _, tc := range testCases {
+		fsr := NewFilteredSortableRooms(lists, listKey, allRoomIDs, tc.filter)
+		if !reflect.DeepEqual(fsr.RoomIDs(), tc.wantRoomIDs) {
+			t.Errorf("filter %+v got %v want %v", *tc.filter, fsr.RoomIDs(), tc.wantRoomIDs)
+		}
+	}
+
+	// rooms move in and out of the window as new events arrive
+	lists.AssignList(context.Background(), listKey, &RequestFilters{ActiveSince: &since, ActiveBefore: &before}, []string{SortByRecency}, nil, Overwrite)
+	assertDelta := func(roomID string, ts uint64, wantOp ListOp) {
+		t.Helper()
+		delta := lists.SetRoom(RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomID,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: ts},
+		})
+		if len(delta.Lists) != 1 || delta.Lists[0].Op != wantOp {
+			t.Errorf("%s at %d: got list deltas %+v want op %v", roomID, ts, delta.Lists, wantOp)
+		}
+	}
+	assertDelta(roomQuiet, 250, ListOpAdd)
+	assertDelta(roomRecent, 350, ListOpDel)
+	assertDelta(roomNew, 299, ListOpAdd)
+}
+
+func TestRoomNameFilter(t *testing.T) {
+	const listKey = "my_list"
+	roomNamed := "!named:localhost"
+	roomDM := "!dm:localhost"
+	roomAlias := "!alias:localhost"
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:    roomNamed,
+				NameEvent: "Bobsleigh Team",
+			},
+		},
+		{
+			// DMs usually have no name, so are named after the other members
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:    roomDM,
+				JoinCount: 2,
+				Heroes: []internal.Hero{
+					{ID: "@bob:localhost", Name: "Bob"},
+				},
+			},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:         roomAlias,
+				CanonicalAlias: "#alice:localhost",
+			},
+		},
+	}
+	f := newFinder(rooms)
+	testCases := []struct {
+		filter      string
+		wantRoomIDs []string
+	}{
+		{
+			filter:      "BOB",
+			wantRoomIDs: []string{roomNamed, roomDM},
+		},
+		{
+			filter:      "team",
+			wantRoomIDs: []string{roomNamed},
+		},
+		{
+			filter:      "alice",
+			wantRoomIDs: []string{roomAlias},
+		},
+		{
+			filter:      "charlie",
+			wantRoomIDs: []string{},
+		},
+	}
+	for _, tc := range testCases {
+		fsr := NewFilteredSortableRooms(f, listKey, []string{roomNamed, roomDM, roomAlias}, &RequestFilters{RoomNameFilter: tc.filter})
+		if !reflect.DeepEqual(fsr.RoomIDs(), tc.wantRoomIDs) {
+			t.Errorf("room_name_like %q got %v want %v", tc.filter, fsr.RoomIDs(), tc.wantRoomIDs)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package sync3
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ContentPatchOp is a JSON patch (RFC 6902) operation on the content of a state event.
+type ContentPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// DiffContent returns the JSON patch operations which turn prev into next. Objects are diffed key by
+// key, whereas any other changed value, including arrays, is replaced in its entirety.
+func DiffContent(prev, next gjson.Result) []ContentPatchOp {
+	return diffContent("", prev, next, nil)
+}
+
+func diffContent(path string, prev, next gjson.Result, ops []ContentPatchOp) []ContentPatchOp {
+	if !prev.IsObject() || !next.IsObject() {
+		if prev.Raw != next.Raw {
+			ops = append(ops, ContentPatchOp{Op: "replace", Path: path, Value: json.RawMessage(next.Raw)})
+		}
+		return ops
+	}
+	prevFields := prev.Map()
+	nextFields := next.Map()
+	// walk the raw JSON rather than the maps, so the ops are in a deterministic order
+	prev.ForEach(func(key, _ gjson.Result) bool {
+		if _, exists := nextFields[key.Str]; !exists {
+			ops = append(ops, ContentPatchOp{Op: "remove", Path: path + "/" + escapePointer(key.Str)})
+		}
+		return true
+	})
+	next.ForEach(func(key, nextValue gjson.Result) bool {
+		keyPath := path + "/" + escapePointer(key.Str)
+		prevValue, exists := prevFields[key.Str]
+		if !exists {
+			ops = append(ops, ContentPatchOp{Op: "add", Path: keyPath, Value: json.RawMessage(nextValue.Raw)})
+		} else if prevValue.IsObject() && nextValue.IsObject() {
+			ops = diffContent(keyPath, prevValue, nextValue, ops)
+		} else if prevValue.Raw != nextValue.Raw {
+			ops = append(ops, ContentPatchOp{Op: "replace", Path: keyPath, Value: json.RawMessage(nextValue.Raw)})
+		}
+		return true
+	})
+	return ops
+}
+
+// escapePointer escapes an object key for use in a JSON pointer (RFC 6901).
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// CompactStateEvent replaces the content of the state event ev with unsigned.content_diff, the JSON
+// patch from the content of prevEvent, which the client already has. unsigned.content_diff_base is
+// set to the event ID of prevEvent. unsigned.prev_content is removed as the client can work it out
+// from prevEvent. Returns ev unaltered if the compact event would not be smaller.
+func CompactStateEvent(ev, prevEvent json.RawMessage) json.RawMessage {
+	prev := gjson.ParseBytes(prevEvent)
+	patch, err := json.Marshal(DiffContent(prev.Get("content"), gjson.GetBytes(ev, "content")))
+	if err != nil {
+		return ev
+	}
+	// sjson can modify the input in place, so work on a copy
+	compact := append(json.RawMessage{}, ev...)
+	if compact, err = sjson.DeleteBytes(compact, "content"); err != nil {
+		return ev
+	}
+	if compact, err = sjson.DeleteBytes(compact, "unsigned.prev_content"); err != nil {
+		return ev
+	}
+	if compact, err = sjson.SetRawBytes(compact, "unsigned.content_diff", patch); err != nil {
+		return ev
+	}
+	if compact, err = sjson.SetBytes(compact, "unsigned.content_diff_base", prev.Get("event_id").Str); err != nil {
+		return ev
+	}
+	if len(compact) >= len(ev) {
+		return ev
+	}
+	return compact
+}
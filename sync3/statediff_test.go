@@ -0,0 +1,64 @@
+package sync3
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDiffContent(t *testing.T) {
+	testCases := []struct {
+		name string
+		prev string
+		next string
+		want []ContentPatchOp
+	}{
+		{
+			name: "no changes",
+			prev: `{"a":1,"b":{"c":2}}`,
+			next: `{"a":1,"b":{"c":2}}`,
+			want: nil,
+		},
+		{
+			name: "nested objects are diffed by key",
+			prev: `{"users":{"@alice:localhost":100,"@bob:localhost":0},"ban":50}`,
+			next: `{"users":{"@alice:localhost":100,"@bob:localhost":50},"ban":50}`,
+			want: []ContentPatchOp{
+				{Op: "replace", Path: "/users/@bob:localhost", Value: json.RawMessage(`50`)},
+			},
+		},
+		{
+			name: "added and removed keys",
+			prev: `{"a":1,"b":2}`,
+			next: `{"b":2,"c":{"d":true}}`,
+			want: []ContentPatchOp{
+				{Op: "remove", Path: "/a"},
+				{Op: "add", Path: "/c", Value: json.RawMessage(`{"d":true}`)},
+			},
+		},
+		{
+			name: "arrays are replaced",
+			prev: `{"via":["a.com","b.com"]}`,
+			next: `{"via":["a.com"]}`,
+			want: []ContentPatchOp{
+				{Op: "replace", Path: "/via", Value: json.RawMessage(`["a.com"]`)},
+			},
+		},
+		{
+			name: "keys are escaped",
+			prev: `{"events":{"m.room/name":50,"a~b":0}}`,
+			next: `{"events":{"m.room/name":100,"a~b":0}}`,
+			want: []ContentPatchOp{
+				{Op: "replace", Path: "/events/m.room~1name", Value: json.RawMessage(`100`)},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		got := DiffContent(gjson.Parse(tc.prev), gjson.Parse(tc.next))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
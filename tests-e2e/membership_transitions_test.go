@@ -63,7 +63,8 @@ func TestRoomStateTransitions(t *testing.T) {
 		inviteRoomID: {
 			m.MatchRoomHighlightCount(1),
 			m.MatchRoomInitial(true),
-			m.MatchRoomRequiredState(nil),
+			// required_state is satisfied from the stripped invite state
+			MatchRoomRequiredStateStrict([]Event{{Type: "m.room.create", StateKey: ptr("")}}),
 			m.MatchInviteCount(1),
 			m.MatchJoinCount(1),
 			MatchRoomInviteState([]Event{
@@ -4,11 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"sync"
 	"testing"
 	"time"
 
 	slidingsync "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/testutils"
@@ -561,6 +563,230 @@ func TestSessionExpiry(t *testing.T) {
 	if gjson.ParseBytes(body).Get("errcode").Str != "M_UNKNOWN_POS" {
 		t.Errorf("got %v want errcode=M_UNKNOWN_POS", string(body))
 	}
+	if gjson.ParseBytes(body).Get("reset_reason").Str != internal.ResetReasonStalePos {
+		t.Errorf("got %v want reset_reason=%s", string(body), internal.ResetReasonStalePos)
+	}
+}
+
+// Test that positions the server never sent are rejected with M_UNKNOWN_POS, so clients start again
+// rather than retrying forever.
+func TestSessionExpiryGarbagePos(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v2.addAccount(t, alice, aliceToken)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	req := sync3.Request{}
+	req.SetTimeoutMSecs(1)
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	for _, pos := range []string{"garbage", "-1", res.Pos + "00"} {
+		_, body, code := v3.doV3Request(t, context.Background(), aliceToken, pos, req)
+		if code != 400 {
+			t.Errorf("pos=%s: got HTTP %d want 400", pos, code)
+		}
+		if gjson.ParseBytes(body).Get("errcode").Str != "M_UNKNOWN_POS" {
+			t.Errorf("pos=%s: got %v want errcode=M_UNKNOWN_POS", pos, string(body))
+		}
+		if gjson.ParseBytes(body).Get("reset_reason").Str != internal.ResetReasonUnknownPos {
+			t.Errorf("pos=%s: got %v want reset_reason=%s", pos, string(body), internal.ResetReasonUnknownPos)
+		}
+	}
+}
+
+// Test that clients are told the connection was lost when the server restarts.
+func TestSessionExpiryOnRestart(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v2.addAccount(t, alice, aliceToken)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	v3.restart(t, v2, pqString)
+	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, res.Pos, sync3.Request{})
+	if code != 400 {
+		t.Errorf("got HTTP %d want 400", code)
+	}
+	if gjson.ParseBytes(body).Get("errcode").Str != "M_UNKNOWN_POS" {
+		t.Errorf("got %v want errcode=M_UNKNOWN_POS", string(body))
+	}
+	if gjson.ParseBytes(body).Get("reset_reason").Str != internal.ResetReasonServerRestart {
+		t.Errorf("got %v want reset_reason=%s", string(body), internal.ResetReasonServerRestart)
+	}
+}
+
+// Test that connections can be resumed after the server restarts when connections are persisted,
+// using the request parameters sent before the restart. Resumed connections are not re-initialised:
+// only the list ranges and rooms which changed whilst the server was down are sent again.
+func TestSessionResumedOnRestart(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v2.addAccount(t, alice, aliceToken)
+	opts := slidingsync.Opts{PersistConnections: true}
+	v3 := runTestServer(t, v2, pqString, opts)
+	defer v2.close()
+	defer v3.close()
+	roomA := "!resume-a:localhost"
+	roomB := "!resume-b:localhost"
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomA,
+				events: createRoomState(t, alice, time.Now()),
+			}, roomEvents{
+				roomID: roomB,
+				events: createRoomState(t, alice, time.Now().Add(-time.Hour)),
+			}),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(m.MatchV3SyncOp(0, 1, []string{roomA, roomB}))))
+
+	v3.restart(t, v2, pqString, opts)
+
+	// nothing changed whilst the server was down, so the client is sent nothing again, despite the
+	// list not being sent again
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2)), m.MatchNoV3Ops(), m.MatchRoomSubscriptionsStrict(nil))
+
+	v3.restart(t, v2, pqString, opts)
+
+	// a new event in room B whilst the client isn't syncing moves it to the top of the list
+	newEvent := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hi"}, testutils.WithTimestamp(time.Now().Add(time.Minute)))
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomB,
+				events: []json.RawMessage{newEvent},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	// only the changed range and room B are sent again
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res,
+		m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(m.MatchV3SyncOp(0, 1, []string{roomB, roomA}))),
+		m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+			roomB: {m.MatchRoomTimelineMostRecent(1, []json.RawMessage{newEvent})},
+		}),
+	)
+
+	// the connection continues as normal afterwards
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchNoV3Ops())
+
+	// older positions cannot be resumed
+	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, "1", sync3.Request{})
+	if code != 400 {
+		t.Errorf("got HTTP %d want 400", code)
+	}
+	if gjson.ParseBytes(body).Get("errcode").Str != "M_UNKNOWN_POS" {
+		t.Errorf("got %v want errcode=M_UNKNOWN_POS", string(body))
+	}
+}
+
+// Test that retrying a request with the same pos and body returns the same response, rather than
+// computing a fresh delta and losing the ops the client never received.
+func TestRetransmitReturnsSameResponse(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v2.addAccount(t, alice, aliceToken)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: "!a:localhost",
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)))
+
+	// a new room arrives, which the client is told about but never receives
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: "!b:localhost",
+				events: createRoomState(t, alice, time.Now().Add(time.Minute)),
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res1 := v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res1, m.MatchList("a", m.MatchV3Count(2)))
+
+	// the client retries, and must see the same ops again
+	res2 := v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	if res1.Pos != res2.Pos {
+		t.Errorf("retransmit: got pos %s want %s", res2.Pos, res1.Pos)
+	}
+	ops1, _ := json.Marshal(res1.Lists["a"].Ops)
+	ops2, _ := json.Marshal(res2.Lists["a"].Ops)
+	if string(ops1) != string(ops2) {
+		t.Errorf("retransmit: got ops %s want %s", string(ops2), string(ops1))
+	}
+	rooms1, _ := json.Marshal(res1.Rooms)
+	rooms2, _ := json.Marshal(res2.Rooms)
+	if string(rooms1) != string(rooms2) {
+		t.Errorf("retransmit: got rooms %s want %s", string(rooms2), string(rooms1))
+	}
+}
+
+// Test that maintenance mode rejects new connections with a retryable error, whilst letting existing
+// connections continue.
+func TestMaintenanceMode(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v2.addAccount(t, alice, aliceToken)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+
+	v3.handler.SetMaintenanceMode(true, 5*time.Second)
+	// new connections are rejected
+	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{})
+	if code != 503 {
+		t.Errorf("got HTTP %d want 503", code)
+	}
+	if gjson.ParseBytes(body).Get("errcode").Str != "M_MAINTENANCE" {
+		t.Errorf("got %v want errcode=M_MAINTENANCE", string(body))
+	}
+	if gjson.ParseBytes(body).Get("retry_after_ms").Int() != 5000 {
+		t.Errorf("got %v want retry_after_ms=5000", string(body))
+	}
+	// existing connections still complete
+	req := sync3.Request{}
+	req.SetTimeoutMSecs(1)
+	v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+
+	// new connections are accepted again once maintenance is over
+	v3.handler.SetMaintenanceMode(false, 0)
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
 }
 
 func TestSessionExpiryOnBufferFill(t *testing.T) {
@@ -622,6 +848,9 @@ func TestSessionExpiryOnBufferFill(t *testing.T) {
 	if gjson.ParseBytes(body).Get("errcode").Str != "M_UNKNOWN_POS" {
 		t.Errorf("got %v want errcode=M_UNKNOWN_POS", string(body))
 	}
+	if gjson.ParseBytes(body).Get("reset_reason").Str != internal.ResetReasonEvictedForMemory {
+		t.Errorf("got %v want reset_reason=%s", string(body), internal.ResetReasonEvictedForMemory)
+	}
 
 	// make sure we can sync from fresh (regression for when we deadlocked after this point)
 	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
@@ -703,3 +932,125 @@ func TestExpiredAccessTokenMultipleConns(t *testing.T) {
 		}
 	}
 }
+
+// Test that clients can obtain the v2 since token for their device when the server allows it,
+// and that the token is the position the poller resumes from.
+func TestV2SinceTokenExposed(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
+		ExposeV2Since: true,
+	})
+	defer v2.close()
+	defer v3.close()
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		NextBatch: "alice_since_1",
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		IncludeV2Since: true,
+	})
+	if res.V2Since != "alice_since_1" {
+		t.Fatalf("got v2_since %q want %q", res.V2Since, "alice_since_1")
+	}
+
+	// the token is not returned unless asked for
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	if res.V2Since != "" {
+		t.Fatalf("got v2_since %q but did not request it", res.V2Since)
+	}
+
+	// the token is usable to resume the v2 stream: it is exactly what the poller sends next.
+	sinceCh := make(chan string, 1)
+	v2.SetCheckRequest(func(userID, token string, req *http.Request) {
+		select {
+		case sinceCh <- req.URL.Query().Get("since"):
+		default:
+		}
+	})
+	v3.restart(t, v2, pqString, slidingsync.Opts{
+		ExposeV2Since: true,
+	})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		NextBatch: "alice_since_2",
+	})
+	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		IncludeV2Since: true,
+	})
+	select {
+	case since := <-sinceCh:
+		if since != "alice_since_1" {
+			t.Errorf("poller resumed from %q want %q", since, "alice_since_1")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("poller did not make a request")
+	}
+	if res.V2Since != "alice_since_2" {
+		t.Fatalf("got v2_since %q want %q", res.V2Since, "alice_since_2")
+	}
+}
+
+// Test that the v2 since token is not exposed unless the server is configured to do so.
+func TestV2SinceTokenNotExposedByDefault(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		NextBatch: "alice_since_1",
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		IncludeV2Since: true,
+	})
+	if res.V2Since != "" {
+		t.Fatalf("got v2_since %q want none", res.V2Since)
+	}
+}
+
+// Test that sync responses warn that data may be stale whilst the device's poller, or the poller
+// fetching room data for the user, is lagging, and that the warning clears once it catches up.
+func TestStaleDataWarningWhenPollerLagging(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	if res.StaleData {
+		t.Fatalf("got stale_data before the poller lagged")
+	}
+
+	// the lag notification is delivered asynchronously, so keep syncing until we see it
+	waitForStaleData := func(want bool) {
+		t.Helper()
+		start := time.Now()
+		for res.StaleData != want {
+			if time.Since(start) > time.Second {
+				t.Fatalf("stale_data did not become %v", want)
+			}
+			res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+		}
+	}
+	v3.h2.OnPollerLagging(context.Background(), alice, v2.deviceID(aliceToken), true, false)
+	waitForStaleData(true)
+
+	// other devices are unaffected
+	v3.h2.OnPollerLagging(context.Background(), alice, "OTHER_DEVICE", false, false)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	if !res.StaleData {
+		t.Fatalf("stale_data cleared by another device's poller catching up")
+	}
+
+	v3.h2.OnPollerLagging(context.Background(), alice, v2.deviceID(aliceToken), false, false)
+	waitForStaleData(false)
+
+	// unless the other device's poller fetches room data for alice
+	v3.h2.OnPollerLagging(context.Background(), alice, "OTHER_DEVICE", true, true)
+	waitForStaleData(true)
+	v3.h2.OnPollerLagging(context.Background(), alice, "OTHER_DEVICE", false, true)
+	waitForStaleData(false)
+}
@@ -2,14 +2,17 @@ package syncv3
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
+	slidingsync "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/tidwall/gjson"
 )
 
 var valTrue = true
@@ -568,6 +571,93 @@ func TestExtensionAccountData(t *testing.T) {
 	))
 }
 
+// Test that m.fully_read markers are sent via the account data extension, and that updates are
+// delivered exactly once and only for rooms in view.
+func TestExtensionAccountDataFullyRead(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	roomAState := createRoomState(t, alice, time.Now())
+	roomBState := createRoomState(t, alice, time.Now().Add(-time.Minute))
+	fullyRead := func(eventJSON json.RawMessage) json.RawMessage {
+		return testutils.NewAccountData(t, "m.fully_read", map[string]interface{}{
+			"event_id": gjson.GetBytes(eventJSON, "event_id").Str,
+		})
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomA: {
+					Timeline: sync2.TimelineResponse{
+						Events: roomAState,
+					},
+					AccountData: sync2.EventsResponse{
+						Events: []json.RawMessage{fullyRead(roomAState[0])},
+					},
+				},
+				roomB: {
+					Timeline: sync2.TimelineResponse{
+						Events: roomBState,
+					},
+				},
+			},
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Extensions: extensions.Request{
+			AccountData: &extensions.AccountDataRequest{
+				Core: extensions.Core{Enabled: &boolTrue},
+			},
+		},
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{
+				[2]int64{0, 0}, // only room A is in view
+			},
+			Sort: []string{sync3.SortByRecency},
+		}},
+	})
+	m.MatchResponse(t, res, m.MatchAccountData(nil, map[string][]json.RawMessage{
+		roomA: {fullyRead(roomAState[0])},
+	}))
+
+	// move both markers along; only room A's should be sent
+	newMarkerA := fullyRead(roomAState[len(roomAState)-1])
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomA: {
+					AccountData: sync2.EventsResponse{
+						Events: []json.RawMessage{newMarkerA},
+					},
+				},
+				roomB: {
+					AccountData: sync2.EventsResponse{
+						Events: []json.RawMessage{fullyRead(roomBState[len(roomBState)-1])},
+					},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	req := sync3.Request{}
+	req.SetTimeoutMSecs(1)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchAccountData(nil, map[string][]json.RawMessage{
+		roomA: {newMarkerA},
+	}))
+
+	// the update is not sent again
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	if res.Extensions.AccountData != nil {
+		t.Errorf("got account data %+v, want none", res.Extensions.AccountData)
+	}
+}
+
 // Regression test to make sure the server doesn't panic when extensions get enabled at a later time.
 func TestExtensionLateEnable(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
@@ -772,3 +862,160 @@ func TestTypingMultiplePoller(t *testing.T) {
 		m.MatchResponse(t, res, m.MatchTyping(roomA, []string{bob}))
 	}
 }
+
+// Test that presence from the v2 presence block is sent to users who share a room with the user,
+// and that only changes to a user's presence are sent.
+func TestExtensionPresence(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	// setup code
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{EnablePresence: true})
+	defer v2.close()
+	defer v3.close()
+	charlie := "@TestExtensionPresence_charlie:localhost"
+	roomID := "!TestExtensionPresence:localhost"
+	presenceEvent := func(userID, presence string, lastActiveAgo int) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(
+			`{"type":"m.presence","sender":"%s","content":{"presence":"%s","last_active_ago":%d}}`,
+			userID, presence, lastActiveAgo,
+		))
+	}
+
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: append(createRoomState(t, alice, time.Now()), testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+					"membership": "join",
+				})),
+			}),
+		},
+		// charlie does not share a room with alice
+		Presence: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				presenceEvent(alice, "online", 0),
+				presenceEvent(bob, "online", 100),
+				presenceEvent(charlie, "online", 100),
+			},
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Extensions: extensions.Request{
+			Presence: &extensions.PresenceRequest{
+				Core: extensions.Core{Enabled: &boolTrue},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchPresence(map[string]string{
+		alice: "online",
+		bob:   "online",
+	}))
+
+	// changes to last_active_ago alone are not sent, but changes to presence are. Only the latest
+	// presence for each user is sent.
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Presence: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				presenceEvent(alice, "online", 5000),
+				presenceEvent(bob, "unavailable", 200),
+				presenceEvent(charlie, "offline", 200),
+			},
+		},
+	})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Presence: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				presenceEvent(bob, "offline", 300),
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchPresence(map[string]string{
+		bob: "offline",
+	}))
+
+	// no changes means no presence extension
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Presence: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				presenceEvent(bob, "offline", 9000),
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchNoPresenceExtension())
+}
+
+func TestExtensionSearch(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!TestExtensionSearch:localhost"
+	messages := []json.RawMessage{
+		testutils.NewMessageEvent(t, alice, "where is the cat"),
+		testutils.NewMessageEvent(t, alice, "lunch?"),
+		testutils.NewMessageEvent(t, alice, "the cats are outside"),
+		testutils.NewMessageEvent(t, alice, "thanks"),
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: append(createRoomState(t, alice, time.Now()), messages...),
+			}),
+		},
+	})
+	searchRes := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Extensions: extensions.Request{
+			Search: &extensions.SearchRequest{
+				Core:         extensions.Core{Enabled: &boolTrue},
+				RoomID:       roomID,
+				Query:        "cat",
+				ContextLimit: 1,
+			},
+		},
+	})
+	if searchRes.Extensions.Search == nil {
+		t.Fatalf("missing search response")
+	}
+	results := searchRes.Extensions.Search.Results
+	wantResults := []struct {
+		event  json.RawMessage
+		before json.RawMessage
+		after  json.RawMessage
+	}{
+		{event: messages[2], before: messages[1], after: messages[3]},
+		{event: messages[0], after: messages[1]},
+	}
+	if len(results) != len(wantResults) {
+		t.Fatalf("got %d search results, want %d", len(results), len(wantResults))
+	}
+	eventID := func(ev json.RawMessage) string {
+		return gjson.GetBytes(ev, "event_id").Str
+	}
+	for i, want := range wantResults {
+		got := results[i]
+		if eventID(got.Event) != eventID(want.event) {
+			t.Errorf("result %d: got event %s want %s", i, eventID(got.Event), eventID(want.event))
+		}
+		if len(got.EventsAfter) != 1 || eventID(got.EventsAfter[0]) != eventID(want.after) {
+			t.Errorf("result %d: got events_after %v want [%s]", i, got.EventsAfter, eventID(want.after))
+		}
+		// the first message is preceded by room state, which is still part of the timeline
+		if want.before != nil && (len(got.EventsBefore) != 1 || eventID(got.EventsBefore[0]) != eventID(want.before)) {
+			t.Errorf("result %d: got events_before %v want [%s]", i, got.EventsBefore, eventID(want.before))
+		}
+	}
+
+	// the search is not repeated on subsequent requests
+	res := v3.mustDoV3RequestWithPos(t, aliceToken, searchRes.Pos, sync3.Request{})
+	if res.Extensions.Search != nil {
+		t.Errorf("search was repeated: %+v", res.Extensions.Search)
+	}
+}
@@ -1,6 +1,7 @@
 package syncv3
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -138,3 +139,53 @@ func TestStuckInvites(t *testing.T) {
 	})
 	m.MatchResponse(t, res, m.MatchNoV3Ops(), m.MatchRoomSubscriptionsStrict(nil))
 }
+
+// Test that required_state for invites is satisfied from the stripped invite state, as that is all
+// the invitee can see.
+func TestInviteRequiredStateFromStrippedState(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	inviteRoomID := "!invite:localhost"
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": "Invited"})
+	avatarEvent := testutils.NewStateEvent(t, "m.room.avatar", "", bob, map[string]interface{}{"url": "mxc://localhost/avatar"})
+	inviteState := createRoomState(t, bob, time.Now())
+	inviteState = append(inviteState, nameEvent, avatarEvent, testutils.NewStateEvent(t, "m.room.member", alice, bob, map[string]interface{}{
+		"membership": "invite",
+	}))
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Invite: map[string]sync2.SyncV2InviteResponse{
+				inviteRoomID: {
+					InviteState: sync2.EventsResponse{
+						Events: inviteState,
+					},
+				},
+			},
+		},
+	})
+
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					RequiredState: [][2]string{
+						{"m.room.name", ""},
+						{"m.room.topic", ""}, // not in the stripped state
+					},
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		inviteRoomID: {
+			m.MatchRoomName("Invited"),
+			m.MatchRoomRequiredState([]json.RawMessage{nameEvent}),
+		},
+	}))
+}
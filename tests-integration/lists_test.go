@@ -361,3 +361,131 @@ func TestBumpEventTypesOnStartup(t *testing.T) {
 		))
 	}
 }
+
+// Test that lists are kept when a request omits "lists", that omitting a list from "lists" stops
+// tracking it, and that re-adding it is treated as a new list.
+func TestListDeleteAndReAdd(t *testing.T) {
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	roomID := "!TestListDeleteAndReAdd:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		roomID: {},
+	})
+	aliceToken := rig.Token(alice)
+	list := sync3.RequestList{
+		Ranges: sync3.SliceRanges{{0, 10}},
+	}
+	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": list,
+			"b": list,
+		},
+	})
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {m.MatchV3Count(1), m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{roomID}))},
+		"b": {m.MatchV3Count(1), m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{roomID}))},
+	}))
+
+	// omitting "lists" keeps both lists, so both see the new event
+	rig.FlushText(t, alice, roomID, "bump")
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {m.MatchV3Count(1)},
+		"b": {m.MatchV3Count(1)},
+	}))
+
+	// sending "lists" without "b" stops tracking it
+	rig.FlushText(t, alice, roomID, "bump again")
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": list,
+		},
+	})
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {m.MatchV3Count(1)},
+	}))
+
+	// re-adding "b" is treated as a new list, so it gets a fresh SYNC op
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": list,
+			"b": list,
+		},
+	})
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"a": {m.MatchV3Count(1), m.MatchV3Ops()},
+		"b": {m.MatchV3Count(1), m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{roomID}))},
+	}))
+}
+
+// Test that rooms which sort equally are returned in the same order on a new connection as on an
+// existing one, so the client's list does not jump around when it reconnects.
+func TestListOrderingSameAcrossConnections(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	// every room has the same timestamp and no unread counts
+	ts := time.Now()
+	roomIDs := []string{
+		"!TestListOrderingSameAcrossConnections_d:localhost",
+		"!TestListOrderingSameAcrossConnections_b:localhost",
+		"!TestListOrderingSameAcrossConnections_a:localhost",
+		"!TestListOrderingSameAcrossConnections_c:localhost",
+	}
+	var rooms []roomEvents
+	for _, roomID := range roomIDs {
+		rooms = append(rooms, roomEvents{
+			roomID: roomID,
+			events: createRoomState(t, alice, ts),
+		})
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(rooms...),
+		},
+	})
+	newReq := func(connID string) sync3.Request {
+		return sync3.Request{
+			ConnID: connID,
+			Lists: map[string]sync3.RequestList{
+				"a": {
+					Ranges: sync3.SliceRanges{{0, 10}},
+					Sort:   []string{sync3.SortByNotificationLevel, sync3.SortByRecency},
+				},
+			},
+		}
+	}
+	res := v3.mustDoV3Request(t, aliceToken, newReq("A"))
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(roomIDs)), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 3, []string{roomIDs[2], roomIDs[1], roomIDs[3], roomIDs[0]}),
+	)))
+
+	// advance the connection by bumping a room to the top
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomIDs[3],
+				events: []json.RawMessage{testutils.NewMessageEvent(t, alice, "bump", testutils.WithTimestamp(ts.Add(time.Minute)))},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, newReq("A"))
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(roomIDs)), m.MatchV3Ops(
+		m.MatchV3DeleteOp(2), m.MatchV3InsertOp(0, roomIDs[3]),
+	)))
+	wantOrder := []string{roomIDs[3], roomIDs[2], roomIDs[1], roomIDs[0]}
+
+	// a new connection sees the same order as the existing connection
+	res = v3.mustDoV3Request(t, aliceToken, newReq("B"))
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(roomIDs)), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 3, wantOrder),
+	)))
+	res = v3.mustDoV3Request(t, aliceToken, newReq("A"))
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(roomIDs)), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 3, wantOrder),
+	)))
+}
@@ -162,3 +162,93 @@ func TestNotificationsOnTop(t *testing.T) {
 		}),
 	)))
 }
+
+// Test that rooms include the unread counts from the v2 unread_notifications, even when lists are
+// not sorted by them, and that changes to the counts are sent live.
+func TestNotificationCountsWithoutNotificationSort(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	bob := "@TestNotificationCountsWithoutNotificationSort_bob:localhost"
+	room := roomEvents{
+		roomID: "!TestNotificationCountsWithoutNotificationSort:localhost",
+		events: append(createRoomState(t, alice, time.Now()), []json.RawMessage{
+			testutils.NewJoinEvent(t, bob),
+		}...),
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(room),
+		},
+	})
+	syncRequestBody := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+				Sort: []string{sync3.SortByRecency},
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, syncRequestBody)
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		room.roomID: {
+			m.MatchRoomHighlightCount(0),
+			m.MatchRoomNotificationCount(0),
+		},
+	}))
+
+	// a highlight arrives with its counts
+	bingEvent := testutils.NewMessageEvent(t, bob, "alice!")
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				room.roomID: {
+					UnreadNotifications: sync2.UnreadNotifications{
+						HighlightCount:    ptr(1),
+						NotificationCount: ptr(1),
+					},
+					Timeline: sync2.TimelineResponse{
+						Events: []json.RawMessage{bingEvent},
+					},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, syncRequestBody)
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		room.roomID: {
+			m.MatchRoomTimeline([]json.RawMessage{bingEvent}),
+			m.MatchRoomHighlightCount(1),
+			m.MatchRoomNotificationCount(1),
+		},
+	}))
+
+	// alice reads the room on another client, so the counts are reset without any new events
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				room.roomID: {
+					UnreadNotifications: sync2.UnreadNotifications{
+						HighlightCount:    ptr(0),
+						NotificationCount: ptr(0),
+					},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, syncRequestBody)
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		room.roomID: {
+			m.MatchRoomHighlightCount(0),
+			m.MatchRoomNotificationCount(0),
+		},
+	}))
+}
@@ -1,15 +1,21 @@
 package syncv3
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	slidingsync "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
@@ -428,3 +434,92 @@ func TestPollersCanBeResumedAfterExpiry(t *testing.T) {
 	m.MatchResponse(t, res, m.MatchAccountData([]json.RawMessage{accdata}, nil))
 
 }
+
+// Test that the admin resync endpoint makes the device's poller start again from an initial sync.
+func TestAdminResyncDevice(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	adminToken := "ADMIN_TOKEN_TestAdminResyncDevice"
+	admin := httptest.NewServer(slidingsync.NewAdminHandler(v3.h2, adminToken))
+	defer admin.Close()
+	doResync := func(token, userID, deviceID string) (int, []byte) {
+		t.Helper()
+		reqBody, _ := json.Marshal(map[string]string{
+			"user_id":   userID,
+			"device_id": deviceID,
+		})
+		req, err := http.NewRequest("POST", admin.URL+slidingsync.AdminResyncPath, bytes.NewReader(reqBody))
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to do request: %s", err)
+		}
+		defer res.Body.Close()
+		resBody, _ := io.ReadAll(res.Body)
+		return res.StatusCode, resBody
+	}
+
+	var mu sync.Mutex
+	var sinces []string
+	v2.SetCheckRequest(func(userID, token string, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		sinces = append(sinces, req.URL.Query().Get("since"))
+	})
+	v2.addAccount(t, alice, aliceToken)
+	deviceID := v2.deviceID(aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		NextBatch: "alice_since_1",
+	})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+
+	if code, _ := doResync("not_the_admin_token", alice, deviceID); code != 401 {
+		t.Errorf("resync with the wrong token returned HTTP %d, want 401", code)
+	}
+	if code, _ := doResync(adminToken, alice, "UNKNOWN_DEVICE"); code != 404 {
+		t.Errorf("resync of an unknown device returned HTTP %d, want 404", code)
+	}
+	code, body := doResync(adminToken, alice, deviceID)
+	if code != 200 {
+		t.Fatalf("resync returned HTTP %d: %s", code, string(body))
+	}
+	if !gjson.GetBytes(body, "poller_running").Bool() {
+		t.Errorf("resync response %s did not report a running poller", string(body))
+	}
+	// keep the poller fed so it never sees an empty next_batch from the test server timing out
+	for i := 2; i < 6; i++ {
+		v2.queueResponse(alice, sync2.SyncResponse{
+			NextBatch: fmt.Sprintf("alice_since_%d", i),
+		})
+	}
+
+	// the first request is the initial sync from when the device started syncing. The request after
+	// it may have been in flight when we resynced, but then the poller starts again from empty.
+	var got []string
+	start := time.Now()
+	for len(got) < 4 {
+		if time.Since(start) > time.Second {
+			t.Fatalf("timed out waiting for the poller to resync, made requests with since tokens %v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		got = append([]string{}, sinces...)
+		mu.Unlock()
+	}
+	resyncIndex := 1
+	if got[resyncIndex] == "alice_since_1" {
+		resyncIndex++
+	}
+	if got[resyncIndex] != "" {
+		t.Fatalf("poller did not resync, made requests with since tokens %v", got)
+	}
+	if !strings.HasPrefix(got[resyncIndex+1], "alice_since_") {
+		t.Fatalf("poller did not continue after resyncing, made requests with since tokens %v", got)
+	}
+}
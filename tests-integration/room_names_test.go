@@ -198,3 +198,42 @@ func TestRoomNameUpdates(t *testing.T) {
 		},
 	}))
 }
+
+// Test that nameless rooms include the other members as heroes, along with the member counts.
+func TestRoomHeroes(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	bob := "@TestRoomHeroes_bob:localhost"
+	room := roomEvents{
+		roomID: "!TestRoomHeroes:localhost",
+		events: append(createRoomState(t, alice, time.Now()), []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+				"membership": "join", "displayname": "Bob", "avatar_url": "mxc://bob",
+			}),
+		}...),
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(room),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			room.roomID: {
+				TimelineLimit: 1,
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		room.roomID: {
+			m.MatchRoomName("Bob"),
+			m.MatchRoomHeroes([]sync3.Hero{{UserID: bob, DisplayName: "Bob", AvatarURL: "mxc://bob"}}),
+			m.MatchJoinCount(2),
+			m.MatchInviteCount(0),
+		},
+	}))
+}
@@ -173,3 +173,140 @@ func TestRoomSubscriptionMisorderedTimeline(t *testing.T) {
 		},
 	}), m.LogResponse(t))
 }
+
+// Test that the first view state is sent when a room first appears, and is not re-sent when the
+// room is subsequently updated, unlike required_state.
+func TestFirstViewStateSentOnce(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	room := roomEvents{
+		roomID: "!first-view:localhost",
+		events: createRoomState(t, alice, time.Now()),
+	}
+	createEvent := room.events[0]
+	powerLevelsEvent := room.events[2]
+	joinRulesEvent := room.events[3]
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(room),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"list": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+					RequiredState: [][2]string{
+						{"m.room.join_rules", ""},
+					},
+					FirstViewState: [][2]string{
+						{"m.room.create", ""},
+						{"m.room.power_levels", ""},
+					},
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		room.roomID: {
+			m.MatchRoomInitial(true),
+			m.MatchRoomRequiredState([]json.RawMessage{joinRulesEvent}),
+			m.MatchRoomFirstViewState([]json.RawMessage{createEvent, powerLevelsEvent}),
+		},
+	}))
+
+	// a subsequent update to the room does not include the first view state again
+	newEvent := testutils.NewMessageEvent(t, alice, "hello")
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: room.roomID,
+				events: []json.RawMessage{newEvent},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		room.roomID: {
+			m.MatchRoomTimeline([]json.RawMessage{newEvent}),
+			m.MatchRoomFirstViewState(nil),
+		},
+	}))
+}
+
+// Test that live events in a room are no longer sent after unsubscribing from it.
+func TestRoomSubscriptionUnsubscribe(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	room := roomEvents{
+		roomID: "!unsubscribe:localhost",
+		events: createRoomState(t, alice, time.Now()),
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(room),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			room.roomID: {
+				TimelineLimit: 1,
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		room.roomID: {
+			m.MatchRoomInitial(true),
+			m.MatchRoomTimeline(room.events[len(room.events)-1:]),
+		},
+	}))
+
+	// live events are sent whilst subscribed
+	subscribedEvent := testutils.NewMessageEvent(t, alice, "subscribed")
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: room.roomID,
+				events: []json.RawMessage{subscribedEvent},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		room.roomID: {
+			m.MatchRoomTimeline([]json.RawMessage{subscribedEvent}),
+		},
+	}))
+
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
+		UnsubscribeRooms: []string{room.roomID},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(nil))
+
+	// live events are not sent once unsubscribed, as the room is not in any list
+	unsubscribedEvent := testutils.NewMessageEvent(t, alice, "unsubscribed")
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: room.roomID,
+				events: []json.RawMessage{unsubscribedEvent},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	req := sync3.Request{}
+	req.SetTimeoutMSecs(100)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(nil))
+}
@@ -126,9 +126,7 @@ func TestSlowGetAllRoomsInitial(t *testing.T) {
 		})
 		v2.waitUntilEmpty(t, alice)
 		// reuse the position from the room name filter test, we should get this new room
-		res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-			Lists: map[string]sync3.RequestList{},
-		})
+		res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
 		m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRoomMatchers)+1)), m.MatchNoV3Ops(), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
 			newRoom.roomID: {
 				m.MatchRoomInitial(true),
@@ -149,9 +147,7 @@ func TestSlowGetAllRoomsInitial(t *testing.T) {
 			},
 		})
 		v2.waitUntilEmpty(t, alice)
-		res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
-			Lists: map[string]sync3.RequestList{},
-		})
+		res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
 		m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRoomMatchers)+1)), m.MatchNoV3Ops(), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
 			allRooms[11].roomID: {
 				m.MatchRoomInitial(false),
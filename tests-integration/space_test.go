@@ -64,3 +64,82 @@ func TestBecomingASpaceDoesntCrash(t *testing.T) {
 		},
 	}))
 }
+
+// Test that a list filtered to spaces includes how many children each space has, and that the count
+// updates as children are added and removed.
+func TestSpaceChildCount(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	spaceRoomID := "!space:localhost"
+	roomID := "!room:localhost"
+	spaceChild := func(childRoomID string, via []string) json.RawMessage {
+		return testutils.NewStateEvent(t, "m.space.child", childRoomID, alice, map[string]interface{}{
+			"via": via,
+		})
+	}
+	spaceState := createRoomStateWithCreateEvent(t, alice, testutils.NewStateEvent(
+		t, "m.room.create", "", alice, map[string]interface{}{"creator": alice, "type": "m.space"},
+	), time.Now())
+	spaceState = append(spaceState,
+		spaceChild("!child1:localhost", []string{"localhost"}),
+		spaceChild("!child2:localhost", []string{"localhost"}),
+	)
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: spaceRoomID,
+				events: spaceState,
+			}, roomEvents{
+				roomID: roomID,
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	spaceType := "m.space"
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"spaces": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				Filters: &sync3.RequestFilters{
+					RoomTypes: []*string{&spaceType},
+				},
+			},
+		},
+	})
+	m.MatchResponse(t, res,
+		m.MatchList("spaces", m.MatchV3Count(1), m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{spaceRoomID}))),
+		m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+			spaceRoomID: {m.MatchRoomSpaceChildCount(2)},
+		}),
+	)
+
+	// add a third child
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: spaceRoomID,
+				events: []json.RawMessage{spaceChild("!child3:localhost", []string{"localhost"})},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(spaceRoomID, m.MatchRoomSpaceChildCount(3)))
+
+	// remove the first child
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: spaceRoomID,
+				events: []json.RawMessage{spaceChild("!child1:localhost", nil)},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(spaceRoomID, m.MatchRoomSpaceChildCount(2)))
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
@@ -575,7 +576,61 @@ func TestHistoryDoesntIncludeState(t *testing.T) {
 	})
 	m.MatchResponse(t, res, m.MatchList("a",
 		m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{roomID})),
-	), m.MatchRoomSubscription(roomID, m.MatchRoomTimeline(room.events), m.MatchRoomPrevBatch(prevBatch)))
+	), m.MatchRoomSubscription(roomID, m.MatchRoomTimeline(room.events), m.MatchRoomPrevBatch(prevBatch), m.MatchRoomTimelineIsState([]bool{true, false})))
+}
+
+// Test that timeline_is_state flags state events in the timeline, for both initial and live events.
+func TestTimelineIsState(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!TestTimelineIsState:localhost"
+	room := roomEvents{
+		roomID: roomID,
+		state:  createRoomState(t, alice, time.Now()),
+		events: []json.RawMessage{
+			testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hello"}),
+			testutils.NewStateEvent(t, "m.room.topic", "", alice, map[string]interface{}{"topic": "boo"}),
+			testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "world"}),
+		},
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(room),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {
+				TimelineLimit: 10,
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID,
+		m.MatchRoomTimeline(room.events), m.MatchRoomTimelineIsState([]bool{false, true, false}),
+	))
+
+	liveEvents := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Room"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "live"}),
+		testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{"membership": "join"}),
+	}
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: liveEvents,
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID,
+		m.MatchRoomTimeline(liveEvents), m.MatchRoomTimelineIsState([]bool{true, false, true}),
+	))
 }
 
 // Test that transaction IDs come down the user's stream correctly in the case where 2 clients are
@@ -1335,3 +1390,132 @@ func TestNumLiveBulk(t *testing.T) {
 		},
 	))
 }
+
+// Test that room subscriptions can centre the timeline on an event for permalinks, and fall back to
+// the most recent events if the event isn't known.
+func TestTimelineCenterEventID(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!center:localhost"
+	var messages []json.RawMessage
+	for i := 0; i < 20; i++ {
+		messages = append(messages, testutils.NewMessageEvent(t, alice, fmt.Sprintf("message %d", i)))
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: append(createRoomState(t, alice, time.Now()), messages...),
+			}),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {
+				TimelineLimit: 3,
+				CenterEventID: gjson.GetBytes(messages[9], "event_id").Str,
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomID: {
+			m.MatchRoomTimeline(messages[6:13]),
+			func(r sync3.Room) error {
+				if r.CenterEventNotFound {
+					return fmt.Errorf("got center_event_not_found, want the event to be found")
+				}
+				return nil
+			},
+		},
+	}))
+
+	// unknown events fall back to the latest timeline
+	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {
+				TimelineLimit: 3,
+				CenterEventID: "$unknown",
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomID: {
+			m.MatchRoomTimeline(messages[17:]),
+			func(r sync3.Room) error {
+				if !r.CenterEventNotFound {
+					return fmt.Errorf("got center_event_not_found=false, want true")
+				}
+				return nil
+			},
+		},
+	}))
+}
+
+// Test that redactions are applied to stored events, so later initial syncs return the redacted
+// event, whilst the redaction is still sent live.
+func TestTimelineRedactionsApplied(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!redact:localhost"
+	message := testutils.NewMessageEvent(t, alice, "secret")
+	messageID := gjson.GetBytes(message, "event_id").Str
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: append(createRoomState(t, alice, time.Now()), message),
+			}),
+		},
+	})
+	req := sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {
+				TimelineLimit: 2,
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{message})))
+
+	redaction := testutils.NewEvent(t, "m.room.redaction", alice, map[string]interface{}{"redacts": messageID})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{redaction},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	// the redaction is sent live
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomTimeline([]json.RawMessage{redaction})))
+
+	// a fresh connection sees the redacted message
+	res = v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, func(r sync3.Room) error {
+		if len(r.Timeline) != 2 {
+			return fmt.Errorf("got %d timeline events want 2", len(r.Timeline))
+		}
+		redacted := gjson.ParseBytes(r.Timeline[0])
+		if redacted.Get("event_id").Str != messageID {
+			return fmt.Errorf("got first event %s want %s", redacted.Get("event_id").Str, messageID)
+		}
+		if len(redacted.Get("content").Map()) != 0 {
+			return fmt.Errorf("message was not redacted: %s", redacted.Raw)
+		}
+		if redacted.Get("unsigned.redacted_because.event_id").Str != gjson.GetBytes(redaction, "event_id").Str {
+			return fmt.Errorf("message missing redacted_because: %s", redacted.Raw)
+		}
+		return nil
+	}))
+}
@@ -384,6 +384,11 @@ func runTestServer(t testutils.TestBenchInterface, v2Server *testV2Server, postg
 		combinedOpts.DBConnMaxIdleTime = opt.DBConnMaxIdleTime
 		combinedOpts.DBMaxConns = opt.DBMaxConns
 		combinedOpts.MaxTransactionIDDelay = opt.MaxTransactionIDDelay
+		combinedOpts.MaxOpsPerResponse = opt.MaxOpsPerResponse
+		combinedOpts.PollTimeout = opt.PollTimeout
+		combinedOpts.ExposeV2Since = opt.ExposeV2Since
+		combinedOpts.PersistConnections = opt.PersistConnections
+		combinedOpts.EnablePresence = opt.EnablePresence
 		if opt.MaxPendingEventUpdates > 0 {
 			combinedOpts.MaxPendingEventUpdates = opt.MaxPendingEventUpdates
 			handler.BufferWaitTime = 5 * time.Millisecond
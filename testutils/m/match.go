@@ -102,6 +102,27 @@ func MatchInviteCount(count int) RoomMatcher {
 	}
 }
 
+func MatchRoomHeroes(heroes []sync3.Hero) RoomMatcher {
+	return func(r sync3.Room) error {
+		if !reflect.DeepEqual(r.Heroes, heroes) {
+			return fmt.Errorf("MatchRoomHeroes: got %+v want %+v", r.Heroes, heroes)
+		}
+		return nil
+	}
+}
+
+func MatchRoomSpaceChildCount(count int) RoomMatcher {
+	return func(r sync3.Room) error {
+		if r.SpaceChildCount == nil {
+			return fmt.Errorf("MatchRoomSpaceChildCount: got nil want %d", count)
+		}
+		if *r.SpaceChildCount != count {
+			return fmt.Errorf("MatchRoomSpaceChildCount: got %d want %d", *r.SpaceChildCount, count)
+		}
+		return nil
+	}
+}
+
 func MatchNumLive(numLive int) RoomMatcher {
 	return func(r sync3.Room) error {
 		if r.NumLive != numLive {
@@ -132,6 +153,27 @@ func MatchRoomRequiredState(events []json.RawMessage) RoomMatcher {
 		return nil
 	}
 }
+func MatchRoomFirstViewState(events []json.RawMessage) RoomMatcher {
+	return func(r sync3.Room) error {
+		if len(r.FirstViewState) != len(events) {
+			return fmt.Errorf("first view state length mismatch, got %d want %d", len(r.FirstViewState), len(events))
+		}
+		// allow any ordering for first view state
+		for _, want := range events {
+			found := false
+			for _, got := range r.FirstViewState {
+				if bytes.Equal(got, want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("first view state want event %v but it does not exist", string(want))
+			}
+		}
+		return nil
+	}
+}
 func MatchRoomInviteState(events []json.RawMessage) RoomMatcher {
 	return func(r sync3.Room) error {
 		if len(r.InviteState) != len(events) {
@@ -196,6 +238,15 @@ func MatchRoomTimeline(events []json.RawMessage) RoomMatcher {
 	}
 }
 
+func MatchRoomTimelineIsState(isState []bool) RoomMatcher {
+	return func(r sync3.Room) error {
+		if !reflect.DeepEqual(r.TimelineIsState, isState) {
+			return fmt.Errorf("timeline_is_state mismatch: got %v want %v", r.TimelineIsState, isState)
+		}
+		return nil
+	}
+}
+
 func MatchRoomHighlightCount(count int64) RoomMatcher {
 	return func(r sync3.Room) error {
 		if r.HighlightCount != count {
@@ -301,6 +352,38 @@ func MatchNoReceiptsExtension() RespMatcher {
 	}
 }
 
+// MatchPresence checks that the presence extension contains exactly these users, with these presence
+// values.
+func MatchPresence(wantUserIDToPresence map[string]string) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Presence == nil {
+			return fmt.Errorf("MatchPresence: no presence extension")
+		}
+		gotUserIDToPresence := make(map[string]string)
+		for _, ev := range res.Extensions.Presence.Events {
+			parsed := gjson.ParseBytes(ev)
+			sender := parsed.Get("sender").Str
+			if _, exists := gotUserIDToPresence[sender]; exists {
+				return fmt.Errorf("MatchPresence: got more than one presence event for %s", sender)
+			}
+			gotUserIDToPresence[sender] = parsed.Get("content.presence").Str
+		}
+		if !reflect.DeepEqual(gotUserIDToPresence, wantUserIDToPresence) {
+			return fmt.Errorf("MatchPresence: got %v want %v", gotUserIDToPresence, wantUserIDToPresence)
+		}
+		return nil
+	}
+}
+
+func MatchNoPresenceExtension() RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Presence != nil {
+			return fmt.Errorf("MatchNoPresenceExtension: got Presence extension: %+v", res.Extensions.Presence)
+		}
+		return nil
+	}
+}
+
 func MatchOTKCounts(otkCounts map[string]int) RespMatcher {
 	return func(res *sync3.Response) error {
 		if res.Extensions.E2EE == nil {
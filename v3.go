@@ -47,9 +47,57 @@ type Opts struct {
 	// confirmation of an event's transaction_id before sending it to its sender.
 	// Set to 0 to disable this delay mechanism entirely.
 	MaxTransactionIDDelay time.Duration
+	// The soft limit on the number of list operations sent to a client in a single response. Live
+	// updates beyond this limit are deferred to subsequent responses. The ops of a single update are
+	// never split, so a response can exceed the limit by up to two ops per range of each list.
+	// Defaults to 50.
+	MaxOpsPerResponse int
 
 	DBMaxConns        int
 	DBConnMaxIdleTime time.Duration
+	// PollTimeout is the long-poll timeout sent to the homeserver on sync v2 requests. Shorter
+	// timeouts reduce the time connections are held open at the cost of more frequent requests.
+	// Defaults to sync2.DefaultPollTimeout.
+	PollTimeout time.Duration
+	// PollTimelineLimit is the timeline limit sent to the homeserver on incremental sync v2 requests.
+	// Lower limits reduce the load on the homeserver, at the cost of more gappy syncs.
+	// Defaults to sync2.DefaultPollTimelineLimit.
+	PollTimelineLimit int
+	// ExposeV2Since allows clients to request the sync v2 since token for their device by setting
+	// include_v2_since. This lets clients migrate back to sync v2 without an initial sync, but
+	// also means the client and the proxy's poller may consume the same v2 stream.
+	ExposeV2Since bool
+	// ConnTTL is how long a connection can go unused before it is reaped. Clients which return
+	// after this time are told to reset their connection. Defaults to sync3.DefaultConnTTL.
+	ConnTTL time.Duration
+	// MaxClockSkew is how far ahead of the proxy's clock an event's origin_server_ts can be before it
+	// is clamped when sorting rooms by recency. Defaults to internal.DefaultMaxClockSkew. Negative
+	// values disable clamping.
+	MaxClockSkew time.Duration
+	// MaxNewConnsPerMinute is the number of connections each user can create per minute. Requests for
+	// more connections are rejected with a retryable error. Defaults to no limit.
+	MaxNewConnsPerMinute int
+	// BatchPollerWrites persists all of the data in each sync v2 response in a single transaction,
+	// along with the since token, so a poll is either stored in full or not at all.
+	BatchPollerWrites bool
+	// ShareRoomPollers only fetches room data on one poller per user, rather than on every device's
+	// poller, to reduce the load on the homeserver. The user's other pollers only fetch device data.
+	ShareRoomPollers bool
+	// ToDeviceRetention is how long to-device messages are kept for before they are deleted, even if
+	// the device never acknowledges them. Defaults to state.DefaultToDeviceRetention. Negative values
+	// keep messages until they are acknowledged.
+	ToDeviceRetention time.Duration
+	// MaxToDevicePerDevice is the number of to-device messages kept for each device. Older messages
+	// beyond this are deleted. Defaults to no limit.
+	MaxToDevicePerDevice int
+	// PersistConnections saves each connection's sticky request parameters, latest pos and the rooms
+	// the client has been sent to the database, so clients can keep using their pos after the proxy
+	// restarts rather than resetting their connection. Resumed connections only resend the list
+	// ranges and rooms which changed whilst the proxy was down.
+	PersistConnections bool
+	// EnablePresence fetches presence from the homeserver for the presence extension. Presence is
+	// high volume, so it isn't fetched by default and the extension returns nothing.
+	EnablePresence bool
 }
 
 type server struct {
@@ -86,6 +134,7 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 			Timeout: 5 * time.Minute,
 		},
 		DestinationServer: destHomeserver,
+		FetchPresence:     opts.EnablePresence,
 	}
 	db, err := sqlx.Open("postgres", postgresURI)
 	if err != nil {
@@ -123,9 +172,28 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	if opts.MaxPendingEventUpdates == 0 {
 		opts.MaxPendingEventUpdates = 2000
 	}
+	if opts.PollTimeout == 0 {
+		opts.PollTimeout = sync2.DefaultPollTimeout
+	}
+	if opts.PollTimelineLimit == 0 {
+		opts.PollTimelineLimit = sync2.DefaultPollTimelineLimit
+	}
+	if opts.MaxOpsPerResponse == 0 {
+		opts.MaxOpsPerResponse = 50
+	}
+	if opts.MaxClockSkew != 0 {
+		internal.SetMaxClockSkew(opts.MaxClockSkew)
+	}
+	if opts.ToDeviceRetention == 0 {
+		opts.ToDeviceRetention = state.DefaultToDeviceRetention
+	}
+	store.ToDeviceTable.SetRetention(opts.ToDeviceRetention, opts.MaxToDevicePerDevice)
+	if opts.ToDeviceRetention > 0 || opts.MaxToDevicePerDevice > 0 {
+		store.ToDeviceTable.StartSweeper(time.Hour)
+	}
 	pubSub := pubsub.NewPubSub(bufferSize)
 
-	pMap := sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics)
+	pMap := sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics, nil, opts.PollTimeout, opts.PollTimelineLimit, opts.BatchPollerWrites, opts.ShareRoomPollers)
 	// create v2 handler
 	h2, err := handler2.NewHandler(pMap, storev2, store, pubSub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency)
 	if err != nil {
@@ -134,7 +202,7 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	pMap.SetCallbacks(h2)
 
 	// create v3 handler
-	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay)
+	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay, opts.MaxOpsPerResponse, opts.ExposeV2Since, opts.ConnTTL, opts.MaxNewConnsPerMinute, opts.PersistConnections)
 	if err != nil {
 		panic(err)
 	}
@@ -151,12 +219,16 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	return h2, h3
 }
 
-// RunSyncV3Server is the main entry point to the server
-func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
+// RunSyncV3Server is the main entry point to the server. If admin is non-nil, admin endpoints are
+// served by it.
+func RunSyncV3Server(h, admin http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
 	// HTTP path routing
 	r := mux.NewRouter()
 	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	if admin != nil {
+		r.Handle(AdminResyncPath, admin)
+	}
 
 	serverJSON, _ := json.Marshal(struct {
 		Server  string `json:"server"`